@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"proxy-service/pkg/agentclient"
+	"proxy-service/pkg/logger"
+)
+
+const (
+	// renewRetryInterval spaces renewals that failed
+	renewRetryInterval = time.Minute
+)
+
+// certificateRenewer keeps the agent's client certificate in its files and
+// renews it once two thirds of its lifetime have passed
+type certificateRenewer struct {
+	endpoint string
+	certFile string
+	keyFile  string
+	source   *agentclient.CertificateSource
+}
+
+// newCertificateRenewer loads the client certificate, requesting it with the
+// bootstrap token first when one is given
+func newCertificateRenewer(ctx context.Context, serverURL, certFile, keyFile, bootstrapToken string) (*certificateRenewer, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("a key file is required with a certificate file")
+	}
+	r := &certificateRenewer{
+		endpoint: certificateEndpoint(serverURL),
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if bootstrapToken != "" {
+		certPEM, keyPEM, err := agentclient.RequestCertificate(ctx, http.DefaultClient, r.endpoint, bootstrapToken)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.save(certPEM, keyPEM); err != nil {
+			return nil, err
+		}
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	r.source, err = agentclient.NewCertificateSource(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certificateRenewer) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		GetClientCertificate: r.source.GetClientCertificate,
+	}
+}
+
+// run renews the certificate until ctx is done
+func (r *certificateRenewer) run(ctx context.Context, log *logger.Logger) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: r.tlsConfig()}}
+	for {
+		wait := time.Until(r.source.NotAfter()) * 2 / 3
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		if err := r.renew(ctx, client); err != nil {
+			log.Error("Failed to renew client certificate", "error", err)
+			select {
+			case <-time.After(renewRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		log.Info("Renewed client certificate", "not_after", r.source.NotAfter())
+	}
+}
+
+func (r *certificateRenewer) renew(ctx context.Context, client *http.Client) error {
+	certPEM, keyPEM, err := agentclient.RequestCertificate(ctx, client, r.endpoint, "")
+	if err != nil {
+		return err
+	}
+	if err := r.source.Set(certPEM, keyPEM); err != nil {
+		return err
+	}
+	return r.save(certPEM, keyPEM)
+}
+
+func (r *certificateRenewer) save(certPEM, keyPEM []byte) error {
+	if err := os.WriteFile(r.keyFile, keyPEM, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(r.certFile, certPEM, 0o644)
+}
+
+// certificateEndpoint derives the signing endpoint from the agent endpoint
+func certificateEndpoint(serverURL string) string {
+	endpoint := strings.Replace(serverURL, "ws", "http", 1)
+	return strings.TrimSuffix(endpoint, "/connect") + "/certificates"
+}
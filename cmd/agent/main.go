@@ -0,0 +1,88 @@
+// Command agent runs the reference proxy agent. It connects to the proxy's
+// agent endpoint and serves the requests it receives against a local
+// upstream until interrupted.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"proxy-service/pkg/agentclient"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/logger"
+)
+
+func main() {
+	config := agentclient.Config{}
+	codec := "binary"
+	var certFile, keyFile string
+
+	flag.StringVar(&config.ServerURL, "server", env("PROXY_AGENT_SERVER", ""), "agent endpoint, e.g. wss://proxy.example.com/api/v1/agents/connect")
+	flag.StringVar(&config.AgentID, "agent-id", env("PROXY_AGENT_ID", ""), "agent ID")
+	flag.StringVar(&config.CustomerID, "customer-id", env("PROXY_AGENT_CUSTOMER_ID", ""), "customer ID")
+	flag.StringVar(&config.CredentialID, "credential-id", env("PROXY_AGENT_CREDENTIAL_ID", ""), "agent credential ID; its secret is read from PROXY_AGENT_SECRET")
+	flag.StringVar(&certFile, "cert-file", env("PROXY_AGENT_CERT_FILE", ""), "client certificate; with PROXY_AGENT_BOOTSTRAP_TOKEN set it is requested first, and it is renewed before it expires")
+	flag.StringVar(&keyFile, "key-file", env("PROXY_AGENT_KEY_FILE", ""), "client certificate key")
+	flag.StringVar(&config.Upstream, "upstream", env("PROXY_AGENT_UPSTREAM", "http://localhost:8080"), "base URL requests are served against")
+	flag.StringVar(&codec, "codec", env("PROXY_AGENT_CODEC", codec), "wire codec, binary or json")
+	flag.DurationVar(&config.MinBackoff, "min-backoff", agentclient.DefaultMinBackoff, "first reconnect delay")
+	flag.DurationVar(&config.MaxBackoff, "max-backoff", agentclient.DefaultMaxBackoff, "longest reconnect delay")
+	flag.Parse()
+
+	// Secrets only come from the environment so they stay out of ps
+	config.APIKey = os.Getenv("PROXY_AGENT_API_KEY")
+	config.Secret = os.Getenv("PROXY_AGENT_SECRET")
+
+	switch codec {
+	case "binary":
+		config.Subprotocol = agentproto.SubprotocolBinary
+	case "json":
+		config.Subprotocol = agentproto.SubprotocolJSON
+	default:
+		fmt.Fprintf(os.Stderr, "unknown codec %q\n", codec)
+		os.Exit(2)
+	}
+
+	log := logger.NewLogger()
+	defer log.Sync()
+	config.Logger = log
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var certificates *certificateRenewer
+	if certFile != "" {
+		var err error
+		certificates, err = newCertificateRenewer(ctx, config.ServerURL, certFile, keyFile, os.Getenv("PROXY_AGENT_BOOTSTRAP_TOKEN"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "client certificate: %v\n", err)
+			os.Exit(1)
+		}
+		config.TLSConfig = certificates.tlsConfig()
+	}
+
+	client, err := agentclient.New(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v (the API key is read from PROXY_AGENT_API_KEY, the credential secret from PROXY_AGENT_SECRET)\n", err)
+		os.Exit(2)
+	}
+
+	if certificates != nil {
+		go certificates.run(ctx, log)
+	}
+
+	log.Info("Starting agent", "agent_id", config.AgentID, "server", config.ServerURL, "upstream", config.Upstream)
+	client.Run(ctx)
+	log.Info("Agent stopped", "agent_id", config.AgentID)
+}
+
+func env(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
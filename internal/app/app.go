@@ -5,6 +5,7 @@ import (
 	"proxy-service/internal/config"
 	"proxy-service/internal/handler"
 	"proxy-service/internal/service"
+	"proxy-service/internal/service/agent"
 	"proxy-service/pkg/cache"
 	"proxy-service/pkg/cloudflare"
 	"proxy-service/pkg/database"
@@ -16,6 +17,7 @@ import (
 type App struct {
 	cfg    *config.Config
 	server *Server
+	tunnel *cloudflare.TunnelClient // nil unless connected
 }
 
 func NewApp(cfg *config.Config) (*App, error) {
@@ -45,6 +47,30 @@ func NewApp(cfg *config.Config) (*App, error) {
 		RetryInterval:     5 * time.Second,
 	}, log)
 
+	// Customers routed through the tunnel fail over, or are refused, while
+	// it is down
+	connectCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var connectedTunnel *cloudflare.TunnelClient
+	if err := tunnelClient.Start(connectCtx); err != nil {
+		log.Error("Failed to connect Cloudflare tunnel", "error", err, "tunnel_id", cfg.Cloudflare.TunnelID)
+	} else {
+		connectedTunnel = tunnelClient
+	}
+
+	// Initialize the CA agent client certificates chain to
+	var agentCA *agent.CertificateAuthority
+	if mtls := cfg.Agent.MTLS; mtls.CACertFile != "" {
+		agentCA, err = agent.LoadCertificateAuthority(mtls.CACertFile, mtls.CAKeyFile, mtls.CRLFile, redisClient, agent.CertificatePolicy{
+			CertificateTTL:    mtls.CertificateTTL,
+			BootstrapTokenTTL: mtls.BootstrapTokenTTL,
+			Required:          mtls.Required,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Initialize services
 	services := service.NewServices(service.Deps{
 		Config:       cfg,
@@ -52,12 +78,14 @@ func NewApp(cfg *config.Config) (*App, error) {
 		Cache:        redisClient,
 		Metrics:      metricsCollector,
 		TunnelClient: tunnelClient,
+		AgentCA:      agentCA,
 	})
 
 	// Initialize handlers
 	handlers := handler.NewHandler(handler.Deps{
 		Services: services,
 		Config:   cfg,
+		Cache:    redisClient,
 	})
 
 	// Initialize server
@@ -66,6 +94,7 @@ func NewApp(cfg *config.Config) (*App, error) {
 	return &App{
 		cfg:    cfg,
 		server: server,
+		tunnel: connectedTunnel,
 	}, nil
 }
 
@@ -74,5 +103,8 @@ func (a *App) Start() error {
 }
 
 func (a *App) Stop(ctx context.Context) error {
+	if a.tunnel != nil {
+		a.tunnel.Stop()
+	}
 	return a.server.Stop(ctx)
 }
@@ -6,9 +6,12 @@ import (
 	"net/http"
 	"proxy-service/internal/config"
 	"proxy-service/internal/handler"
+	agenthandler "proxy-service/internal/handler/agent"
 	"proxy-service/internal/middleware"
+	"proxy-service/internal/routes"
 	"proxy-service/pkg/logger"
 	"proxy-service/pkg/validator"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,7 +19,11 @@ import (
 
 type Server struct {
 	httpServer *http.Server
-	handler    *handler.Handler
+	// internalServer takes requests handed over by other replicas; nil when
+	// clustering is off
+	internalServer *http.Server
+	handler        *handler.Handler
+	logger         *logger.Logger
 }
 
 // func NewServer(cfg *config.Config, handler *handler.Handler) *Server {
@@ -109,24 +116,48 @@ func NewServer(cfg *config.Config, handler *handler.Handler) *Server {
 		// Pass the entire handler instead of just the Auth handler
 		protected.Use(middleware.Auth(handler))
 		{
-			// Proxy routes
-			protected.Any("/*path", handler.Proxy.HandleRequest)
-
 			// Metrics routes
 			protected.GET("/metrics", handler.Metrics.GetMetrics)
 		}
 	}
 
+	// Agent endpoint, agent management and the operator command API
+	agents := agenthandler.NewAgentHandler(handler.AgentManager(), handler.GetAuthService(), cache, cfg, handler.MetricsCollector(), log)
+	routes.SetupAgentRoutes(router, agents, middleware.NewAuthMiddleware(handler.GetAuthService(), handler.MetricsCollector()), cfg.Admin.Token)
+
+	// Operator routes, across customers; off without an admin token
+	if cfg.Admin.Token != "" {
+		admin := router.Group("/admin/v1", middleware.AdminToken(cfg.Admin.Token))
+		{
+			admin.POST("/cache/purge", handler.Caching.HandlePurge)
+		}
+	}
+
+	// Every other path under /api/v1 is proxied. gin does not allow a
+	// catch-all next to the routes above, so the proxy takes the requests
+	// none of them matched.
+	router.NoRoute(func(c *gin.Context) {
+		if !strings.HasPrefix(c.Request.URL.Path, "/api/v1/") {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+		}
+	}, middleware.Auth(handler), handler.Proxy.HandleRequest)
+
 	tlsConfig := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 		PreferServerCipherSuites: true,
 	}
+	// Agents may present a client certificate; the agent endpoint decides
+	// whether one is required
+	if ca := handler.AgentManager().CertificateAuthority(); ca != nil {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = ca.Pool()
+	}
 
-	return &Server{
+	server := &Server{
 		httpServer: &http.Server{
 			Addr:              ":" + cfg.Server.Port,
-			Handler:           router,
+			Handler:           handler.TCP.Wrap(router),
 			TLSConfig:         tlsConfig,
 			ReadTimeout:       time.Duration(cfg.Server.ReadTimeout) * time.Second,
 			WriteTimeout:      time.Duration(cfg.Server.WriteTimeout) * time.Second,
@@ -134,16 +165,63 @@ func NewServer(cfg *config.Config, handler *handler.Handler) *Server {
 			ReadHeaderTimeout: 20 * time.Second,
 		},
 		handler: handler,
+		logger:  log,
+	}
+
+	// Other replicas hand requests for agents connected here to this endpoint
+	if cfg.Cluster.AdvertiseAddress != "" && cfg.Cluster.ListenAddress != "" {
+		internal := gin.New()
+		internal.Use(gin.Recovery())
+		internal.Any("/*path", handler.Replica.HandleRequest)
+
+		server.internalServer = &http.Server{
+			Addr:              cfg.Cluster.ListenAddress,
+			Handler:           internal,
+			IdleTimeout:       time.Duration(cfg.Server.IdleTimeout) * time.Second,
+			ReadHeaderTimeout: 20 * time.Second,
+		}
 	}
+
+	return server
+}
+
+// Handler serves the public listener, agents included
+func (s *Server) Handler() http.Handler {
+	return s.httpServer.Handler
 }
 
 func (s *Server) Start() error {
+	if s.internalServer != nil {
+		go func() {
+			if err := s.internalServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logger.Error("Internal replica endpoint stopped", "error", err)
+			}
+		}()
+	}
+
 	return s.httpServer.ListenAndServeTLS(
 		s.handler.Config().Server.TLSCertFile,
 		s.handler.Config().Server.TLSKeyFile,
 	)
 }
 
+// Stop drains the agents first, so they move to other replicas while the
+// listeners still serve the requests in flight on them, then shuts the
+// listeners and the agent manager down
 func (s *Server) Stop(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	agents := s.handler.AgentManager()
+
+	drainCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout := s.handler.Config().Agent.DrainTimeout; timeout > 0 {
+		drainCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	agents.Drain(drainCtx)
+	cancel()
+
+	if s.internalServer != nil {
+		s.internalServer.Shutdown(ctx)
+	}
+	err := s.httpServer.Shutdown(ctx)
+	agents.Close()
+	return err
 }
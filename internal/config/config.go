@@ -15,6 +15,31 @@ type Config struct {
 	Proxy      ProxyConfig      `mapstructure:"proxy"`
 	Cloudflare CloudflareConfig `mapstructure:"cloudflare"`
 	Agent      AgentConfig      `mapstructure:"agent"`
+	Cluster    ClusterConfig    `mapstructure:"cluster"`
+	Admin      AdminConfig      `mapstructure:"admin"`
+}
+
+// AdminConfig guards the operator endpoints under /admin/v1, which are off
+// while Token is empty
+type AdminConfig struct {
+	// Token is the bearer token operators present
+	Token string `mapstructure:"token"`
+}
+
+// ClusterConfig lets replicas serve agents connected to each other. It is
+// off while AdvertiseAddress is empty.
+type ClusterConfig struct {
+	// ReplicaID names this replica in the agent directory; defaults to the
+	// hostname
+	ReplicaID string `mapstructure:"replica_id"`
+	// ListenAddress is where the internal endpoint listens, e.g. ":8081"
+	ListenAddress string `mapstructure:"listen_address"`
+	// AdvertiseAddress is the base URL other replicas reach the internal
+	// endpoint at, e.g. "http://10.0.3.7:8081"
+	AdvertiseAddress string `mapstructure:"advertise_address"`
+	// Secret authenticates replicas to each other
+	Secret   string        `mapstructure:"secret"`
+	LeaseTTL time.Duration `mapstructure:"lease_ttl"`
 }
 
 type CloudflareConfig struct {
@@ -38,6 +63,47 @@ type AgentConfig struct {
 	AllowedOrigins    []string       `mapstructure:"allowed_origins"`
 	Security          SecurityConfig `mapstructure:"security"`
 	MaxRequestSize    int64          `mapstructure:"max_request_size"`
+	// MinProtocolVersion rejects agents speaking an older protocol; 1 also
+	// admits agents that send no hello
+	MinProtocolVersion int           `mapstructure:"min_protocol_version"`
+	HandshakeTimeout   time.Duration `mapstructure:"handshake_timeout"`
+	// DrainTimeout bounds how long shutdown waits for requests in flight on
+	// agents that were told to go away
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+	// ConnectTokenTTL is how long an agent's connect token is accepted
+	ConnectTokenTTL time.Duration `mapstructure:"connect_token_ttl"`
+	// CredentialOverlap is how long a rotated agent credential keeps working
+	CredentialOverlap time.Duration `mapstructure:"credential_overlap"`
+	// MTLS lets agents authenticate with client certificates
+	MTLS AgentMTLSConfig `mapstructure:"mtls"`
+	// Health ejects agents from routing while their traffic fails
+	Health AgentHealthConfig `mapstructure:"health"`
+}
+
+// AgentMTLSConfig enables client certificates for agents when CACertFile is
+// set. Without CAKeyFile the proxy verifies certificates but signs none.
+type AgentMTLSConfig struct {
+	CACertFile        string        `mapstructure:"ca_cert_file"`
+	CAKeyFile         string        `mapstructure:"ca_key_file"`
+	CRLFile           string        `mapstructure:"crl_file"`
+	CertificateTTL    time.Duration `mapstructure:"certificate_ttl"`
+	BootstrapTokenTTL time.Duration `mapstructure:"bootstrap_token_ttl"`
+	// Required refuses agents that present no client certificate
+	Required bool `mapstructure:"required"`
+}
+
+// AgentHealthConfig sets when agents are ejected from routing. Zero values
+// keep the defaults; a negative rate or latency turns its check off.
+type AgentHealthConfig struct {
+	Window         time.Duration `mapstructure:"window"`
+	MinRequests    int           `mapstructure:"min_requests"`
+	MaxErrorRate   float64       `mapstructure:"max_error_rate"`
+	MaxTimeoutRate float64       `mapstructure:"max_timeout_rate"`
+	MaxLatencyP99  time.Duration `mapstructure:"max_latency_p99"`
+	BaseEjection   time.Duration `mapstructure:"base_ejection"`
+	MaxEjection    time.Duration `mapstructure:"max_ejection"`
+	// MaxEjectedPercent caps the share of a customer's agents ejected at once
+	MaxEjectedPercent int `mapstructure:"max_ejected_percent"`
 }
 
 type SecurityConfig struct {
@@ -53,6 +119,25 @@ type RateLimitConfig struct {
 // Add new ProxyConfig struct
 type ProxyConfig struct {
 	TargetHost string `mapstructure:"target_host"`
+	// Transport tunes the connections kept to direct upstreams
+	Transport UpstreamTransportConfig `mapstructure:"transport"`
+}
+
+// UpstreamTransportConfig tunes the connection pool kept to each direct
+// upstream. Zero values keep the defaults.
+type UpstreamTransportConfig struct {
+	// MaxIdleConnsPerHost is how many keep-alive connections are kept
+	MaxIdleConnsPerHost int `mapstructure:"max_idle_conns_per_host"`
+	// MaxConnsPerHost caps the connections to an upstream; 0 is unlimited
+	MaxConnsPerHost     int           `mapstructure:"max_conns_per_host"`
+	IdleConnTimeout     time.Duration `mapstructure:"idle_conn_timeout"`
+	KeepAlive           time.Duration `mapstructure:"keep_alive"`
+	DialTimeout         time.Duration `mapstructure:"dial_timeout"`
+	TLSHandshakeTimeout time.Duration `mapstructure:"tls_handshake_timeout"`
+	// DisableHTTP2 keeps TLS upstreams on HTTP/1.1
+	DisableHTTP2 bool `mapstructure:"disable_http2"`
+	// PoolIdleTimeout evicts the pool of an upstream unused for this long
+	PoolIdleTimeout time.Duration `mapstructure:"pool_idle_timeout"`
 }
 
 type ServerConfig struct {
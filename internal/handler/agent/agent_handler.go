@@ -2,15 +2,9 @@ package agent
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
 	"crypto/tls"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -18,6 +12,7 @@ import (
 	"proxy-service/internal/config"
 	"proxy-service/internal/models"
 	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
 	"proxy-service/pkg/cache"
 	"proxy-service/pkg/logger"
 	"proxy-service/pkg/metrics"
@@ -27,27 +22,12 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// Message types for WebSocket communication
 const (
-	MessageTypeProxyRequest  = "proxy_request"
-	MessageTypeProxyResponse = "proxy_response"
-	MessageTypeHeartbeat     = "heartbeat"
-	MessageTypeConfig        = "config_update"
-	MessageTypeMetrics       = "metrics_update"
-	MessageTypeError         = "error"
-
 	AgentTokenExpiry  = 24 * time.Hour
 	TokenCachePrefix  = "agent_token:"
 	HeartbeatInterval = 30 * time.Second
 )
 
-type WSMessage struct {
-	Type      string      `json:"type"`
-	RequestID string      `json:"request_id,omitempty"`
-	Payload   interface{} `json:"payload"`
-	Timestamp time.Time   `json:"timestamp"`
-}
-
 type AgentHandler struct {
 	agentManager *agent.AgentManager
 	metrics      *metrics.MetricsCollector
@@ -89,8 +69,9 @@ func NewAgentHandler(
 				agentID := r.Header.Get("X-Agent-ID")
 				customerID := r.Header.Get("X-Customer-ID")
 
-				// 2. Validate basic requirements
-				if agentID == "" || customerID == "" {
+				// 2. Validate basic requirements; a client certificate names
+				// the agent by itself
+				if (agentID == "" || customerID == "") && !hasClientCertificate(r) {
 					return false
 				}
 
@@ -114,9 +95,14 @@ func NewAgentHandler(
 				return true // Authentication is handled in HandleConnection
 			},
 			HandshakeTimeout: 10 * time.Second,
+			// The agent picks its codec by requesting one of these
+			Subprotocols: agentproto.Subprotocols,
+			// Only used once the agent negotiates the compression capability
+			EnableCompression: true,
 		},
 	}
 	h.validator = validator.NewRequestValidator(&config.Agent, cache, logger)
+	agentManager.SetMessageHandler(h.handleMessage)
 	return h
 }
 
@@ -127,7 +113,16 @@ func (h *AgentHandler) HandleConnection(c *gin.Context) {
 	customerID := c.GetHeader("X-Customer-ID")
 	token := c.GetHeader("X-Agent-Token")
 
-	if err := h.validateAgentCredentials(agentID, customerID, token); err != nil {
+	credentialID := ""
+	identity, err := h.validateClientCertificate(c.Request, agentID, customerID)
+	if identity != nil {
+		agentID, customerID = identity.AgentID, identity.CustomerID
+	}
+	// A token presented with a certificate has to be valid as well
+	if err == nil && (identity == nil || token != "") {
+		credentialID, err = h.validateAgentCredentials(agentID, customerID, token)
+	}
+	if err != nil {
 		h.logger.Error("Agent authentication failed", "error", err, "agent_id", agentID)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid agent credentials"})
 		return
@@ -140,154 +135,111 @@ func (h *AgentHandler) HandleConnection(c *gin.Context) {
 		return
 	}
 
-	// 3. Initialize agent connection
-	agentConn := &models.AgentConnection{
-		ID:         agentID,
-		CustomerID: customerID,
-		Conn:       conn,
-		StartTime:  time.Now(),
-		LastPing:   time.Now(),
+	// 3. Register agent with manager; it owns the reader and writer routines from here on
+	ctx := agent.WithCredential(c.Request.Context(), credentialID)
+	if identity != nil {
+		ctx = agent.WithCertificate(ctx, identity.Serial)
 	}
-
-	// 4. Register agent with manager
-	if err := h.agentManager.RegisterAgent(c.Request.Context(), agentID, customerID, conn); err != nil {
+	ctx = agent.WithRemoteAddr(ctx, c.ClientIP())
+	if err := h.agentManager.RegisterAgent(ctx, agentID, customerID, conn); err != nil {
 		h.logger.Error("Agent registration failed", "error", err, "agent_id", agentID)
 		conn.Close()
 		return
 	}
 
-	// 5. Record connection metric
+	// 4. Record connection metric
 	h.metrics.RecordAgentConnection(customerID)
 
-	// 6. Start message handling routines
-	go h.handleMessages(agentConn)
-	go h.monitorHeartbeat(agentConn)
-
 	h.logger.Info("Agent connected successfully", "agent_id", agentID, "customer_id", customerID)
 }
 
-func (h *AgentHandler) handleHeartbeat(agent *models.AgentConnection) {
-	agent.LastPing = time.Now()
-	h.metrics.RecordAgentHeartbeat(agent.CustomerID, agent.ID)
+func (h *AgentHandler) handleHeartbeat(conn *agent.AgentConnection) {
+	conn.Touch()
+	h.metrics.RecordAgentHeartbeat(conn.CustomerID, conn.AgentID)
+	h.agentManager.RenewLease(conn)
+	h.agentManager.RecordSeen(conn)
+
+	// Changes are pushed as they are made; this only catches up on a push
+	// that did not go through
+	h.agentManager.SyncConfig(conn)
+}
 
-	// Check for config updates
-	if config := h.agentManager.GetConfigUpdate(agent.ID); config != nil {
-		h.sendMessage(agent, MessageTypeConfig, config)
+func (h *AgentHandler) handleConfigAck(conn *agent.AgentConnection, msg *agentproto.WSMessage) {
+	var ack agentproto.ConfigAckPayload
+	if err := msg.Decode(&ack); err != nil {
+		h.logger.Error("Failed to decode config ack", "error", err, "agent_id", conn.AgentID)
+		return
 	}
+
+	h.agentManager.AcknowledgeConfig(conn, &ack)
 }
 
-func (h *AgentHandler) handleProxyRequest(agent *models.AgentConnection, msg *WSMessage) {
+func (h *AgentHandler) handleProxyRequest(ctx context.Context, conn *agent.AgentConnection, msg *agentproto.WSMessage) {
 	var proxyReq models.ProxyRequest
-	if err := json.Unmarshal([]byte(fmt.Sprintf("%v", msg.Payload)), &proxyReq); err != nil {
-		h.logger.Error("Failed to decode proxy request", "error", err, "agent_id", agent.ID)
-		h.sendError(agent, msg.RequestID, "invalid request format")
+	if err := msg.Decode(&proxyReq); err != nil {
+		h.logger.Error("Failed to decode proxy request", "error", err, "agent_id", conn.AgentID)
+		h.sendError(conn, msg.RequestID, "invalid request format")
 		return
 	}
 
 	// Process proxy request through manager
-	response, err := h.agentManager.HandleProxyRequest(context.Background(), &proxyReq)
+	response, err := h.agentManager.HandleProxyRequest(ctx, &proxyReq)
 	if err != nil {
-		h.logger.Error("Proxy request failed", "error", err, "agent_id", agent.ID)
-		h.sendError(agent, msg.RequestID, err.Error())
+		h.logger.Error("Proxy request failed", "error", err, "agent_id", conn.AgentID)
+		h.sendError(conn, msg.RequestID, err.Error())
 		return
 	}
 
 	// Send response back to agent
-	h.sendMessage(agent, MessageTypeProxyResponse, response)
+	h.sendMessage(conn, agentproto.MessageTypeProxyResponse, msg.RequestID, response)
 }
 
-func (h *AgentHandler) handleMetricsUpdate(agent *models.AgentConnection, msg *WSMessage) {
-	var metrics models.AgentMetrics
-	if err := json.Unmarshal([]byte(fmt.Sprintf("%v", msg.Payload)), &metrics); err != nil {
-		h.logger.Error("Failed to decode metrics", "error", err, "agent_id", agent.ID)
+func (h *AgentHandler) handleMetricsUpdate(conn *agent.AgentConnection, msg *agentproto.WSMessage) {
+	var metrics agentproto.MetricsUpdatePayload
+	if err := msg.Decode(&metrics); err != nil {
+		h.logger.Error("Failed to decode metrics", "error", err, "agent_id", conn.AgentID)
 		return
 	}
 
-	h.metrics.UpdateAgentMetrics(agent.CustomerID, agent.ID, &metrics)
-}
-
-func (h *AgentHandler) monitorHeartbeat(agent *models.AgentConnection) {
-	ticker := time.NewTicker(HeartbeatInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			if time.Since(agent.LastPing) > HeartbeatInterval*3 {
-				h.logger.Warn("Agent heartbeat timeout",
-					zap.String("agent_id", agent.ID),
-					zap.Duration("last_ping", time.Since(agent.LastPing)))
-				agent.Conn.Close()
-				return
-			}
-		}
-	}
+	h.metrics.UpdateAgentMetrics(conn.CustomerID, conn.AgentID, &metrics)
 }
 
-func (h *AgentHandler) handleMessages(agent *models.AgentConnection) {
-	defer func() {
-		h.handleDisconnection(agent)
-	}()
-
-	for {
-		messageType, message, err := agent.Conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				h.logger.Error("WebSocket read error",
-					zap.Error(err),
-					zap.String("agent_id", agent.ID))
-			}
-			return
-		}
-
-		if messageType == websocket.TextMessage {
-			var wsMessage WSMessage
-			if err := json.Unmarshal(message, &wsMessage); err != nil {
-				h.logger.Error("Failed to parse message",
-					zap.Error(err),
-					zap.String("agent_id", agent.ID))
-				continue
-			}
-
-			switch wsMessage.Type {
-			case MessageTypeHeartbeat:
-				h.handleHeartbeat(agent)
-			case MessageTypeProxyRequest:
-				h.handleProxyRequest(agent, &wsMessage)
-			case MessageTypeMetrics:
-				h.handleMetricsUpdate(agent, &wsMessage)
-			default:
-				h.logger.Warn("Unknown message type",
-					zap.String("message_type", wsMessage.Type),
-					zap.String("agent_id", agent.ID))
-			}
-		}
+// handleMessage is called by the connection's reader for every message that
+// is not a reply to a request sent by the proxy
+func (h *AgentHandler) handleMessage(conn *agent.AgentConnection, msg *agentproto.WSMessage) {
+	switch msg.Type {
+	case agentproto.MessageTypeHeartbeat:
+		h.handleHeartbeat(conn)
+	case agentproto.MessageTypeProxyRequest:
+		// Served by another agent, so it must not hold up this reader. The
+		// context is registered first so an early cancel is not missed.
+		ctx, cancel := conn.ServeContext(msg.RequestID)
+		go func() {
+			defer cancel()
+			h.handleProxyRequest(ctx, conn, msg)
+		}()
+	case agentproto.MessageTypeMetrics:
+		h.handleMetricsUpdate(conn, msg)
+	case agentproto.MessageTypeConfigAck:
+		h.handleConfigAck(conn, msg)
+	default:
+		h.logger.Warn("Unknown message type",
+			zap.String("message_type", msg.Type),
+			zap.String("agent_id", conn.AgentID))
 	}
 }
 
-func (h *AgentHandler) handleDisconnection(agent *models.AgentConnection) {
-	h.agentManager.DeregisterAgent(context.Background(), agent.ID, agent.CustomerID)
-	h.metrics.RecordAgentDisconnection(agent.CustomerID)
-	agent.Conn.Close()
-	h.logger.Info("Agent disconnected", "agent_id", agent.ID)
-}
-
-func (h *AgentHandler) sendMessage(agent *models.AgentConnection, messageType string, payload interface{}) {
-	msg := WSMessage{
-		Type:      messageType,
-		Payload:   payload,
-		Timestamp: time.Now(),
-	}
-
-	if err := agent.Conn.WriteJSON(msg); err != nil {
-		h.logger.Error("Failed to send message", "error", err, "agent_id", agent.ID)
+func (h *AgentHandler) sendMessage(conn *agent.AgentConnection, messageType, requestID string, payload interface{}) {
+	msg := agentproto.NewMessage(messageType, requestID, payload)
+	if err := conn.Send(context.Background(), msg); err != nil {
+		h.logger.Error("Failed to send message", "error", err, "agent_id", conn.AgentID)
 	}
 }
 
-func (h *AgentHandler) sendError(agent *models.AgentConnection, requestID, errorMsg string) {
-	h.sendMessage(agent, MessageTypeError, gin.H{
-		"request_id": requestID,
-		"error":      errorMsg,
+func (h *AgentHandler) sendError(conn *agent.AgentConnection, requestID, errorMsg string) {
+	h.sendMessage(conn, agentproto.MessageTypeError, requestID, agentproto.ErrorPayload{
+		RequestID: requestID,
+		Error:     errorMsg,
 	})
 }
 
@@ -337,122 +289,182 @@ func (h *AgentHandler) sendError(agent *models.AgentConnection, requestID, error
 // 	h.metrics.RecordAgentConnection(customerID)
 // }
 
-func (h *AgentHandler) validateAgentCredentials(agentID, customerID, token string) error {
+// validateAgentCredentials authenticates a connecting agent. It returns the
+// ID of the credential that signed the token, or "" for a token signed with
+// the customer's API key.
+func (h *AgentHandler) validateAgentCredentials(agentID, customerID, token string) (string, error) {
 	ctx := context.Background()
 
 	// 1. Basic validation
 	if agentID == "" || customerID == "" || token == "" {
-		return fmt.Errorf("missing required credentials")
+		return "", fmt.Errorf("missing required credentials")
 	}
 
-	// 2. Check cache first for rate limiting and recently validated tokens
-	cacheKey := fmt.Sprintf("%s%s_%s", TokenCachePrefix, customerID, agentID)
-	if cachedToken, err := h.cache.Get(ctx, cacheKey); err == nil {
-		if cachedToken == token {
-			return nil // Token recently validated
+	// 2. Tokens signed with an agent credential are single use and verified
+	// in full every time
+	if agent.IsConnectToken(token) {
+		if err := h.validateAgentAccount(ctx, agentID, customerID); err != nil {
+			return "", err
 		}
+		store := h.agentManager.Credentials()
+		if store == nil {
+			return "", agent.ErrNoCredentialStore
+		}
+		return store.Verify(ctx, customerID, agentID, token)
 	}
 
-	// 3. Get customer details
-	customer, err := h.authService.GetCustomer(ctx, customerID)
-	if err != nil {
-		return fmt.Errorf("invalid customer: %w", err)
-	}
-
-	// 4. Verify customer status
-	if customer.Status != "active" {
-		return fmt.Errorf("customer account is not active")
+	// 3. Agents that were issued a credential no longer use the API key
+	if store := h.agentManager.Credentials(); store != nil {
+		enrolled, err := store.Enrolled(ctx, agentID)
+		if err != nil {
+			return "", err
+		}
+		if enrolled {
+			return "", agent.ErrCredentialRequired
+		}
 	}
 
-	// 5. Get agent details
-	agent, err := h.authService.GetAgent(ctx, agentID)
+	// 4. Verify the agent; a disabled agent is refused even with a
+	// recently validated token
+	agentInfo, err := h.activeAgent(ctx, agentID, customerID)
 	if err != nil {
-		return fmt.Errorf("invalid agent: %w", err)
+		return "", err
 	}
 
-	// 6. Verify agent belongs to customer
-	if agent.CustomerID != customerID {
-		return fmt.Errorf("agent does not belong to customer")
+	// 5. Check cache first for rate limiting and recently validated tokens
+	cacheKey := fmt.Sprintf("%s%s_%s", TokenCachePrefix, customerID, agentID)
+	if cachedToken, err := h.cache.Get(ctx, cacheKey); err == nil {
+		if cachedToken == token {
+			return "", nil // Token recently validated
+		}
 	}
 
-	// 7. Verify agent status
-	if agent.Status != "active" {
-		return fmt.Errorf("agent is not active")
+	// 6. Get customer details
+	customer, err := h.authService.GetCustomer(ctx, customerID)
+	if err != nil {
+		return "", fmt.Errorf("invalid customer: %w", err)
 	}
 
-	// 8. Validate token format and expiry
-	if err := h.validateTokenFormat(token); err != nil {
-		return fmt.Errorf("invalid token format: %w", err)
+	// 7. Verify customer status
+	if customer.Status != "active" {
+		return "", fmt.Errorf("customer account is not active")
 	}
 
-	// 9. Verify token signature
-	expectedToken := h.generateAgentToken(agent, customer.APIKey)
-	if !h.compareTokens(token, expectedToken) {
-		return fmt.Errorf("invalid token signature")
+	// 8. Verify token expiry and signature
+	if err := agent.VerifyToken(token, agentInfo.ID, agentInfo.CustomerID, customer.APIKey, AgentTokenExpiry); err != nil {
+		return "", err
 	}
 
-	// 10. Cache the validated token
+	// 9. Cache the validated token
 	err = h.cache.Set(ctx, cacheKey, token, 15*time.Minute)
 	if err != nil {
 		h.logger.Error("failed to cache token", "error", err)
 		// Don't return error here as validation was successful
 	}
 
-	return nil
+	return "", nil
 }
 
-func (h *AgentHandler) validateTokenFormat(token string) error {
-	// Token format: timestamp.signature
-	parts := strings.Split(token, ".")
-	if len(parts) != 2 {
-		return fmt.Errorf("invalid token format")
+// validateClientCertificate authenticates an agent by its client
+// certificate. It returns nil without an error when the agent presented none
+// and certificates are optional. IDs sent in headers must match the ones the
+// certificate names.
+func (h *AgentHandler) validateClientCertificate(r *http.Request, agentID, customerID string) (*agent.AgentIdentity, error) {
+	ca := h.agentManager.CertificateAuthority()
+	if !hasClientCertificate(r) {
+		if ca != nil && ca.Required() {
+			return nil, agent.ErrCertificateRequired
+		}
+		return nil, nil
+	}
+	if ca == nil {
+		return nil, agent.ErrNoCertificateAuthority
 	}
 
-	// Verify timestamp
-	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	ctx := r.Context()
+	identity, err := ca.Verify(ctx, r.TLS.PeerCertificates)
 	if err != nil {
-		return fmt.Errorf("invalid timestamp")
+		return nil, err
 	}
-
-	// Check token expiry
-	if time.Unix(timestamp, 0).Add(AgentTokenExpiry).Before(time.Now()) {
-		return fmt.Errorf("token expired")
+	if (agentID != "" && agentID != identity.AgentID) || (customerID != "" && customerID != identity.CustomerID) {
+		return nil, fmt.Errorf("agent certificate was issued to another agent")
 	}
-
-	return nil
+	if err := h.validateAgentAccount(ctx, identity.AgentID, identity.CustomerID); err != nil {
+		return nil, err
+	}
+	return identity, nil
 }
 
-func (h *AgentHandler) generateAgentToken(agent *models.Agent, apiKey string) string {
-	timestamp := time.Now().Unix()
-	message := fmt.Sprintf("%s:%s:%d", agent.ID, agent.CustomerID, timestamp)
+func hasClientCertificate(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+}
 
-	mac := hmac.New(sha256.New, []byte(apiKey))
-	mac.Write([]byte(message))
-	signature := hex.EncodeToString(mac.Sum(nil))
+// validateAgentAccount checks that the customer and the agent are active and
+// that the agent belongs to the customer
+func (h *AgentHandler) validateAgentAccount(ctx context.Context, agentID, customerID string) error {
+	customer, err := h.authService.GetCustomer(ctx, customerID)
+	if err != nil {
+		return fmt.Errorf("invalid customer: %w", err)
+	}
+	if customer.Status != "active" {
+		return fmt.Errorf("customer account is not active")
+	}
 
-	return fmt.Sprintf("%d.%s", timestamp, signature)
+	_, err = h.activeAgent(ctx, agentID, customerID)
+	return err
 }
 
-func (h *AgentHandler) compareTokens(providedToken, expectedToken string) bool {
-	// Use constant-time comparison to prevent timing attacks
-	return hmac.Equal([]byte(providedToken), []byte(expectedToken))
+// activeAgent reads the agent from the registry and checks that it belongs
+// to the customer and is enabled
+func (h *AgentHandler) activeAgent(ctx context.Context, agentID, customerID string) (*models.Agent, error) {
+	registry := h.agentManager.Registry()
+	if registry == nil {
+		return nil, agent.ErrNoRegistry
+	}
+
+	agentInfo, err := registry.Get(ctx, customerID, agentID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent: %w", err)
+	}
+	if agentInfo.Status != agent.AgentStatusActive {
+		return nil, fmt.Errorf("agent is not active")
+	}
+	return agentInfo, nil
 }
 
-// AuthService interface for dependency injection
+// AuthService interface for dependency injection; agents come from the
+// manager's registry
 type AuthService interface {
 	GetCustomer(ctx context.Context, customerID string) (*models.Customer, error)
-	GetAgent(ctx context.Context, agentID string) (*models.Agent, error)
 }
 
-// HandleAgentHealth handles agent health check endpoints
+// HandleAgentHealth returns the health of a connected agent of the
+// customer, named by the agent_id path or query parameter or the X-Agent-ID
+// header, or of all of them when none is named
 func (h *AgentHandler) HandleAgentHealth(c *gin.Context) {
-	agentID := c.GetHeader("X-Agent-ID")
-	if status := h.agentManager.GetAgentStatus(agentID); status == "" {
-		c.JSON(http.StatusNotFound, gin.H{"error": "agent not found"})
+	customerID, ok := h.managementCustomer(c)
+	if !ok {
+		return
+	}
+
+	agentID := c.Param("agent_id")
+	if agentID == "" {
+		agentID = c.Query("agent_id")
+	}
+	if agentID == "" {
+		agentID = c.GetHeader("X-Agent-ID")
+	}
+	if agentID == "" {
+		c.JSON(http.StatusOK, gin.H{"agents": h.agentManager.CustomerHealth(customerID)})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "healthy"})
+	health, found := h.agentManager.AgentHealth(agentID)
+	if !found || health.CustomerID != customerID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "agent not connected"})
+		return
+	}
+	c.JSON(http.StatusOK, health)
 }
 
 func (h *AgentHandler) HandleAgentDeregistration(c *gin.Context) {
@@ -502,13 +514,26 @@ func (h *AgentHandler) HandleAgentMetrics(c *gin.Context) {
 	})
 }
 
+// HandleAgentRegistration creates an agent for the authenticated customer;
+// the ID is generated unless the body names one
 func (h *AgentHandler) HandleAgentRegistration(c *gin.Context) {
-	// Implementation for agent registration
-	var agent models.Agent
-	if err := c.ShouldBindJSON(&agent); err != nil {
+	registry, customerID, ok := h.registryTarget(c)
+	if !ok {
+		return
+	}
+
+	var agentInfo models.Agent
+	if err := c.ShouldBindJSON(&agentInfo); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	// Add your registration logic
-	c.JSON(http.StatusOK, gin.H{"status": "registered"})
+
+	created, err := registry.Create(c.Request.Context(), customerID, &agentInfo)
+	if err != nil {
+		h.registryError(c, err, agentInfo.ID)
+		return
+	}
+
+	h.logger.Info("Agent created", "agent_id", created.ID, "customer_id", customerID)
+	c.JSON(http.StatusCreated, created)
 }
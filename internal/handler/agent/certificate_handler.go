@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+
+	"proxy-service/internal/service/agent"
+
+	"github.com/gin-gonic/gin"
+)
+
+// certificateRequest asks for an agent certificate. The bootstrap token is
+// left out when the agent renews with its current certificate.
+type certificateRequest struct {
+	BootstrapToken string `json:"bootstrap_token"`
+	CSR            string `json:"csr" binding:"required"`
+}
+
+// HandleIssueBootstrapToken returns a one-time token the agent named by
+// ?agent_id= exchanges for its first client certificate
+func (h *AgentHandler) HandleIssueBootstrapToken(c *gin.Context) {
+	customerID, agentID, ok := h.credentialTarget(c)
+	if !ok {
+		return
+	}
+
+	ca := h.agentManager.CertificateAuthority()
+	if ca == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": agent.ErrNoCertificateAuthority.Error()})
+		return
+	}
+
+	token, expiresAt, err := ca.IssueBootstrapToken(c.Request.Context(), customerID, agentID)
+	if err != nil {
+		h.logger.Error("Failed to issue bootstrap token", "error", err, "agent_id", agentID)
+		status := http.StatusInternalServerError
+		if errors.Is(err, agent.ErrCannotSignCertificates) {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"error": "failed to issue bootstrap token"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"agent_id":   agentID,
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+// HandleSignCertificate signs a client certificate for the CSR of an agent
+// that redeems a bootstrap token, or that presents its current certificate
+// to renew it
+func (h *AgentHandler) HandleSignCertificate(c *gin.Context) {
+	var req certificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ca := h.agentManager.CertificateAuthority()
+	if ca == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": agent.ErrNoCertificateAuthority.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var identity *agent.AgentIdentity
+	var err error
+	switch {
+	case req.BootstrapToken != "":
+		identity, err = ca.RedeemBootstrapToken(ctx, req.BootstrapToken)
+		if err == nil {
+			err = h.validateAgentAccount(ctx, identity.AgentID, identity.CustomerID)
+		}
+	case hasClientCertificate(c.Request):
+		identity, err = h.validateClientCertificate(c.Request, "", "")
+	default:
+		err = agent.ErrInvalidBootstrapToken
+	}
+	if err != nil {
+		h.logger.Error("Agent certificate refused", "error", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid agent credentials"})
+		return
+	}
+
+	certificate, err := ca.Sign(ctx, identity, []byte(req.CSR))
+	if err != nil {
+		h.logger.Error("Failed to sign agent certificate", "error", err, "agent_id", identity.AgentID)
+		status := http.StatusBadRequest
+		if errors.Is(err, agent.ErrCannotSignCertificates) {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.logger.Info("Signed agent certificate",
+		"agent_id", certificate.AgentID,
+		"serial", certificate.Serial,
+		"not_after", certificate.NotAfter)
+	c.JSON(http.StatusCreated, certificate)
+}
+
+// HandleRevokeCertificate denies the certificate with the serial in
+// ?serial= and closes the session it authenticated
+func (h *AgentHandler) HandleRevokeCertificate(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	if customerID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "customer not authenticated"})
+		return
+	}
+	serial := c.Query("serial")
+	if serial == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serial is required"})
+		return
+	}
+
+	err := h.agentManager.RevokeCertificate(c.Request.Context(), customerID, serial)
+	switch {
+	case err == nil:
+	case errors.Is(err, agent.ErrNoCertificateAuthority):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, agent.ErrCertificateNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	default:
+		h.logger.Error("Failed to revoke agent certificate", "error", err, "serial", serial)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke agent certificate"})
+		return
+	}
+
+	h.logger.Info("Revoked agent certificate", "customer_id", customerID, "serial", serial)
+	c.JSON(http.StatusOK, gin.H{"message": "certificate revoked"})
+}
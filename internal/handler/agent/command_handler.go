@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"proxy-service/internal/service/agent"
+
+	"github.com/gin-gonic/gin"
+)
+
+// commandRequest is an operator command for an agent. Timeout is a duration
+// such as "30s"; it defaults to agent.DefaultCommandTimeout.
+type commandRequest struct {
+	Command string `json:"command" binding:"required"`
+	Level   string `json:"level"`
+	Timeout string `json:"timeout"`
+}
+
+// HandleIssueCommand sends a command to a connected agent of the customer
+// in the path. It answers 202 with the pending command, whose result is
+// fetched later. Commands are for operators: the routes sit behind the
+// admin token.
+func (h *AgentHandler) HandleIssueCommand(c *gin.Context) {
+	customerID, ok := commandCustomer(c)
+	if !ok {
+		return
+	}
+
+	var req commandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var timeout time.Duration
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid timeout: %v", err)})
+			return
+		}
+	}
+
+	agentID := c.Param("agent_id")
+	command, err := h.agentManager.IssueCommand(c.Request.Context(), customerID, agentID, req.Command, req.Level, timeout)
+	if err != nil {
+		h.commandError(c, err, agentID)
+		return
+	}
+	c.JSON(http.StatusAccepted, command)
+}
+
+// HandleListCommands returns the latest commands sent to an agent, newest
+// first
+func (h *AgentHandler) HandleListCommands(c *gin.Context) {
+	log, customerID, ok := h.commandTarget(c)
+	if !ok {
+		return
+	}
+
+	agentID := c.Param("agent_id")
+	commands, err := log.List(c.Request.Context(), customerID, agentID)
+	if err != nil {
+		h.commandError(c, err, agentID)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"commands": commands})
+}
+
+// HandleGetCommand returns a command with its result once the agent answered
+func (h *AgentHandler) HandleGetCommand(c *gin.Context) {
+	log, customerID, ok := h.commandTarget(c)
+	if !ok {
+		return
+	}
+
+	agentID := c.Param("agent_id")
+	command, err := log.Get(c.Request.Context(), customerID, c.Param("command_id"))
+	if err == nil && command.AgentID != agentID {
+		err = agent.ErrCommandNotFound
+	}
+	if err != nil {
+		h.commandError(c, err, agentID)
+		return
+	}
+	c.JSON(http.StatusOK, command)
+}
+
+// commandTarget resolves the command log and the customer in the path
+func (h *AgentHandler) commandTarget(c *gin.Context) (*agent.CommandLog, string, bool) {
+	customerID, ok := commandCustomer(c)
+	if !ok {
+		return nil, "", false
+	}
+
+	log := h.agentManager.CommandLog()
+	if log == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": agent.ErrNoCommandLog.Error()})
+		return nil, "", false
+	}
+	return log, customerID, true
+}
+
+// commandCustomer returns the customer an operator request names in its path
+func commandCustomer(c *gin.Context) (string, bool) {
+	customerID := c.Param("customer_id")
+	if customerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "customer_id is required"})
+		return "", false
+	}
+	return customerID, true
+}
+
+// commandError maps a command failure to its response
+func (h *AgentHandler) commandError(c *gin.Context, err error, agentID string) {
+	switch {
+	case errors.Is(err, agent.ErrNoCommandLog):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, agent.ErrCommandNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, agent.ErrAgentNotConnected):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, agent.ErrInvalidCommand), errors.Is(err, agent.ErrInvalidLogLevel), errors.Is(err, agent.ErrInvalidTimeout):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Agent command failed", "error", err, "agent_id", agentID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "agent command failed"})
+	}
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+	"proxy-service/internal/service/agent"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleGetConfig returns the agent configuration of the authenticated
+// customer, or with ?agent_id= the configuration that agent should run
+func (h *AgentHandler) HandleGetConfig(c *gin.Context) {
+	customerID, agentID, ok := h.configTarget(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, h.agentManager.GetAgentConfig(customerID, agentID))
+}
+
+// HandleUpdateConfig stores a new revision of the customer's agent
+// configuration, or with ?agent_id= an override for that agent, and pushes
+// it to the connected agents it applies to
+func (h *AgentHandler) HandleUpdateConfig(c *gin.Context) {
+	customerID, agentID, ok := h.configTarget(c)
+	if !ok {
+		return
+	}
+
+	var config models.AgentConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateRoutes(config.Routes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var stored *models.AgentConfig
+	var err error
+	if agentID == "" {
+		stored, err = h.agentManager.SetCustomerConfig(c.Request.Context(), customerID, &config)
+	} else {
+		stored, err = h.agentManager.SetAgentConfig(c.Request.Context(), customerID, agentID, &config)
+	}
+	if err != nil {
+		h.logger.Error("Failed to store agent config", "error", err, "customer_id", customerID, "agent_id", agentID)
+		status := http.StatusInternalServerError
+		if errors.Is(err, agent.ErrNoConfigStore) {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"error": "failed to store agent config"})
+		return
+	}
+
+	c.JSON(http.StatusOK, stored)
+}
+
+// HandleConfigStatus lists which configuration revision every connected agent
+// of the customer is running
+func (h *AgentHandler) HandleConfigStatus(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	if customerID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "customer not authenticated"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"customer_id": customerID,
+		"revision":    h.agentManager.GetCustomerConfig(customerID).Revision,
+		"agents":      h.agentManager.ConfigRollouts(customerID),
+	})
+}
+
+// configTarget resolves the customer from the auth middleware and checks
+// that an agent named in the query belongs to it
+func (h *AgentHandler) configTarget(c *gin.Context) (string, string, bool) {
+	customerID := c.GetString("customer_id")
+	if customerID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "customer not authenticated"})
+		return "", "", false
+	}
+
+	agentID := c.Query("agent_id")
+	if agentID == "" {
+		return customerID, "", true
+	}
+
+	registry := h.agentManager.Registry()
+	if registry == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": agent.ErrNoRegistry.Error()})
+		return "", "", false
+	}
+	if _, err := registry.Get(c.Request.Context(), customerID, agentID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "agent not found"})
+		return "", "", false
+	}
+	return customerID, agentID, true
+}
+
+// validateRoutes rejects routes whose agent selector, routing modes or
+// header rules could never be applied
+func validateRoutes(routes []models.RouteConfig) error {
+	for _, route := range routes {
+		if _, err := agent.ParseSelector(route.AgentSelector); err != nil {
+			return fmt.Errorf("route %s: %w", route.Path, err)
+		}
+		if !agent.ValidSelectorFallback(route.SelectorFallback) {
+			return fmt.Errorf("route %s: selector_fallback must be %s or %s", route.Path, agent.SelectorFallbackReject, agent.SelectorFallbackAny)
+		}
+		if !service.ValidRoutingMode(route.RoutingMode) || !service.ValidRoutingMode(route.FailoverMode) {
+			return fmt.Errorf("route %s: %w", route.Path, service.ErrInvalidRoutingMode)
+		}
+		if err := service.ValidateHeaderPolicy(route.HeaderPolicy); err != nil {
+			return fmt.Errorf("route %s: %w", route.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"proxy-service/internal/service/agent"
+
+	"github.com/gin-gonic/gin"
+)
+
+// connectTokenRequest proves an agent holds a credential's secret
+type connectTokenRequest struct {
+	CredentialID string `json:"credential_id" binding:"required"`
+	Secret       string `json:"secret" binding:"required"`
+}
+
+// HandleIssueCredential issues a new credential to the agent named by
+// ?agent_id= and returns it with its secret, which is never shown again.
+// The agent's previous credentials keep working for ?overlap=, or for the
+// configured rotation overlap.
+func (h *AgentHandler) HandleIssueCredential(c *gin.Context) {
+	customerID, agentID, ok := h.credentialTarget(c)
+	if !ok {
+		return
+	}
+
+	overlap := time.Duration(-1)
+	if value := c.Query("overlap"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid overlap"})
+			return
+		}
+		overlap = parsed
+	}
+
+	store := h.agentManager.Credentials()
+	if store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": agent.ErrNoCredentialStore.Error()})
+		return
+	}
+
+	credential, err := store.Issue(c.Request.Context(), customerID, agentID, overlap)
+	if err != nil {
+		h.logger.Error("Failed to issue agent credential", "error", err, "agent_id", agentID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue agent credential"})
+		return
+	}
+
+	h.logger.Info("Issued agent credential", "agent_id", agentID, "credential_id", credential.ID)
+	c.JSON(http.StatusCreated, credential)
+}
+
+// HandleListCredentials lists the credentials the agent named by ?agent_id=
+// can still connect with
+func (h *AgentHandler) HandleListCredentials(c *gin.Context) {
+	_, agentID, ok := h.credentialTarget(c)
+	if !ok {
+		return
+	}
+
+	store := h.agentManager.Credentials()
+	if store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": agent.ErrNoCredentialStore.Error()})
+		return
+	}
+
+	credentials, err := store.List(c.Request.Context(), agentID)
+	if err != nil {
+		h.logger.Error("Failed to list agent credentials", "error", err, "agent_id", agentID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list agent credentials"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"agent_id":    agentID,
+		"credentials": credentials,
+	})
+}
+
+// HandleRevokeCredential revokes the credential named by ?credential_id=, or
+// every credential of the agent without it, and disconnects the sessions
+// they authenticated
+func (h *AgentHandler) HandleRevokeCredential(c *gin.Context) {
+	_, agentID, ok := h.credentialTarget(c)
+	if !ok {
+		return
+	}
+	credentialID := c.Query("credential_id")
+
+	err := h.agentManager.RevokeCredential(c.Request.Context(), agentID, credentialID)
+	switch {
+	case err == nil:
+	case errors.Is(err, agent.ErrNoCredentialStore):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, agent.ErrCredentialNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	default:
+		h.logger.Error("Failed to revoke agent credential", "error", err, "agent_id", agentID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke agent credential"})
+		return
+	}
+
+	h.logger.Info("Revoked agent credential", "agent_id", agentID, "credential_id", credentialID)
+	c.JSON(http.StatusOK, gin.H{"message": "credential revoked"})
+}
+
+// HandleConnectToken exchanges a credential's secret for a short-lived
+// connect token. Agents that can sign tokens themselves do not need it.
+func (h *AgentHandler) HandleConnectToken(c *gin.Context) {
+	agentID := c.GetHeader("X-Agent-ID")
+	customerID := c.GetHeader("X-Customer-ID")
+
+	var req connectTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil || agentID == "" || customerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent, customer, credential and secret are required"})
+		return
+	}
+
+	store := h.agentManager.Credentials()
+	if store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": agent.ErrNoCredentialStore.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err := h.validateAgentAccount(ctx, agentID, customerID); err != nil {
+		h.logger.Error("Connect token refused", "error", err, "agent_id", agentID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid agent credentials"})
+		return
+	}
+
+	token, expiresAt, err := store.Exchange(ctx, customerID, agentID, req.CredentialID, req.Secret)
+	if err != nil {
+		h.logger.Error("Connect token refused", "error", err, "agent_id", agentID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid agent credentials"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+// credentialTarget is configTarget for endpoints that always name an agent
+func (h *AgentHandler) credentialTarget(c *gin.Context) (string, string, bool) {
+	if c.Query("agent_id") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent_id is required"})
+		return "", "", false
+	}
+	return h.configTarget(c)
+}
@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+
+	"github.com/gin-gonic/gin"
+)
+
+// agentUpdate holds the fields of an agent its customer may change
+type agentUpdate struct {
+	Name        string                 `json:"name"`
+	Metadata    map[string]interface{} `json:"metadata"`
+	Permissions []string               `json:"permissions"`
+	Labels      map[string]string      `json:"labels"`
+}
+
+// HandleListAgents returns the agents of the authenticated customer
+func (h *AgentHandler) HandleListAgents(c *gin.Context) {
+	registry, customerID, ok := h.registryTarget(c)
+	if !ok {
+		return
+	}
+
+	agents, err := registry.List(c.Request.Context(), customerID)
+	if err != nil {
+		h.registryError(c, err, "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"agents": agents})
+}
+
+// HandleGetAgent returns an agent of the authenticated customer
+func (h *AgentHandler) HandleGetAgent(c *gin.Context) {
+	registry, customerID, ok := h.registryTarget(c)
+	if !ok {
+		return
+	}
+
+	agentID := c.Param("agent_id")
+	agentInfo, err := registry.Get(c.Request.Context(), customerID, agentID)
+	if err != nil {
+		h.registryError(c, err, agentID)
+		return
+	}
+	c.JSON(http.StatusOK, agentInfo)
+}
+
+// HandleUpdateAgent replaces the name, metadata, permissions and labels of an
+// agent
+func (h *AgentHandler) HandleUpdateAgent(c *gin.Context) {
+	registry, customerID, ok := h.registryTarget(c)
+	if !ok {
+		return
+	}
+
+	var req agentUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	agentID := c.Param("agent_id")
+	agentInfo, err := registry.Update(c.Request.Context(), customerID, agentID, &models.Agent{
+		Name:        req.Name,
+		Metadata:    req.Metadata,
+		Permissions: req.Permissions,
+		Labels:      req.Labels,
+	})
+	if err != nil {
+		h.registryError(c, err, agentID)
+		return
+	}
+	c.JSON(http.StatusOK, agentInfo)
+}
+
+// HandleDisableAgent disconnects an agent and refuses it until it is
+// enabled again
+func (h *AgentHandler) HandleDisableAgent(c *gin.Context) {
+	customerID, ok := h.managementCustomer(c)
+	if !ok {
+		return
+	}
+
+	agentID := c.Param("agent_id")
+	if err := h.agentManager.DisableAgent(c.Request.Context(), customerID, agentID, false); err != nil {
+		h.registryError(c, err, agentID)
+		return
+	}
+
+	h.logger.Info("Agent disabled", "agent_id", agentID, "customer_id", customerID)
+	c.JSON(http.StatusOK, gin.H{"message": "agent disabled"})
+}
+
+// HandleEnableAgent lets a disabled agent connect again
+func (h *AgentHandler) HandleEnableAgent(c *gin.Context) {
+	registry, customerID, ok := h.registryTarget(c)
+	if !ok {
+		return
+	}
+
+	agentID := c.Param("agent_id")
+	agentInfo, err := registry.SetStatus(c.Request.Context(), customerID, agentID, agent.AgentStatusActive)
+	if err != nil {
+		h.registryError(c, err, agentID)
+		return
+	}
+
+	h.logger.Info("Agent enabled", "agent_id", agentID, "customer_id", customerID)
+	c.JSON(http.StatusOK, agentInfo)
+}
+
+// HandleDeleteAgent removes an agent and disconnects it
+func (h *AgentHandler) HandleDeleteAgent(c *gin.Context) {
+	customerID, ok := h.managementCustomer(c)
+	if !ok {
+		return
+	}
+
+	agentID := c.Param("agent_id")
+	if err := h.agentManager.DisableAgent(c.Request.Context(), customerID, agentID, true); err != nil {
+		h.registryError(c, err, agentID)
+		return
+	}
+
+	h.logger.Info("Agent deleted", "agent_id", agentID, "customer_id", customerID)
+	c.JSON(http.StatusOK, gin.H{"message": "agent deleted"})
+}
+
+func (h *AgentHandler) managementCustomer(c *gin.Context) (string, bool) {
+	customerID := c.GetString("customer_id")
+	if customerID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "customer not authenticated"})
+		return "", false
+	}
+	return customerID, true
+}
+
+// registryTarget resolves the agent registry and the authenticated customer
+// for management requests
+func (h *AgentHandler) registryTarget(c *gin.Context) (*agent.Registry, string, bool) {
+	customerID, ok := h.managementCustomer(c)
+	if !ok {
+		return nil, "", false
+	}
+
+	registry := h.agentManager.Registry()
+	if registry == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": agent.ErrNoRegistry.Error()})
+		return nil, "", false
+	}
+	return registry, customerID, true
+}
+
+// registryError maps a registry failure to its response
+func (h *AgentHandler) registryError(c *gin.Context, err error, agentID string) {
+	switch {
+	case errors.Is(err, agent.ErrNoRegistry):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, agent.ErrAgentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, agent.ErrAgentExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, agent.ErrInvalidStatus), errors.Is(err, agent.ErrInvalidLabels):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Agent management failed", "error", err, "agent_id", agentID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "agent management failed"})
+	}
+}
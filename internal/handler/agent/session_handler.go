@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleListSessions returns a page of the customer's agent sessions, newest
+// first. The agent comes from the path or the agent_id query; from and to
+// (RFC 3339) keep the sessions that were open at some point in between, and
+// page and page_size pick the page.
+func (h *AgentHandler) HandleListSessions(c *gin.Context) {
+	customerID, ok := h.managementCustomer(c)
+	if !ok {
+		return
+	}
+
+	history := h.agentManager.SessionHistory()
+	if history == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": agent.ErrNoSessionHistory.Error()})
+		return
+	}
+
+	query, err := sessionQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	query.CustomerID = customerID
+
+	page, err := history.List(c.Request.Context(), query)
+	if errors.Is(err, agent.ErrInvalidSessionPage) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to list agent sessions", "error", err, "customer_id", customerID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list agent sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// sessionQuery reads the filters of a session listing
+func sessionQuery(c *gin.Context) (models.AgentSessionQuery, error) {
+	query := models.AgentSessionQuery{AgentID: c.Param("agent_id")}
+	if query.AgentID == "" {
+		query.AgentID = c.Query("agent_id")
+	}
+
+	var err error
+	for _, bound := range []struct {
+		name string
+		into *time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		if value := c.Query(bound.name); value != "" {
+			if *bound.into, err = time.Parse(time.RFC3339, value); err != nil {
+				return query, fmt.Errorf("invalid %s: %w", bound.name, err)
+			}
+		}
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && query.To.Before(query.From) {
+		return query, errors.New("to must not be before from")
+	}
+
+	for _, number := range []struct {
+		name string
+		into *int
+	}{{"page", &query.Page}, {"page_size", &query.PageSize}} {
+		if value := c.Query(number.name); value != "" {
+			if *number.into, err = strconv.Atoi(value); err != nil || *number.into <= 0 {
+				return query, fmt.Errorf("%s must be a positive integer", number.name)
+			}
+		}
+	}
+	return query, nil
+}
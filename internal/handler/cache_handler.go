@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"net/http"
+	"proxy-service/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CacheHandler lets operators purge cached responses
+type CacheHandler struct {
+	proxyService *service.ProxyService
+}
+
+func NewCacheHandler(service *service.ProxyService) *CacheHandler {
+	return &CacheHandler{
+		proxyService: service,
+	}
+}
+
+type purgeRequest struct {
+	CustomerID string `json:"customer_id" binding:"required"`
+	// PathPrefix and Tags narrow the purge; without either every cached
+	// response of the customer is purged
+	PathPrefix string   `json:"path_prefix"`
+	Tags       []string `json:"tags"`
+}
+
+func (h *CacheHandler) HandlePurge(c *gin.Context) {
+	var req purgeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request format"})
+		return
+	}
+
+	purged, err := h.proxyService.PurgeResponses(c.Request.Context(), req.CustomerID, req.PathPrefix, req.Tags)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to purge cached responses",
+			"code":  "CACHE_PURGE_ERROR",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"proxy-service/internal/config"
 	"proxy-service/internal/service"
+	"proxy-service/internal/service/agent"
 	"proxy-service/pkg/cache"
 	"proxy-service/pkg/metrics"
 )
@@ -17,16 +18,23 @@ type Handler struct {
 	Auth     *AuthHandler
 	Proxy    *ProxyHandler
 	Metrics  *MetricsHandler
+	TCP      *TCPHandler
+	Replica  *ReplicaHandler
+	Caching  *CacheHandler
 	services *service.Services
 	config   *config.Config
 	cache    *cache.RedisCache
 }
 
 func NewHandler(deps Deps) *Handler {
+	proxy := NewProxyHandler(deps.Services.Proxy, deps.Cache) // This is correct now
 	return &Handler{
 		Auth:     NewAuthHandler(deps.Services.Auth),
-		Proxy:    NewProxyHandler(deps.Services.Proxy, deps.Cache), // This is correct now
+		Proxy:    proxy,
 		Metrics:  NewMetricsHandler(deps.Services.Metrics),
+		TCP:      NewTCPHandler(deps.Services.Proxy, ProxyAuthResolver(deps.Services.Auth)),
+		Replica:  NewReplicaHandler(deps.Services.Proxy, proxy),
+		Caching:  NewCacheHandler(deps.Services.Proxy),
 		services: deps.Services,
 		config:   deps.Config,
 		cache:    deps.Cache,
@@ -48,6 +56,10 @@ func (h *Handler) GetAuthService() *service.AuthService {
 	return h.services.Auth
 }
 
+func (h *Handler) AgentManager() *agent.AgentManager {
+	return h.services.Agents
+}
+
 func (h *Handler) Cache() *cache.RedisCache {
 	return h.cache
 }
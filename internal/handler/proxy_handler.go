@@ -1,13 +1,18 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"proxy-service/internal/service"
+	"proxy-service/internal/service/agent"
 	"proxy-service/pkg/cache"
 	"proxy-service/pkg/logger"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 )
 
 type ProxyHandler struct {
@@ -30,31 +35,164 @@ func (h *ProxyHandler) HandleRequest(c *gin.Context) {
 	// Get proxy configuration
 	_, err := h.cache.GetProxyConfig(c.Request.Context(), customerID)
 	if err != nil {
+		// A customer without configuration was removed, so are its upstream
+		// connections. Failing to read the configuration says nothing
+		// about the customer.
+		if cache.IsNotFound(err) {
+			h.proxyService.RemoveCustomer(customerID)
+		} else {
+			h.logger.Error("failed to get proxy configuration",
+				"error", err,
+				"customer_id", customerID,
+			)
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get proxy configuration"})
 		return
 	}
 
+	ctx := context.WithValue(c.Request.Context(), "customer_id", customerID)
+	// Requests handed over by another replica already carry the client's address
+	if _, _, ok := service.ClientInfo(ctx); !ok {
+		ctx = service.WithClientInfo(ctx, c.ClientIP(), c.GetHeader(service.RequestIDHeader))
+	}
+
+	if h.proxyService.RoutingMode(ctx, customerID, c.Request) == service.RoutingModeAgent {
+		// Agents connected to another replica are reached through that replica
+		location, err := h.proxyService.RemoteAgent(ctx, customerID, c.Request)
+		if err != nil {
+			h.logger.Error("failed to look up remote agents",
+				"error", err,
+				"customer_id", customerID,
+			)
+		}
+		if location != nil {
+			h.proxyService.ForwardToReplica(c.Writer, c.Request.WithContext(ctx), customerID, location)
+			return
+		}
+
+		// WebSocket upgrades become a tunnel through the agent
+		if websocket.IsWebSocketUpgrade(c.Request) {
+			h.handleWebSocket(ctx, c, customerID)
+			return
+		}
+	} else if websocket.IsWebSocketUpgrade(c.Request) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "websocket upgrades are only relayed through agents"})
+		return
+	}
+
 	// Forward the request
-	resp, err := h.proxyService.ForwardRequest(c.Request.Context(), c.Request)
+	resp, err := h.proxyService.ForwardRequest(ctx, c.Request)
+	if err != nil {
+		h.writeForwardError(c, err)
+		return
+	}
+
+	h.writeResponse(c, customerID, resp)
+}
+
+func (h *ProxyHandler) handleWebSocket(ctx context.Context, c *gin.Context, customerID string) {
+	tunnel, resp, err := h.proxyService.OpenTunnel(ctx, c.Request)
+	if err != nil {
+		h.writeForwardError(c, err)
+		return
+	}
+
+	// The agent refused, so its answer goes back as a normal response
+	if tunnel == nil {
+		h.writeResponse(c, customerID, resp)
+		return
+	}
+
+	// Origin checks are left to the upstream, which sees the Origin header.
+	// The subprotocol the upstream picked is passed on in resp.Header.
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	client, err := upgrader.Upgrade(c.Writer, c.Request, resp.Header)
 	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": "proxy request failed"})
+		h.logger.Error("failed to upgrade client connection",
+			"error", err,
+			"customer_id", customerID,
+		)
+		tunnel.Close(websocket.CloseGoingAway, "client upgrade failed")
 		return
 	}
+
+	h.proxyService.RelayTunnel(customerID, client, tunnel)
+}
+
+func (h *ProxyHandler) writeForwardError(c *gin.Context, err error) {
+	if retries := service.Retries(err); retries > 0 {
+		c.Header(service.RetriesHeader, strconv.Itoa(retries))
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "proxy request timed out"})
+		return
+	}
+	if errors.Is(err, agent.ErrInvalidSelector) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": agent.ErrInvalidSelector.Error()})
+		return
+	}
+	if errors.Is(err, service.ErrNoMatchingAgent) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": service.ErrNoMatchingAgent.Error()})
+		return
+	}
+	for _, unavailable := range []error{service.ErrNoTargetURL, service.ErrTunnelUnavailable} {
+		if errors.Is(err, unavailable) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": unavailable.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"error": "proxy request failed"})
+}
+
+func (h *ProxyHandler) writeResponse(c *gin.Context, customerID string, resp *http.Response) {
 	defer resp.Body.Close()
 
-	// Copy headers
+	// Copy headers, keeping every value of repeated headers
 	for key, values := range resp.Header {
 		for _, value := range values {
-			c.Header(key, value)
+			c.Writer.Header().Add(key, value)
 		}
 	}
 
 	// Set status code
 	c.Status(resp.StatusCode)
 
-	// Copy body
-	if _, err := io.Copy(c.Writer, resp.Body); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to copy response"})
+	// Stream body; the status is already committed, so failures can only be logged
+	if err := streamResponseBody(c.Writer, resp.Body); err != nil {
+		h.logger.Error("failed to copy response",
+			"error", err,
+			"customer_id", customerID,
+		)
 		return
 	}
+
+	// Trailers are only known once the body is done
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			c.Writer.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
+
+// streamResponseBody copies body to the client, flushing after every chunk
+// so large downloads are relayed as they arrive instead of being buffered
+func streamResponseBody(w gin.ResponseWriter, body io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			w.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
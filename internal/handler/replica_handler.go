@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"net/http"
+	"proxy-service/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReplicaHandler serves the internal endpoint other replicas hand requests
+// to when the customer's agent is connected to this replica
+type ReplicaHandler struct {
+	proxyService *service.ProxyService
+	proxy        *ProxyHandler
+}
+
+func NewReplicaHandler(proxyService *service.ProxyService, proxy *ProxyHandler) *ReplicaHandler {
+	return &ReplicaHandler{
+		proxyService: proxyService,
+		proxy:        proxy,
+	}
+}
+
+// HandleRequest authenticates the sending replica, then serves the request
+// with the agent it was meant for, exactly as a client request
+func (h *ReplicaHandler) HandleRequest(c *gin.Context) {
+	if !h.proxyService.ValidReplicaToken(c.GetHeader(service.ReplicaTokenHeader)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "invalid replica token"})
+		return
+	}
+
+	customerID := c.GetHeader(service.ReplicaCustomerHeader)
+	agentID := c.GetHeader(service.ReplicaAgentHeader)
+	if customerID == "" || agentID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing customer or agent"})
+		return
+	}
+
+	ctx := service.WithPinnedAgent(c.Request.Context(), agentID)
+	if clientIP := c.GetHeader(service.ReplicaClientIPHeader); clientIP != "" {
+		ctx = service.WithClientInfo(ctx, clientIP, c.GetHeader(service.ReplicaRequestIDHeader))
+	}
+	for _, name := range service.ReplicaHeaders {
+		c.Request.Header.Del(name)
+	}
+	c.Request = c.Request.WithContext(ctx)
+	c.Set("customer_id", customerID)
+
+	h.proxy.HandleRequest(c)
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"proxy-service/internal/service"
+	"proxy-service/pkg/logger"
+	"strings"
+	"time"
+)
+
+// CustomerResolver identifies the customer behind a CONNECT request
+type CustomerResolver func(r *http.Request) (string, error)
+
+// TCPHandler accepts CONNECT requests for customer TCP targets and pipes the
+// hijacked connection through one of the customer's agents
+type TCPHandler struct {
+	proxyService *service.ProxyService
+	resolve      CustomerResolver
+	logger       *logger.Logger
+}
+
+func NewTCPHandler(proxyService *service.ProxyService, resolve CustomerResolver) *TCPHandler {
+	return &TCPHandler{
+		proxyService: proxyService,
+		resolve:      resolve,
+		logger:       logger.NewLogger(),
+	}
+}
+
+// ProxyAuthResolver takes the customer from the bearer token in
+// Proxy-Authorization, which is where CONNECT clients send credentials
+func ProxyAuthResolver(authService *service.AuthService) CustomerResolver {
+	return func(r *http.Request) (string, error) {
+		token := strings.TrimPrefix(r.Header.Get("Proxy-Authorization"), "Bearer ")
+		if token == "" {
+			return "", errors.New("missing proxy authorization")
+		}
+
+		claims, err := authService.VerifyToken(r.Context(), token)
+		if err != nil {
+			return "", err
+		}
+		return claims.CustomerID, nil
+	}
+}
+
+// Wrap sends CONNECT requests to the handler and everything else to next.
+// CONNECT has no path, so it never reaches the router.
+func (h *TCPHandler) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *TCPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	customerID, err := h.resolve(r)
+	if err != nil {
+		w.Header().Set("Proxy-Authenticate", "Bearer")
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	stream, target, err := h.proxyService.OpenTCPStream(r.Context(), customerID, r.Host)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrTCPTargetNotAllowed):
+			http.Error(w, "target not allowed", http.StatusForbidden)
+		case errors.Is(err, context.DeadlineExceeded):
+			http.Error(w, "target connection timed out", http.StatusGatewayTimeout)
+		default:
+			http.Error(w, "failed to connect to target", http.StatusBadGateway)
+		}
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		stream.Close()
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		stream.Close()
+		h.logger.Error("failed to hijack connection",
+			"error", err,
+			"customer_id", customerID,
+			"target", target.Address)
+		return
+	}
+
+	// The server's read and write timeouts are meant for requests; a tunnel
+	// lives as long as its peers. Recent net/http releases clear them on
+	// hijack, older ones and other servers do not.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+
+	// The client may have sent its first bytes along with the request
+	h.proxyService.PipeTCP(customerID, target, &bufferedConn{Conn: conn, reader: buffered.Reader}, stream)
+}
+
+// bufferedConn reads through the buffer left over from the HTTP request
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
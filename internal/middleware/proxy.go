@@ -28,11 +28,6 @@ func Proxy() gin.HandlerFunc {
 			return
 		}
 
-		// Add proxy headers
-		c.Request.Header.Set("X-Forwarded-For", c.ClientIP())
-		c.Request.Header.Set("X-Real-IP", c.ClientIP())
-		c.Request.Header.Set("X-Proxy-ID", "proxy-service")
-
 		c.Next()
 	}
 }
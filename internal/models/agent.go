@@ -17,6 +17,12 @@ type Agent struct {
 	UpdatedAt   time.Time              `json:"updated_at" bson:"updated_at"`
 	Metadata    map[string]interface{} `json:"metadata" bson:"metadata"`
 	Permissions []string               `json:"permissions" bson:"permissions"`
+	// Labels such as region=eu steer requests to the agent through selectors
+	Labels map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+	// ConnectionStatus is the state of the agent's live connection:
+	// connected, draining or disconnected
+	ConnectionStatus string    `json:"connection_status" bson:"connection_status"`
+	LastConnected    time.Time `json:"last_connected" bson:"last_connected"`
 }
 
 func (a *Agent) IsActive() bool {
@@ -32,16 +38,6 @@ type AgentStatus struct {
 	Metrics       AgentMetrics `json:"metrics"`
 }
 
-type AgentMetrics struct {
-	ConnectionUptime  float64 `json:"connection_uptime"`
-	RequestsProcessed int64   `json:"requests_processed"`
-	AverageLatency    float64 `json:"average_latency"`
-	ErrorCount        int64   `json:"error_count"`
-	MemoryUsage       float64 `json:"memory_usage"`
-	CPUUsage          float64 `json:"cpu_usage"`
-	Uptime            float64 `json:"uptime"`
-}
-
 type AgentConnection struct {
 	ID         string
 	CustomerID string
@@ -49,3 +45,16 @@ type AgentConnection struct {
 	StartTime  time.Time
 	LastPing   time.Time
 }
+
+// AgentCredential is a secret issued to a single agent, which it signs its
+// connect tokens with. Secret is only returned when the credential is issued.
+type AgentCredential struct {
+	ID         string    `json:"id"`
+	AgentID    string    `json:"agent_id"`
+	CustomerID string    `json:"customer_id"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	// ExpiresAt is set once a newer credential replaces this one, which
+	// keeps working until then so the agent can switch over
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
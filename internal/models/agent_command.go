@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// AgentCommand is an operator command sent to an agent, kept with its
+// result so it can be reviewed after the fact
+type AgentCommand struct {
+	ID         string `json:"id" bson:"_id"`
+	CustomerID string `json:"customer_id" bson:"customer_id"`
+	AgentID    string `json:"agent_id" bson:"agent_id"`
+	// Command is reload_config, restart, diagnostics or set_log_level
+	Command string `json:"command" bson:"command"`
+	// Level is the log level set_log_level switches to
+	Level string `json:"level,omitempty" bson:"level,omitempty"`
+	// Status is pending until the agent answers: succeeded, failed or
+	// timed_out
+	Status      string              `json:"status" bson:"status"`
+	Result      *AgentCommandResult `json:"result,omitempty" bson:"result,omitempty"`
+	Error       string              `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedAt   time.Time           `json:"created_at" bson:"created_at"`
+	Deadline    time.Time           `json:"deadline" bson:"deadline"`
+	CompletedAt *time.Time          `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+}
+
+// AgentCommandResult is what the agent reported back
+type AgentCommandResult struct {
+	Message     string            `json:"message,omitempty" bson:"message,omitempty"`
+	Diagnostics *AgentDiagnostics `json:"diagnostics,omitempty" bson:"diagnostics,omitempty"`
+}
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// AgentSession is one connection of an agent, from its admission until the
+// socket went away
+type AgentSession struct {
+	ID              string `json:"id" bson:"_id"`
+	CustomerID      string `json:"customer_id" bson:"customer_id"`
+	AgentID         string `json:"agent_id" bson:"agent_id"`
+	ReplicaID       string `json:"replica_id,omitempty" bson:"replica_id,omitempty"`
+	RemoteAddr      string `json:"remote_addr" bson:"remote_addr"`
+	AgentVersion    string `json:"agent_version,omitempty" bson:"agent_version,omitempty"`
+	ProtocolVersion int    `json:"protocol_version" bson:"protocol_version"`
+	// ConnectedAt is when the socket was opened
+	ConnectedAt time.Time `json:"connected_at" bson:"connected_at"`
+	// DisconnectedAt and DisconnectReason stay empty while the session is open
+	DisconnectedAt   *time.Time `json:"disconnected_at,omitempty" bson:"disconnected_at"`
+	DisconnectReason string     `json:"disconnect_reason,omitempty" bson:"disconnect_reason,omitempty"`
+	// RequestsServed counts the proxied requests the agent answered
+	RequestsServed int64 `json:"requests_served" bson:"requests_served"`
+}
+
+// AgentSessionQuery selects a page of a customer's sessions. Zero times leave
+// that end of the range open; a session matches when it was open at any
+// point between From and To.
+type AgentSessionQuery struct {
+	CustomerID string
+	AgentID    string
+	From       time.Time
+	To         time.Time
+	Page       int
+	PageSize   int
+}
+
+// AgentSessionPage is a page of sessions, newest first
+type AgentSessionPage struct {
+	Sessions []*AgentSession `json:"sessions"`
+	Page     int             `json:"page"`
+	PageSize int             `json:"page_size"`
+	Total    int64           `json:"total"`
+}
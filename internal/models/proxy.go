@@ -1,6 +1,9 @@
 package models
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 type ProxyConfig struct {
 	ID            string            `bson:"_id" json:"id"`
@@ -8,10 +11,58 @@ type ProxyConfig struct {
 	TargetURL     string            `bson:"target_url" json:"target_url"`
 	Headers       map[string]string `bson:"headers" json:"headers"`
 	RateLimit     int               `bson:"rate_limit" json:"rate_limit"`
-	Timeout       int               `bson:"timeout" json:"timeout"`
+	Timeout       int               `bson:"timeout" json:"timeout"` // seconds, 0 for none
 	RetryCount    int               `bson:"retry_count" json:"retry_count"`
 	CacheEnabled  bool              `bson:"cache_enabled" json:"cache_enabled"`
 	TunnelEnabled bool              `bson:"tunnel_enabled" json:"tunnel_enabled"`
+	// LoadBalancing picks how requests are spread over the customer's agents:
+	// round_robin (default), least_in_flight, latency_ewma or consistent_hash
+	LoadBalancing string `bson:"load_balancing,omitempty" json:"load_balancing,omitempty"`
+	// HashHeader is the request header keyed on by consistent_hash
+	HashHeader string `bson:"hash_header,omitempty" json:"hash_header,omitempty"`
+	// AgentSelector limits requests to agents with matching labels, e.g.
+	// "region=eu"; routes and the X-Agent-Selector header override it
+	AgentSelector string `bson:"agent_selector,omitempty" json:"agent_selector,omitempty"`
+	// SelectorFallback is what happens when no agent matches: reject
+	// (default) or any
+	SelectorFallback string `bson:"selector_fallback,omitempty" json:"selector_fallback,omitempty"`
+	// TCPTargets lists the endpoints reachable by TCP forwarding
+	TCPTargets []TCPTarget `bson:"tcp_targets,omitempty" json:"tcp_targets,omitempty"`
+	// RoutingMode is how requests reach the customer: agent (default),
+	// direct to TargetURL, or cloudflare through the tunnel to TargetURL
+	RoutingMode string `bson:"routing_mode,omitempty" json:"routing_mode,omitempty"`
+	// FailoverMode is tried when RoutingMode cannot serve a request; empty
+	// means no failover
+	FailoverMode string `bson:"failover_mode,omitempty" json:"failover_mode,omitempty"`
+	// UpstreamTLS is how TLS connections to TargetURL are made
+	UpstreamTLS *UpstreamTLS `bson:"upstream_tls,omitempty" json:"upstream_tls,omitempty"`
+	// RetryOtherAgent sends retries to agents the request was not tried on
+	// yet, while there are any
+	RetryOtherAgent bool `bson:"retry_other_agent,omitempty" json:"retry_other_agent,omitempty"`
+	// CacheTTL is how long, in seconds, cached responses that carry no
+	// freshness of their own stay fresh; 0 caches only those that do
+	CacheTTL int `bson:"cache_ttl,omitempty" json:"cache_ttl,omitempty"`
+	// CacheStaleTTL is how long, in seconds, a response past its freshness
+	// may still be served while it is revalidated or the upstream fails,
+	// unless the response says otherwise
+	CacheStaleTTL int `bson:"cache_stale_ttl,omitempty" json:"cache_stale_ttl,omitempty"`
+	// CacheVary lists request headers whose values are part of the cache key
+	CacheVary []string `bson:"cache_vary,omitempty" json:"cache_vary,omitempty"`
+	// HeaderPolicy rewrites the headers of the customer's requests and
+	// responses; Headers are set on requests before its rules run
+	HeaderPolicy *HeaderPolicy `bson:"header_policy,omitempty" json:"header_policy,omitempty"`
+}
+
+// UpstreamTLS customises the TLS connections to a customer's upstream
+type UpstreamTLS struct {
+	// CACert is a PEM bundle trusted instead of the system roots
+	CACert string `bson:"ca_cert,omitempty" json:"ca_cert,omitempty"`
+	// ServerName is sent as SNI and verified instead of the target's host
+	ServerName string `bson:"server_name,omitempty" json:"server_name,omitempty"`
+	// ClientCert and ClientKey are the PEM certificate and key presented to
+	// upstreams that ask for one
+	ClientCert string `bson:"client_cert,omitempty" json:"client_cert,omitempty"`
+	ClientKey  string `bson:"client_key,omitempty" json:"client_key,omitempty"`
 }
 
 type ProxyRoute struct {
@@ -29,6 +80,7 @@ type ProxyRequest struct {
 	Body       []byte            `json:"body"`
 	CustomerID string            `json:"customer_id"`
 	AgentID    string            `json:"agent_id"`
+	Deadline   *time.Time        `json:"deadline,omitempty"`
 }
 
 type ProxyResponse struct {
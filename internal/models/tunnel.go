@@ -7,3 +7,12 @@ type TunnelConfig struct {
 	TargetURL string `bson:"target_url" json:"target_url"`
 	Status    string `bson:"status" json:"status"`
 }
+
+// TCPTarget is an endpoint on the customer network that authenticated
+// CONNECT requests may reach through the customer's agents. Targets double
+// as the allowlist: connections to any other address are refused.
+type TCPTarget struct {
+	Name string `bson:"name" json:"name"`
+	// Address is the host:port as seen from the agent
+	Address string `bson:"address" json:"address"`
+}
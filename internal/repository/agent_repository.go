@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"proxy-service/internal/models"
@@ -11,6 +12,11 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+)
+
 type AgentRepository struct {
 	db *mongo.Database
 }
@@ -37,11 +43,29 @@ func (r *AgentRepository) SaveAgent(ctx context.Context, agent *models.Agent) er
 	return err
 }
 
+// CreateAgent stores a new agent and fails with ErrAlreadyExists when the ID
+// is taken
+func (r *AgentRepository) CreateAgent(ctx context.Context, agent *models.Agent) error {
+	collection := r.db.Collection("agents")
+
+	agent.CreatedAt = time.Now()
+	agent.UpdatedAt = agent.CreatedAt
+
+	_, err := collection.InsertOne(ctx, agent)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
 func (r *AgentRepository) GetAgent(ctx context.Context, agentID string) (*models.Agent, error) {
 	collection := r.db.Collection("agents")
 
 	var agent models.Agent
 	err := collection.FindOne(ctx, bson.M{"_id": agentID}).Decode(&agent)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -66,23 +90,68 @@ func (r *AgentRepository) GetAgentsByCustomer(ctx context.Context, customerID st
 	return agents, nil
 }
 
+// UpdateAgentDetails changes the fields of an agent its owner may edit
+func (r *AgentRepository) UpdateAgentDetails(ctx context.Context, agent *models.Agent) error {
+	return r.update(ctx, agent.ID, bson.M{
+		"name":        agent.Name,
+		"metadata":    agent.Metadata,
+		"permissions": agent.Permissions,
+		"labels":      agent.Labels,
+		"updated_at":  time.Now(),
+	})
+}
+
+// UpdateAgentStatus enables or disables an agent
 func (r *AgentRepository) UpdateAgentStatus(ctx context.Context, agentID, status string) error {
-	collection := r.db.Collection("agents")
+	return r.update(ctx, agentID, bson.M{
+		"status":     status,
+		"updated_at": time.Now(),
+	})
+}
 
-	update := bson.M{
-		"$set": bson.M{
-			"status":         status,
-			"last_connected": time.Now(),
-			"updated_at":     time.Now(),
-		},
-	}
+// RecordConnect records that the agent connected running version
+func (r *AgentRepository) RecordConnect(ctx context.Context, agentID, status, version string, at time.Time) error {
+	return r.update(ctx, agentID, bson.M{
+		"connection_status": status,
+		"version":           version,
+		"last_connected":    at,
+		"last_seen":         at,
+	})
+}
 
-	_, err := collection.UpdateOne(ctx, bson.M{"_id": agentID}, update)
-	return err
+// UpdateConnectionStatus records a later change of the agent's connection
+func (r *AgentRepository) UpdateConnectionStatus(ctx context.Context, agentID, status string, at time.Time) error {
+	return r.update(ctx, agentID, bson.M{
+		"connection_status": status,
+		"last_seen":         at,
+	})
+}
+
+// TouchAgent records that the agent was seen
+func (r *AgentRepository) TouchAgent(ctx context.Context, agentID string, at time.Time) error {
+	return r.update(ctx, agentID, bson.M{"last_seen": at})
 }
 
 func (r *AgentRepository) DeleteAgent(ctx context.Context, agentID string) error {
 	collection := r.db.Collection("agents")
-	_, err := collection.DeleteOne(ctx, bson.M{"_id": agentID})
-	return err
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": agentID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *AgentRepository) update(ctx context.Context, agentID string, fields bson.M) error {
+	collection := r.db.Collection("agents")
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": agentID}, bson.M{"$set": fields})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"proxy-service/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CommandRepository keeps the commands sent to agents and their results
+type CommandRepository struct {
+	db *mongo.Database
+}
+
+func NewCommandRepository(db *mongo.Database) *CommandRepository {
+	return &CommandRepository{
+		db: db,
+	}
+}
+
+func (r *CommandRepository) CreateCommand(ctx context.Context, command *models.AgentCommand) error {
+	collection := r.db.Collection("agent_commands")
+
+	_, err := collection.InsertOne(ctx, command)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (r *CommandRepository) GetCommand(ctx context.Context, commandID string) (*models.AgentCommand, error) {
+	collection := r.db.Collection("agent_commands")
+
+	var command models.AgentCommand
+	err := collection.FindOne(ctx, bson.M{"_id": commandID}).Decode(&command)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &command, nil
+}
+
+// GetCommandsByAgent returns the latest commands sent to an agent, newest
+// first
+func (r *CommandRepository) GetCommandsByAgent(ctx context.Context, agentID string, limit int) ([]*models.AgentCommand, error) {
+	collection := r.db.Collection("agent_commands")
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, bson.M{"agent_id": agentID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var commands []*models.AgentCommand
+	if err = cursor.All(ctx, &commands); err != nil {
+		return nil, err
+	}
+
+	return commands, nil
+}
+
+// CompleteCommand records the outcome of a command that is still pending. It
+// fails with ErrNotFound when the command is unknown or already completed.
+func (r *CommandRepository) CompleteCommand(ctx context.Context, command *models.AgentCommand) error {
+	collection := r.db.Collection("agent_commands")
+
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": command.ID, "status": "pending"},
+		bson.M{"$set": bson.M{
+			"status":       command.Status,
+			"result":       command.Result,
+			"error":        command.Error,
+			"completed_at": command.CompletedAt,
+		}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"context"
+
+	"proxy-service/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SessionRepository keeps the history of agent connections
+type SessionRepository struct {
+	db *mongo.Database
+}
+
+func NewSessionRepository(db *mongo.Database) *SessionRepository {
+	return &SessionRepository{
+		db: db,
+	}
+}
+
+func (r *SessionRepository) CreateSession(ctx context.Context, session *models.AgentSession) error {
+	collection := r.db.Collection("agent_sessions")
+
+	_, err := collection.InsertOne(ctx, session)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+// EndSession records how a session ended. It fails with ErrNotFound when the
+// session is unknown or already ended.
+func (r *SessionRepository) EndSession(ctx context.Context, session *models.AgentSession) error {
+	collection := r.db.Collection("agent_sessions")
+
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": session.ID, "disconnected_at": nil},
+		bson.M{"$set": bson.M{
+			"disconnected_at":   session.DisconnectedAt,
+			"disconnect_reason": session.DisconnectReason,
+			"requests_served":   session.RequestsServed,
+		}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListSessions returns a page of the sessions matching query, newest first,
+// with the number of sessions matching in total
+func (r *SessionRepository) ListSessions(ctx context.Context, query models.AgentSessionQuery) ([]*models.AgentSession, int64, error) {
+	collection := r.db.Collection("agent_sessions")
+
+	filter := bson.M{"customer_id": query.CustomerID}
+	if query.AgentID != "" {
+		filter["agent_id"] = query.AgentID
+	}
+	if !query.To.IsZero() {
+		filter["connected_at"] = bson.M{"$lte": query.To}
+	}
+	if !query.From.IsZero() {
+		// Sessions still open overlap any range that reaches the present
+		filter["$or"] = bson.A{
+			bson.M{"disconnected_at": bson.M{"$gte": query.From}},
+			bson.M{"disconnected_at": nil},
+		}
+	}
+
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "connected_at", Value: -1}}).
+		SetSkip(int64((query.Page - 1) * query.PageSize)).
+		SetLimit(int64(query.PageSize))
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []*models.AgentSession
+	if err = cursor.All(ctx, &sessions); err != nil {
+		return nil, 0, err
+	}
+
+	return sessions, total, nil
+}
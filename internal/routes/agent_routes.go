@@ -7,12 +7,17 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func SetupAgentRoutes(router *gin.Engine, handler *agent.AgentHandler, authMiddleware *middleware.AuthMiddleware) {
+func SetupAgentRoutes(router *gin.Engine, handler *agent.AgentHandler, authMiddleware *middleware.AuthMiddleware, adminToken string) {
 	// Agent management routes
 	agentGroup := router.Group("/api/v1/agents")
 	{
 		// Agent connection endpoint
 		agentGroup.GET("/connect", handler.HandleConnection)
+		// Agents holding a credential trade its secret for a connect token
+		agentGroup.POST("/token", handler.HandleConnectToken)
+		// Agents redeem a bootstrap token, or renew with their current
+		// certificate, for a client certificate
+		agentGroup.POST("/certificates", handler.HandleSignCertificate)
 
 		// Protected routes requiring authentication
 		protected := agentGroup.Use(authMiddleware.ValidateToken())
@@ -21,6 +26,45 @@ func SetupAgentRoutes(router *gin.Engine, handler *agent.AgentHandler, authMiddl
 			protected.GET("/metrics", handler.HandleAgentMetrics)
 			protected.POST("/register", handler.HandleAgentRegistration)
 			protected.DELETE("/deregister", handler.HandleAgentDeregistration)
+
+			// Agents of the authenticated customer
+			protected.GET("", handler.HandleListAgents)
+			protected.POST("", handler.HandleAgentRegistration)
+			protected.GET("/:agent_id", handler.HandleGetAgent)
+			protected.PATCH("/:agent_id", handler.HandleUpdateAgent)
+			protected.DELETE("/:agent_id", handler.HandleDeleteAgent)
+			protected.POST("/:agent_id/disable", handler.HandleDisableAgent)
+			protected.POST("/:agent_id/enable", handler.HandleEnableAgent)
+			protected.GET("/:agent_id/health", handler.HandleAgentHealth)
+
+			// Connection history of the customer's agents
+			protected.GET("/sessions", handler.HandleListSessions)
+			protected.GET("/:agent_id/sessions", handler.HandleListSessions)
+
+			// Revisioned agent configuration, pushed to agents on change
+			protected.GET("/config", handler.HandleGetConfig)
+			protected.PUT("/config", handler.HandleUpdateConfig)
+			protected.GET("/config/status", handler.HandleConfigStatus)
+
+			// Per-agent credentials
+			protected.POST("/credentials", handler.HandleIssueCredential)
+			protected.GET("/credentials", handler.HandleListCredentials)
+			protected.DELETE("/credentials", handler.HandleRevokeCredential)
+
+			// Client certificates
+			protected.POST("/certificates/bootstrap", handler.HandleIssueBootstrapToken)
+			protected.DELETE("/certificates", handler.HandleRevokeCertificate)
+		}
+	}
+
+	// Operator routes, across customers; off without an admin token
+	if adminToken != "" {
+		admin := router.Group("/admin/v1", middleware.AdminToken(adminToken))
+		{
+			// Commands sent to agents and their results
+			admin.POST("/customers/:customer_id/agents/:agent_id/commands", handler.HandleIssueCommand)
+			admin.GET("/customers/:customer_id/agents/:agent_id/commands", handler.HandleListCommands)
+			admin.GET("/customers/:customer_id/agents/:agent_id/commands/:command_id", handler.HandleGetCommand)
 		}
 	}
 }
@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
 	"sync"
 	"time"
 
 	"proxy-service/internal/models"
+	"proxy-service/pkg/agentproto"
 	"proxy-service/pkg/cache"
 	"proxy-service/pkg/logger"
 	"proxy-service/pkg/metrics"
@@ -16,23 +19,35 @@ import (
 	"go.uber.org/zap"
 )
 
-type AgentConnection struct {
-	AgentID    string
-	CustomerID string
-	Connection *websocket.Conn
-	Status     string
-	LastPing   time.Time
-	mutex      sync.RWMutex
-}
-
 type AgentManager struct {
-	connections map[string]*AgentConnection
-	metrics     *metrics.MetricsCollector
-	cache       *cache.Cache
-	mutex       sync.RWMutex
-	logger      *logger.Logger
+	connections    map[string]*AgentConnection
+	metrics        *metrics.MetricsCollector
+	cache          *cache.Cache
+	mutex          sync.RWMutex
+	logger         *logger.Logger
+	messageHandler MessageHandler
+	listeners      []RoutingListener
+	policy         HandshakePolicy
+	healthPolicy   HealthPolicy
+	configMutex    sync.Mutex            // serializes config revisions
+	directory      *Directory            // nil when running as a single replica
+	draining       bool                  // set by Drain, turns new agents away
+	credentials    *CredentialStore      // nil when agents use API key tokens only
+	certificates   *CertificateAuthority // nil when client certificates are not accepted
+	registry       *Registry             // nil when agent status is not persisted
+	commands       *CommandLog           // nil when agents take no commands
+	sessions       *SessionHistory       // nil when sessions are not recorded
+
+	// ctx stops the background loops once the manager is closed
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+// RoutingListener receives the connected agents of a customer, ordered by
+// agent ID, every time that set changes. It runs with the manager lock held,
+// so it must be quick and must not call back into the manager.
+type RoutingListener func(customerID string, agents []*AgentConnection)
+
 type AgentMetrics struct {
 	Uptime      float64   `json:"uptime"`
 	MemoryUsage float64   `json:"memory_usage"`
@@ -46,10 +61,19 @@ const (
 )
 
 func NewAgentManager(metrics *metrics.MetricsCollector, cache *cache.Cache) *AgentManager {
+	ctx, cancel := context.WithCancel(context.Background())
 	manager := &AgentManager{
 		connections: make(map[string]*AgentConnection),
 		metrics:     metrics,
 		cache:       cache,
+		logger:      logger.NewLogger(),
+		policy: HandshakePolicy{
+			MinProtocolVersion: agentproto.ProtocolVersionLegacy,
+			Timeout:            DefaultHandshakeTimeout,
+		},
+		healthPolicy: DefaultHealthPolicy(),
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 
 	// Start cleanup routine
@@ -58,44 +82,135 @@ func NewAgentManager(metrics *metrics.MetricsCollector, cache *cache.Cache) *Age
 	return manager
 }
 
+// ProxyRequest is a request for an agent. Only the embedded payload is
+// sent in the proxy_request message.
 type ProxyRequest struct {
-	Method     string
-	Path       string
-	Headers    map[string][]string
-	Body       []byte
-	CustomerID string
+	agentproto.ProxyRequest
+
+	// BodyStream, when set, is streamed instead of Body; BodySize is its
+	// length or -1 when unknown
+	BodyStream io.Reader
+	BodySize   int64
 }
 
+// ProxyResponse is an agent's answer to a ProxyRequest
 type ProxyResponse struct {
-	StatusCode int
-	Headers    map[string][]string
-	Body       []byte
+	agentproto.ProxyResponse
+
+	// BodyStream carries a streamed body; callers must close it. Trailers
+	// sent in its "end" frame are merged into Trailers once it hits EOF.
+	BodyStream io.ReadCloser
+	// Tunnel is set when the agent accepted a tunnel request; callers must
+	// close it
+	Tunnel *Tunnel
+}
+
+// SetMessageHandler installs the callback that receives agent-initiated
+// messages. It must be set before agents are registered.
+func (am *AgentManager) SetMessageHandler(handler MessageHandler) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	am.messageHandler = handler
+}
+
+// SetHandshakePolicy sets the minimum protocol version and hello timeout
+// for agents that connect from now on; zero values keep the defaults
+func (am *AgentManager) SetHandshakePolicy(policy HandshakePolicy) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	if policy.MinProtocolVersion > 0 {
+		am.policy.MinProtocolVersion = policy.MinProtocolVersion
+	}
+	if policy.Timeout > 0 {
+		am.policy.Timeout = policy.Timeout
+	}
+}
+
+// SetDirectory publishes the agents connected to this replica in the
+// cluster-wide directory. It must be set before agents are registered.
+func (am *AgentManager) SetDirectory(directory *Directory) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	am.directory = directory
+}
+
+// OnRoutingChange subscribes listener to changes in the set of connected
+// agents. It is first called once for every customer that already has agents,
+// so the subscriber never misses an update.
+func (am *AgentManager) OnRoutingChange(listener RoutingListener) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	am.listeners = append(am.listeners, listener)
+
+	seen := make(map[string]bool)
+	for _, agent := range am.connections {
+		if !seen[agent.CustomerID] {
+			seen[agent.CustomerID] = true
+			listener(agent.CustomerID, am.customerAgents(agent.CustomerID))
+		}
+	}
 }
 
 func (am *AgentManager) RegisterAgent(ctx context.Context, agentID, customerID string, conn *websocket.Conn) error {
+	// Labels are read up front so the agent is never routed without them
+	labels := am.agentLabels(agentID)
+
 	am.mutex.Lock()
 	defer am.mutex.Unlock()
 
+	// A draining replica sends agents elsewhere
+	if am.draining {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, ErrDraining.Error()),
+			time.Now().Add(writeWait))
+		conn.Close()
+		return ErrDraining
+	}
+
 	// Check if agent already exists
 	if existing, exists := am.connections[agentID]; exists {
-		existing.Connection.Close()
+		existing.setDisconnectReason(DisconnectTakeover)
+		existing.Close()
 		delete(am.connections, agentID)
+		am.metrics.RemoveAgentHealth(existing.CustomerID, agentID)
+		if existing.CustomerID != customerID {
+			am.notifyRouting(existing.CustomerID)
+		}
 	}
 
-	// Create new agent connection
-	agent := &AgentConnection{
-		AgentID:    agentID,
-		CustomerID: customerID,
-		Connection: conn,
-		Status:     "connected",
-		LastPing:   time.Now(),
+	// Create new agent connection, speaking the codec chosen during the upgrade
+	agent := newAgentConnection(agentID, customerID, conn, agentproto.CodecForSubprotocol(conn.Subprotocol()), am.policy, am.logger)
+	agent.credentialID = credentialFromContext(ctx)
+	agent.certificateSerial = certificateFromContext(ctx)
+	agent.labels = labels
+	agent.connectedAt = time.Now()
+	agent.remoteAddr = remoteAddrFromContext(ctx)
+	if agent.remoteAddr == "" {
+		agent.remoteAddr = conn.RemoteAddr().String()
 	}
 
 	// Store connection
 	am.connections[agentID] = agent
 
+	// Start reader and writer routines; the agent is routable once its
+	// handshake completes and starts out with its current configuration
+	agent.start(am.messageHandler, func() {
+		am.admitConnection(agent)
+		am.registerLease(agent)
+		am.recordConnect(agent)
+		am.recordSessionStart(agent)
+		am.pushConfig(agent, true)
+	}, func() {
+		am.removeConnection(agent)
+		am.releaseLease(agent)
+		am.recordDisconnect(agent)
+		am.recordSessionEnd(agent)
+	})
+
 	// Record metric
 	am.metrics.RecordAgentConnection(customerID)
+	am.notifyRouting(customerID)
 
 	// Start monitoring routine
 	go am.monitorAgent(agent)
@@ -109,7 +224,11 @@ func (am *AgentManager) GetActiveAgents() []*AgentConnection {
 
 	agents := make([]*AgentConnection, 0, len(am.connections))
 	for _, agent := range am.connections {
-		if agent.Status == "connected" {
+		agent.mutex.RLock()
+		status := agent.Status
+		agent.mutex.RUnlock()
+
+		if status == StatusConnected {
 			agents = append(agents, agent)
 		}
 	}
@@ -117,34 +236,67 @@ func (am *AgentManager) GetActiveAgents() []*AgentConnection {
 	return agents
 }
 
-func (am *AgentManager) RouteRequest(ctx context.Context, agentID string, request *ProxyRequest) (*ProxyResponse, error) {
+// GetCustomerAgents returns the connected agents of a customer ordered by
+// agent ID
+func (am *AgentManager) GetCustomerAgents(customerID string) []*AgentConnection {
 	am.mutex.RLock()
-	agent, exists := am.connections[agentID]
-	am.mutex.RUnlock()
+	defer am.mutex.RUnlock()
+	return am.customerAgents(customerID)
+}
 
-	if !exists {
-		return nil, fmt.Errorf("agent not found")
+// customerAgents returns the agents requests may be routed to, leaving out
+// ejected ones; it must be called with am.mutex held
+func (am *AgentManager) customerAgents(customerID string) []*AgentConnection {
+	var agents []*AgentConnection
+	now := time.Now()
+	for _, agent := range am.connections {
+		if agent.CustomerID != customerID {
+			continue
+		}
+
+		agent.mutex.RLock()
+		status := agent.Status
+		agent.mutex.RUnlock()
+
+		if status == StatusConnected && !agent.health.ejected(now) {
+			agents = append(agents, agent)
+		}
 	}
 
-	return agent.sendRequest(request)
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].AgentID < agents[j].AgentID
+	})
+	return agents
 }
 
-func (ac *AgentConnection) sendRequest(request *ProxyRequest) (*ProxyResponse, error) {
-	ac.mutex.Lock()
-	defer ac.mutex.Unlock()
+// notifyRouting must be called with am.mutex held
+func (am *AgentManager) notifyRouting(customerID string) {
+	if len(am.listeners) == 0 {
+		return
+	}
 
-	// Send request through websocket
-	if err := ac.Connection.WriteJSON(request); err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+	agents := am.customerAgents(customerID)
+	for _, listener := range am.listeners {
+		listener(customerID, agents)
 	}
+}
 
-	// Read response
-	response := &ProxyResponse{}
-	if err := ac.Connection.ReadJSON(response); err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+func (am *AgentManager) RouteRequest(ctx context.Context, agentID string, request *ProxyRequest) (*ProxyResponse, error) {
+	am.mutex.RLock()
+	agent, exists := am.connections[agentID]
+	am.mutex.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("agent not found")
+	}
+	if agent.status() == StatusDraining {
+		return nil, ErrAgentDraining
 	}
 
-	return response, nil
+	start := time.Now()
+	response, err := agent.sendRequest(ctx, request)
+	am.observeOutcome(agent, response, err, time.Since(start))
+	return response, err
 }
 
 func (am *AgentManager) cleanupInactiveAgents() {
@@ -156,13 +308,22 @@ func (am *AgentManager) cleanupInactiveAgents() {
 		case <-ticker.C:
 			am.mutex.Lock()
 			for id, agent := range am.connections {
-				if time.Since(agent.LastPing) > 5*time.Minute {
-					agent.Connection.Close()
+				agent.mutex.RLock()
+				lastPing := agent.LastPing
+				agent.mutex.RUnlock()
+
+				if time.Since(lastPing) > 5*time.Minute {
+					agent.setDisconnectReason(DisconnectHeartbeatTimeout)
+					agent.Close()
 					delete(am.connections, id)
 					am.metrics.RecordAgentDisconnection(agent.CustomerID)
+					am.metrics.RemoveAgentHealth(agent.CustomerID, id)
+					am.notifyRouting(agent.CustomerID)
 				}
 			}
 			am.mutex.Unlock()
+		case <-am.ctx.Done():
+			return
 		}
 	}
 }
@@ -172,20 +333,23 @@ func (am *AgentManager) GetAgentStatus(agentID string) string {
 	defer am.mutex.RUnlock()
 
 	if agent, exists := am.connections[agentID]; exists {
+		agent.mutex.RLock()
+		defer agent.mutex.RUnlock()
 		return agent.Status
 	}
 	return ""
 }
 
 func (am *AgentManager) checkAgentHealth(agent *AgentConnection) error {
-	agent.mutex.Lock()
-	defer agent.mutex.Unlock()
+	agent.mutex.RLock()
+	lastPing := agent.LastPing
+	agent.mutex.RUnlock()
 
-	if time.Since(agent.LastPing) > 2*time.Minute {
+	if time.Since(lastPing) > 2*time.Minute {
 		return fmt.Errorf("agent timeout")
 	}
 
-	// Send ping message
+	// Send ping message; control frames may be written alongside the writer goroutine
 	if err := agent.Connection.WriteControl(
 		websocket.PingMessage,
 		[]byte{},
@@ -206,10 +370,38 @@ func (am *AgentManager) handleAgentDisconnection(agentID string) {
 		am.metrics.RecordAgentDisconnection(agent.CustomerID)
 
 		// Close connection
-		agent.Connection.Close()
+		agent.setDisconnectReason(DisconnectHeartbeatTimeout)
+		agent.Close()
 
 		// Remove from connections map
 		delete(am.connections, agentID)
+		am.metrics.RemoveAgentHealth(agent.CustomerID, agentID)
+		am.notifyRouting(agent.CustomerID)
+	}
+}
+
+// admitConnection publishes an agent that completed its handshake, unless it
+// has already been replaced
+func (am *AgentManager) admitConnection(agent *AgentConnection) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	if current, exists := am.connections[agent.AgentID]; exists && current == agent {
+		am.notifyRouting(agent.CustomerID)
+	}
+}
+
+// removeConnection drops a connection whose socket has gone away, unless it
+// has already been replaced by a newer connection for the same agent
+func (am *AgentManager) removeConnection(agent *AgentConnection) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	if current, exists := am.connections[agent.AgentID]; exists && current == agent {
+		am.metrics.RecordAgentDisconnection(agent.CustomerID)
+		delete(am.connections, agent.AgentID)
+		am.metrics.RemoveAgentHealth(agent.CustomerID, agent.AgentID)
+		am.notifyRouting(agent.CustomerID)
 	}
 }
 
@@ -224,6 +416,12 @@ func (am *AgentManager) monitorAgent(agent *AgentConnection) {
 				am.handleAgentDisconnection(agent.AgentID)
 				return
 			}
+			am.RenewLease(agent)
+			am.publishHealth(agent)
+		case <-agent.Done():
+			return
+		case <-am.ctx.Done():
+			return
 		}
 	}
 }
@@ -238,12 +436,15 @@ func (am *AgentManager) DeregisterAgent(ctx context.Context, agentID, customerID
 		}
 
 		// Close the connection
-		if err := agent.Connection.Close(); err != nil {
+		agent.setDisconnectReason(DisconnectDeregistered)
+		if err := agent.Close(); err != nil {
 			return fmt.Errorf("error closing connection: %w", err)
 		}
 
 		// Remove from connections map
 		delete(am.connections, agentID)
+		am.metrics.RemoveAgentHealth(customerID, agentID)
+		am.notifyRouting(customerID)
 		return nil
 	}
 
@@ -279,8 +480,13 @@ func (am *AgentManager) GetConfigUpdate(agentID string) *models.AgentConfig {
 		return nil
 	}
 
-	// Return any pending configuration updates
-	return am.getAgentConfig(agent.CustomerID)
+	// Return the configuration the agent should be running
+	return am.GetAgentConfig(agent.CustomerID, agentID)
+}
+
+// GetCustomerConfig returns the agent configuration of a customer
+func (am *AgentManager) GetCustomerConfig(customerID string) *models.AgentConfig {
+	return am.getAgentConfig(customerID)
 }
 
 func (am *AgentManager) HandleProxyRequest(ctx context.Context, req *models.ProxyRequest) (*models.ProxyResponse, error) {
@@ -292,21 +498,38 @@ func (am *AgentManager) HandleProxyRequest(ctx context.Context, req *models.Prox
 		return nil, fmt.Errorf("agent not found")
 	}
 
+	// Honour the deadline of the agent that asked
+	if req.Deadline != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, *req.Deadline)
+		defer cancel()
+	}
+
 	// Create proxy request
-	proxyReq := &ProxyRequest{
+	proxyReq := &ProxyRequest{ProxyRequest: agentproto.ProxyRequest{
 		Method:     req.Method,
 		Path:       req.Path,
 		Headers:    convertHeaders(req.Headers), // Convert map[string]string to map[string][]string
 		Body:       req.Body,
 		CustomerID: agent.CustomerID,
-	}
+	}}
 
 	// Use the connection to send the request
-	proxyResp, err := agent.sendRequest(proxyReq)
+	proxyResp, err := agent.sendRequest(ctx, proxyReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to proxy request: %w", err)
 	}
 
+	// models.ProxyResponse carries the whole body, so collect a streamed one
+	if proxyResp.BodyStream != nil {
+		body, err := io.ReadAll(proxyResp.BodyStream)
+		proxyResp.BodyStream.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		proxyResp.Body = body
+	}
+
 	// Convert to models.ProxyResponse
 	response := &models.ProxyResponse{
 		RequestID:  req.RequestID,
@@ -330,15 +553,18 @@ func (am *AgentManager) getAgentConfig(customerID string) *models.AgentConfig {
 	cacheKey := fmt.Sprintf(configCacheKey, customerID)
 
 	// Using the generic Get method since we're working with the Cache interface
-	configData, err := (*am.cache).Get(ctx, cacheKey)
-	if err == nil {
-		var config models.AgentConfig
-		if err := json.Unmarshal([]byte(configData), &config); err == nil {
-			return &config
+	if am.cache != nil {
+		configData, err := (*am.cache).Get(ctx, cacheKey)
+		if err == nil {
+			var config models.AgentConfig
+			if err := json.Unmarshal([]byte(configData), &config); err == nil {
+				return &config
+			}
 		}
 	}
 
 	// If not in cache or error occurred, create default configuration
+	cacheEnabled := true
 	config := &models.AgentConfig{
 		CustomerID:        customerID,
 		MaxConnections:    100,
@@ -367,7 +593,7 @@ func (am *AgentManager) getAgentConfig(customerID string) *models.AgentConfig {
 				Methods:      []string{"GET", "POST", "PUT", "DELETE"},
 				RateLimit:    1000,
 				Timeout:      30 * time.Second,
-				CacheEnabled: true,
+				CacheEnabled: &cacheEnabled,
 				CacheTTL:     5 * time.Minute,
 			},
 		},
@@ -380,6 +606,9 @@ func (am *AgentManager) getAgentConfig(customerID string) *models.AgentConfig {
 	}
 
 	// Store in cache for future use
+	if am.cache == nil {
+		return config
+	}
 	if configData, err := json.Marshal(config); err == nil {
 		err = (*am.cache).Set(ctx, cacheKey, string(configData), configTTL)
 		if err != nil {
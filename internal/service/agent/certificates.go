@@ -0,0 +1,499 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/pkg/cache"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	agentCertificateKey  = "agent_certificate:%s"
+	deniedCertificateKey = "agent_certificate_denied:%s"
+	bootstrapTokenKey    = "agent_bootstrap_token:%s"
+
+	certificateRevokedChannel = "agent_certificate_revoked"
+
+	DefaultAgentCertificateTTL = 24 * time.Hour
+	DefaultBootstrapTokenTTL   = time.Hour
+
+	// agentURIScheme names the agent in the URI SAN of its certificate:
+	// agent://<customer ID>/<agent ID>
+	agentURIScheme = "agent"
+
+	// certificateBackdate tolerates agent clocks running behind the proxy
+	certificateBackdate = time.Minute
+)
+
+var (
+	ErrNoCertificateAuthority = errors.New("agent certificate authority is not configured")
+	// ErrCannotSignCertificates is returned when the proxy only verifies
+	// certificates of a CA whose key it does not hold
+	ErrCannotSignCertificates = errors.New("agent certificate authority cannot sign certificates")
+	ErrInvalidBootstrapToken  = errors.New("invalid bootstrap token")
+	ErrCertificateRevoked     = errors.New("agent certificate is revoked")
+	ErrCertificateNotFound    = errors.New("agent certificate not found")
+	// ErrCertificateRequired refuses agents without a client certificate
+	// when certificates are mandatory
+	ErrCertificateRequired = errors.New("agent must present a client certificate")
+)
+
+// CertificatePolicy bounds the certificates the proxy signs; zero values
+// keep the defaults
+type CertificatePolicy struct {
+	// CertificateTTL is how long a signed agent certificate is valid
+	CertificateTTL time.Duration
+	// BootstrapTokenTTL is how long an unused bootstrap token is valid
+	BootstrapTokenTTL time.Duration
+	// Required refuses agents that present no client certificate
+	Required bool
+}
+
+// AgentIdentity is the agent a verified client certificate speaks for
+type AgentIdentity struct {
+	AgentID    string
+	CustomerID string
+	// Serial is the certificate's serial number in hex
+	Serial string
+}
+
+// CertificateAuthority verifies agent client certificates against a CA,
+// its CRL and a deny list in Redis shared by every replica. Holding the CA
+// key, it also signs short-lived certificates for agents that redeem a
+// bootstrap token or present their current certificate.
+type CertificateAuthority struct {
+	certificate *x509.Certificate
+	key         crypto.Signer // nil when the proxy only verifies
+	pool        *x509.CertPool
+	cache       *cache.RedisCache
+	policy      CertificatePolicy
+
+	mutex   sync.RWMutex
+	revoked map[string]bool // serials listed in the CRL
+}
+
+// bootstrapGrant is what a bootstrap token entitles its bearer to
+type bootstrapGrant struct {
+	AgentID    string `json:"agent_id"`
+	CustomerID string `json:"customer_id"`
+}
+
+func NewCertificateAuthority(certificate *x509.Certificate, key crypto.Signer, cache *cache.RedisCache, policy CertificatePolicy) *CertificateAuthority {
+	if policy.CertificateTTL <= 0 {
+		policy.CertificateTTL = DefaultAgentCertificateTTL
+	}
+	if policy.BootstrapTokenTTL <= 0 {
+		policy.BootstrapTokenTTL = DefaultBootstrapTokenTTL
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return &CertificateAuthority{
+		certificate: certificate,
+		key:         key,
+		pool:        pool,
+		cache:       cache,
+		policy:      policy,
+		revoked:     make(map[string]bool),
+	}
+}
+
+// LoadCertificateAuthority reads the CA certificate, and optionally its key
+// and a CRL, from PEM files
+func LoadCertificateAuthority(certFile, keyFile, crlFile string, cache *cache.RedisCache, policy CertificatePolicy) (*CertificateAuthority, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent CA certificate: %w", err)
+	}
+
+	var certificate *x509.Certificate
+	var key crypto.Signer
+	if keyFile == "" {
+		block, _ := pem.Decode(certPEM)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("agent CA certificate is not PEM encoded")
+		}
+		if certificate, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid agent CA certificate: %w", err)
+		}
+	} else {
+		keyPEM, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read agent CA key: %w", err)
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid agent CA key pair: %w", err)
+		}
+		if certificate, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("invalid agent CA certificate: %w", err)
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("agent CA key cannot sign")
+		}
+		key = signer
+	}
+
+	ca := NewCertificateAuthority(certificate, key, cache, policy)
+	if crlFile != "" {
+		crl, err := os.ReadFile(crlFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read agent CRL: %w", err)
+		}
+		if err := ca.LoadCRL(crl); err != nil {
+			return nil, err
+		}
+	}
+	return ca, nil
+}
+
+// Pool holds the CA, for the ClientCAs of the agent listener
+func (ca *CertificateAuthority) Pool() *x509.CertPool {
+	return ca.pool
+}
+
+// Required reports whether agents must present a client certificate
+func (ca *CertificateAuthority) Required() bool {
+	return ca.policy.Required
+}
+
+// LoadCRL replaces the revoked serials with those of a CRL, PEM or DER
+// encoded, which the CA must have signed
+func (ca *CertificateAuthority) LoadCRL(data []byte) error {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("invalid agent CRL: %w", err)
+	}
+	if err := crl.CheckSignatureFrom(ca.certificate); err != nil {
+		return fmt.Errorf("agent CRL is not signed by the agent CA: %w", err)
+	}
+
+	revoked := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.Text(16)] = true
+	}
+
+	ca.mutex.Lock()
+	ca.revoked = revoked
+	ca.mutex.Unlock()
+	return nil
+}
+
+// Verify checks a client certificate chain, leaf first, and returns the
+// agent it names. Revoked certificates are refused, and so are all
+// certificates while the deny list cannot be read.
+func (ca *CertificateAuthority) Verify(ctx context.Context, chain []*x509.Certificate) (*AgentIdentity, error) {
+	if len(chain) == 0 {
+		return nil, ErrCertificateRequired
+	}
+	leaf := chain[0]
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range chain[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         ca.pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("untrusted agent certificate: %w", err)
+	}
+
+	identity, err := certificateIdentity(leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.mutex.RLock()
+	revoked := ca.revoked[identity.Serial]
+	ca.mutex.RUnlock()
+	if revoked {
+		return nil, ErrCertificateRevoked
+	}
+
+	_, err = ca.cache.Get(ctx, fmt.Sprintf(deniedCertificateKey, identity.Serial))
+	if err == nil {
+		return nil, ErrCertificateRevoked
+	}
+	if !cache.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to read certificate deny list: %w", err)
+	}
+	return identity, nil
+}
+
+// IssueBootstrapToken returns a token the agent exchanges once for its first
+// certificate
+func (ca *CertificateAuthority) IssueBootstrapToken(ctx context.Context, customerID, agentID string) (string, time.Time, error) {
+	if ca.key == nil {
+		return "", time.Time{}, ErrCannotSignCertificates
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate bootstrap token: %w", err)
+	}
+	token := hex.EncodeToString(secret)
+
+	grant := bootstrapGrant{AgentID: agentID, CustomerID: customerID}
+	if err := ca.cache.Set(ctx, bootstrapKey(token), grant, ca.policy.BootstrapTokenTTL); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to store bootstrap token: %w", err)
+	}
+	return token, time.Now().Add(ca.policy.BootstrapTokenTTL), nil
+}
+
+// RedeemBootstrapToken spends a bootstrap token and returns the agent it was
+// issued to
+func (ca *CertificateAuthority) RedeemBootstrapToken(ctx context.Context, token string) (*AgentIdentity, error) {
+	data, err := ca.cache.Take(ctx, bootstrapKey(token))
+	if cache.IsNotFound(err) {
+		return nil, ErrInvalidBootstrapToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bootstrap token: %w", err)
+	}
+
+	var grant bootstrapGrant
+	if err := json.Unmarshal([]byte(data), &grant); err != nil {
+		return nil, fmt.Errorf("corrupt bootstrap token: %w", err)
+	}
+	return &AgentIdentity{AgentID: grant.AgentID, CustomerID: grant.CustomerID}, nil
+}
+
+// Sign issues a short-lived client certificate for the agent over the public
+// key of a PEM encoded CSR. Only the key is taken from the CSR; the subject
+// always names the agent.
+func (ca *CertificateAuthority) Sign(ctx context.Context, identity *AgentIdentity, csrPEM []byte) (*models.AgentCertificate, error) {
+	if ca.key == nil {
+		return nil, ErrCannotSignCertificates
+	}
+
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("certificate request is not PEM encoded")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate serial: %w", err)
+	}
+
+	now := time.Now()
+	notAfter := now.Add(ca.policy.CertificateTTL)
+	if notAfter.After(ca.certificate.NotAfter) {
+		notAfter = ca.certificate.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   identity.AgentID,
+			Organization: []string{identity.CustomerID},
+		},
+		URIs:        []*url.URL{agentURI(identity.CustomerID, identity.AgentID)},
+		NotBefore:   now.Add(-certificateBackdate),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign agent certificate: %w", err)
+	}
+
+	issued := &models.AgentCertificate{
+		Serial:     serial.Text(16),
+		AgentID:    identity.AgentID,
+		CustomerID: identity.CustomerID,
+		NotAfter:   notAfter,
+	}
+	// The record lets the customer revoke the certificate for as long as
+	// it is valid
+	if err := ca.cache.Set(ctx, fmt.Sprintf(agentCertificateKey, issued.Serial), issued, time.Until(notAfter)); err != nil {
+		return nil, fmt.Errorf("failed to store agent certificate: %w", err)
+	}
+
+	issued.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return issued, nil
+}
+
+// Revoke adds a certificate the proxy signed for one of the customer's
+// agents to the deny list and tells every replica to close the sessions it
+// authenticated
+func (ca *CertificateAuthority) Revoke(ctx context.Context, customerID, serial string) error {
+	data, err := ca.cache.Get(ctx, fmt.Sprintf(agentCertificateKey, serial))
+	if cache.IsNotFound(err) {
+		return ErrCertificateNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read agent certificate: %w", err)
+	}
+
+	var certificate models.AgentCertificate
+	if err := json.Unmarshal([]byte(data), &certificate); err != nil {
+		return fmt.Errorf("corrupt agent certificate: %w", err)
+	}
+	if certificate.CustomerID != customerID {
+		return ErrCertificateNotFound
+	}
+
+	// Past its expiry the certificate is refused anyway
+	ttl := time.Until(certificate.NotAfter) + certificateBackdate
+	if err := ca.cache.Set(ctx, fmt.Sprintf(deniedCertificateKey, serial), "revoked", ttl); err != nil {
+		return fmt.Errorf("failed to revoke agent certificate: %w", err)
+	}
+	if err := ca.cache.Publish(ctx, certificateRevokedChannel, serial); err != nil {
+		return fmt.Errorf("failed to announce certificate revocation: %w", err)
+	}
+	return nil
+}
+
+// revocations delivers the serials of certificates revoked on any replica
+// until ctx is done
+func (ca *CertificateAuthority) revocations(ctx context.Context) (<-chan string, error) {
+	messages, err := ca.cache.Subscribe(ctx, certificateRevokedChannel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to certificate revocations: %w", err)
+	}
+	return messages, nil
+}
+
+// certificateIdentity reads the agent from the agent:// URI SAN, or for
+// certificates of other issuers from the common name and the single
+// organization
+func certificateIdentity(certificate *x509.Certificate) (*AgentIdentity, error) {
+	serial := certificate.SerialNumber.Text(16)
+	for _, uri := range certificate.URIs {
+		if uri.Scheme != agentURIScheme {
+			continue
+		}
+		agentID := strings.TrimPrefix(uri.Path, "/")
+		if uri.Host != "" && agentID != "" && !strings.Contains(agentID, "/") {
+			return &AgentIdentity{AgentID: agentID, CustomerID: uri.Host, Serial: serial}, nil
+		}
+	}
+
+	subject := certificate.Subject
+	if subject.CommonName != "" && len(subject.Organization) == 1 && subject.Organization[0] != "" {
+		return &AgentIdentity{AgentID: subject.CommonName, CustomerID: subject.Organization[0], Serial: serial}, nil
+	}
+	return nil, fmt.Errorf("agent certificate names no agent")
+}
+
+func agentURI(customerID, agentID string) *url.URL {
+	return &url.URL{Scheme: agentURIScheme, Host: customerID, Path: "/" + agentID}
+}
+
+// bootstrapKey stores tokens hashed, so Redis never holds a usable one
+func bootstrapKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf(bootstrapTokenKey, hex.EncodeToString(sum[:]))
+}
+
+// SetCertificateAuthority lets agents authenticate with client certificates
+// and closes the sessions of certificates revoked on any replica. It must be
+// set before agents are registered.
+func (am *AgentManager) SetCertificateAuthority(ca *CertificateAuthority) {
+	am.mutex.Lock()
+	am.certificates = ca
+	am.mutex.Unlock()
+
+	revocations, err := ca.revocations(am.ctx)
+	if err != nil {
+		am.logger.Error("Revoked certificates will only close sessions on this replica", "error", err)
+		return
+	}
+	go func() {
+		for serial := range revocations {
+			am.closeRevokedCertificate(serial)
+		}
+	}()
+}
+
+// CertificateAuthority returns the agent CA, or nil when client
+// certificates are not accepted
+func (am *AgentManager) CertificateAuthority() *CertificateAuthority {
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	return am.certificates
+}
+
+// RevokeCertificate revokes a certificate signed for one of the customer's
+// agents and closes the session it authenticated on every replica
+func (am *AgentManager) RevokeCertificate(ctx context.Context, customerID, serial string) error {
+	ca := am.CertificateAuthority()
+	if ca == nil {
+		return ErrNoCertificateAuthority
+	}
+	if err := ca.Revoke(ctx, customerID, serial); err != nil {
+		return err
+	}
+
+	// Other replicas hear of it through Redis, this one closes at once
+	am.closeRevokedCertificate(serial)
+	return nil
+}
+
+// closeRevokedCertificate closes the session the certificate with serial
+// authenticated, if any
+func (am *AgentManager) closeRevokedCertificate(serial string) {
+	var revoked []*AgentConnection
+	am.mutex.RLock()
+	for _, conn := range am.connections {
+		if conn.certificateSerial == serial {
+			revoked = append(revoked, conn)
+		}
+	}
+	am.mutex.RUnlock()
+
+	for _, conn := range revoked {
+		am.logger.Info("Closing session of revoked agent certificate",
+			"agent_id", conn.AgentID,
+			"serial", serial)
+		conn.closeWith(websocket.ClosePolicyViolation, "agent certificate revoked")
+	}
+}
+
+type certificateKey struct{}
+
+// WithCertificate records the serial of the client certificate that
+// authenticated a connection, for RegisterAgent
+func WithCertificate(ctx context.Context, serial string) context.Context {
+	return context.WithValue(ctx, certificateKey{}, serial)
+}
+
+func certificateFromContext(ctx context.Context) string {
+	serial, _ := ctx.Value(certificateKey{}).(string)
+	return serial
+}
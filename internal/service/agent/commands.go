@@ -0,0 +1,407 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/repository"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+)
+
+// Command statuses
+const (
+	CommandPending   = "pending"
+	CommandSucceeded = "succeeded"
+	CommandFailed    = "failed"
+	CommandTimedOut  = "timed_out"
+)
+
+const (
+	agentCommandsChannel = "agent_commands"
+
+	DefaultCommandTimeout = 30 * time.Second
+	MaxCommandTimeout     = 5 * time.Minute
+
+	// commandHistory is how many commands are listed per agent
+	commandHistory = 50
+)
+
+var (
+	ErrNoCommandLog        = errors.New("agent command log is not available")
+	ErrInvalidCommand      = errors.New("command must be reload_config, restart, diagnostics or set_log_level")
+	ErrInvalidLogLevel     = errors.New("log level must be debug, info, warn or error")
+	ErrInvalidTimeout      = fmt.Errorf("command timeout must be positive and at most %s", MaxCommandTimeout)
+	ErrCommandNotFound     = errors.New("command not found")
+	ErrAgentNotConnected   = errors.New("agent is not connected")
+	ErrCommandsUnsupported = errors.New("agent does not support commands")
+)
+
+// CommandStore persists agent commands; repository.CommandRepository
+// implements it. Lookups of unknown commands, and completing a command that
+// is no longer pending, fail with repository.ErrNotFound.
+type CommandStore interface {
+	CreateCommand(ctx context.Context, command *models.AgentCommand) error
+	GetCommand(ctx context.Context, commandID string) (*models.AgentCommand, error)
+	GetCommandsByAgent(ctx context.Context, agentID string, limit int) ([]*models.AgentCommand, error)
+	CompleteCommand(ctx context.Context, command *models.AgentCommand) error
+}
+
+// CommandLog keeps the commands sent to agents with their results. New
+// commands are announced through Redis so the replica holding the agent
+// runs them.
+type CommandLog struct {
+	store CommandStore
+	cache *cache.RedisCache
+}
+
+func NewCommandLog(store CommandStore, cache *cache.RedisCache) *CommandLog {
+	return &CommandLog{
+		store: store,
+		cache: cache,
+	}
+}
+
+// Get returns a command issued by the customer
+func (l *CommandLog) Get(ctx context.Context, customerID, commandID string) (*models.AgentCommand, error) {
+	command, err := l.store.GetCommand(ctx, commandID)
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && command.CustomerID != customerID) {
+		return nil, ErrCommandNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command: %w", err)
+	}
+	return l.expire(ctx, command), nil
+}
+
+// List returns the latest commands sent to an agent of the customer, newest
+// first
+func (l *CommandLog) List(ctx context.Context, customerID, agentID string) ([]*models.AgentCommand, error) {
+	commands, err := l.store.GetCommandsByAgent(ctx, agentID, commandHistory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commands: %w", err)
+	}
+
+	listed := make([]*models.AgentCommand, 0, len(commands))
+	for _, command := range commands {
+		if command.CustomerID == customerID {
+			listed = append(listed, l.expire(ctx, command))
+		}
+	}
+	return listed, nil
+}
+
+// expire times out a command nobody completed by its deadline, e.g. because
+// the replica running it went away
+func (l *CommandLog) expire(ctx context.Context, command *models.AgentCommand) *models.AgentCommand {
+	if command.Status != CommandPending || time.Now().Before(command.Deadline.Add(writeWait)) {
+		return command
+	}
+	completeCommand(command, CommandTimedOut, nil, "agent did not answer in time")
+	// A command completed meanwhile keeps its actual outcome
+	if err := l.store.CompleteCommand(ctx, command); errors.Is(err, repository.ErrNotFound) {
+		if stored, err := l.store.GetCommand(ctx, command.ID); err == nil {
+			return stored
+		}
+	}
+	return command
+}
+
+func (l *CommandLog) create(ctx context.Context, command *models.AgentCommand) error {
+	if err := l.store.CreateCommand(ctx, command); err != nil {
+		return fmt.Errorf("failed to store command: %w", err)
+	}
+	return nil
+}
+
+// complete records the outcome of a pending command
+func (l *CommandLog) complete(ctx context.Context, command *models.AgentCommand) error {
+	err := l.store.CompleteCommand(ctx, command)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return fmt.Errorf("failed to store command result: %w", err)
+	}
+	return nil
+}
+
+// announce tells every replica about a command for an agent connected
+// elsewhere
+func (l *CommandLog) announce(ctx context.Context, commandID string) error {
+	if l.cache == nil {
+		return errors.New("no cache to announce the command through")
+	}
+	return l.cache.Publish(ctx, agentCommandsChannel, commandID)
+}
+
+// announced delivers the commands issued on any replica until ctx is done
+func (l *CommandLog) announced(ctx context.Context) (<-chan string, error) {
+	if l.cache == nil {
+		return nil, nil
+	}
+	messages, err := l.cache.Subscribe(ctx, agentCommandsChannel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to agent commands: %w", err)
+	}
+	return messages, nil
+}
+
+func completeCommand(command *models.AgentCommand, status string, result *models.AgentCommandResult, message string) {
+	now := time.Now()
+	command.Status = status
+	command.Result = result
+	command.Error = message
+	command.CompletedAt = &now
+}
+
+// validLogLevel reports whether set_log_level accepts level
+func validLogLevel(level string) bool {
+	switch level {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
+
+// SetCommandLog lets operators send commands to agents and keeps the
+// results. Commands announced by other replicas run here when the agent is
+// connected here.
+func (am *AgentManager) SetCommandLog(log *CommandLog) {
+	am.mutex.Lock()
+	am.commands = log
+	am.mutex.Unlock()
+
+	announced, err := log.announced(am.ctx)
+	if err != nil {
+		am.logger.Error("Commands will only reach agents connected to the replica they were issued on", "error", err)
+		return
+	}
+	if announced == nil {
+		return
+	}
+	go func() {
+		for commandID := range announced {
+			am.runAnnounced(commandID)
+		}
+	}()
+}
+
+// CommandLog returns the command log, or nil when none is set
+func (am *AgentManager) CommandLog() *CommandLog {
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	return am.commands
+}
+
+// IssueCommand records a command for a connected agent of the customer and
+// sends it. It returns the pending command at once; the result is stored
+// when the agent answers or the timeout passes. A zero timeout means
+// DefaultCommandTimeout.
+func (am *AgentManager) IssueCommand(ctx context.Context, customerID, agentID, name, level string, timeout time.Duration) (*models.AgentCommand, error) {
+	log := am.CommandLog()
+	if log == nil {
+		return nil, ErrNoCommandLog
+	}
+
+	switch name {
+	case agentproto.CommandReloadConfig, agentproto.CommandRestart, agentproto.CommandDiagnostics:
+		level = ""
+	case agentproto.CommandSetLogLevel:
+		if !validLogLevel(level) {
+			return nil, ErrInvalidLogLevel
+		}
+	default:
+		return nil, ErrInvalidCommand
+	}
+	if timeout == 0 {
+		timeout = DefaultCommandTimeout
+	}
+	if timeout < 0 || timeout > MaxCommandTimeout {
+		return nil, ErrInvalidTimeout
+	}
+
+	conn, err := am.commandTarget(ctx, customerID, agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	command := &models.AgentCommand{
+		ID:         agentproto.NewRequestID(),
+		CustomerID: customerID,
+		AgentID:    agentID,
+		Command:    name,
+		Level:      level,
+		Status:     CommandPending,
+		CreatedAt:  now,
+		Deadline:   now.Add(timeout),
+	}
+	if err := log.create(ctx, command); err != nil {
+		return nil, err
+	}
+
+	am.logger.Info("Issued agent command",
+		"command_id", command.ID,
+		"command", name,
+		"agent_id", agentID,
+		"customer_id", customerID)
+
+	if conn != nil {
+		go am.runCommand(conn, *command)
+		return command, nil
+	}
+	if err := log.announce(ctx, command.ID); err != nil {
+		completeCommand(command, CommandFailed, nil, "could not reach the agent's replica")
+		log.complete(ctx, command)
+		return nil, fmt.Errorf("failed to announce command: %w", err)
+	}
+	return command, nil
+}
+
+// commandTarget returns the agent's connection when it is connected here,
+// nil when it is connected to another replica, or ErrAgentNotConnected
+func (am *AgentManager) commandTarget(ctx context.Context, customerID, agentID string) (*AgentConnection, error) {
+	am.mutex.RLock()
+	conn, exists := am.connections[agentID]
+	am.mutex.RUnlock()
+	if exists && conn.CustomerID == customerID && conn.status() != StatusHandshaking {
+		return conn, nil
+	}
+
+	directory := am.clusterDirectory()
+	if directory == nil {
+		return nil, ErrAgentNotConnected
+	}
+	locations, err := directory.RemoteAgents(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up agent: %w", err)
+	}
+	for _, location := range locations {
+		if location.AgentID == agentID {
+			return nil, nil
+		}
+	}
+	return nil, ErrAgentNotConnected
+}
+
+// runAnnounced runs a command issued on another replica if its agent is
+// connected here
+func (am *AgentManager) runAnnounced(commandID string) {
+	log := am.CommandLog()
+	if log == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	command, err := log.store.GetCommand(ctx, commandID)
+	if err != nil {
+		if !errors.Is(err, repository.ErrNotFound) {
+			am.logger.Error("Failed to read announced command", "error", err, "command_id", commandID)
+		}
+		return
+	}
+
+	am.mutex.RLock()
+	conn, exists := am.connections[command.AgentID]
+	am.mutex.RUnlock()
+	if !exists || conn.CustomerID != command.CustomerID || command.Status != CommandPending {
+		return
+	}
+	go am.runCommand(conn, *command)
+}
+
+// runCommand sends a command to the agent, waits for its answer and stores
+// the outcome
+func (am *AgentManager) runCommand(conn *AgentConnection, command models.AgentCommand) {
+	ctx, cancel := context.WithDeadline(am.ctx, command.Deadline)
+	defer cancel()
+
+	// The agent applies the configuration before it reads the command
+	if command.Command == agentproto.CommandReloadConfig {
+		am.pushConfig(conn, true)
+	}
+
+	result, err := conn.runCommand(ctx, &command)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		completeCommand(&command, CommandTimedOut, nil, "agent did not answer in time")
+	case err != nil:
+		completeCommand(&command, CommandFailed, nil, err.Error())
+	case result.Error != "":
+		completeCommand(&command, CommandFailed, commandResult(result), result.Error)
+	default:
+		completeCommand(&command, CommandSucceeded, commandResult(result), "")
+	}
+
+	am.logger.Info("Agent command completed",
+		"command_id", command.ID,
+		"command", command.Command,
+		"agent_id", command.AgentID,
+		"status", command.Status)
+
+	storeCtx, storeCancel := context.WithTimeout(context.Background(), writeWait)
+	defer storeCancel()
+	if log := am.CommandLog(); log != nil {
+		if err := log.complete(storeCtx, &command); err != nil {
+			am.logger.Error("Failed to store command result", "error", err, "command_id", command.ID)
+		}
+	}
+}
+
+func commandResult(result *agentproto.CommandResultPayload) *models.AgentCommandResult {
+	if result.Message == "" && result.Diagnostics == nil {
+		return nil
+	}
+	return &models.AgentCommandResult{Message: result.Message, Diagnostics: result.Diagnostics}
+}
+
+// runCommand sends a command and waits for the agent's answer, correlated
+// by the command ID
+func (ac *AgentConnection) runCommand(ctx context.Context, command *models.AgentCommand) (*agentproto.CommandResultPayload, error) {
+	if !ac.Supports(agentproto.CapabilityCommands) {
+		return nil, ErrCommandsUnsupported
+	}
+
+	respCh := ac.addPending(command.ID)
+	defer ac.removePending(command.ID)
+
+	deadline := command.Deadline
+	msg := agentproto.NewMessage(agentproto.MessageTypeCommand, command.ID, agentproto.CommandPayload{
+		Command:  command.Command,
+		Level:    command.Level,
+		Deadline: &deadline,
+	})
+	if err := ac.Send(ctx, msg); err != nil {
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	var reply *agentproto.WSMessage
+	select {
+	case reply = <-respCh:
+	case <-ac.done:
+		// A restarting agent hangs up right after answering
+		select {
+		case reply = <-respCh:
+		default:
+			return nil, ErrConnectionClosed
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if reply.Type == agentproto.MessageTypeError {
+		var agentErr agentproto.ErrorPayload
+		if err := reply.Decode(&agentErr); err != nil {
+			return nil, fmt.Errorf("agent returned an unreadable error: %w", err)
+		}
+		return nil, fmt.Errorf("agent error: %s", agentErr.Error)
+	}
+
+	var result agentproto.CommandResultPayload
+	if err := reply.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to read command result: %w", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,257 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/pkg/agentproto"
+
+	"go.uber.org/zap"
+)
+
+const (
+	agentConfigCacheKey = "agent_config:%s:%s"
+	configRevisionKey   = "agent_config_revision:%s"
+)
+
+var ErrNoConfigStore = errors.New("agent configuration store is not available")
+
+// configState tracks what a connection was sent and what the agent reported
+// back; it is guarded by the connection mutex
+type configState struct {
+	sent     bool
+	sentRev  int64
+	acked    bool
+	ackedRev int64
+	ackedAt  time.Time
+	err      string
+}
+
+// ConfigRollout is where one connected agent stands with its configuration
+type ConfigRollout struct {
+	AgentID string `json:"agent_id"`
+	// DesiredRevision is the revision the agent should be running
+	DesiredRevision int64 `json:"desired_revision"`
+	// SentRevision is the last revision pushed, nil before the first push
+	SentRevision *int64 `json:"sent_revision"`
+	// AppliedRevision is the last revision the agent applied, nil when it
+	// has not acknowledged any
+	AppliedRevision *int64     `json:"applied_revision"`
+	AppliedAt       *time.Time `json:"applied_at,omitempty"`
+	InSync          bool       `json:"in_sync"`
+	// Error is why the agent refused the last revision it was sent
+	Error string `json:"error,omitempty"`
+}
+
+// SetCustomerConfig stores the configuration shared by a customer's agents
+// under a new revision and pushes it to every connected agent without an
+// override of its own
+func (am *AgentManager) SetCustomerConfig(ctx context.Context, customerID string, config *models.AgentConfig) (*models.AgentConfig, error) {
+	return am.storeConfig(ctx, customerID, "", config)
+}
+
+// SetAgentConfig stores a configuration for a single agent under a new
+// revision, overriding the customer's, and pushes it if the agent is
+// connected
+func (am *AgentManager) SetAgentConfig(ctx context.Context, customerID, agentID string, config *models.AgentConfig) (*models.AgentConfig, error) {
+	return am.storeConfig(ctx, customerID, agentID, config)
+}
+
+// GetAgentConfig returns the configuration an agent should run: its own
+// override if there is one, otherwise the customer's
+func (am *AgentManager) GetAgentConfig(customerID, agentID string) *models.AgentConfig {
+	if agentID != "" {
+		if config := am.getAgentOverride(customerID, agentID); config != nil {
+			return config
+		}
+	}
+	return am.getAgentConfig(customerID)
+}
+
+func (am *AgentManager) storeConfig(ctx context.Context, customerID, agentID string, config *models.AgentConfig) (*models.AgentConfig, error) {
+	if am.cache == nil {
+		return nil, ErrNoConfigStore
+	}
+
+	// Revisions are read-modify-write, one change at a time
+	am.configMutex.Lock()
+	revision, err := am.nextConfigRevision(ctx, customerID)
+	if err != nil {
+		am.configMutex.Unlock()
+		return nil, err
+	}
+
+	stored := *config
+	stored.CustomerID = customerID
+	stored.AgentID = agentID
+	stored.Revision = revision
+	stored.LastUpdated = time.Now()
+
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		am.configMutex.Unlock()
+		return nil, fmt.Errorf("failed to encode agent config: %w", err)
+	}
+
+	key := fmt.Sprintf(configCacheKey, customerID)
+	if agentID != "" {
+		key = fmt.Sprintf(agentConfigCacheKey, customerID, agentID)
+	}
+	// Stored configurations never expire, unlike the cached default
+	err = (*am.cache).Set(ctx, key, string(data), 0)
+	am.configMutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to store agent config: %w", err)
+	}
+
+	am.logger.Info("Stored agent configuration",
+		"customer_id", customerID,
+		"agent_id", agentID,
+		"revision", revision)
+
+	// Agents the change does not affect are already up to date and skipped
+	for _, conn := range am.GetCustomerAgents(customerID) {
+		if agentID == "" || conn.AgentID == agentID {
+			am.pushConfig(conn, false)
+		}
+	}
+
+	return &stored, nil
+}
+
+func (am *AgentManager) nextConfigRevision(ctx context.Context, customerID string) (int64, error) {
+	key := fmt.Sprintf(configRevisionKey, customerID)
+
+	current := int64(0)
+	if value, err := (*am.cache).Get(ctx, key); err == nil {
+		if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, fmt.Errorf("corrupt config revision %q: %w", value, err)
+		}
+	}
+
+	next := current + 1
+	if err := (*am.cache).Set(ctx, key, strconv.FormatInt(next, 10), 0); err != nil {
+		return 0, fmt.Errorf("failed to store config revision: %w", err)
+	}
+	return next, nil
+}
+
+func (am *AgentManager) getAgentOverride(customerID, agentID string) *models.AgentConfig {
+	if am.cache == nil {
+		return nil
+	}
+
+	data, err := (*am.cache).Get(context.Background(), fmt.Sprintf(agentConfigCacheKey, customerID, agentID))
+	if err != nil {
+		return nil
+	}
+
+	var config models.AgentConfig
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		am.logger.Error("Ignoring unreadable agent config override",
+			"error", err,
+			"customer_id", customerID,
+			"agent_id", agentID)
+		return nil
+	}
+	return &config
+}
+
+// SyncConfig pushes the agent's configuration if it has not been sent the
+// current revision yet, e.g. because an earlier push failed
+func (am *AgentManager) SyncConfig(conn *AgentConnection) {
+	am.pushConfig(conn, false)
+}
+
+// pushConfig sends the agent its configuration, or with force even when it
+// was already sent the current revision
+func (am *AgentManager) pushConfig(conn *AgentConnection, force bool) {
+	config := am.GetAgentConfig(conn.CustomerID, conn.AgentID)
+
+	conn.mutex.RLock()
+	current := conn.config.sent && conn.config.sentRev >= config.Revision
+	conn.mutex.RUnlock()
+	if current && !force {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if err := conn.Send(ctx, agentproto.NewMessage(agentproto.MessageTypeConfig, "", config)); err != nil {
+		am.logger.Error("Failed to push agent config",
+			"error", err,
+			"agent_id", conn.AgentID,
+			"revision", config.Revision)
+		return
+	}
+
+	// A slower concurrent push must not move the revision backwards
+	conn.mutex.Lock()
+	if !conn.config.sent || config.Revision > conn.config.sentRev {
+		conn.config.sent = true
+		conn.config.sentRev = config.Revision
+	}
+	conn.mutex.Unlock()
+}
+
+// AcknowledgeConfig records the revision an agent reports having applied.
+// A refused revision is recorded as the error while the agent keeps running
+// the one it had.
+func (am *AgentManager) AcknowledgeConfig(conn *AgentConnection, ack *agentproto.ConfigAckPayload) {
+	conn.mutex.Lock()
+	conn.config.err = ack.Error
+	if ack.Error == "" {
+		conn.config.acked = true
+		conn.config.ackedRev = ack.Revision
+		conn.config.ackedAt = time.Now()
+	}
+	conn.mutex.Unlock()
+
+	if ack.Error != "" {
+		am.logger.Error("Agent failed to apply config",
+			"error", ack.Error,
+			"agent_id", conn.AgentID,
+			"revision", ack.Revision)
+		return
+	}
+	am.logger.Debug("Agent applied config",
+		zap.String("agent_id", conn.AgentID),
+		zap.Int64("revision", ack.Revision))
+}
+
+// ConfigRollouts reports which revision each connected agent of a customer
+// runs, ordered by agent ID
+func (am *AgentManager) ConfigRollouts(customerID string) []ConfigRollout {
+	agents := am.GetCustomerAgents(customerID)
+	rollouts := make([]ConfigRollout, 0, len(agents))
+	for _, conn := range agents {
+		rollout := ConfigRollout{
+			AgentID:         conn.AgentID,
+			DesiredRevision: am.GetAgentConfig(customerID, conn.AgentID).Revision,
+		}
+
+		conn.mutex.RLock()
+		state := conn.config
+		conn.mutex.RUnlock()
+
+		if state.sent {
+			sent := state.sentRev
+			rollout.SentRevision = &sent
+		}
+		if state.acked {
+			applied, appliedAt := state.ackedRev, state.ackedAt
+			rollout.AppliedRevision = &applied
+			rollout.AppliedAt = &appliedAt
+		}
+		rollout.Error = state.err
+		rollout.InSync = state.acked && state.err == "" && state.ackedRev == rollout.DesiredRevision
+
+		rollouts = append(rollouts, rollout)
+	}
+	return rollouts
+}
@@ -0,0 +1,465 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/logger"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	sendBufferSize = 256
+	writeWait      = 10 * time.Second
+
+	// latencyDecay is the weight of the newest sample in the latency EWMA
+	latencyDecay = 0.3
+)
+
+// Connection states reported by GetAgentStatus. Agents only take requests
+// once the handshake has put them in StatusConnected, and stop taking them
+// in StatusDraining.
+const (
+	StatusHandshaking  = "handshaking"
+	StatusConnected    = "connected"
+	StatusDraining     = "draining"
+	StatusDisconnected = "disconnected"
+)
+
+var ErrConnectionClosed = errors.New("agent connection closed")
+
+// MessageHandler receives every agent message that is not a reply to an
+// in-flight request (heartbeats, metrics updates, agent-initiated requests).
+// It runs on the connection's reader goroutine and must not block on the
+// same connection.
+type MessageHandler func(conn *AgentConnection, msg *agentproto.WSMessage)
+
+// AgentConnection owns a single agent WebSocket. All writes go through one
+// writer goroutine and all reads through one reader goroutine, so any number
+// of requests can be in flight at once; replies are matched back to their
+// caller by WSMessage.RequestID.
+type AgentConnection struct {
+	id         string // tells this connection from later ones of the same agent
+	AgentID    string
+	CustomerID string
+	Connection *websocket.Conn
+	Status     string
+	LastPing   time.Time
+	latency    time.Duration // EWMA of time to response head, 0 until sampled
+	mutex      sync.RWMutex
+
+	codec     agentproto.Codec
+	send      chan []byte
+	pending   map[string]chan *agentproto.WSMessage
+	streams   map[string]*bodyStream
+	pendingMu sync.Mutex
+	inbound   map[string]context.CancelFunc // agent-initiated requests being served
+	ctx       context.Context               // canceled when the connection closes
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+	logger    *logger.Logger
+
+	policy            HandshakePolicy
+	handshake         *handshakeResult // nil until the handshake completes
+	onReady           func()           // called once the agent is admitted
+	config            configState
+	credentialID      string // credential that authenticated the agent, if any
+	certificateSerial string // client certificate that authenticated it, if any
+	labels            map[string]string
+	health            *healthTracker
+
+	connectedAt time.Time
+	remoteAddr  string
+	closeReason string       // why the session ended, see setDisconnectReason
+	served      atomic.Int64 // proxied requests the agent answered
+}
+
+func newAgentConnection(agentID, customerID string, conn *websocket.Conn, codec agentproto.Codec, policy HandshakePolicy, logger *logger.Logger) *AgentConnection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &AgentConnection{
+		id:         agentproto.NewRequestID(),
+		AgentID:    agentID,
+		CustomerID: customerID,
+		Connection: conn,
+		Status:     StatusHandshaking,
+		LastPing:   time.Now(),
+		codec:      codec,
+		send:       make(chan []byte, sendBufferSize),
+		pending:    make(map[string]chan *agentproto.WSMessage),
+		streams:    make(map[string]*bodyStream),
+		inbound:    make(map[string]context.CancelFunc),
+		policy:     policy,
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		logger:     logger,
+		health:     newHealthTracker(),
+	}
+}
+
+// start launches the reader and writer goroutines. onReady is invoked once
+// the handshake admits the agent, onClose once the reader stops, i.e. when
+// the socket is gone for good.
+func (ac *AgentConnection) start(handler MessageHandler, onReady, onClose func()) {
+	ac.Connection.SetPongHandler(func(string) error {
+		ac.Touch()
+		return nil
+	})
+	ac.onReady = onReady
+
+	go ac.writePump()
+	go ac.awaitHello()
+	go func() {
+		ac.readPump(handler)
+		ac.Close()
+		if onClose != nil {
+			onClose()
+		}
+	}()
+}
+
+// Send encodes a message with the negotiated codec and queues it for the
+// writer goroutine
+func (ac *AgentConnection) Send(ctx context.Context, msg *agentproto.WSMessage) error {
+	data, err := ac.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ac.send <- data:
+		return nil
+	case <-ac.done:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Touch records that the agent has shown signs of life
+func (ac *AgentConnection) Touch() {
+	ac.mutex.Lock()
+	ac.LastPing = time.Now()
+	ac.mutex.Unlock()
+}
+
+func (ac *AgentConnection) status() string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.Status
+}
+
+// InFlight is the number of requests whose response has not been fully read
+func (ac *AgentConnection) InFlight() int {
+	ac.pendingMu.Lock()
+	defer ac.pendingMu.Unlock()
+	return len(ac.streams)
+}
+
+// Latency is the smoothed time the agent takes to answer with a response
+// head, or 0 while no request has completed yet
+func (ac *AgentConnection) Latency() time.Duration {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.latency
+}
+
+func (ac *AgentConnection) observeLatency(sample time.Duration) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	if ac.latency == 0 {
+		ac.latency = sample
+		return
+	}
+	ac.latency = time.Duration(latencyDecay*float64(sample) + (1-latencyDecay)*float64(ac.latency))
+}
+
+// Done is closed once the connection has been torn down
+func (ac *AgentConnection) Done() <-chan struct{} {
+	return ac.done
+}
+
+// closeWith closes the socket with a close frame the agent can read
+func (ac *AgentConnection) closeWith(code int, reason string) {
+	select {
+	case <-ac.done:
+		return
+	default:
+	}
+
+	ac.Connection.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeWait))
+	ac.Close()
+}
+
+// Close tears down the socket and releases every waiting caller
+func (ac *AgentConnection) Close() error {
+	var err error
+	ac.closeOnce.Do(func() {
+		ac.mutex.Lock()
+		ac.Status = StatusDisconnected
+		ac.mutex.Unlock()
+
+		close(ac.done)
+		ac.cancel()
+		err = ac.Connection.Close()
+	})
+	return err
+}
+
+func (ac *AgentConnection) sendRequest(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+	requestID := agentproto.NewRequestID()
+	request.Streamed = request.BodyStream != nil
+	if deadline, ok := ctx.Deadline(); ok {
+		request.Deadline = &deadline
+	}
+
+	msg := agentproto.NewMessage(agentproto.MessageTypeProxyRequest, requestID, &request.ProxyRequest)
+
+	// The stream is opened up front so body frames that overtake the caller
+	// are buffered rather than dropped
+	respCh := ac.addPending(requestID)
+	defer ac.removePending(requestID)
+	stream := ac.openStream(requestID, request.Streamed || request.Tunnel)
+
+	// A streamed body or an accepted tunnel keeps the stream past this call
+	keepStream := false
+	defer func() {
+		if !keepStream {
+			ac.finishStream(requestID, stream)
+		}
+	}()
+
+	// Send request through websocket
+	sentAt := time.Now()
+	if err := ac.Send(ctx, msg); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	// Upload the body alongside waiting, the agent may answer before reading all of it
+	if request.Streamed {
+		stream.uploaded = make(chan struct{})
+		go func() {
+			defer close(stream.uploaded)
+			if err := ac.writeBody(ctx, requestID, stream, request.BodyStream, request.BodySize, request.Trailers); err != nil && err != errStreamClosed {
+				ac.logger.Error("Failed to stream request body",
+					"error", err,
+					"agent_id", ac.AgentID,
+					"request_id", requestID)
+			}
+		}()
+	}
+
+	// Wait for the matching response
+	select {
+	case reply := <-respCh:
+		ac.observeLatency(time.Since(sentAt))
+		ac.served.Add(1)
+
+		if reply.Type == agentproto.MessageTypeError {
+			var agentErr agentproto.ErrorPayload
+			if err := reply.Decode(&agentErr); err != nil {
+				return nil, fmt.Errorf("agent returned an unreadable error: %w", err)
+			}
+			return nil, fmt.Errorf("agent error: %s", agentErr.Error)
+		}
+
+		response := &ProxyResponse{}
+		if err := reply.Decode(&response.ProxyResponse); err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+
+		switch {
+		case response.Streamed:
+			if response.Trailers == nil {
+				response.Trailers = make(map[string][]string)
+			}
+			keepStream = true
+			response.BodyStream = ac.newBodyReader(ctx, requestID, stream, response.Trailers)
+		case request.Tunnel && tunnelAccepted(request.Method, response.StatusCode):
+			keepStream = true
+			response.Tunnel = ac.newTunnel(requestID, stream)
+		}
+		return response, nil
+	case <-ac.done:
+		return nil, fmt.Errorf("failed to read response: %w", ErrConnectionClosed)
+	case <-ctx.Done():
+		ac.sendCancel(requestID, ctx.Err().Error())
+		return nil, ctx.Err()
+	}
+}
+
+// sendCancel tells the agent to stop working on a request the proxy has
+// given up on. It is best effort and never waits longer than a write would.
+func (ac *AgentConnection) sendCancel(requestID, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+
+	if err := ac.Send(ctx, agentproto.NewMessage(agentproto.MessageTypeCancel, requestID, agentproto.CancelPayload{Reason: reason})); err != nil && err != ErrConnectionClosed {
+		ac.logger.Error("Failed to send cancel",
+			"error", err,
+			"agent_id", ac.AgentID,
+			"request_id", requestID)
+	}
+}
+
+// ServeContext returns the context for serving an agent-initiated request.
+// It is canceled when the agent cancels requestID, when the connection
+// closes, or when the returned CancelFunc is called.
+func (ac *AgentConnection) ServeContext(requestID string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ac.ctx)
+
+	ac.pendingMu.Lock()
+	ac.inbound[requestID] = cancel
+	ac.pendingMu.Unlock()
+
+	return ctx, func() {
+		ac.pendingMu.Lock()
+		delete(ac.inbound, requestID)
+		ac.pendingMu.Unlock()
+		cancel()
+	}
+}
+
+func (ac *AgentConnection) cancelInbound(requestID string) {
+	ac.pendingMu.Lock()
+	cancel, exists := ac.inbound[requestID]
+	ac.pendingMu.Unlock()
+
+	if exists {
+		cancel()
+	}
+}
+
+func (ac *AgentConnection) addPending(requestID string) chan *agentproto.WSMessage {
+	ch := make(chan *agentproto.WSMessage, 1)
+
+	ac.pendingMu.Lock()
+	ac.pending[requestID] = ch
+	ac.pendingMu.Unlock()
+
+	return ch
+}
+
+func (ac *AgentConnection) removePending(requestID string) {
+	ac.pendingMu.Lock()
+	delete(ac.pending, requestID)
+	ac.pendingMu.Unlock()
+}
+
+// resolve hands a reply to the caller waiting on its request ID. It reports
+// false when nobody is waiting, so the message can be handled elsewhere.
+func (ac *AgentConnection) resolve(msg *agentproto.WSMessage) bool {
+	ac.pendingMu.Lock()
+	ch, exists := ac.pending[msg.RequestID]
+	if exists {
+		delete(ac.pending, msg.RequestID)
+	}
+	ac.pendingMu.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	ch <- msg
+	return true
+}
+
+func (ac *AgentConnection) writePump() {
+	for {
+		select {
+		case data := <-ac.send:
+			ac.Connection.SetWriteDeadline(time.Now().Add(writeWait))
+			ac.Connection.EnableWriteCompression(ac.Supports(agentproto.CapabilityCompression))
+			if err := ac.Connection.WriteMessage(ac.codec.FrameType(), data); err != nil {
+				ac.logger.Error("Failed to write agent message",
+					zap.Error(err),
+					zap.String("agent_id", ac.AgentID))
+				ac.setDisconnectReason(DisconnectConnectionLost)
+				ac.Close()
+				return
+			}
+		case <-ac.done:
+			return
+		}
+	}
+}
+
+func (ac *AgentConnection) readPump(handler MessageHandler) {
+	for {
+		messageType, data, err := ac.Connection.ReadMessage()
+		if err != nil {
+			ac.setDisconnectReason(readFailure(err))
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				ac.logger.Error("WebSocket read error",
+					zap.Error(err),
+					zap.String("agent_id", ac.AgentID))
+			}
+			return
+		}
+
+		if messageType != ac.codec.FrameType() {
+			continue
+		}
+
+		msg, err := ac.codec.Decode(data)
+		if err != nil {
+			ac.logger.Error("Failed to parse message",
+				zap.Error(err),
+				zap.String("agent_id", ac.AgentID))
+			continue
+		}
+
+		// The first message is the hello; anything else means a legacy agent
+		if ac.handshaking() {
+			if msg.Type == agentproto.MessageTypeHello {
+				ac.handleHello(msg)
+				continue
+			}
+			if ac.completeHandshake(nil); ac.ctx.Err() != nil {
+				return
+			}
+		}
+
+		switch msg.Type {
+		case agentproto.MessageTypeHello:
+			ac.logger.Warn("Ignoring hello after handshake",
+				zap.String("agent_id", ac.AgentID))
+			continue
+		case agentproto.MessageTypeBodyChunk:
+			ac.deliverBodyFrame(msg)
+			continue
+		case agentproto.MessageTypeCancel:
+			ac.cancelInbound(msg.RequestID)
+			continue
+		}
+
+		// Replies to in-flight requests go straight to their caller
+		if msg.RequestID != "" && ac.resolve(msg) {
+			continue
+		}
+
+		// A reply nobody waits for belongs to a request that was canceled or
+		// a command that timed out
+		if msg.Type == agentproto.MessageTypeProxyResponse || msg.Type == agentproto.MessageTypeError || msg.Type == agentproto.MessageTypeCommandResult {
+			ac.logger.Debug("Dropping late reply",
+				zap.String("agent_id", ac.AgentID),
+				zap.String("request_id", msg.RequestID))
+			continue
+		}
+
+		if handler != nil {
+			handler(ac, msg)
+		}
+	}
+}
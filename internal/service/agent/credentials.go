@@ -0,0 +1,419 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	agentCredentialsKey      = "agent_credentials:%s"
+	connectNonceKey          = "agent_token_nonce:%s:%s"
+	credentialRevokedChannel = "agent_credential_revoked"
+
+	DefaultConnectTokenTTL = 5 * time.Minute
+	DefaultRotationOverlap = 24 * time.Hour
+
+	// connectTokenSkew tolerates agent clocks running ahead of the proxy
+	connectTokenSkew = time.Minute
+)
+
+var (
+	ErrNoCredentialStore  = errors.New("agent credential store is not available")
+	ErrCredentialNotFound = errors.New("agent credential not found")
+	// ErrCredentialRequired refuses API key tokens of agents that were
+	// issued a credential
+	ErrCredentialRequired = errors.New("agent must connect with a credential token")
+)
+
+// CredentialPolicy bounds connect tokens and rotations; zero values keep the
+// defaults
+type CredentialPolicy struct {
+	// TokenTTL is how long a connect token is accepted after it was signed
+	TokenTTL time.Duration
+	// RotationOverlap is how long a replaced credential keeps working
+	RotationOverlap time.Duration
+}
+
+// CredentialStore keeps the credentials of every agent in Redis, so any
+// replica can verify them. An agent that was issued a credential once may
+// only connect with connect tokens signed by one from then on, even after
+// all of them were revoked.
+type CredentialStore struct {
+	cache  *cache.RedisCache
+	policy CredentialPolicy
+	mutex  sync.Mutex // serializes changes to an agent's credentials
+}
+
+// credentialRevocation is published to every replica so each closes the
+// sessions a revoked credential authenticated
+type credentialRevocation struct {
+	AgentID string `json:"agent_id"`
+	// CredentialID is empty when all of the agent's credentials were revoked
+	CredentialID string `json:"credential_id,omitempty"`
+}
+
+type credentialKey struct{}
+
+func NewCredentialStore(cache *cache.RedisCache, policy CredentialPolicy) *CredentialStore {
+	if policy.TokenTTL <= 0 {
+		policy.TokenTTL = DefaultConnectTokenTTL
+	}
+	if policy.RotationOverlap <= 0 {
+		policy.RotationOverlap = DefaultRotationOverlap
+	}
+	return &CredentialStore{
+		cache:  cache,
+		policy: policy,
+	}
+}
+
+// WithCredential records which credential authenticated a connection, for
+// RegisterAgent
+func WithCredential(ctx context.Context, credentialID string) context.Context {
+	return context.WithValue(ctx, credentialKey{}, credentialID)
+}
+
+func credentialFromContext(ctx context.Context) string {
+	credentialID, _ := ctx.Value(credentialKey{}).(string)
+	return credentialID
+}
+
+// TokenTTL is how long connect tokens are accepted
+func (s *CredentialStore) TokenTTL() time.Duration {
+	return s.policy.TokenTTL
+}
+
+// Issue creates a new credential for the agent and returns it with its
+// secret, which List never shows again. Credentials the agent already had
+// keep working for overlap, or for the policy's rotation overlap when
+// overlap is negative.
+func (s *CredentialStore) Issue(ctx context.Context, customerID, agentID string, overlap time.Duration) (*models.AgentCredential, error) {
+	if overlap < 0 {
+		overlap = s.policy.RotationOverlap
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate agent secret: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	credentials, _, err := s.load(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(overlap)
+	current := credentials[:0]
+	for _, credential := range credentials {
+		if !active(&credential, now) {
+			continue
+		}
+		if credential.ExpiresAt == nil || credential.ExpiresAt.After(expiresAt) {
+			credential.ExpiresAt = &expiresAt
+		}
+		current = append(current, credential)
+	}
+
+	issued := models.AgentCredential{
+		ID:         agentproto.NewRequestID(),
+		AgentID:    agentID,
+		CustomerID: customerID,
+		Secret:     hex.EncodeToString(secret),
+		CreatedAt:  now,
+	}
+	if err := s.save(ctx, agentID, append(current, issued)); err != nil {
+		return nil, err
+	}
+	return &issued, nil
+}
+
+// List returns the credentials of the agent that are still accepted, without
+// their secrets
+func (s *CredentialStore) List(ctx context.Context, agentID string) ([]models.AgentCredential, error) {
+	credentials, _, err := s.load(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	listed := make([]models.AgentCredential, 0, len(credentials))
+	for _, credential := range credentials {
+		if active(&credential, now) {
+			credential.Secret = ""
+			listed = append(listed, credential)
+		}
+	}
+	return listed, nil
+}
+
+// Revoke deletes one credential of the agent, or all of them when
+// credentialID is empty, and tells every replica to close the sessions they
+// authenticated
+func (s *CredentialStore) Revoke(ctx context.Context, agentID, credentialID string) error {
+	s.mutex.Lock()
+	credentials, _, err := s.load(ctx, agentID)
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+
+	kept := credentials[:0]
+	for _, credential := range credentials {
+		if credentialID != "" && credential.ID != credentialID {
+			kept = append(kept, credential)
+		}
+	}
+	if credentialID != "" && len(kept) == len(credentials) {
+		s.mutex.Unlock()
+		return ErrCredentialNotFound
+	}
+
+	// An empty list is kept so the agent stays enrolled
+	err = s.save(ctx, agentID, kept)
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.announceRevoked(ctx, credentialRevocation{AgentID: agentID, CredentialID: credentialID})
+}
+
+// Forget deletes every credential of a deleted agent, enrollment included,
+// so an agent created again with its ID starts over with the API key, and
+// tells every replica to close the sessions they authenticated
+func (s *CredentialStore) Forget(ctx context.Context, agentID string) error {
+	s.mutex.Lock()
+	err := s.cache.Delete(ctx, fmt.Sprintf(agentCredentialsKey, agentID))
+	s.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to delete agent credentials: %w", err)
+	}
+
+	return s.announceRevoked(ctx, credentialRevocation{AgentID: agentID})
+}
+
+func (s *CredentialStore) announceRevoked(ctx context.Context, revocation credentialRevocation) error {
+	data, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+	if err := s.cache.Publish(ctx, credentialRevokedChannel, string(data)); err != nil {
+		return fmt.Errorf("failed to announce credential revocation: %w", err)
+	}
+	return nil
+}
+
+// Enrolled reports whether the agent was ever issued a credential
+func (s *CredentialStore) Enrolled(ctx context.Context, agentID string) (bool, error) {
+	_, enrolled, err := s.load(ctx, agentID)
+	return enrolled, err
+}
+
+// Verify checks a connect token presented by the agent and spends its
+// nonce. It returns the ID of the credential that signed the token.
+func (s *CredentialStore) Verify(ctx context.Context, customerID, agentID, token string) (string, error) {
+	parsed, err := parseConnectToken(token)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if parsed.issuedAt.Add(s.policy.TokenTTL).Before(now) {
+		return "", fmt.Errorf("token expired")
+	}
+	if parsed.issuedAt.After(now.Add(connectTokenSkew)) {
+		return "", fmt.Errorf("token issued in the future")
+	}
+
+	credential, err := s.find(ctx, customerID, agentID, parsed.credentialID)
+	if err != nil {
+		return "", err
+	}
+
+	expected := agentproto.SignConnectToken(agentID, customerID, credential.ID, credential.Secret, parsed.issuedAt, parsed.nonce)
+	if !hmac.Equal([]byte(token), []byte(expected)) {
+		return "", fmt.Errorf("invalid token signature")
+	}
+
+	// The nonce is remembered for as long as the token could be accepted
+	fresh, err := s.cache.ClaimOnce(ctx, fmt.Sprintf(connectNonceKey, agentID, parsed.nonce), s.policy.TokenTTL+connectTokenSkew)
+	if err != nil {
+		return "", fmt.Errorf("failed to record token nonce: %w", err)
+	}
+	if !fresh {
+		return "", fmt.Errorf("token already used")
+	}
+	return credential.ID, nil
+}
+
+// Exchange mints a connect token for an agent that proves it holds the
+// secret of a credential, for agents that do not sign their own
+func (s *CredentialStore) Exchange(ctx context.Context, customerID, agentID, credentialID, secret string) (string, time.Time, error) {
+	credential, err := s.find(ctx, customerID, agentID, credentialID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !hmac.Equal([]byte(secret), []byte(credential.Secret)) {
+		return "", time.Time{}, ErrCredentialNotFound
+	}
+
+	issuedAt := time.Now()
+	token := agentproto.SignConnectToken(agentID, customerID, credential.ID, credential.Secret, issuedAt, agentproto.NewRequestID())
+	return token, issuedAt.Add(s.policy.TokenTTL), nil
+}
+
+// find returns an accepted credential of the agent
+func (s *CredentialStore) find(ctx context.Context, customerID, agentID, credentialID string) (*models.AgentCredential, error) {
+	credentials, _, err := s.load(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, credential := range credentials {
+		if credential.ID == credentialID && credential.CustomerID == customerID && active(&credential, now) {
+			return &credential, nil
+		}
+	}
+	return nil, ErrCredentialNotFound
+}
+
+// load returns the agent's credentials and whether it was ever issued any
+func (s *CredentialStore) load(ctx context.Context, agentID string) ([]models.AgentCredential, bool, error) {
+	data, err := s.cache.Get(ctx, fmt.Sprintf(agentCredentialsKey, agentID))
+	if cache.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read agent credentials: %w", err)
+	}
+
+	var credentials []models.AgentCredential
+	if err := json.Unmarshal([]byte(data), &credentials); err != nil {
+		return nil, false, fmt.Errorf("corrupt agent credentials: %w", err)
+	}
+	return credentials, true, nil
+}
+
+func (s *CredentialStore) save(ctx context.Context, agentID string, credentials []models.AgentCredential) error {
+	if credentials == nil {
+		credentials = []models.AgentCredential{}
+	}
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		return fmt.Errorf("failed to encode agent credentials: %w", err)
+	}
+	if err := s.cache.Set(ctx, fmt.Sprintf(agentCredentialsKey, agentID), string(data), 0); err != nil {
+		return fmt.Errorf("failed to store agent credentials: %w", err)
+	}
+	return nil
+}
+
+// revocations delivers the revocations announced by any replica until ctx
+// is done
+func (s *CredentialStore) revocations(ctx context.Context) (<-chan credentialRevocation, error) {
+	messages, err := s.cache.Subscribe(ctx, credentialRevokedChannel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to credential revocations: %w", err)
+	}
+
+	revocations := make(chan credentialRevocation)
+	go func() {
+		defer close(revocations)
+		for message := range messages {
+			var revocation credentialRevocation
+			if err := json.Unmarshal([]byte(message), &revocation); err != nil {
+				continue
+			}
+			select {
+			case revocations <- revocation:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return revocations, nil
+}
+
+func active(credential *models.AgentCredential, now time.Time) bool {
+	return credential.ExpiresAt == nil || credential.ExpiresAt.After(now)
+}
+
+// SetCredentialStore lets agents authenticate with credentials of their own
+// and closes the sessions of credentials revoked on any replica. It must be
+// set before agents are registered.
+func (am *AgentManager) SetCredentialStore(store *CredentialStore) {
+	am.mutex.Lock()
+	am.credentials = store
+	am.mutex.Unlock()
+
+	revocations, err := store.revocations(am.ctx)
+	if err != nil {
+		am.logger.Error("Revoked credentials will only close sessions on this replica", "error", err)
+		return
+	}
+	go func() {
+		for revocation := range revocations {
+			am.closeRevoked(revocation.AgentID, revocation.CredentialID)
+		}
+	}()
+}
+
+// Credentials returns the credential store, or nil when agents can only
+// authenticate with the customer's API key
+func (am *AgentManager) Credentials() *CredentialStore {
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	return am.credentials
+}
+
+// RevokeCredential revokes one credential of an agent, or all of them when
+// credentialID is empty, and closes the sessions they authenticated on
+// every replica
+func (am *AgentManager) RevokeCredential(ctx context.Context, agentID, credentialID string) error {
+	store := am.Credentials()
+	if store == nil {
+		return ErrNoCredentialStore
+	}
+	if err := store.Revoke(ctx, agentID, credentialID); err != nil {
+		return err
+	}
+
+	// Other replicas hear of it through Redis, this one closes at once
+	am.closeRevoked(agentID, credentialID)
+	return nil
+}
+
+// closeRevoked closes the agent's session if a revoked credential
+// authenticated it; revoking all credentials closes any session
+func (am *AgentManager) closeRevoked(agentID, credentialID string) {
+	am.mutex.RLock()
+	conn, exists := am.connections[agentID]
+	am.mutex.RUnlock()
+
+	if !exists || (credentialID != "" && conn.credentialID != credentialID) {
+		return
+	}
+
+	am.logger.Info("Closing session of revoked agent credential",
+		"agent_id", agentID,
+		"credential_id", conn.credentialID)
+	conn.closeWith(websocket.ClosePolicyViolation, "agent credential revoked")
+}
@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"proxy-service/pkg/cache"
+	"proxy-service/pkg/logger"
+)
+
+const (
+	agentLeaseKey     = "agent_lease:%s"
+	customerAgentsKey = "agent_directory:%s"
+	agentLabelsKey    = "agent_labels:%s"
+
+	DefaultLeaseTTL = 90 * time.Second
+)
+
+// Replica identifies one proxy process to its peers
+type Replica struct {
+	ID string
+	// Address is the base URL of the replica's internal endpoint
+	Address string
+}
+
+// AgentLocation says which replica holds an agent's connection
+type AgentLocation struct {
+	AgentID      string `json:"agent_id"`
+	CustomerID   string `json:"customer_id"`
+	ReplicaID    string `json:"replica_id"`
+	Address      string `json:"address"`
+	ConnectionID string `json:"connection_id"`
+	// Labels are kept beside the lease, which must not change while the
+	// connection lives, and filled in by CustomerAgents
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Directory records in Redis which replica owns each agent connection, so
+// any replica can find an agent connected to another. Ownership is a lease
+// that the owner renews on heartbeats; a replica that dies stops renewing
+// and its agents drop out once the lease runs out.
+type Directory struct {
+	cache   *cache.RedisCache
+	replica Replica
+	ttl     time.Duration
+	logger  *logger.Logger
+}
+
+func NewDirectory(cache *cache.RedisCache, replica Replica, ttl time.Duration) *Directory {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &Directory{
+		cache:   cache,
+		replica: replica,
+		ttl:     ttl,
+		logger:  logger.NewLogger(),
+	}
+}
+
+// Replica is the replica this directory registers agents for
+func (d *Directory) Replica() Replica {
+	return d.replica
+}
+
+// Register claims an agent for this replica, taking it over from any replica
+// that held an older connection
+func (d *Directory) Register(ctx context.Context, conn *AgentConnection) error {
+	value, err := d.leaseValue(conn)
+	if err != nil {
+		return err
+	}
+	if err := d.cache.ClaimLease(ctx, leaseKey(conn.AgentID), value, fmt.Sprintf(customerAgentsKey, conn.CustomerID), conn.AgentID, d.ttl); err != nil {
+		return err
+	}
+	return d.PublishLabels(ctx, conn)
+}
+
+// Renew extends the lease of a connection. It reports false once another
+// replica owns the agent, i.e. the agent has reconnected elsewhere.
+func (d *Directory) Renew(ctx context.Context, conn *AgentConnection) (bool, error) {
+	value, err := d.leaseValue(conn)
+	if err != nil {
+		return false, err
+	}
+	held, err := d.cache.RenewLease(ctx, leaseKey(conn.AgentID), value, fmt.Sprintf(customerAgentsKey, conn.CustomerID), conn.AgentID, d.ttl)
+	if err != nil || !held {
+		return held, err
+	}
+	return true, d.PublishLabels(ctx, conn)
+}
+
+// PublishLabels records the labels of a connection for the other replicas.
+// They expire with the lease, which renewals keep extending.
+func (d *Directory) PublishLabels(ctx context.Context, conn *AgentConnection) error {
+	data, err := json.Marshal(conn.Labels())
+	if err != nil {
+		return fmt.Errorf("failed to encode agent labels: %w", err)
+	}
+	return d.cache.Set(ctx, fmt.Sprintf(agentLabelsKey, conn.AgentID), data, d.ttl)
+}
+
+// Release gives up the lease of a connection that has gone away. A lease
+// that has since been claimed by a newer connection is left alone.
+func (d *Directory) Release(ctx context.Context, conn *AgentConnection) error {
+	value, err := d.leaseValue(conn)
+	if err != nil {
+		return err
+	}
+	_, err = d.cache.ReleaseLease(ctx, leaseKey(conn.AgentID), value, fmt.Sprintf(customerAgentsKey, conn.CustomerID), conn.AgentID)
+	return err
+}
+
+// CustomerAgents lists where the connected agents of a customer are, across
+// all replicas, ordered by agent ID
+func (d *Directory) CustomerAgents(ctx context.Context, customerID string) ([]AgentLocation, error) {
+	held, err := d.cache.LeaseMembers(ctx, fmt.Sprintf(customerAgentsKey, customerID), leaseKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent directory: %w", err)
+	}
+
+	labelKeys := make([]string, 0, len(held))
+	for agentID := range held {
+		labelKeys = append(labelKeys, fmt.Sprintf(agentLabelsKey, agentID))
+	}
+	labels, err := d.cache.GetMany(ctx, labelKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent labels: %w", err)
+	}
+
+	locations := make([]AgentLocation, 0, len(held))
+	for agentID, value := range held {
+		var location AgentLocation
+		if err := json.Unmarshal([]byte(value), &location); err != nil {
+			d.logger.Error("Skipping unreadable agent lease", "error", err, "agent_id", agentID)
+			continue
+		}
+		if value, ok := labels[fmt.Sprintf(agentLabelsKey, agentID)]; ok {
+			if err := json.Unmarshal([]byte(value), &location.Labels); err != nil {
+				d.logger.Error("Ignoring unreadable agent labels", "error", err, "agent_id", agentID)
+			}
+		}
+		locations = append(locations, location)
+	}
+
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].AgentID < locations[j].AgentID
+	})
+	return locations, nil
+}
+
+// RemoteAgents is CustomerAgents without the agents held by this replica
+func (d *Directory) RemoteAgents(ctx context.Context, customerID string) ([]AgentLocation, error) {
+	locations, err := d.CustomerAgents(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := locations[:0]
+	for _, location := range locations {
+		if location.ReplicaID != d.replica.ID {
+			remote = append(remote, location)
+		}
+	}
+	return remote, nil
+}
+
+// leaseValue is the same for every call on one connection, which is what
+// lets the lease tell this connection from a newer one
+func (d *Directory) leaseValue(conn *AgentConnection) (string, error) {
+	data, err := json.Marshal(AgentLocation{
+		AgentID:      conn.AgentID,
+		CustomerID:   conn.CustomerID,
+		ReplicaID:    d.replica.ID,
+		Address:      d.replica.Address,
+		ConnectionID: conn.id,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode agent lease: %w", err)
+	}
+	return string(data), nil
+}
+
+func leaseKey(agentID string) string {
+	return fmt.Sprintf(agentLeaseKey, agentID)
+}
+
+// registerLease publishes a newly admitted agent in the directory
+func (am *AgentManager) registerLease(conn *AgentConnection) {
+	directory := am.clusterDirectory()
+	if directory == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if err := directory.Register(ctx, conn); err != nil {
+		am.logger.Error("Failed to register agent in directory",
+			"error", err,
+			"agent_id", conn.AgentID)
+	}
+}
+
+// RenewLease keeps the agent listed in the directory. A connection whose
+// agent has since been claimed by another replica is stale and is closed.
+// Draining connections are no longer listed.
+func (am *AgentManager) RenewLease(conn *AgentConnection) {
+	directory := am.clusterDirectory()
+	if directory == nil || conn.status() != StatusConnected {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	held, err := directory.Renew(ctx, conn)
+	if err != nil {
+		am.logger.Error("Failed to renew agent lease",
+			"error", err,
+			"agent_id", conn.AgentID)
+		return
+	}
+	if !held {
+		am.logger.Info("Agent moved to another replica, closing stale connection",
+			"agent_id", conn.AgentID)
+		conn.Close()
+	}
+}
+
+// releaseLease drops a closed connection from the directory
+func (am *AgentManager) releaseLease(conn *AgentConnection) {
+	directory := am.clusterDirectory()
+	if directory == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if err := directory.Release(ctx, conn); err != nil {
+		am.logger.Error("Failed to release agent lease",
+			"error", err,
+			"agent_id", conn.AgentID)
+	}
+}
+
+// publishLabels shares changed labels of an agent with the other replicas
+func (am *AgentManager) publishLabels(conn *AgentConnection) {
+	directory := am.clusterDirectory()
+	if directory == nil || conn.status() != StatusConnected {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if err := directory.PublishLabels(ctx, conn); err != nil {
+		am.logger.Error("Failed to publish agent labels",
+			"error", err,
+			"agent_id", conn.AgentID)
+	}
+}
+
+func (am *AgentManager) clusterDirectory() *Directory {
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	return am.directory
+}
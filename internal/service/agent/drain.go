@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"proxy-service/pkg/agentproto"
+)
+
+const (
+	drainReason       = "replica shutting down"
+	drainPollInterval = 20 * time.Millisecond
+)
+
+var (
+	// ErrDraining is returned to agents connecting while the replica drains
+	ErrDraining = errors.New("replica is draining")
+	// ErrAgentDraining is returned for requests routed to an agent that has
+	// been told to go away
+	ErrAgentDraining = errors.New("agent is draining")
+)
+
+// Drain prepares the replica for shutdown. Every agent is sent a goaway, so
+// it reconnects to another replica, and is taken out of routing; agents still
+// handshaking and agents connecting from now on are turned away. Drain then
+// waits until the requests in flight on the draining agents have finished,
+// or ctx is done, and closes their connections. It returns ctx.Err() when
+// requests were cut short.
+func (am *AgentManager) Drain(ctx context.Context) error {
+	goAway := agentproto.GoAwayPayload{Reason: drainReason}
+	if deadline, ok := ctx.Deadline(); ok {
+		goAway.Deadline = &deadline
+	}
+
+	am.mutex.Lock()
+	am.draining = true
+	var draining, handshaking []*AgentConnection
+	customers := make(map[string]bool)
+	for _, conn := range am.connections {
+		conn.setDisconnectReason(DisconnectShutdown)
+		switch conn.beginDrain() {
+		case StatusConnected:
+			draining = append(draining, conn)
+			customers[conn.CustomerID] = true
+		case StatusHandshaking:
+			handshaking = append(handshaking, conn)
+		}
+	}
+	for customerID := range customers {
+		am.notifyRouting(customerID)
+	}
+	am.mutex.Unlock()
+
+	// Nothing is in flight on a connection that has not been admitted
+	for _, conn := range handshaking {
+		conn.closeWith(websocket.CloseGoingAway, drainReason)
+	}
+
+	am.logger.Info("Draining agents", "agents", len(draining))
+	for _, conn := range draining {
+		// Other replicas stop handing requests over for the agent at once
+		am.releaseLease(conn)
+		am.recordStatus(conn.AgentID, StatusDraining)
+		if err := conn.Send(ctx, agentproto.NewMessage(agentproto.MessageTypeGoAway, "", goAway)); err != nil && err != ErrConnectionClosed {
+			am.logger.Error("Failed to send goaway",
+				"error", err,
+				"agent_id", conn.AgentID)
+		}
+	}
+
+	err := waitIdle(ctx, draining)
+	for _, conn := range draining {
+		conn.closeWith(websocket.CloseGoingAway, drainReason)
+	}
+	if err != nil {
+		am.logger.Error("Drain deadline passed with requests in flight", "error", err)
+	}
+	return err
+}
+
+// Close stops the manager's background loops and closes every connection
+// still open. Call it after Drain; the manager takes no agents afterwards.
+func (am *AgentManager) Close() {
+	am.cancel()
+
+	am.mutex.Lock()
+	am.draining = true
+	connections := make([]*AgentConnection, 0, len(am.connections))
+	for _, conn := range am.connections {
+		conn.setDisconnectReason(DisconnectShutdown)
+		connections = append(connections, conn)
+	}
+	am.mutex.Unlock()
+
+	for _, conn := range connections {
+		conn.closeWith(websocket.CloseGoingAway, drainReason)
+	}
+}
+
+// waitIdle returns once none of the connections has requests in flight
+func waitIdle(ctx context.Context, connections []*AgentConnection) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		idle := true
+		for _, conn := range connections {
+			if !conn.idle() {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// beginDrain takes the connection out of service and returns the status it
+// had. A connection still handshaking will not be admitted anymore.
+func (ac *AgentConnection) beginDrain() string {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	status := ac.Status
+	if status == StatusConnected || status == StatusHandshaking {
+		ac.Status = StatusDraining
+	}
+	return status
+}
+
+// idle reports whether no request is in flight in either direction, which
+// is always the case once the connection has closed
+func (ac *AgentConnection) idle() bool {
+	select {
+	case <-ac.done:
+		return true
+	default:
+	}
+
+	ac.pendingMu.Lock()
+	defer ac.pendingMu.Unlock()
+	return len(ac.streams) == 0 && len(ac.inbound) == 0
+}
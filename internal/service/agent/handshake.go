@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"proxy-service/pkg/agentproto"
+)
+
+// DefaultHandshakeTimeout is how long agents get to send their hello
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// ServerCapabilities is everything this proxy can use
+var ServerCapabilities = []string{
+	agentproto.CapabilityStreaming,
+	agentproto.CapabilityCompression,
+	agentproto.CapabilityBinaryCodec,
+	agentproto.CapabilityWebSocketTunnels,
+	agentproto.CapabilityTCPTunnels,
+	agentproto.CapabilityCommands,
+}
+
+// HandshakePolicy decides which agents are admitted
+type HandshakePolicy struct {
+	// MinProtocolVersion rejects older agents; ProtocolVersionLegacy or
+	// less admits agents that send no hello
+	MinProtocolVersion int
+	// Timeout is how long a silent agent gets to send its hello before it
+	// is treated as a legacy agent
+	Timeout time.Duration
+}
+
+// handshakeResult is what was negotiated with an agent
+type handshakeResult struct {
+	protocolVersion int
+	agentVersion    string
+	capabilities    map[string]bool
+}
+
+// negotiate intersects the hello with what the proxy supports. A nil hello
+// stands for a legacy agent.
+func negotiate(hello *agentproto.HelloPayload, codec agentproto.Codec) *handshakeResult {
+	result := &handshakeResult{
+		protocolVersion: agentproto.ProtocolVersionLegacy,
+		capabilities:    make(map[string]bool),
+	}
+	if hello == nil {
+		return result
+	}
+
+	result.protocolVersion = hello.ProtocolVersion
+	if result.protocolVersion > agentproto.ProtocolVersion {
+		result.protocolVersion = agentproto.ProtocolVersion
+	}
+	result.agentVersion = hello.AgentVersion
+
+	supported := make(map[string]bool, len(ServerCapabilities))
+	for _, capability := range ServerCapabilities {
+		supported[capability] = true
+	}
+	for _, capability := range hello.Capabilities {
+		if supported[capability] {
+			result.capabilities[capability] = true
+		}
+	}
+
+	// The codec was settled by the upgrade, this only reports it
+	if codec != agentproto.BinaryCodec {
+		delete(result.capabilities, agentproto.CapabilityBinaryCodec)
+	}
+
+	return result
+}
+
+func (r *handshakeResult) capabilityList() []string {
+	list := make([]string, 0, len(r.capabilities))
+	for capability := range r.capabilities {
+		list = append(list, capability)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// handleHello completes the handshake from the agent's hello
+func (ac *AgentConnection) handleHello(msg *agentproto.WSMessage) {
+	var hello agentproto.HelloPayload
+	if err := msg.Decode(&hello); err != nil {
+		ac.reject(fmt.Sprintf("invalid hello: %v", err))
+		return
+	}
+	ac.completeHandshake(&hello)
+}
+
+// completeHandshake admits or rejects the agent once, from its hello or as
+// a legacy agent when hello is nil. Admitted agents become routable.
+func (ac *AgentConnection) completeHandshake(hello *agentproto.HelloPayload) {
+	ac.mutex.Lock()
+	if ac.handshake != nil || ac.Status != StatusHandshaking {
+		ac.mutex.Unlock()
+		return
+	}
+
+	result := negotiate(hello, ac.codec)
+	if result.protocolVersion < ac.policy.MinProtocolVersion {
+		ac.mutex.Unlock()
+		ac.reject(fmt.Sprintf("protocol version %d is below the minimum %d", result.protocolVersion, ac.policy.MinProtocolVersion))
+		return
+	}
+
+	ac.handshake = result
+	ac.Status = StatusConnected
+	ac.mutex.Unlock()
+
+	if hello != nil {
+		ac.Send(ac.ctx, agentproto.NewMessage(agentproto.MessageTypeWelcome, "", agentproto.WelcomePayload{
+			ProtocolVersion: result.protocolVersion,
+			Capabilities:    result.capabilityList(),
+		}))
+	}
+
+	ac.logger.Info("Agent handshake completed",
+		"agent_id", ac.AgentID,
+		"protocol_version", result.protocolVersion,
+		"agent_version", result.agentVersion,
+		"capabilities", result.capabilityList())
+
+	if ac.onReady != nil {
+		ac.onReady()
+	}
+}
+
+// reject closes the socket with a policy violation the agent can read
+func (ac *AgentConnection) reject(reason string) {
+	ac.logger.Error("Agent rejected", "agent_id", ac.AgentID, "reason", reason)
+	ac.closeWith(websocket.ClosePolicyViolation, reason)
+}
+
+func (ac *AgentConnection) handshaking() bool {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.Status == StatusHandshaking
+}
+
+// awaitHello treats an agent that stays silent past the policy timeout as a
+// legacy agent
+func (ac *AgentConnection) awaitHello() {
+	timer := time.NewTimer(ac.policy.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		ac.completeHandshake(nil)
+	case <-ac.done:
+	}
+}
+
+// ProtocolVersion is the negotiated protocol version, 0 during the handshake
+func (ac *AgentConnection) ProtocolVersion() int {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	if ac.handshake == nil {
+		return 0
+	}
+	return ac.handshake.protocolVersion
+}
+
+// AgentVersion is the software version the agent reported in its hello
+func (ac *AgentConnection) AgentVersion() string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	if ac.handshake == nil {
+		return ""
+	}
+	return ac.handshake.agentVersion
+}
+
+// Capabilities lists the negotiated capabilities in sorted order
+func (ac *AgentConnection) Capabilities() []string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	if ac.handshake == nil {
+		return nil
+	}
+	return ac.handshake.capabilityList()
+}
+
+// Supports reports whether a capability was negotiated with the agent
+func (ac *AgentConnection) Supports(capability string) bool {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.handshake != nil && ac.handshake.capabilities[capability]
+}
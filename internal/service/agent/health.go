@@ -0,0 +1,467 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// healthBuckets splits the health window so old outcomes age out in steps
+const healthBuckets = 10
+
+// maxLatencySamples bounds the latencies kept per agent for percentiles
+const maxLatencySamples = 512
+
+// latencyCheckInterval spaces the latency percentile checks, which sort the
+// samples
+const latencyCheckInterval = time.Second
+
+// Health states of an agent
+const (
+	HealthHealthy = "healthy"
+	HealthEjected = "ejected"
+)
+
+// HealthPolicy decides when an agent is taken out of routing because of the
+// traffic it served. Thresholds of zero or less are not checked.
+type HealthPolicy struct {
+	// Window is how far back error rate, timeout rate and latency look
+	Window time.Duration
+	// MinRequests in the window are needed before an agent is judged
+	MinRequests int
+	// MaxErrorRate is the share of requests that failed in the agent or
+	// came back 502, 503 or 504
+	MaxErrorRate float64
+	// MaxTimeoutRate is the share of requests that ran past their deadline
+	MaxTimeoutRate float64
+	// MaxLatencyP99 is the highest tolerated 99th percentile latency
+	MaxLatencyP99 time.Duration
+	// BaseEjection is how long the first ejection lasts; every further one
+	// in a row doubles it, up to MaxEjection
+	BaseEjection time.Duration
+	MaxEjection  time.Duration
+	// MaxEjectedPercent caps the share of a customer's agents ejected at
+	// once, so a customer-wide outage does not empty the routing pool
+	MaxEjectedPercent int
+}
+
+// DefaultHealthPolicy ejects agents failing or timing out on half of at
+// least 20 requests a minute
+func DefaultHealthPolicy() HealthPolicy {
+	return HealthPolicy{
+		Window:            time.Minute,
+		MinRequests:       20,
+		MaxErrorRate:      0.5,
+		MaxTimeoutRate:    0.5,
+		BaseEjection:      30 * time.Second,
+		MaxEjection:       5 * time.Minute,
+		MaxEjectedPercent: 50,
+	}
+}
+
+// AgentHealth is the health of one connected agent as judged from the
+// requests it served in the health window
+type AgentHealth struct {
+	AgentID    string `json:"agent_id"`
+	CustomerID string `json:"customer_id"`
+	Status     string `json:"status"`
+	// Score runs from 100 for a flawless agent down to 0; ejected agents
+	// score 0
+	Score        float64    `json:"score"`
+	Requests     int        `json:"requests"`
+	ErrorRate    float64    `json:"error_rate"`
+	TimeoutRate  float64    `json:"timeout_rate"`
+	LatencyP50   float64    `json:"latency_p50_ms"`
+	LatencyP90   float64    `json:"latency_p90_ms"`
+	LatencyP99   float64    `json:"latency_p99_ms"`
+	Ejections    int        `json:"ejections"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+}
+
+// Outcomes of a proxied request as far as agent health goes
+type outcome int
+
+const (
+	outcomeIgnored outcome = iota
+	outcomeSuccess
+	outcomeError
+	outcomeTimeout
+)
+
+// classifyOutcome judges a request routed to an agent. Requests the client
+// gave up on say nothing about the agent.
+func classifyOutcome(response *ProxyResponse, err error) outcome {
+	switch {
+	case err == nil && response != nil:
+		switch response.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return outcomeError
+		}
+		return outcomeSuccess
+	case errors.Is(err, context.DeadlineExceeded):
+		return outcomeTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrAgentDraining):
+		return outcomeIgnored
+	default:
+		return outcomeError
+	}
+}
+
+type healthBucket struct {
+	start    time.Time
+	requests int
+	errors   int
+	timeouts int
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// healthTracker keeps the rolling outcomes and ejection state of one
+// connection
+type healthTracker struct {
+	mu            sync.Mutex
+	buckets       [healthBuckets]healthBucket
+	samples       []latencySample // ring of the latest latencies
+	nextSample    int
+	latencyTooBad bool
+	latencyAt     time.Time // when latencyTooBad was last worked out
+
+	ejectedUntil time.Time
+	ejections    int       // ejections in a row, doubling each one
+	readmittedAt time.Time // when the last ejection ended
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{samples: make([]latencySample, 0, maxLatencySamples)}
+}
+
+// bucket returns the bucket for now, recycling the one it replaces
+func (h *healthTracker) bucket(now time.Time, policy HealthPolicy) *healthBucket {
+	width := policy.Window / healthBuckets
+	if width <= 0 {
+		width = time.Second
+	}
+	start := now.Truncate(width)
+	b := &h.buckets[int(start.UnixNano()/int64(width))%healthBuckets]
+	if !b.start.Equal(start) {
+		*b = healthBucket{start: start}
+	}
+	return b
+}
+
+// record adds an outcome and reports whether the agent now breaks the
+// policy and should be ejected
+func (h *healthTracker) record(now time.Time, result outcome, latency time.Duration, policy HealthPolicy) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b := h.bucket(now, policy)
+	b.requests++
+	switch result {
+	case outcomeError:
+		b.errors++
+	case outcomeTimeout:
+		b.timeouts++
+	}
+	if result != outcomeTimeout {
+		sample := latencySample{at: now, latency: latency}
+		if len(h.samples) < maxLatencySamples {
+			h.samples = append(h.samples, sample)
+		} else {
+			h.samples[h.nextSample] = sample
+			h.nextSample = (h.nextSample + 1) % maxLatencySamples
+		}
+	}
+
+	if now.Before(h.ejectedUntil) {
+		return false
+	}
+	requests, errorCount, timeouts := h.totals(now, policy)
+	if requests < policy.MinRequests || requests == 0 {
+		return false
+	}
+	if policy.MaxErrorRate > 0 && float64(errorCount)/float64(requests) > policy.MaxErrorRate {
+		return true
+	}
+	if policy.MaxTimeoutRate > 0 && float64(timeouts)/float64(requests) > policy.MaxTimeoutRate {
+		return true
+	}
+	if policy.MaxLatencyP99 > 0 {
+		if now.Sub(h.latencyAt) >= latencyCheckInterval {
+			h.latencyAt = now
+			h.latencyTooBad = percentile(h.latencies(now, policy), 0.99) > policy.MaxLatencyP99
+		}
+		return h.latencyTooBad
+	}
+	return false
+}
+
+// totals sums the buckets inside the window; h.mu must be held
+func (h *healthTracker) totals(now time.Time, policy HealthPolicy) (requests, errorCount, timeouts int) {
+	for _, b := range h.buckets {
+		if now.Sub(b.start) < policy.Window {
+			requests += b.requests
+			errorCount += b.errors
+			timeouts += b.timeouts
+		}
+	}
+	return requests, errorCount, timeouts
+}
+
+// latencies returns the sorted latencies inside the window; h.mu must be held
+func (h *healthTracker) latencies(now time.Time, policy HealthPolicy) []time.Duration {
+	latencies := make([]time.Duration, 0, len(h.samples))
+	for _, sample := range h.samples {
+		if now.Sub(sample.at) < policy.Window {
+			latencies = append(latencies, sample.latency)
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies
+}
+
+// percentile of sorted latencies, 0 when there are none
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1)+0.5)]
+}
+
+// eject takes the agent out of routing and returns for how long. Agents
+// that stayed healthy for MaxEjection since their last ejection start over
+// at BaseEjection.
+func (h *healthTracker) eject(now time.Time, policy HealthPolicy) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.readmittedAt.IsZero() && now.Sub(h.readmittedAt) > policy.MaxEjection {
+		h.ejections = 0
+	}
+	duration := policy.BaseEjection
+	for i := 0; i < h.ejections && duration < policy.MaxEjection; i++ {
+		duration *= 2
+	}
+	if duration > policy.MaxEjection {
+		duration = policy.MaxEjection
+	}
+
+	h.ejections++
+	h.ejectedUntil = now.Add(duration)
+	return duration
+}
+
+// readmit ends an ejection and forgets the outcomes that caused it, so the
+// agent is judged on what it does from now on
+func (h *healthTracker) readmit(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.ejectedUntil = time.Time{}
+	h.readmittedAt = now
+	h.buckets = [healthBuckets]healthBucket{}
+	h.samples = h.samples[:0]
+	h.nextSample = 0
+	h.latencyTooBad = false
+}
+
+func (h *healthTracker) ejected(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return now.Before(h.ejectedUntil)
+}
+
+// snapshot works out the health of the agent
+func (h *healthTracker) snapshot(now time.Time, policy HealthPolicy) AgentHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	health := AgentHealth{Status: HealthHealthy, Ejections: h.ejections}
+	requests, errorCount, timeouts := h.totals(now, policy)
+	health.Requests = requests
+	if requests > 0 {
+		health.ErrorRate = float64(errorCount) / float64(requests)
+		health.TimeoutRate = float64(timeouts) / float64(requests)
+	}
+	latencies := h.latencies(now, policy)
+	p99 := percentile(latencies, 0.99)
+	health.LatencyP50 = milliseconds(percentile(latencies, 0.5))
+	health.LatencyP90 = milliseconds(percentile(latencies, 0.9))
+	health.LatencyP99 = milliseconds(p99)
+
+	health.Score = 100 * (1 - health.ErrorRate) * (1 - health.TimeoutRate)
+	if policy.MaxLatencyP99 > 0 && p99 > policy.MaxLatencyP99 {
+		health.Score *= float64(policy.MaxLatencyP99) / float64(p99)
+	}
+	if now.Before(h.ejectedUntil) {
+		until := h.ejectedUntil
+		health.Status = HealthEjected
+		health.EjectedUntil = &until
+		health.Score = 0
+	}
+	return health
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// SetHealthPolicy sets when agents are ejected from routing. Zero values keep
+// the defaults; a negative threshold turns its check off.
+func (am *AgentManager) SetHealthPolicy(policy HealthPolicy) {
+	defaults := DefaultHealthPolicy()
+	if policy.MaxErrorRate == 0 {
+		policy.MaxErrorRate = defaults.MaxErrorRate
+	}
+	if policy.MaxTimeoutRate == 0 {
+		policy.MaxTimeoutRate = defaults.MaxTimeoutRate
+	}
+	if policy.Window <= 0 {
+		policy.Window = defaults.Window
+	}
+	if policy.MinRequests <= 0 {
+		policy.MinRequests = defaults.MinRequests
+	}
+	if policy.BaseEjection <= 0 {
+		policy.BaseEjection = defaults.BaseEjection
+	}
+	if policy.MaxEjection < policy.BaseEjection {
+		policy.MaxEjection = max(defaults.MaxEjection, policy.BaseEjection)
+	}
+	if policy.MaxEjectedPercent <= 0 {
+		policy.MaxEjectedPercent = defaults.MaxEjectedPercent
+	}
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	am.healthPolicy = policy
+}
+
+func (am *AgentManager) currentHealthPolicy() HealthPolicy {
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	return am.healthPolicy
+}
+
+// observeOutcome feeds a routed request into the agent's health and ejects
+// the agent once it breaks the policy
+func (am *AgentManager) observeOutcome(conn *AgentConnection, response *ProxyResponse, err error, latency time.Duration) {
+	result := classifyOutcome(response, err)
+	if result == outcomeIgnored {
+		return
+	}
+	if conn.health.record(time.Now(), result, latency, am.currentHealthPolicy()) {
+		am.eject(conn)
+	}
+}
+
+// eject takes an agent out of its customer's routing pool for a while,
+// unless that would eject more of the customer's agents than allowed
+func (am *AgentManager) eject(conn *AgentConnection) {
+	policy := am.currentHealthPolicy()
+	now := time.Now()
+
+	am.mutex.Lock()
+	if current, exists := am.connections[conn.AgentID]; !exists || current != conn {
+		am.mutex.Unlock()
+		return
+	}
+	total, ejected := 0, 0
+	for _, candidate := range am.connections {
+		if candidate.CustomerID != conn.CustomerID || candidate.status() != StatusConnected {
+			continue
+		}
+		total++
+		if candidate.health.ejected(now) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > total*policy.MaxEjectedPercent {
+		am.mutex.Unlock()
+		return
+	}
+
+	duration := conn.health.eject(now, policy)
+	am.notifyRouting(conn.CustomerID)
+	am.mutex.Unlock()
+
+	am.logger.Warn("Ejected unhealthy agent from routing",
+		zap.String("agent_id", conn.AgentID),
+		zap.String("customer_id", conn.CustomerID),
+		zap.Duration("duration", duration))
+	am.metrics.RecordAgentEjection(conn.CustomerID, conn.AgentID)
+	am.publishHealth(conn)
+
+	time.AfterFunc(duration, func() { am.readmit(conn) })
+}
+
+// readmit returns an ejected agent to routing
+func (am *AgentManager) readmit(conn *AgentConnection) {
+	conn.health.readmit(time.Now())
+
+	am.mutex.Lock()
+	current, exists := am.connections[conn.AgentID]
+	if exists && current == conn {
+		am.notifyRouting(conn.CustomerID)
+	}
+	am.mutex.Unlock()
+	if !exists || current != conn {
+		return
+	}
+
+	am.logger.Info("Readmitted agent to routing", "agent_id", conn.AgentID, "customer_id", conn.CustomerID)
+	am.publishHealth(conn)
+}
+
+// publishHealth updates the health gauges of a connected agent
+func (am *AgentManager) publishHealth(conn *AgentConnection) {
+	health := conn.health.snapshot(time.Now(), am.currentHealthPolicy())
+	am.metrics.UpdateAgentHealth(conn.CustomerID, conn.AgentID, health.Score, health.ErrorRate, health.TimeoutRate,
+		health.LatencyP99/1000, health.Status == HealthEjected)
+}
+
+// AgentHealth returns the health of a connected agent
+func (am *AgentManager) AgentHealth(agentID string) (*AgentHealth, bool) {
+	am.mutex.RLock()
+	conn, exists := am.connections[agentID]
+	am.mutex.RUnlock()
+	if !exists || conn.status() == StatusHandshaking {
+		return nil, false
+	}
+	return am.healthOf(conn), true
+}
+
+// CustomerHealth returns the health of the customer's connected agents,
+// ejected ones included, ordered by agent ID
+func (am *AgentManager) CustomerHealth(customerID string) []*AgentHealth {
+	am.mutex.RLock()
+	var connections []*AgentConnection
+	for _, conn := range am.connections {
+		if conn.CustomerID == customerID && conn.status() != StatusHandshaking {
+			connections = append(connections, conn)
+		}
+	}
+	am.mutex.RUnlock()
+
+	health := make([]*AgentHealth, 0, len(connections))
+	for _, conn := range connections {
+		health = append(health, am.healthOf(conn))
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].AgentID < health[j].AgentID })
+	return health
+}
+
+func (am *AgentManager) healthOf(conn *AgentConnection) *AgentHealth {
+	health := conn.health.snapshot(time.Now(), am.currentHealthPolicy())
+	health.AgentID = conn.AgentID
+	health.CustomerID = conn.CustomerID
+	return &health
+}
@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	agentLabelsChannel = "agent_labels"
+
+	// maxLabelLength bounds label keys and values
+	maxLabelLength = 63
+)
+
+var (
+	ErrInvalidLabels   = errors.New("label keys and values must be 1-63 letters, digits, '-', '_', '.' or '/'")
+	ErrInvalidSelector = errors.New("invalid agent selector")
+)
+
+// ValidateLabels checks that labels can be written in a selector
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !validLabelText(key) || !validLabelText(value) {
+			return fmt.Errorf("%w: %s=%s", ErrInvalidLabels, key, value)
+		}
+	}
+	return nil
+}
+
+func validLabelText(s string) bool {
+	if s == "" || len(s) > maxLabelLength {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Operators of a selector requirement
+const (
+	opEquals    = "="
+	opNotEquals = "!="
+	opExists    = "exists"
+	opNotExists = "!exists"
+)
+
+type requirement struct {
+	key      string
+	operator string
+	value    string
+}
+
+// Selector picks agents by their labels. It is written as comma separated
+// requirements, all of which must hold: "key=value", "key!=value", "key"
+// (the label is set) and "!key" (it is not). The empty selector matches
+// every agent.
+type Selector []requirement
+
+// ParseSelector reads a selector such as "region=eu,env!=staging"
+func ParseSelector(s string) (Selector, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var selector Selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var req requirement
+		switch {
+		case strings.Contains(part, "!="):
+			req.key, req.value, _ = strings.Cut(part, "!=")
+			req.operator = opNotEquals
+		case strings.Contains(part, "="):
+			req.key, req.value, _ = strings.Cut(part, "=")
+			req.value = strings.TrimPrefix(req.value, "=")
+			req.operator = opEquals
+		case strings.HasPrefix(part, "!"):
+			req.key = strings.TrimPrefix(part, "!")
+			req.operator = opNotExists
+		default:
+			req.key = part
+			req.operator = opExists
+		}
+
+		req.key, req.value = strings.TrimSpace(req.key), strings.TrimSpace(req.value)
+		if !validLabelText(req.key) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidSelector, part)
+		}
+		if (req.operator == opEquals || req.operator == opNotEquals) && !validLabelText(req.value) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidSelector, part)
+		}
+		selector = append(selector, req)
+	}
+	return selector, nil
+}
+
+// Empty reports whether the selector matches every agent
+func (s Selector) Empty() bool {
+	return len(s) == 0
+}
+
+// Matches reports whether labels satisfy every requirement
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, set := labels[req.key]
+		var ok bool
+		switch req.operator {
+		case opEquals:
+			ok = set && value == req.value
+		case opNotEquals:
+			ok = !set || value != req.value
+		case opExists:
+			ok = set
+		case opNotExists:
+			ok = !set
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	parts := make([]string, len(s))
+	for i, req := range s {
+		switch req.operator {
+		case opEquals, opNotEquals:
+			parts[i] = req.key + req.operator + req.value
+		case opExists:
+			parts[i] = req.key
+		case opNotExists:
+			parts[i] = "!" + req.key
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Labels returns the labels the agent is routed by. The map is replaced,
+// never modified, so callers must not change it.
+func (ac *AgentConnection) Labels() map[string]string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.labels
+}
+
+func (ac *AgentConnection) setLabels(labels map[string]string) {
+	ac.mutex.Lock()
+	ac.labels = labels
+	ac.mutex.Unlock()
+}
+
+// labels reads the labels of an agent from the store
+func (r *Registry) labels(ctx context.Context, agentID string) (map[string]string, error) {
+	agent, err := r.store.GetAgent(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+	return agent.Labels, nil
+}
+
+// announceLabels tells every replica to reload the labels of the agent
+func (r *Registry) announceLabels(ctx context.Context, agentID string) {
+	if r.cache == nil {
+		return
+	}
+	r.cache.Publish(ctx, agentLabelsChannel, agentID)
+}
+
+// relabeled delivers the agents whose labels changed on any replica until
+// ctx is done
+func (r *Registry) relabeled(ctx context.Context) (<-chan string, error) {
+	if r.cache == nil {
+		return nil, nil
+	}
+	messages, err := r.cache.Subscribe(ctx, agentLabelsChannel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to agent labels: %w", err)
+	}
+	return messages, nil
+}
+
+// agentLabels reads the labels an agent connects with. Agents unknown to
+// the registry, or connecting while it cannot be read, carry none.
+func (am *AgentManager) agentLabels(agentID string) map[string]string {
+	registry := am.Registry()
+	if registry == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	labels, err := registry.labels(ctx, agentID)
+	if err != nil {
+		am.logger.Error("Failed to read agent labels", "error", err, "agent_id", agentID)
+		return nil
+	}
+	return labels
+}
+
+// reloadLabels applies changed labels to the agent's connection here, if
+// any; requests are routed by the new labels from then on
+func (am *AgentManager) reloadLabels(agentID string) {
+	am.mutex.RLock()
+	conn, exists := am.connections[agentID]
+	am.mutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	conn.setLabels(am.agentLabels(agentID))
+	am.publishLabels(conn)
+}
+
+// What happens when no agent matches a selector
+const (
+	// SelectorFallbackReject fails the request; it is the default
+	SelectorFallbackReject = "reject"
+	// SelectorFallbackAny routes to any agent of the customer
+	SelectorFallbackAny = "any"
+)
+
+// ValidSelectorFallback reports whether fallback is empty or a known value
+func ValidSelectorFallback(fallback string) bool {
+	return fallback == "" || fallback == SelectorFallbackReject || fallback == SelectorFallbackAny
+}
@@ -0,0 +1,393 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/repository"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	AgentStatusActive   = "active"
+	AgentStatusDisabled = "disabled"
+
+	agentDisabledChannel = "agent_disabled"
+
+	// lastSeenInterval spaces the LastSeen writes heartbeats cause
+	lastSeenInterval = time.Minute
+)
+
+var (
+	ErrNoRegistry    = errors.New("agent registry is not available")
+	ErrAgentNotFound = errors.New("agent not found")
+	ErrAgentExists   = errors.New("agent already exists")
+	ErrInvalidStatus = errors.New("agent status must be active or disabled")
+)
+
+// AgentStore persists agents; repository.AgentRepository implements it.
+// Lookups of unknown agents fail with repository.ErrNotFound.
+type AgentStore interface {
+	CreateAgent(ctx context.Context, agent *models.Agent) error
+	GetAgent(ctx context.Context, agentID string) (*models.Agent, error)
+	GetAgentsByCustomer(ctx context.Context, customerID string) ([]*models.Agent, error)
+	UpdateAgentDetails(ctx context.Context, agent *models.Agent) error
+	UpdateAgentStatus(ctx context.Context, agentID, status string) error
+	RecordConnect(ctx context.Context, agentID, status, version string, at time.Time) error
+	UpdateConnectionStatus(ctx context.Context, agentID, status string, at time.Time) error
+	TouchAgent(ctx context.Context, agentID string, at time.Time) error
+	DeleteAgent(ctx context.Context, agentID string) error
+}
+
+// Registry manages the agents customers have set up. Disabling or deleting
+// an agent disconnects it on every replica, announced through Redis.
+type Registry struct {
+	store AgentStore
+	cache *cache.RedisCache
+
+	mutex    sync.Mutex
+	lastSeen map[string]time.Time // when LastSeen was last written per agent
+}
+
+func NewRegistry(store AgentStore, cache *cache.RedisCache) *Registry {
+	return &Registry{
+		store:    store,
+		cache:    cache,
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+// Create sets up a new agent for the customer, generating its ID when it
+// has none
+func (r *Registry) Create(ctx context.Context, customerID string, agent *models.Agent) (*models.Agent, error) {
+	if agent.ID == "" {
+		agent.ID = agentproto.NewRequestID()
+	}
+	if agent.Status == "" {
+		agent.Status = AgentStatusActive
+	}
+	if agent.Status != AgentStatusActive && agent.Status != AgentStatusDisabled {
+		return nil, ErrInvalidStatus
+	}
+	if err := ValidateLabels(agent.Labels); err != nil {
+		return nil, err
+	}
+	agent.CustomerID = customerID
+	agent.ConnectionStatus = StatusDisconnected
+	agent.Version = ""
+	agent.LastSeen = time.Time{}
+	agent.LastConnected = time.Time{}
+
+	err := r.store.CreateAgent(ctx, agent)
+	if errors.Is(err, repository.ErrAlreadyExists) {
+		return nil, ErrAgentExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create agent: %w", err)
+	}
+	return agent, nil
+}
+
+// Get returns an agent of the customer
+func (r *Registry) Get(ctx context.Context, customerID, agentID string) (*models.Agent, error) {
+	agent, err := r.store.GetAgent(ctx, agentID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrAgentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent: %w", err)
+	}
+	// Agents of other customers do not exist as far as the caller knows
+	if agent.CustomerID != customerID {
+		return nil, ErrAgentNotFound
+	}
+	return agent, nil
+}
+
+func (r *Registry) List(ctx context.Context, customerID string) ([]*models.Agent, error) {
+	agents, err := r.store.GetAgentsByCustomer(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list agents: %w", err)
+	}
+	if agents == nil {
+		agents = []*models.Agent{}
+	}
+	return agents, nil
+}
+
+// Update replaces the name, metadata, permissions and labels of an agent.
+// Changed labels apply to its live connection at once.
+func (r *Registry) Update(ctx context.Context, customerID, agentID string, changes *models.Agent) (*models.Agent, error) {
+	if err := ValidateLabels(changes.Labels); err != nil {
+		return nil, err
+	}
+	agent, err := r.Get(ctx, customerID, agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	relabeled := !maps.Equal(agent.Labels, changes.Labels)
+	agent.Name = changes.Name
+	agent.Metadata = changes.Metadata
+	agent.Permissions = changes.Permissions
+	agent.Labels = changes.Labels
+	if err := r.store.UpdateAgentDetails(ctx, agent); err != nil {
+		return nil, r.storeError(err)
+	}
+	if relabeled {
+		r.announceLabels(ctx, agentID)
+	}
+	return r.Get(ctx, customerID, agentID)
+}
+
+// SetStatus enables or disables an agent. A disabled agent is disconnected
+// and cannot connect again until it is enabled.
+func (r *Registry) SetStatus(ctx context.Context, customerID, agentID, status string) (*models.Agent, error) {
+	if status != AgentStatusActive && status != AgentStatusDisabled {
+		return nil, ErrInvalidStatus
+	}
+	if _, err := r.Get(ctx, customerID, agentID); err != nil {
+		return nil, err
+	}
+
+	if err := r.store.UpdateAgentStatus(ctx, agentID, status); err != nil {
+		return nil, r.storeError(err)
+	}
+	if status == AgentStatusDisabled {
+		r.announceDisabled(ctx, agentID)
+	}
+	return r.Get(ctx, customerID, agentID)
+}
+
+// Delete removes an agent and disconnects it
+func (r *Registry) Delete(ctx context.Context, customerID, agentID string) error {
+	if _, err := r.Get(ctx, customerID, agentID); err != nil {
+		return err
+	}
+	if err := r.store.DeleteAgent(ctx, agentID); err != nil {
+		return r.storeError(err)
+	}
+
+	r.mutex.Lock()
+	delete(r.lastSeen, agentID)
+	r.mutex.Unlock()
+
+	r.announceDisabled(ctx, agentID)
+	return nil
+}
+
+// recordConnect persists that the agent completed its handshake
+func (r *Registry) recordConnect(ctx context.Context, conn *AgentConnection) error {
+	now := time.Now()
+	r.mutex.Lock()
+	r.lastSeen[conn.AgentID] = now
+	r.mutex.Unlock()
+
+	return r.store.RecordConnect(ctx, conn.AgentID, StatusConnected, conn.AgentVersion(), now)
+}
+
+// recordStatus persists a later change of the agent's connection
+func (r *Registry) recordStatus(ctx context.Context, agentID, status string) error {
+	now := time.Now()
+	r.mutex.Lock()
+	if status == StatusDisconnected {
+		delete(r.lastSeen, agentID)
+	} else {
+		r.lastSeen[agentID] = now
+	}
+	r.mutex.Unlock()
+
+	return r.store.UpdateConnectionStatus(ctx, agentID, status, now)
+}
+
+// recordSeen persists LastSeen, at most once every lastSeenInterval
+func (r *Registry) recordSeen(ctx context.Context, agentID string) error {
+	now := time.Now()
+	r.mutex.Lock()
+	if now.Sub(r.lastSeen[agentID]) < lastSeenInterval {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.lastSeen[agentID] = now
+	r.mutex.Unlock()
+
+	return r.store.TouchAgent(ctx, agentID, now)
+}
+
+// announceDisabled tells every replica to disconnect the agent. The agent is
+// refused when it reconnects either way, so a failure is only logged by the
+// replicas that miss it.
+func (r *Registry) announceDisabled(ctx context.Context, agentID string) {
+	if r.cache == nil {
+		return
+	}
+	r.cache.Publish(ctx, agentDisabledChannel, agentID)
+}
+
+// disabled delivers the agents disabled on any replica until ctx is done
+func (r *Registry) disabled(ctx context.Context) (<-chan string, error) {
+	if r.cache == nil {
+		return nil, nil
+	}
+	messages, err := r.cache.Subscribe(ctx, agentDisabledChannel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to disabled agents: %w", err)
+	}
+	return messages, nil
+}
+
+func (r *Registry) storeError(err error) error {
+	if errors.Is(err, repository.ErrNotFound) {
+		return ErrAgentNotFound
+	}
+	return fmt.Errorf("failed to update agent: %w", err)
+}
+
+// SetRegistry persists the connection status of agents, routes them by
+// their labels and disconnects agents disabled or deleted on any replica. It
+// must be set before agents are registered.
+func (am *AgentManager) SetRegistry(registry *Registry) {
+	am.mutex.Lock()
+	am.registry = registry
+	am.mutex.Unlock()
+
+	disabled, err := registry.disabled(am.ctx)
+	if err != nil {
+		am.logger.Error("Disabled agents will only be disconnected on this replica", "error", err)
+	} else if disabled != nil {
+		go func() {
+			for agentID := range disabled {
+				am.closeDisabled(agentID)
+			}
+		}()
+	}
+
+	relabeled, err := registry.relabeled(am.ctx)
+	if err != nil {
+		am.logger.Error("Label changes will only apply once agents reconnect", "error", err)
+	} else if relabeled != nil {
+		go func() {
+			for agentID := range relabeled {
+				am.reloadLabels(agentID)
+			}
+		}()
+	}
+}
+
+// Registry returns the agent registry, or nil when none is set
+func (am *AgentManager) Registry() *Registry {
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	return am.registry
+}
+
+// DisableAgent disables or deletes an agent and closes its session here
+// at once; other replicas close theirs when the announcement reaches them.
+// Deleting an agent also deletes its credentials.
+func (am *AgentManager) DisableAgent(ctx context.Context, customerID, agentID string, remove bool) error {
+	registry := am.Registry()
+	if registry == nil {
+		return ErrNoRegistry
+	}
+
+	var err error
+	if remove {
+		err = registry.Delete(ctx, customerID, agentID)
+	} else {
+		_, err = registry.SetStatus(ctx, customerID, agentID, AgentStatusDisabled)
+	}
+	if err != nil {
+		return err
+	}
+
+	am.closeDisabled(agentID)
+
+	// A deleted agent's credentials go with it, or an agent created again
+	// with the same ID would still count as enrolled
+	if store := am.Credentials(); remove && store != nil {
+		if err := store.Forget(ctx, agentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (am *AgentManager) closeDisabled(agentID string) {
+	am.mutex.RLock()
+	conn, exists := am.connections[agentID]
+	am.mutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	am.logger.Info("Closing session of disabled agent", "agent_id", agentID)
+	conn.setDisconnectReason(DisconnectDisabled)
+	conn.closeWith(websocket.ClosePolicyViolation, "agent disabled")
+}
+
+// recordConnect persists that an agent was admitted
+func (am *AgentManager) recordConnect(conn *AgentConnection) {
+	registry := am.Registry()
+	if registry == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if err := registry.recordConnect(ctx, conn); err != nil {
+		am.logger.Error("Failed to record agent connection", "error", err, "agent_id", conn.AgentID)
+	}
+}
+
+// recordDisconnect persists that an agent went away, unless a newer
+// connection of the same agent has taken its place
+func (am *AgentManager) recordDisconnect(conn *AgentConnection) {
+	registry := am.Registry()
+	if registry == nil {
+		return
+	}
+
+	am.mutex.RLock()
+	_, replaced := am.connections[conn.AgentID]
+	am.mutex.RUnlock()
+	if replaced {
+		return
+	}
+
+	am.recordStatus(conn.AgentID, StatusDisconnected)
+}
+
+func (am *AgentManager) recordStatus(agentID, status string) {
+	registry := am.Registry()
+	if registry == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if err := registry.recordStatus(ctx, agentID, status); err != nil {
+		am.logger.Error("Failed to record agent status", "error", err, "agent_id", agentID, "status", status)
+	}
+}
+
+// RecordSeen persists that the agent was heard from
+func (am *AgentManager) RecordSeen(conn *AgentConnection) {
+	registry := am.Registry()
+	if registry == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if err := registry.recordSeen(ctx, conn.AgentID); err != nil {
+		am.logger.Error("Failed to record agent last seen", "error", err, "agent_id", conn.AgentID)
+	}
+}
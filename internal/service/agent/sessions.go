@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/repository"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reasons a session ended. The first one recorded for a connection wins, so
+// the server closing a socket is not reported as the agent going away.
+const (
+	// DisconnectHeartbeatTimeout is an agent that stopped answering pings
+	DisconnectHeartbeatTimeout = "heartbeat_timeout"
+	// DisconnectTakeover is a session replaced by a newer connection with the
+	// same agent ID
+	DisconnectTakeover = "takeover"
+	// DisconnectShutdown is a session ended by the replica draining or
+	// shutting down
+	DisconnectShutdown = "server_shutdown"
+	// DisconnectClientClose is an agent that closed the connection itself
+	DisconnectClientClose = "client_close"
+	// DisconnectConnectionLost is a socket that failed without a close frame
+	DisconnectConnectionLost = "connection_lost"
+	// DisconnectDisabled is an agent disabled or deleted by an operator
+	DisconnectDisabled = "disabled"
+	// DisconnectDeregistered is an agent deregistered through the API
+	DisconnectDeregistered = "deregistered"
+)
+
+const (
+	DefaultSessionPageSize = 50
+	MaxSessionPageSize     = 500
+)
+
+var (
+	ErrNoSessionHistory   = errors.New("agent session history is not available")
+	ErrInvalidSessionPage = fmt.Errorf("page must be positive and page size at most %d", MaxSessionPageSize)
+)
+
+// SessionStore persists agent sessions; repository.SessionRepository
+// implements it. Ending a session that is unknown or already ended fails
+// with repository.ErrNotFound.
+type SessionStore interface {
+	CreateSession(ctx context.Context, session *models.AgentSession) error
+	EndSession(ctx context.Context, session *models.AgentSession) error
+	ListSessions(ctx context.Context, query models.AgentSessionQuery) ([]*models.AgentSession, int64, error)
+}
+
+// SessionHistory records every agent session, so it can be told later when
+// and why an agent was offline
+type SessionHistory struct {
+	store SessionStore
+}
+
+func NewSessionHistory(store SessionStore) *SessionHistory {
+	return &SessionHistory{store: store}
+}
+
+// List returns a page of the customer's sessions, newest first. A zero page
+// or page size picks the first page or the default size.
+func (h *SessionHistory) List(ctx context.Context, query models.AgentSessionQuery) (*models.AgentSessionPage, error) {
+	if query.Page == 0 {
+		query.Page = 1
+	}
+	if query.PageSize == 0 {
+		query.PageSize = DefaultSessionPageSize
+	}
+	if query.Page < 0 || query.PageSize < 0 || query.PageSize > MaxSessionPageSize {
+		return nil, ErrInvalidSessionPage
+	}
+
+	sessions, total, err := h.store.ListSessions(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	if sessions == nil {
+		sessions = []*models.AgentSession{}
+	}
+	return &models.AgentSessionPage{
+		Sessions: sessions,
+		Page:     query.Page,
+		PageSize: query.PageSize,
+		Total:    total,
+	}, nil
+}
+
+// SetSessionHistory records agent sessions in history. It must be set before
+// agents are registered.
+func (am *AgentManager) SetSessionHistory(history *SessionHistory) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	am.sessions = history
+}
+
+// SessionHistory returns the session history, or nil when none is set
+func (am *AgentManager) SessionHistory() *SessionHistory {
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	return am.sessions
+}
+
+// recordSessionStart persists a session once the agent has been admitted
+func (am *AgentManager) recordSessionStart(conn *AgentConnection) {
+	am.mutex.RLock()
+	history, directory := am.sessions, am.directory
+	am.mutex.RUnlock()
+	if history == nil {
+		return
+	}
+
+	session := &models.AgentSession{
+		ID:              conn.id,
+		CustomerID:      conn.CustomerID,
+		AgentID:         conn.AgentID,
+		RemoteAddr:      conn.remoteAddr,
+		AgentVersion:    conn.AgentVersion(),
+		ProtocolVersion: conn.ProtocolVersion(),
+		ConnectedAt:     conn.connectedAt,
+	}
+	if directory != nil {
+		session.ReplicaID = directory.Replica().ID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if err := history.store.CreateSession(ctx, session); err != nil {
+		am.logger.Error("Failed to record agent session", "error", err, "agent_id", conn.AgentID)
+	}
+}
+
+// recordSessionEnd persists how a session ended. Agents that were never
+// admitted have no session to end.
+func (am *AgentManager) recordSessionEnd(conn *AgentConnection) {
+	history := am.SessionHistory()
+	if history == nil {
+		return
+	}
+
+	disconnectedAt := time.Now()
+	session := &models.AgentSession{
+		ID:               conn.id,
+		DisconnectedAt:   &disconnectedAt,
+		DisconnectReason: conn.disconnectReason(),
+		RequestsServed:   conn.served.Load(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	err := history.store.EndSession(ctx, session)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		am.logger.Error("Failed to record end of agent session", "error", err, "agent_id", conn.AgentID)
+	}
+}
+
+// WithRemoteAddr records the address an agent connected from, for
+// RegisterAgent. Without it the socket's peer address is used.
+func WithRemoteAddr(ctx context.Context, remoteAddr string) context.Context {
+	return context.WithValue(ctx, remoteAddrKey{}, remoteAddr)
+}
+
+type remoteAddrKey struct{}
+
+func remoteAddrFromContext(ctx context.Context) string {
+	remoteAddr, _ := ctx.Value(remoteAddrKey{}).(string)
+	return remoteAddr
+}
+
+// setDisconnectReason records why the connection is going away, unless a
+// reason was already recorded
+func (ac *AgentConnection) setDisconnectReason(reason string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if ac.closeReason == "" {
+		ac.closeReason = reason
+	}
+}
+
+func (ac *AgentConnection) disconnectReason() string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.closeReason
+}
+
+// readFailure is the reason for a socket the reader lost. An abnormal
+// closure is what the websocket package reports for a socket that went away
+// without a close frame.
+func readFailure(err error) string {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+		return DisconnectClientClose
+	}
+	return DisconnectConnectionLost
+}
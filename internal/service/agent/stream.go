@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"proxy-service/pkg/agentproto"
+)
+
+var errStreamClosed = errors.New("body stream closed")
+
+// bodyStream is the per-request state shared by both body directions
+type bodyStream struct {
+	frames    chan *agentproto.BodyFrame // inbound frames from the agent
+	credits   chan struct{}              // outbound window, one token per data frame
+	uploaded  chan struct{}              // closed once the outbound body writer returns
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newBodyStream() *bodyStream {
+	return &bodyStream{
+		frames: make(chan *agentproto.BodyFrame, agentproto.StreamWindow+2),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *bodyStream) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+// openStream registers the per-request stream state. It stays registered
+// until the response has been fully consumed, which is what InFlight counts.
+func (ac *AgentConnection) openStream(requestID string, outbound bool) *bodyStream {
+	stream := newBodyStream()
+	if outbound {
+		stream.credits = make(chan struct{}, agentproto.StreamWindow)
+		for i := 0; i < agentproto.StreamWindow; i++ {
+			stream.credits <- struct{}{}
+		}
+	}
+
+	ac.pendingMu.Lock()
+	ac.streams[requestID] = stream
+	ac.pendingMu.Unlock()
+
+	return stream
+}
+
+func (ac *AgentConnection) closeStream(requestID string) {
+	ac.pendingMu.Lock()
+	stream, exists := ac.streams[requestID]
+	delete(ac.streams, requestID)
+	ac.pendingMu.Unlock()
+
+	if exists {
+		stream.close()
+	}
+}
+
+// finishStream closes the stream and waits for its body writer, so the
+// caller's request body is never read after the caller has moved on
+func (ac *AgentConnection) finishStream(requestID string, stream *bodyStream) {
+	ac.closeStream(requestID)
+	if stream.uploaded != nil {
+		<-stream.uploaded
+	}
+}
+
+// deliverBodyFrame routes a body_chunk message to its stream. It only blocks
+// when the agent ignores the window.
+func (ac *AgentConnection) deliverBodyFrame(msg *agentproto.WSMessage) {
+	ac.pendingMu.Lock()
+	stream, exists := ac.streams[msg.RequestID]
+	ac.pendingMu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	var frame agentproto.BodyFrame
+	if err := msg.Decode(&frame); err != nil {
+		ac.logger.Error("Failed to decode body frame",
+			"error", err,
+			"agent_id", ac.AgentID,
+			"request_id", msg.RequestID)
+		return
+	}
+
+	if frame.Frame == agentproto.BodyFrameAck {
+		for i := 0; i < frame.Count && stream.credits != nil; i++ {
+			select {
+			case stream.credits <- struct{}{}:
+			default:
+			}
+		}
+		return
+	}
+
+	select {
+	case stream.frames <- &frame:
+	case <-stream.closed:
+	case <-ac.done:
+	}
+}
+
+func (ac *AgentConnection) sendBodyFrame(ctx context.Context, requestID string, frame *agentproto.BodyFrame) error {
+	return ac.Send(ctx, agentproto.NewMessage(agentproto.MessageTypeBodyChunk, requestID, frame))
+}
+
+// writeBody streams body to the agent as start/data/end frames. trailers is
+// read only after body returns EOF, which is when net/http fills it in.
+func (ac *AgentConnection) writeBody(ctx context.Context, requestID string, stream *bodyStream, body io.Reader, size int64, trailers map[string][]string) error {
+	if err := ac.sendBodyFrame(ctx, requestID, &agentproto.BodyFrame{Frame: agentproto.BodyFrameStart, Size: size}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, agentproto.BodyChunkSize)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			// Wait until the agent has room for another chunk
+			select {
+			case <-stream.credits:
+			case <-stream.closed:
+				return errStreamClosed
+			case <-ac.done:
+				return ErrConnectionClosed
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := ac.sendBodyFrame(ctx, requestID, &agentproto.BodyFrame{Frame: agentproto.BodyFrameData, Data: data}); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return ac.sendBodyFrame(ctx, requestID, &agentproto.BodyFrame{Frame: agentproto.BodyFrameEnd, Trailers: trailers})
+		}
+		if readErr != nil {
+			ac.sendBodyFrame(ctx, requestID, &agentproto.BodyFrame{Frame: agentproto.BodyFrameEnd, Error: readErr.Error()})
+			return readErr
+		}
+	}
+}
+
+// bodyReader exposes an inbound streamed body as an io.ReadCloser
+type bodyReader struct {
+	ctx       context.Context
+	conn      *AgentConnection
+	requestID string
+	stream    *bodyStream
+	trailers  map[string][]string
+	buf       []byte
+	unacked   int
+	err       error
+}
+
+func (ac *AgentConnection) newBodyReader(ctx context.Context, requestID string, stream *bodyStream, trailers map[string][]string) *bodyReader {
+	return &bodyReader{
+		ctx:       ctx,
+		conn:      ac,
+		requestID: requestID,
+		stream:    stream,
+		trailers:  trailers,
+	}
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		select {
+		case frame := <-r.stream.frames:
+			switch frame.Frame {
+			case agentproto.BodyFrameData:
+				r.buf = frame.Data
+				r.ack()
+			case agentproto.BodyFrameEnd:
+				if frame.Error != "" {
+					r.err = fmt.Errorf("agent aborted body: %s", frame.Error)
+				} else {
+					for name, values := range frame.Trailers {
+						r.trailers[name] = values
+					}
+					r.err = io.EOF
+				}
+			}
+		case <-r.stream.closed:
+			r.err = errStreamClosed
+		case <-r.conn.done:
+			r.err = ErrConnectionClosed
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// ack returns credits in batches so acks cost far fewer frames than data
+func (r *bodyReader) ack() {
+	r.unacked++
+	if r.unacked < agentproto.StreamWindow/2 {
+		return
+	}
+
+	if err := r.conn.sendBodyFrame(r.ctx, r.requestID, &agentproto.BodyFrame{Frame: agentproto.BodyFrameAck, Count: r.unacked}); err == nil {
+		r.unacked = 0
+	}
+}
+
+// Close releases the stream; closing before EOF cancels the request so the
+// agent stops sending the rest of the body
+func (r *bodyReader) Close() error {
+	switch r.err {
+	case io.EOF, ErrConnectionClosed, errStreamClosed:
+	default:
+		r.conn.sendCancel(r.requestID, "response body closed")
+		r.err = errStreamClosed
+	}
+	r.conn.finishStream(r.requestID, r.stream)
+	return nil
+}
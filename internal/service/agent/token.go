@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy-service/pkg/agentproto"
+)
+
+// apiKeyTokenSkew tolerates agent clocks running ahead of the proxy for
+// tokens signed with the API key
+const apiKeyTokenSkew = 5 * time.Minute
+
+// VerifyToken checks a token signed with the customer's API key. The
+// signature is recomputed with the token's own timestamp, which must be no
+// older than maxAge, so it only matches when the agent knows the key.
+func VerifyToken(token, agentID, customerID, apiKey string, maxAge time.Duration) error {
+	issuedAt, err := tokenIssuedAt(token)
+	if err != nil {
+		return fmt.Errorf("invalid token format: %w", err)
+	}
+
+	now := time.Now()
+	if issuedAt.Add(maxAge).Before(now) {
+		return fmt.Errorf("invalid token format: token expired")
+	}
+	if issuedAt.After(now.Add(apiKeyTokenSkew)) {
+		return fmt.Errorf("invalid token format: token issued in the future")
+	}
+
+	expected := agentproto.SignToken(agentID, customerID, apiKey, issuedAt)
+	if !hmac.Equal([]byte(token), []byte(expected)) {
+		return fmt.Errorf("invalid token signature")
+	}
+	return nil
+}
+
+// tokenIssuedAt returns the time a token was signed at, without checking
+// its signature
+func tokenIssuedAt(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return time.Time{}, fmt.Errorf("invalid token format")
+	}
+
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp")
+	}
+	return time.Unix(timestamp, 0), nil
+}
+
+// IsConnectToken tells credential tokens from tokens signed with the
+// customer's API key
+func IsConnectToken(token string) bool {
+	return strings.Count(token, ".") == 3
+}
+
+// connectToken is a parsed connect token whose signature is still unchecked
+type connectToken struct {
+	credentialID string
+	issuedAt     time.Time
+	nonce        string
+}
+
+func parseConnectToken(token string) (*connectToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid token format")
+	}
+
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp")
+	}
+	return &connectToken{
+		credentialID: parts[0],
+		issuedAt:     time.Unix(timestamp, 0),
+		nonce:        parts[2],
+	}, nil
+}
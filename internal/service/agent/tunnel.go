@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"proxy-service/pkg/agentproto"
+)
+
+// Tunnel is a WebSocket relayed through an agent. It reuses the body stream
+// of the request that opened it, in both directions at once: every WebSocket
+// message is one data frame tagged with its message type, windowed and acked
+// exactly like a body, and closing the socket is an end frame carrying the
+// close code. A Tunnel may be read and written by one goroutine each.
+type Tunnel struct {
+	conn      *AgentConnection
+	requestID string
+	stream    *bodyStream
+	unacked   int
+	closeOnce sync.Once
+}
+
+func (ac *AgentConnection) newTunnel(requestID string, stream *bodyStream) *Tunnel {
+	return &Tunnel{
+		conn:      ac,
+		requestID: requestID,
+		stream:    stream,
+	}
+}
+
+// tunnelAccepted reports whether the agent's answer opened the tunnel: 101
+// for a WebSocket upgrade, any 2xx for CONNECT as in HTTP
+func tunnelAccepted(method string, status int) bool {
+	if method == http.MethodConnect {
+		return status >= 200 && status < 300
+	}
+	return status == http.StatusSwitchingProtocols
+}
+
+// ReadMessage returns the next message from the agent. Once the agent closes
+// the tunnel it returns a *websocket.CloseError with the upstream close code.
+func (t *Tunnel) ReadMessage() (int, []byte, error) {
+	for {
+		select {
+		case frame := <-t.stream.frames:
+			switch frame.Frame {
+			case agentproto.BodyFrameData:
+				t.ack()
+				return frame.MessageType, frame.Data, nil
+			case agentproto.BodyFrameEnd:
+				code := frame.CloseCode
+				if code == 0 {
+					code = websocket.CloseNoStatusReceived
+				}
+				return 0, nil, &websocket.CloseError{Code: code, Text: frame.CloseText}
+			}
+		case <-t.stream.closed:
+			return 0, nil, errStreamClosed
+		case <-t.conn.done:
+			return 0, nil, ErrConnectionClosed
+		}
+	}
+}
+
+func (t *Tunnel) ack() {
+	t.unacked++
+	if t.unacked < agentproto.StreamWindow/2 {
+		return
+	}
+
+	if err := t.conn.sendBodyFrame(context.Background(), t.requestID, &agentproto.BodyFrame{Frame: agentproto.BodyFrameAck, Count: t.unacked}); err == nil {
+		t.unacked = 0
+	}
+}
+
+// WriteMessage sends a text or binary message, waiting while the agent has
+// a full window of unacknowledged messages
+func (t *Tunnel) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-t.stream.credits:
+	case <-t.stream.closed:
+		return errStreamClosed
+	case <-t.conn.done:
+		return ErrConnectionClosed
+	}
+
+	return t.conn.sendBodyFrame(context.Background(), t.requestID, &agentproto.BodyFrame{
+		Frame:       agentproto.BodyFrameData,
+		MessageType: messageType,
+		Data:        data,
+	})
+}
+
+// Close tells the agent to close the upstream socket with code and reason,
+// then releases the tunnel. Only the first call has any effect.
+func (t *Tunnel) Close(code int, reason string) error {
+	var err error
+	t.closeOnce.Do(func() {
+		err = t.conn.sendBodyFrame(context.Background(), t.requestID, &agentproto.BodyFrame{
+			Frame:     agentproto.BodyFrameEnd,
+			CloseCode: code,
+			CloseText: reason,
+		})
+		t.conn.finishStream(t.requestID, t.stream)
+	})
+	if err == ErrConnectionClosed || err == errStreamClosed {
+		return nil
+	}
+	return err
+}
+
+// TunnelStream exposes a CONNECT tunnel as a plain byte stream. Writes are
+// split into binary messages of at most BodyChunkSize, and a normal close by
+// the agent reads as io.EOF.
+type TunnelStream struct {
+	tunnel *Tunnel
+	buf    []byte
+	err    error
+}
+
+// Stream returns the byte stream view of the tunnel
+func (t *Tunnel) Stream() *TunnelStream {
+	return &TunnelStream{tunnel: t}
+}
+
+func (s *TunnelStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		_, data, err := s.tunnel.ReadMessage()
+		if err != nil {
+			s.err = streamReadError(err)
+			continue
+		}
+		s.buf = data
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func streamReadError(err error) error {
+	if err == errStreamClosed {
+		return io.EOF
+	}
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		switch closeErr.Code {
+		case websocket.CloseNormalClosure, websocket.CloseNoStatusReceived:
+			return io.EOF
+		}
+	}
+	return err
+}
+
+func (s *TunnelStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + agentproto.BodyChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := s.tunnel.WriteMessage(websocket.BinaryMessage, p[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Close ends the connection; the agent closes its side towards the target
+func (s *TunnelStream) Close() error {
+	return s.tunnel.Close(websocket.CloseNormalClosure, "")
+}
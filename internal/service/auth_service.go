@@ -102,6 +102,12 @@ func (s *AuthService) VerifyToken(ctx context.Context, token string) (*jwt.Claim
 	return claims, nil
 }
 
+// GetCustomer returns the customer with the given ID, for the agent endpoint
+// to check the account of connecting agents
+func (s *AuthService) GetCustomer(ctx context.Context, customerID string) (*models.Customer, error) {
+	return s.repo.GetCustomer(ctx, customerID)
+}
+
 func (s *AuthService) IsRouteAllowed(ctx context.Context, customerID, route string) bool {
 	// Check route permissions in cache first
 	if allowed, exists := s.cache.GetRoutePermission(ctx, customerID, route); exists {
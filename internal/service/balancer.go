@@ -0,0 +1,155 @@
+package service
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+)
+
+// Load balancing strategies, selected per customer by ProxyConfig.LoadBalancing
+const (
+	StrategyRoundRobin     = "round_robin"
+	StrategyLeastInFlight  = "least_in_flight"
+	StrategyLatencyEWMA    = "latency_ewma"
+	StrategyConsistentHash = "consistent_hash"
+)
+
+// agentPool is the routing table entry of one customer. The agent list is
+// replaced, never modified, when agents come and go.
+type agentPool struct {
+	agents []*agent.AgentConnection
+	next   uint32 // round-robin cursor
+}
+
+func newAgentPool(agents []*agent.AgentConnection) *agentPool {
+	return &agentPool{agents: agents}
+}
+
+// pick chooses the agent for req among agents, the pool's or a subset of
+// them, that negotiated every required capability. Consistent hashing falls
+// back to round-robin when there is no request or it lacks the hash header.
+func (p *agentPool) pick(agents []*agent.AgentConnection, config *models.ProxyConfig, req *http.Request, required []string) *agent.AgentConnection {
+	candidates := capable(agents, required)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch config.LoadBalancing {
+	case StrategyLeastInFlight:
+		return p.leastInFlight(candidates)
+	case StrategyLatencyEWMA:
+		return p.latencyWeighted(candidates)
+	case StrategyConsistentHash:
+		if config.HashHeader != "" && req != nil {
+			if key := req.Header.Get(config.HashHeader); key != "" {
+				return p.consistentHash(candidates, key)
+			}
+		}
+	}
+
+	return p.roundRobin(candidates)
+}
+
+// capable filters agents down to those supporting every capability in
+// required, returning agents itself when nothing is required
+func capable(agents []*agent.AgentConnection, required []string) []*agent.AgentConnection {
+	if len(required) == 0 {
+		return agents
+	}
+
+	candidates := make([]*agent.AgentConnection, 0, len(agents))
+	for _, candidate := range agents {
+		supported := true
+		for _, capability := range required {
+			if !candidate.Supports(capability) {
+				supported = false
+				break
+			}
+		}
+		if supported {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+func (p *agentPool) roundRobin(agents []*agent.AgentConnection) *agent.AgentConnection {
+	n := atomic.AddUint32(&p.next, 1)
+	return agents[int(n-1)%len(agents)]
+}
+
+// leastInFlight scans from the round-robin cursor so ties are spread out
+// instead of always landing on the first agent
+func (p *agentPool) leastInFlight(agents []*agent.AgentConnection) *agent.AgentConnection {
+	start := int(atomic.AddUint32(&p.next, 1) - 1)
+
+	var best *agent.AgentConnection
+	bestLoad := 0
+	for i := range agents {
+		candidate := agents[(start+i)%len(agents)]
+		if load := candidate.InFlight(); best == nil || load < bestLoad {
+			best, bestLoad = candidate, load
+		}
+	}
+	return best
+}
+
+// latencyWeighted picks at random with weights inversely proportional to
+// latency EWMA times pending load. Agents without a latency sample yet are
+// scored like the fastest agent so they start receiving traffic.
+func (p *agentPool) latencyWeighted(agents []*agent.AgentConnection) *agent.AgentConnection {
+	latencies := make([]time.Duration, len(agents))
+	fastest := time.Duration(0)
+	for i, candidate := range agents {
+		latencies[i] = candidate.Latency()
+		if latencies[i] > 0 && (fastest == 0 || latencies[i] < fastest) {
+			fastest = latencies[i]
+		}
+	}
+	if fastest == 0 {
+		fastest = time.Millisecond
+	}
+
+	weights := make([]float64, len(agents))
+	total := 0.0
+	for i, candidate := range agents {
+		latency := latencies[i]
+		if latency == 0 {
+			latency = fastest
+		}
+		weights[i] = 1 / (float64(latency) * float64(candidate.InFlight()+1))
+		total += weights[i]
+	}
+
+	target := rand.Float64() * total
+	for i, weight := range weights {
+		if target < weight {
+			return agents[i]
+		}
+		target -= weight
+	}
+	return agents[len(agents)-1]
+}
+
+// consistentHash uses rendezvous hashing: every agent scores the key and the
+// highest score wins, so adding or removing an agent only moves the keys
+// that agent gains or loses
+func (p *agentPool) consistentHash(agents []*agent.AgentConnection, key string) *agent.AgentConnection {
+	var best *agent.AgentConnection
+	var bestScore uint64
+	for _, candidate := range agents {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(candidate.AgentID))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
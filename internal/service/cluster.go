@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/logger"
+
+	"github.com/gorilla/websocket"
+)
+
+// Headers a replica adds when it hands a request to the replica holding the
+// agent. They never reach the agent.
+const (
+	ReplicaTokenHeader    = "X-Proxy-Replica-Token"
+	ReplicaCustomerHeader = "X-Proxy-Customer-ID"
+	ReplicaAgentHeader    = "X-Proxy-Agent-ID"
+	// The client's address and the request's ID, for header rules
+	ReplicaClientIPHeader  = "X-Proxy-Client-IP"
+	ReplicaRequestIDHeader = "X-Proxy-Request-ID"
+)
+
+// ReplicaHeaders are stripped from forwarded requests by the receiving replica
+var ReplicaHeaders = []string{ReplicaTokenHeader, ReplicaCustomerHeader, ReplicaAgentHeader, ReplicaClientIPHeader, ReplicaRequestIDHeader}
+
+// cluster lets requests reach agents connected to other replicas
+type cluster struct {
+	directory *agent.Directory
+	secret    string
+	transport http.RoundTripper
+	next      uint32 // spreads requests over remote agents
+	logger    *logger.Logger
+}
+
+type pinnedAgentKey struct{}
+
+// WithPinnedAgent marks a request handed over by another replica. It is
+// served by agentID if that agent is connected here, and never forwarded
+// again.
+func WithPinnedAgent(ctx context.Context, agentID string) context.Context {
+	return context.WithValue(ctx, pinnedAgentKey{}, agentID)
+}
+
+func pinnedAgent(ctx context.Context) (string, bool) {
+	agentID, ok := ctx.Value(pinnedAgentKey{}).(string)
+	return agentID, ok
+}
+
+// EnableCluster lets this replica serve customers whose agents are connected
+// to other replicas, as found in directory. secret authenticates replicas to
+// each other and must be the same on all of them.
+func (s *ProxyService) EnableCluster(directory *agent.Directory, secret string) {
+	s.cluster = &cluster{
+		directory: directory,
+		secret:    secret,
+		transport: http.DefaultTransport,
+		logger:    logger.NewLogger(),
+	}
+}
+
+// ValidReplicaToken reports whether token is the shared replica secret
+func (s *ProxyService) ValidReplicaToken(token string) bool {
+	if s.cluster == nil || s.cluster.secret == "" || token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(s.cluster.secret))
+}
+
+// RemoteAgent returns where to hand req over to when none of the customer's
+// agents matching its selector is connected here. It returns nil when the
+// request is to be served locally: clustering is off, a matching local agent
+// is connected, the request was already handed over, or no replica has a
+// matching agent either, in which case the local replica applies the
+// selector fallback.
+func (s *ProxyService) RemoteAgent(ctx context.Context, customerID string, req *http.Request) (*agent.AgentLocation, error) {
+	if s.cluster == nil {
+		return nil, nil
+	}
+	if _, pinned := pinnedAgent(ctx); pinned {
+		return nil, nil
+	}
+
+	// A request that cannot be routed is refused locally
+	config, err := s.getProxyConfig(ctx, customerID)
+	if err != nil {
+		return nil, nil
+	}
+	routing, err := s.routingFor(customerID, config, req)
+	if err != nil {
+		return nil, nil
+	}
+
+	s.routingMutex.RLock()
+	pool, local := s.routingTable[customerID]
+	s.routingMutex.RUnlock()
+	if local && len(labelled(pool.agents, routing.selector)) > 0 {
+		return nil, nil
+	}
+
+	remote, err := s.cluster.directory.RemoteAgents(ctx, customerID)
+	if err != nil || len(remote) == 0 {
+		return nil, err
+	}
+
+	candidates := labelledLocations(remote, routing.selector)
+	if len(candidates) == 0 {
+		if local || !routing.fallback {
+			return nil, nil
+		}
+		candidates = remote
+	}
+
+	n := atomic.AddUint32(&s.cluster.next, 1)
+	location := candidates[int(n-1)%len(candidates)]
+	return &location, nil
+}
+
+// ForwardToReplica relays a client request, WebSocket upgrades included, to
+// the replica holding the agent and streams its answer back
+func (s *ProxyService) ForwardToReplica(w http.ResponseWriter, r *http.Request, customerID string, location *agent.AgentLocation) {
+	target, err := url.Parse(location.Address)
+	if err != nil {
+		s.metrics.RecordError(customerID, "replica_forward_error")
+		s.cluster.logger.Error("Invalid replica address",
+			"error", err,
+			"replica_id", location.ReplicaID,
+			"address", location.Address)
+		writeReplicaError(w, http.StatusBadGateway)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(out *httputil.ProxyRequest) {
+			out.SetURL(target)
+			out.Out.Host = r.Host
+			for _, name := range ReplicaHeaders {
+				out.Out.Header.Del(name)
+			}
+			out.Out.Header.Set(ReplicaTokenHeader, s.cluster.secret)
+			out.Out.Header.Set(ReplicaCustomerHeader, customerID)
+			out.Out.Header.Set(ReplicaAgentHeader, location.AgentID)
+			if clientIP, requestID, ok := ClientInfo(r.Context()); ok {
+				out.Out.Header.Set(ReplicaClientIPHeader, clientIP)
+				out.Out.Header.Set(ReplicaRequestIDHeader, requestID)
+			}
+		},
+		Transport: s.cluster.transport,
+		// Streamed bodies are relayed as they arrive
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			s.metrics.RecordError(customerID, "replica_forward_error")
+			s.cluster.logger.Error("Failed to forward request to replica",
+				"error", err,
+				"customer_id", customerID,
+				"agent_id", location.AgentID,
+				"replica_id", location.ReplicaID)
+
+			if errors.Is(err, context.DeadlineExceeded) {
+				writeReplicaError(w, http.StatusGatewayTimeout)
+				return
+			}
+			writeReplicaError(w, http.StatusBadGateway)
+		},
+	}
+
+	// An upgraded connection outlives the server's request timeouts
+	if websocket.IsWebSocketUpgrade(r) {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// writeReplicaError answers like the proxy handler does when a local agent fails
+func writeReplicaError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if status == http.StatusGatewayTimeout {
+		fmt.Fprint(w, `{"error":"proxy request timed out"}`)
+		return
+	}
+	fmt.Fprint(w, `{"error":"proxy request failed"}`)
+}
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"proxy-service/internal/models"
+	"proxy-service/pkg/agentproto"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Actions of header rules
+const (
+	HeaderActionSet    = "set"
+	HeaderActionAppend = "append"
+	HeaderActionRemove = "remove"
+	HeaderActionRename = "rename"
+)
+
+// RequestIDHeader carries the ID of a request; clients may send their own
+const RequestIDHeader = "X-Request-ID"
+
+// Variables header rule values may refer to as ${name}
+var headerVariables = []string{"customer_id", "client_ip", "request_id"}
+
+// DefaultStrippedHeaders are removed from requests before forwarding, unless
+// the customer's header policy keeps them: they authenticate with the proxy,
+// not with the upstream
+var DefaultStrippedHeaders = []string{"Authorization", "X-Agent-Token"}
+
+// defaultRequestRules tell the upstream who the client is before the
+// customer's rules run, which may change or remove them. X-Forwarded-For is
+// set by the proxy alone.
+var defaultRequestRules = []models.HeaderRule{
+	{Action: HeaderActionSet, Name: "X-Real-IP", Value: "${client_ip}"},
+	{Action: HeaderActionSet, Name: "X-Proxy-ID", Value: "proxy-service"},
+}
+
+// Headers the proxy manages itself, which rules may not touch
+var managedHeaders = append([]string{"Content-Length", "Host", "X-Forwarded-For"}, hopByHopHeaders...)
+
+var ErrInvalidHeaderRule = errors.New("invalid header rule")
+
+// ValidateHeaderPolicy rejects policies with rules that could not be
+// applied: unknown actions, malformed or proxy managed header names, and
+// values with unknown variables or line breaks. A nil policy is valid.
+func ValidateHeaderPolicy(policy *models.HeaderPolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	for i, rule := range policy.Request {
+		if err := validateHeaderRule(rule); err != nil {
+			return fmt.Errorf("%w: request rule %d: %s", ErrInvalidHeaderRule, i+1, err)
+		}
+	}
+	for i, rule := range policy.Response {
+		if err := validateHeaderRule(rule); err != nil {
+			return fmt.Errorf("%w: response rule %d: %s", ErrInvalidHeaderRule, i+1, err)
+		}
+	}
+	for _, name := range slices.Concat(policy.Strip, policy.Keep) {
+		if !validHeaderName(name) {
+			return fmt.Errorf("%w: invalid header name %q", ErrInvalidHeaderRule, name)
+		}
+	}
+	return nil
+}
+
+// ValidateProxyHeaders rejects proxy configs whose Headers or header policy
+// could not be applied, as ValidateHeaderPolicy does
+func ValidateProxyHeaders(config *models.ProxyConfig) error {
+	names := make([]string, 0, len(config.Headers))
+	for name := range config.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rule := models.HeaderRule{Action: HeaderActionSet, Name: name, Value: config.Headers[name]}
+		if err := validateHeaderRule(rule); err != nil {
+			return fmt.Errorf("%w: header %s: %s", ErrInvalidHeaderRule, name, err)
+		}
+	}
+	return ValidateHeaderPolicy(config.HeaderPolicy)
+}
+
+func validateHeaderRule(rule models.HeaderRule) error {
+	if err := validateRuleHeader(rule.Name); err != nil {
+		return err
+	}
+
+	switch rule.Action {
+	case HeaderActionSet, HeaderActionAppend:
+		if rule.Value == "" {
+			return errors.New("value is required")
+		}
+		return validateHeaderTemplate(rule.Value)
+	case HeaderActionRemove:
+		return nil
+	case HeaderActionRename:
+		return validateRuleHeader(rule.To)
+	}
+	return fmt.Errorf("action must be %s, %s, %s or %s", HeaderActionSet, HeaderActionAppend, HeaderActionRemove, HeaderActionRename)
+}
+
+func validateRuleHeader(name string) error {
+	if !validHeaderName(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if managed, ok := managedHeader(name); ok {
+		return fmt.Errorf("header %s is managed by the proxy", managed)
+	}
+	return nil
+}
+
+// managedHeader returns the proxy managed header name is, if it is one
+func managedHeader(name string) (string, bool) {
+	for _, managed := range managedHeaders {
+		if strings.EqualFold(name, managed) {
+			return managed, true
+		}
+	}
+	return "", false
+}
+
+// validHeaderName reports whether name is an HTTP token (RFC 9110 section 5.1)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > '~' || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func validateHeaderTemplate(value string) error {
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return errors.New("value must not contain line breaks")
+	}
+
+	var err error
+	expandHeaderTemplate(value, func(name string) string {
+		if err == nil && !slices.Contains(headerVariables, name) {
+			err = fmt.Errorf("unknown variable ${%s}", name)
+		}
+		return ""
+	})
+	return err
+}
+
+// expandHeaderTemplate replaces every ${name} in value with lookup(name);
+// a "$" that starts no variable is kept as it is
+func expandHeaderTemplate(value string, lookup func(name string) string) string {
+	var result strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			break
+		}
+		result.WriteString(value[:start])
+		result.WriteString(lookup(value[start+2 : start+end]))
+		value = value[start+end+1:]
+	}
+	result.WriteString(value)
+	return result.String()
+}
+
+type clientInfoKey struct{}
+
+// clientInfo is what header rules know about the client of a request
+type clientInfo struct {
+	ip        string
+	requestID string
+}
+
+// WithClientInfo attaches the client's address and the request's ID to ctx
+// for header rules; an empty requestID is replaced by a new one
+func WithClientInfo(ctx context.Context, clientIP, requestID string) context.Context {
+	if requestID == "" {
+		requestID = agentproto.NewRequestID()
+	}
+	return context.WithValue(ctx, clientInfoKey{}, clientInfo{ip: clientIP, requestID: requestID})
+}
+
+// ClientInfo returns the client address and request ID attached to ctx
+func ClientInfo(ctx context.Context) (clientIP, requestID string, ok bool) {
+	info, ok := ctx.Value(clientInfoKey{}).(clientInfo)
+	return info.ip, info.requestID, ok
+}
+
+// headerPolicy is what is done to the headers of a request and its response
+type headerPolicy struct {
+	strip     []string
+	request   []models.HeaderRule
+	response  []models.HeaderRule
+	variables map[string]string
+}
+
+// headerPolicy combines the proxy's defaults, the proxy config's Headers and
+// policy, and the policy of the request's route, in that order
+func (s *ProxyService) headerPolicy(ctx context.Context, customerID string, config *models.ProxyConfig, req *http.Request) *headerPolicy {
+	clientIP, requestID, _ := ClientInfo(ctx)
+	policy := &headerPolicy{
+		request: slices.Clone(defaultRequestRules),
+		variables: map[string]string{
+			"customer_id": customerID,
+			"client_ip":   clientIP,
+			"request_id":  requestID,
+		},
+	}
+
+	names := make([]string, 0, len(config.Headers))
+	for name := range config.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		policy.request = append(policy.request, models.HeaderRule{Action: HeaderActionSet, Name: name, Value: config.Headers[name]})
+	}
+
+	policies := []*models.HeaderPolicy{config.HeaderPolicy}
+	if agentConfig := s.agentManager.GetCustomerConfig(customerID); agentConfig != nil {
+		if route := findRoute(agentConfig.Routes, req.Method, req.URL.Path); route != nil {
+			policies = append(policies, route.HeaderPolicy)
+		}
+	}
+
+	strip := slices.Clone(DefaultStrippedHeaders)
+	var keep []string
+	for _, p := range policies {
+		if p == nil {
+			continue
+		}
+		policy.request = append(policy.request, p.Request...)
+		policy.response = append(policy.response, p.Response...)
+		strip = append(strip, p.Strip...)
+		keep = append(keep, p.Keep...)
+	}
+	for _, name := range strip {
+		if !slices.ContainsFunc(keep, func(kept string) bool { return strings.EqualFold(kept, name) }) {
+			policy.strip = append(policy.strip, name)
+		}
+	}
+	return policy
+}
+
+// rewriteRequest returns a copy of req with the stripped headers removed and
+// the request rules applied. Only the headers are copied: net/http fills in
+// the trailers of the original request once its body is read.
+func (p *headerPolicy) rewriteRequest(req *http.Request) *http.Request {
+	header := req.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	req = req.WithContext(req.Context())
+	req.Header = header
+	for _, name := range p.strip {
+		req.Header.Del(name)
+	}
+	if clientIP := p.variables["client_ip"]; clientIP != "" {
+		req.Header.Set("X-Forwarded-For", clientIP)
+	}
+	p.apply(req.Header, p.request)
+	return req
+}
+
+// rewriteResponse applies the response rules to h
+func (p *headerPolicy) rewriteResponse(h http.Header) {
+	p.apply(h, p.response)
+}
+
+// apply runs rules on h. Values that expand to nothing, such as the client
+// address of a request without one, leave the header alone. Rules on proxy
+// managed headers are skipped: configs that were never validated may have
+// them.
+func (p *headerPolicy) apply(h http.Header, rules []models.HeaderRule) {
+	for _, rule := range rules {
+		if _, managed := managedHeader(rule.Name); managed {
+			continue
+		}
+		if _, managed := managedHeader(rule.To); managed && rule.Action == HeaderActionRename {
+			continue
+		}
+		switch rule.Action {
+		case HeaderActionSet, HeaderActionAppend:
+			value := expandHeaderTemplate(rule.Value, func(name string) string { return p.variables[name] })
+			if value == "" {
+				continue
+			}
+			if rule.Action == HeaderActionSet {
+				h.Set(rule.Name, value)
+			} else {
+				h.Add(rule.Name, value)
+			}
+		case HeaderActionRemove:
+			h.Del(rule.Name)
+		case HeaderActionRename:
+			values := h.Values(rule.Name)
+			if len(values) == 0 {
+				continue
+			}
+			values = slices.Clone(values)
+			h.Del(rule.Name)
+			h.Del(rule.To)
+			for _, value := range values {
+				h.Add(rule.To, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Hop-by-hop headers apply to a single connection and must not be forwarded
+// (RFC 9110 section 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardableHeaders returns a copy of h without hop-by-hop headers,
+// including any listed in the Connection header
+func forwardableHeaders(h http.Header) http.Header {
+	result := h.Clone()
+	if result == nil {
+		return http.Header{}
+	}
+
+	for _, value := range result.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				result.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		result.Del(name)
+	}
+
+	return result
+}
+
+// requestHeaders is forwardableHeaders for a client request, which also
+// drops the headers that only steer the proxy
+func requestHeaders(h http.Header) http.Header {
+	result := forwardableHeaders(h)
+	result.Del(AgentSelectorHeader)
+	return result
+}
+
+// setContentLength replaces any client supplied length with the one we
+// actually send; -1 means unknown and leaves framing to the receiver
+func setContentLength(h http.Header, length int64) {
+	if length < 0 {
+		h.Del("Content-Length")
+		return
+	}
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+}
+
+// bodyAllowed reports whether a response may carry a body (RFC 9110 section 6.4.1)
+func bodyAllowed(method string, status int) bool {
+	if method == http.MethodHead {
+		return false
+	}
+	if status >= 100 && status < 200 {
+		return false
+	}
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -1,13 +1,22 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"proxy-service/internal/config"
 	"proxy-service/internal/models"
 	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
 	"proxy-service/pkg/cache"
+	"proxy-service/pkg/cloudflare"
 	"proxy-service/pkg/metrics"
+	"proxy-service/pkg/proxy"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,8 +25,13 @@ type ProxyService struct {
 	agentManager *agent.AgentManager
 	cache        *cache.RedisCache
 	metrics      *metrics.MetricsCollector
-	routingTable map[string]string // customerID -> agentID
+	routingTable map[string]*agentPool // customerID -> connected agents
 	routingMutex sync.RWMutex
+	cluster      *cluster                 // nil when running as a single replica
+	transports   *proxy.TransportPool     // connections of the direct mode
+	tunnel       *cloudflare.TunnelClient // nil when no tunnel is configured
+	retryBudgets map[string]*retryBudget  // customerID -> retries saved up
+	budgetMutex  sync.Mutex
 }
 
 type ProxyRequest struct {
@@ -32,6 +46,8 @@ type ProxyResponse struct {
 	StatusCode int
 	Headers    http.Header
 	Body       []byte
+	BodyStream io.ReadCloser
+	Trailers   http.Header
 }
 
 func NewProxyService(
@@ -43,64 +59,191 @@ func NewProxyService(
 		agentManager: agentManager,
 		cache:        cache,
 		metrics:      metrics,
-		routingTable: make(map[string]string),
+		routingTable: make(map[string]*agentPool),
+		retryBudgets: make(map[string]*retryBudget),
+		transports:   proxy.NewTransportPool(config.UpstreamTransportConfig{}, metrics),
 	}
 
-	// Start routing table maintenance
-	go service.maintainRoutingTable()
+	// Keep the routing table in step with agents connecting and leaving
+	agentManager.OnRoutingChange(service.updateRoute)
 
 	return service
 }
 
+// ForwardRequest serves req from the response cache when caching is on for
+// it, and otherwise in the customer's routing mode, or in the failover mode
+// when that mode cannot
 func (s *ProxyService) ForwardRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
 	startTime := time.Now()
 	customerID := ctx.Value("customer_id").(string)
 
 	// Get proxy configuration
-	_, err := s.getProxyConfig(ctx, customerID)
+	config, err := s.getProxyConfig(ctx, customerID)
 	if err != nil {
 		s.metrics.RecordError(customerID, "config_error")
 		return nil, fmt.Errorf("failed to get proxy config: %w", err)
 	}
 
-	// Get agent ID for the customer
-	agentID, err := s.getAgentForCustomer(customerID)
+	// Header rules shape the request the cache and the upstream see, and
+	// every response, cached or not
+	headers := s.headerPolicy(ctx, customerID, config, req)
+	req = headers.rewriteRequest(req)
+
+	var resp *http.Response
+	if policy := s.cachePolicy(customerID, config, req); policy != nil {
+		resp, err = s.serveCached(ctx, customerID, config, policy, req)
+	} else {
+		resp, err = s.forward(ctx, customerID, config, req)
+	}
 	if err != nil {
-		s.metrics.RecordError(customerID, "routing_error")
-		return nil, fmt.Errorf("failed to get agent: %w", err)
+		return nil, err
+	}
+	headers.rewriteResponse(resp.Header)
+
+	// Record metrics
+	s.metrics.RecordRequestDuration(customerID, req.URL.Path, req.Method, time.Since(startTime))
+
+	return resp, nil
+}
+
+// forward sends req in the customer's routing mode, and in the failover
+// mode when that mode cannot. Failed requests that may be sent again are
+// retried with backoff while the customer's retry budget lasts.
+func (s *ProxyService) forward(ctx context.Context, customerID string, config *models.ProxyConfig, req *http.Request) (*http.Response, error) {
+	modes := s.routingModes(customerID, config, req)
+	policy := s.retryPolicy(customerID, config)
+	budget := s.retryBudget(customerID)
+	budget.earn()
+
+	// A request that may fail over or be retried is held on to, unless its
+	// body is too large to keep in memory
+	var body []byte
+	replayable := false
+	if modes.failover != "" || policy.retries > 0 {
+		var err error
+		if body, replayable, err = bufferBody(req); err != nil {
+			s.metrics.RecordError(customerID, "request_body_error")
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+	}
+	canRetry := policy.retries > 0 && retryable(req, replayable)
+	if canRetry && policy.otherAgent {
+		req = req.WithContext(withTriedAgents(req.Context(), &triedAgents{}))
+	}
+
+	// The deadline covers both modes and, once the response is returned,
+	// reading its body
+	cancel := context.CancelFunc(func() {})
+	if timeout := s.requestTimeout(customerID, config, req); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	resp, err := s.attempt(ctx, modes, customerID, config, req, body, replayable)
+	retries := 0
+	for canRetry && retries < policy.retries && ShouldRetry(ctx, resp, err) {
+		if !budget.spend() {
+			s.metrics.RecordRetry(customerID, "budget_exhausted")
+			break
+		}
+		if !backoff(ctx, policy.baseDelay, retries) {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		retries++
+		s.metrics.RecordRetry(customerID, "retried")
+		rewindBody(req, body)
+		resp, err = s.attempt(ctx, modes, customerID, config, req, body, replayable)
 	}
 
+	if err != nil {
+		cancel()
+		if retries > 0 {
+			err = &retriedError{err: err, retries: retries}
+		}
+		return nil, err
+	}
+	if retries > 0 {
+		resp.Header.Set(RetriesHeader, strconv.Itoa(retries))
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// attempt serves req in the primary mode, and in the failover mode when
+// that mode cannot
+func (s *ProxyService) attempt(ctx context.Context, modes routingModes, customerID string, config *models.ProxyConfig, req *http.Request, body []byte, replayable bool) (*http.Response, error) {
+	resp, err := s.forwardVia(ctx, modes.primary, customerID, config, req)
+	if err != nil && modes.failover != "" && shouldFailOver(ctx, err, req, replayable) {
+		s.metrics.RecordError(customerID, "routing_failover")
+		rewindBody(req, body)
+		resp, err = s.forwardVia(ctx, modes.failover, customerID, config, req)
+	}
+	return resp, err
+}
+
+// forwardToAgent relays req through one of the customer's agents
+func (s *ProxyService) forwardToAgent(ctx context.Context, customerID string, config *models.ProxyConfig, req *http.Request) (*http.Response, error) {
 	// Create proxy request
-	proxyReq := &agent.ProxyRequest{
+	proxyReq := &agent.ProxyRequest{ProxyRequest: agentproto.ProxyRequest{
 		Method:     req.Method,
-		Path:       req.URL.Path,
-		Headers:    req.Header,
+		Path:       req.URL.EscapedPath(),
+		RawQuery:   req.URL.RawQuery,
+		Headers:    requestHeaders(req.Header),
 		CustomerID: customerID,
+	}}
+
+	if err := attachRequestBody(proxyReq, req); err != nil {
+		s.metrics.RecordError(customerID, "request_body_error")
+		return nil, fmt.Errorf("failed to read request body: %w", err)
 	}
 
-	// Forward request through agent
+	// Pick one of the customer's agents, one that can take a streamed body
+	// if it is needed. Without one the request was not sent and another
+	// mode may serve it, unless its selector is invalid.
+	var required []string
+	if proxyReq.BodyStream != nil {
+		required = append(required, agentproto.CapabilityStreaming)
+	}
+	agentID, err := s.getAgentForCustomer(customerID, config, req, required...)
+	if err != nil {
+		s.metrics.RecordError(customerID, "routing_error")
+		err = fmt.Errorf("failed to get agent: %w", err)
+		if errors.Is(err, agent.ErrInvalidSelector) {
+			return nil, err
+		}
+		return nil, unavailable(err)
+	}
+	triedAgentsOf(req.Context()).add(agentID)
+
+	// Forward request through agent; it learns the deadline and is told to
+	// cancel once it passes
 	response, err := s.agentManager.RouteRequest(ctx, agentID, proxyReq)
 	if err != nil {
 		s.metrics.RecordError(customerID, "forward_error")
-		return nil, fmt.Errorf("failed to forward request: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrForwardFailed, err)
 	}
 
-	// Record metrics
-	s.metrics.RecordRequestDuration(customerID, req.URL.Path, req.Method, time.Since(startTime))
-
 	// Convert agent.ProxyResponse to ProxyResponse
 	localResponse := &ProxyResponse{
 		StatusCode: response.StatusCode,
 		Headers:    response.Headers,
 		Body:       response.Body,
+		BodyStream: response.BodyStream,
+		Trailers:   response.Trailers,
 	}
 
-	return s.createHTTPResponse(localResponse), nil
+	return s.createHTTPResponse(req.Method, localResponse), nil
 }
 
 func (s *ProxyService) getProxyConfig(ctx context.Context, customerID string) (*models.ProxyConfig, error) {
 	// Try cache first
 	if config, err := s.cache.GetProxyConfig(ctx, customerID); err == nil {
+		// Nothing checks configs on their way into the cache
+		if err := ValidateProxyHeaders(config); err != nil {
+			return nil, fmt.Errorf("invalid proxy configuration: %w", err)
+		}
 		return config, nil
 	}
 
@@ -108,50 +251,174 @@ func (s *ProxyService) getProxyConfig(ctx context.Context, customerID string) (*
 	return nil, fmt.Errorf("proxy configuration not found")
 }
 
-func (s *ProxyService) getAgentForCustomer(customerID string) (string, error) {
+// requestTimeout is the tighter of the matching route timeout and the
+// customer's proxy timeout, or 0 when neither is set
+func (s *ProxyService) requestTimeout(customerID string, config *models.ProxyConfig, req *http.Request) time.Duration {
+	timeout := time.Duration(config.Timeout) * time.Second
+
+	if agentConfig := s.agentManager.GetCustomerConfig(customerID); agentConfig != nil {
+		if route := findRoute(agentConfig.Routes, req.Method, req.URL.Path); route != nil && route.Timeout > 0 {
+			if timeout == 0 || route.Timeout < timeout {
+				timeout = route.Timeout
+			}
+		}
+	}
+
+	return timeout
+}
+
+// cancelOnClose releases a request context once its response body is done
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// getAgentForCustomer picks an agent of the customer that matches the
+// request's selector and negotiated every capability in required
+func (s *ProxyService) getAgentForCustomer(customerID string, config *models.ProxyConfig, req *http.Request, required ...string) (string, error) {
 	s.routingMutex.RLock()
-	agentID, exists := s.routingTable[customerID]
+	pool, exists := s.routingTable[customerID]
 	s.routingMutex.RUnlock()
 
 	if !exists {
 		return "", fmt.Errorf("no agent found for customer")
 	}
 
-	return agentID, nil
-}
-
-func (s *ProxyService) maintainRoutingTable() {
-	ticker := time.NewTicker(time.Minute)
-	defer ticker.Stop()
+	// A request handed over by another replica is for one agent only
+	if req != nil {
+		if agentID, pinned := pinnedAgent(req.Context()); pinned {
+			for _, candidate := range capable(pool.agents, required) {
+				if candidate.AgentID == agentID {
+					return agentID, nil
+				}
+			}
+			return "", fmt.Errorf("agent %s is not available on this replica", agentID)
+		}
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			s.updateRoutingTable()
+	routing, err := s.routingFor(customerID, config, req)
+	if err != nil {
+		return "", err
+	}
+	matching := labelled(pool.agents, routing.selector)
+	if len(matching) == 0 {
+		if !routing.fallback {
+			return "", fmt.Errorf("%w: %s", ErrNoMatchingAgent, routing.selector)
 		}
+		matching = pool.agents
+	}
+	// A retry goes to another agent while there is one
+	if req != nil {
+		matching = triedAgentsOf(req.Context()).untried(matching)
 	}
-}
 
-func (s *ProxyService) updateRoutingTable() {
-	// Get all active agents
-	agents := s.agentManager.GetActiveAgents()
+	selected := pool.pick(matching, config, req, required)
+	if selected == nil {
+		return "", fmt.Errorf("no agent of the customer supports %s", strings.Join(required, ", "))
+	}
 
+	return selected.AgentID, nil
+}
+
+// updateRoute replaces the routing entry of a customer; it is called by the
+// agent manager whenever that customer's agents change
+func (s *ProxyService) updateRoute(customerID string, agents []*agent.AgentConnection) {
 	s.routingMutex.Lock()
 	defer s.routingMutex.Unlock()
 
-	// Clear current routing table
-	s.routingTable = make(map[string]string)
+	if len(agents) == 0 {
+		delete(s.routingTable, customerID)
+		return
+	}
+	s.routingTable[customerID] = newAgentPool(agents)
+}
+
+// attachRequestBody sends small bodies inline and streams large or
+// unknown-length ones, so memory use does not grow with the upload size.
+// Content-Length is always rewritten to what is actually forwarded.
+func attachRequestBody(proxyReq *agent.ProxyRequest, req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		setContentLength(proxyReq.Headers, contentLengthWithoutBody(req))
+		return nil
+	}
 
-	// Update routing table based on active agents
-	for _, agent := range agents {
-		s.routingTable[agent.CustomerID] = agent.AgentID
+	if req.ContentLength >= 0 && req.ContentLength <= agentproto.MaxInlineBodySize {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		proxyReq.Body = body
+		proxyReq.Trailers = req.Trailer
+		setContentLength(proxyReq.Headers, int64(len(body)))
+		return nil
 	}
+
+	// req.Trailer is filled in by net/http once the body reaches EOF, which
+	// is when the end frame carrying it is built
+	proxyReq.BodyStream = req.Body
+	proxyReq.BodySize = req.ContentLength
+	proxyReq.Trailers = req.Trailer
+	setContentLength(proxyReq.Headers, req.ContentLength)
+	return nil
 }
 
-func (s *ProxyService) createHTTPResponse(proxyResp *ProxyResponse) *http.Response {
-	return &http.Response{
-		StatusCode: proxyResp.StatusCode,
-		Header:     proxyResp.Headers,
-		Body:       http.NoBody,
+// contentLengthWithoutBody keeps an explicit "Content-Length: 0" on methods
+// that normally carry a body, and drops the header otherwise
+func contentLengthWithoutBody(req *http.Request) int64 {
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return 0
+	default:
+		return -1
 	}
 }
+
+func (s *ProxyService) createHTTPResponse(method string, proxyResp *ProxyResponse) *http.Response {
+	headers := forwardableHeaders(proxyResp.Headers)
+
+	resp := &http.Response{
+		StatusCode:    proxyResp.StatusCode,
+		Header:        headers,
+		Body:          http.NoBody,
+		Trailer:       proxyResp.Trailers,
+		ContentLength: -1,
+	}
+
+	switch {
+	case !bodyAllowed(method, proxyResp.StatusCode):
+		// HEAD keeps the length the upstream reported, the others never have one
+		if proxyResp.BodyStream != nil {
+			proxyResp.BodyStream.Close()
+		}
+		if method != http.MethodHead {
+			headers.Del("Content-Length")
+		}
+		resp.Trailer = nil
+	case proxyResp.BodyStream != nil:
+		resp.Body = proxyResp.BodyStream
+		if length, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64); err == nil && length >= 0 && len(proxyResp.Trailers) == 0 {
+			resp.ContentLength = length
+		} else {
+			setContentLength(headers, -1)
+		}
+	default:
+		if len(proxyResp.Body) > 0 {
+			resp.Body = io.NopCloser(bytes.NewReader(proxyResp.Body))
+		}
+		// Trailers need chunked framing, so the length is left out
+		if len(proxyResp.Trailers) > 0 {
+			setContentLength(headers, -1)
+		} else {
+			resp.ContentLength = int64(len(proxyResp.Body))
+			setContentLength(headers, resp.ContentLength)
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,721 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"proxy-service/internal/models"
+	"proxy-service/pkg/cache"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheHeader tells clients how the response cache served a request
+const CacheHeader = "X-Cache"
+
+// Values of CacheHeader
+const (
+	CacheHit         = "HIT"
+	CacheMiss        = "MISS"
+	CacheStale       = "STALE"
+	CacheRevalidated = "REVALIDATED"
+	CacheBypass      = "BYPASS"
+)
+
+const (
+	// MaxCachedBodySize is the largest response body that is cached
+	MaxCachedBodySize = 1 << 20
+	// MaxCacheStorage caps how long a response is kept, however long it
+	// stays fresh
+	MaxCacheStorage = 24 * time.Hour
+	// revalidationStorage keeps responses that are stale at once, but carry
+	// a validator, around to be revalidated
+	revalidationStorage = time.Hour
+	// revalidationTimeout bounds a revalidation done after a stale response
+	// was served
+	revalidationTimeout = 30 * time.Second
+	cacheWriteTimeout   = 2 * time.Second
+)
+
+// Response headers that tag cached responses for purging; they are not
+// passed on to clients
+var cacheTagHeaders = []string{"Cache-Tag", "Surrogate-Key"}
+
+// cacheableStatus lists the statuses cached without being told to (RFC 9110
+// section 15.1)
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// cachePolicy is how a customer's responses are cached on a route
+type cachePolicy struct {
+	ttl   time.Duration // freshness of responses without their own
+	stale time.Duration // how long stale responses may be served by default
+	vary  []string      // request headers in the key, canonical and sorted
+}
+
+// cachedResponse is a response kept in the cache
+type cachedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+	// Date is when the response was generated, from when it was received
+	// and its Age
+	Date time.Time `json:"date"`
+	// Vary holds the request's values of the headers named in the
+	// response's Vary header
+	Vary map[string]string `json:"vary,omitempty"`
+	// Tags are what the response is purged by
+	Tags []string `json:"tags,omitempty"`
+}
+
+// cachePolicy returns how req is cached, or nil when neither the proxy
+// config nor the matching route enables caching. The route's settings
+// override the config's; those of the built-in default configuration do
+// not apply, so caching stays off until a customer turns it on. HEAD
+// requests match the routes of GET.
+func (s *ProxyService) cachePolicy(customerID string, config *models.ProxyConfig, req *http.Request) *cachePolicy {
+	enabled := config.CacheEnabled
+	policy := &cachePolicy{
+		ttl:   time.Duration(config.CacheTTL) * time.Second,
+		stale: time.Duration(config.CacheStaleTTL) * time.Second,
+	}
+	vary := config.CacheVary
+
+	method := req.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	if agentConfig := s.agentManager.GetCustomerConfig(customerID); agentConfig != nil && agentConfig.Revision > 0 {
+		if route := findRoute(agentConfig.Routes, method, req.URL.Path); route != nil {
+			if route.CacheEnabled != nil {
+				enabled = *route.CacheEnabled
+			}
+			if route.CacheTTL > 0 {
+				policy.ttl = route.CacheTTL
+			}
+			if route.CacheStaleTTL > 0 {
+				policy.stale = route.CacheStaleTTL
+			}
+			if len(route.CacheVary) > 0 {
+				vary = route.CacheVary
+			}
+		}
+	}
+	if !enabled {
+		return nil
+	}
+
+	for _, name := range vary {
+		policy.vary = append(policy.vary, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+	}
+	sort.Strings(policy.vary)
+	return policy
+}
+
+// serveCached answers req from the cache when a stored response may be
+// used, revalidates stored responses that may not, and stores the
+// responses that may be cached. Only GET requests are stored; HEAD
+// requests are answered from them.
+func (s *ProxyService) serveCached(ctx context.Context, customerID string, config *models.ProxyConfig, policy *cachePolicy, req *http.Request) (*http.Response, error) {
+	directives := ParseCacheControl(req.Header)
+	if !cacheableRequest(req, directives) {
+		s.metrics.RecordCacheRequest(customerID, "bypass")
+		resp, err := s.forwardMarked(ctx, customerID, config, req, CacheBypass)
+		if err == nil {
+			dropCacheTags(resp.Header)
+		}
+		return resp, err
+	}
+
+	key := responseKey(customerID, req, policy.vary)
+	entry := s.loadResponse(ctx, customerID, key)
+	if entry == nil || !entry.matches(req) {
+		return s.fetch(ctx, customerID, config, policy, req, key)
+	}
+
+	age := entry.age(time.Now())
+	fresh := entry.freshness(policy)
+	if maxAge, ok := directives.Seconds("max-age"); ok && maxAge < fresh {
+		fresh = maxAge
+	}
+	revalidate := directives.Has("no-cache") || pragmaNoCache(req.Header)
+
+	if !revalidate && age < fresh {
+		s.metrics.RecordCacheRequest(customerID, "hit")
+		return entry.response(req, age, CacheHit), nil
+	}
+	if !revalidate && age < fresh+entry.staleFor("stale-while-revalidate", policy) {
+		s.metrics.RecordCacheRequest(customerID, "stale")
+		// A stale answer to HEAD is refreshed with the GET it came from
+		background := req.Clone(context.WithoutCancel(ctx))
+		background.Method = http.MethodGet
+		go s.revalidateInBackground(background, customerID, config, policy, key, entry)
+		return entry.response(req, age, CacheStale), nil
+	}
+
+	// A HEAD request cannot refresh the response, so it is passed on
+	if req.Method != http.MethodGet {
+		return s.fetch(ctx, customerID, config, policy, req, key)
+	}
+
+	resp, err := s.revalidate(ctx, customerID, config, policy, req, key, entry)
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		// The upstream is down, so the stale response may do
+		if age < fresh+entry.staleFor("stale-if-error", policy) {
+			if err == nil {
+				resp.Body.Close()
+			}
+			s.metrics.RecordError(customerID, "cache_revalidation_failed")
+			s.metrics.RecordCacheRequest(customerID, "stale")
+			return entry.response(req, entry.age(time.Now()), CacheStale), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.Header.Get(CacheHeader) == CacheMiss {
+		s.metrics.RecordCacheRequest(customerID, "miss")
+	}
+	return resp, nil
+}
+
+// fetch forwards req and stores the response once it was read, when it may
+// be cached
+func (s *ProxyService) fetch(ctx context.Context, customerID string, config *models.ProxyConfig, policy *cachePolicy, req *http.Request, key string) (*http.Response, error) {
+	s.metrics.RecordCacheRequest(customerID, "miss")
+	resp, err := s.forwardMarked(ctx, customerID, config, req, CacheMiss)
+	if err != nil {
+		return nil, err
+	}
+	s.storeOnRead(customerID, policy, req, key, resp)
+	return resp, nil
+}
+
+// revalidate asks the upstream whether entry is still current. A 304
+// refreshes and serves entry; any other response is passed on, and stored
+// in its place when it may be cached.
+func (s *ProxyService) revalidate(ctx context.Context, customerID string, config *models.ProxyConfig, policy *cachePolicy, req *http.Request, key string, entry *cachedResponse) (*http.Response, error) {
+	resp, err := s.forward(ctx, customerID, config, entry.conditional(ctx, req))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		entry.refresh(resp.Header, time.Now())
+		s.storeResponse(customerID, policy, req, key, entry)
+		s.metrics.RecordCacheRequest(customerID, "revalidated")
+		return entry.response(req, entry.age(time.Now()), CacheRevalidated), nil
+	}
+
+	resp.Header.Set(CacheHeader, CacheMiss)
+	s.storeOnRead(customerID, policy, req, key, resp)
+	return resp, nil
+}
+
+// revalidateInBackground refreshes a stale response that was served, with
+// a copy of the request that outlives it; only one replica does so at a
+// time
+func (s *ProxyService) revalidateInBackground(req *http.Request, customerID string, config *models.ProxyConfig, policy *cachePolicy, key string, entry *cachedResponse) {
+	ctx, cancel := context.WithTimeout(req.Context(), revalidationTimeout)
+	defer cancel()
+
+	lock := "response_cache_revalidation:" + strings.TrimPrefix(key, "response_cache:")
+	if claimed, err := s.cache.ClaimOnce(ctx, lock, revalidationTimeout); err != nil || !claimed {
+		return
+	}
+	defer s.cache.Delete(context.WithoutCancel(ctx), lock)
+
+	req = req.WithContext(ctx)
+	resp, err := s.revalidate(ctx, customerID, config, policy, req, key, entry)
+	if err != nil {
+		s.metrics.RecordError(customerID, "cache_revalidation_failed")
+		return
+	}
+	// Reading the body is what stores a new response
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// forwardMarked forwards req and marks the response with how the cache
+// handled it
+func (s *ProxyService) forwardMarked(ctx context.Context, customerID string, config *models.ProxyConfig, req *http.Request, status string) (*http.Response, error) {
+	resp, err := s.forward(ctx, customerID, config, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set(CacheHeader, status)
+	return resp, nil
+}
+
+// storeOnRead stores the response to a GET once its body was read in full,
+// when it may be cached, and drops the tags meant for the cache from it
+// either way
+func (s *ProxyService) storeOnRead(customerID string, policy *cachePolicy, req *http.Request, key string, resp *http.Response) {
+	tags := responseTags(resp.Header)
+	dropCacheTags(resp.Header)
+
+	received := time.Now()
+	if req.Method != http.MethodGet || !Storable(resp) {
+		return
+	}
+
+	entry := &cachedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     storedHeaders(resp.Header),
+		Date:       received.Add(-headerAge(resp.Header)),
+		Vary:       varyValues(resp.Header, req),
+		Tags:       tags,
+	}
+	store := func(body []byte) {
+		entry.Body = body
+		s.storeResponse(customerID, policy, req, key, entry)
+	}
+
+	if resp.Body == nil || resp.Body == http.NoBody || resp.ContentLength == 0 {
+		store(nil)
+		return
+	}
+	resp.Body = &cachingBody{ReadCloser: resp.Body, length: resp.ContentLength, store: store}
+}
+
+// storeResponse keeps entry for as long as it may be served or revalidated
+func (s *ProxyService) storeResponse(customerID string, policy *cachePolicy, req *http.Request, key string, entry *cachedResponse) {
+	fresh := entry.freshness(policy)
+	stale := max(entry.staleFor("stale-while-revalidate", policy), entry.staleFor("stale-if-error", policy))
+	ttl := fresh + stale - entry.age(time.Now())
+	if entry.Header.Get("ETag") != "" || entry.Header.Get("Last-Modified") != "" {
+		ttl = max(ttl, revalidationStorage)
+	}
+	if ttl <= 0 {
+		return
+	}
+	ttl = min(ttl, MaxCacheStorage)
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		s.metrics.RecordError(customerID, "cache_store_error")
+		return
+	}
+	tagSets := make([]string, len(entry.Tags))
+	for i, tag := range entry.Tags {
+		tagSets[i] = responseTagKey(customerID, tag)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheWriteTimeout)
+	defer cancel()
+	if err := s.cache.StoreResponse(ctx, key, responseIndexKey(customerID), req.URL.Path, tagSets, value, ttl, MaxCacheStorage); err != nil {
+		s.metrics.RecordError(customerID, "cache_store_error")
+	}
+}
+
+// loadResponse returns the response stored under key, or nil when there is
+// none that can be read
+func (s *ProxyService) loadResponse(ctx context.Context, customerID, key string) *cachedResponse {
+	value, err := s.cache.LoadResponse(ctx, key)
+	if err != nil {
+		if !cache.IsNotFound(err) {
+			s.metrics.RecordError(customerID, "cache_load_error")
+		}
+		return nil
+	}
+
+	var entry cachedResponse
+	if err := json.Unmarshal(value, &entry); err != nil {
+		s.metrics.RecordError(customerID, "cache_load_error")
+		return nil
+	}
+	return &entry
+}
+
+// PurgeResponses drops cached responses of a customer: those tagged with
+// any of tags and those whose path starts with pathPrefix. Without either,
+// all of them are dropped. It returns how many were.
+func (s *ProxyService) PurgeResponses(ctx context.Context, customerID, pathPrefix string, tags []string) (int64, error) {
+	index := responseIndexKey(customerID)
+
+	var purged int64
+	for _, tag := range tags {
+		n, err := s.cache.PurgeResponseTag(ctx, index, responseTagKey(customerID, tag))
+		if err != nil {
+			return purged, fmt.Errorf("failed to purge tag %q: %w", tag, err)
+		}
+		purged += n
+	}
+	if pathPrefix != "" || len(tags) == 0 {
+		n, err := s.cache.PurgeResponses(ctx, index, pathPrefix)
+		if err != nil {
+			return purged, fmt.Errorf("failed to purge responses: %w", err)
+		}
+		purged += n
+	}
+
+	s.metrics.RecordCachePurge(customerID, purged)
+	return purged, nil
+}
+
+// responseKey identifies the responses to GET requests like req: same path,
+// query and values of the policy's vary headers
+func responseKey(customerID string, req *http.Request, vary []string) string {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	canonicalQuery := query.Encode()
+	if err != nil {
+		canonicalQuery = req.URL.RawQuery
+	}
+
+	hash := sha256.New()
+	for _, part := range []string{http.MethodGet, req.URL.EscapedPath(), canonicalQuery} {
+		fmt.Fprintf(hash, "%d:%s", len(part), part)
+	}
+	for _, name := range vary {
+		value := strings.Join(req.Header.Values(name), ",")
+		fmt.Fprintf(hash, "%d:%s%d:%s", len(name), name, len(value), value)
+	}
+	return "response_cache:" + customerID + ":" + hex.EncodeToString(hash.Sum(nil))
+}
+
+func responseIndexKey(customerID string) string {
+	return "response_cache_index:" + customerID
+}
+
+func responseTagKey(customerID, tag string) string {
+	return "response_cache_tag:" + customerID + ":" + tag
+}
+
+// cacheableRequest reports whether req may be answered from or stored in
+// the cache
+func cacheableRequest(req *http.Request, directives CacheDirectives) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.ContentLength > 0 || req.Header.Get("Range") != "" {
+		return false
+	}
+	// Every request carries the customer's token in Authorization and the
+	// cache is the customer's own, so Authorization does not keep responses
+	// out of it; routes serving per-user responses list it in CacheVary
+	return !directives.Has("no-store")
+}
+
+// Storable reports whether resp may be stored (RFC 9111 section 3); it is
+// only kept when it can be served or revalidated later on
+func Storable(resp *http.Response) bool {
+	if !cacheableStatus[resp.StatusCode] {
+		return false
+	}
+	if resp.ContentLength > MaxCachedBodySize || len(resp.Trailer) > 0 {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" || strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+
+	directives := ParseCacheControl(resp.Header)
+	return !directives.Has("no-store") && !directives.Has("private")
+}
+
+// storedHeaders is what of the response headers is kept with it
+func storedHeaders(h http.Header) http.Header {
+	stored := h.Clone()
+	for _, name := range []string{CacheHeader, RetriesHeader, "Age", "Set-Cookie"} {
+		stored.Del(name)
+	}
+	return stored
+}
+
+// responseTags reads the comma separated Cache-Tag and space separated
+// Surrogate-Key headers
+func responseTags(h http.Header) []string {
+	var tags []string
+	for _, value := range h.Values("Cache-Tag") {
+		tags = append(tags, strings.Split(value, ",")...)
+	}
+	for _, value := range h.Values("Surrogate-Key") {
+		tags = append(tags, strings.Fields(value)...)
+	}
+
+	result := tags[:0]
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+func dropCacheTags(h http.Header) {
+	for _, name := range cacheTagHeaders {
+		h.Del(name)
+	}
+}
+
+// varyValues records req's values of the headers resp varies on
+func varyValues(h http.Header, req *http.Request) map[string]string {
+	var values map[string]string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				if values == nil {
+					values = make(map[string]string)
+				}
+				values[name] = strings.Join(req.Header.Values(name), ",")
+			}
+		}
+	}
+	return values
+}
+
+// headerAge is the Age a response arrived with
+func headerAge(h http.Header) time.Duration {
+	age, err := strconv.ParseInt(strings.TrimSpace(h.Get("Age")), 10, 64)
+	if err != nil || age < 0 {
+		return 0
+	}
+	return time.Duration(age) * time.Second
+}
+
+func pragmaNoCache(h http.Header) bool {
+	return h.Get("Cache-Control") == "" && strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache")
+}
+
+// matches reports whether the response was selected by the same values of
+// the headers it varies on as req has
+func (e *cachedResponse) matches(req *http.Request) bool {
+	for name, value := range e.Vary {
+		if strings.Join(req.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *cachedResponse) age(now time.Time) time.Duration {
+	return max(now.Sub(e.Date), 0)
+}
+
+// freshness is how long after its Date the response may be served without
+// revalidation
+func (e *cachedResponse) freshness(policy *cachePolicy) time.Duration {
+	return Freshness(e.Header, e.Date, policy.ttl)
+}
+
+// Freshness is how long after its date a response with header h may be
+// served without revalidation (RFC 9111 section 4.2.1). date stands in for
+// a missing or invalid Date header; responses that carry no freshness of
+// their own get ttl.
+func Freshness(h http.Header, date time.Time, ttl time.Duration) time.Duration {
+	directives := ParseCacheControl(h)
+	if directives.Has("no-cache") {
+		return 0
+	}
+	if lifetime, ok := directives.Seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := directives.Seconds("max-age"); ok {
+		return lifetime
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		// An invalid date means the response is already stale
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		if generated, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = generated
+		}
+		return max(expiresAt.Sub(date), 0)
+	}
+	return ttl
+}
+
+// staleFor is how long past its freshness the response may be served in
+// the case named by directive, stale-while-revalidate or stale-if-error.
+// Responses that must be revalidated never are.
+func (e *cachedResponse) staleFor(directive string, policy *cachePolicy) time.Duration {
+	directives := ParseCacheControl(e.Header)
+	for _, strict := range []string{"no-cache", "must-revalidate", "proxy-revalidate", "s-maxage"} {
+		if directives.Has(strict) {
+			return 0
+		}
+	}
+	if stale, ok := directives.Seconds(directive); ok {
+		return stale
+	}
+	return policy.stale
+}
+
+// conditional is req asking the upstream whether the response changed
+func (e *cachedResponse) conditional(ctx context.Context, req *http.Request) *http.Request {
+	conditional := req.Clone(ctx)
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		conditional.Header.Del(name)
+	}
+	if etag := e.Header.Get("ETag"); etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+	return conditional
+}
+
+// refresh takes the headers of a 304 answering a revalidation (RFC 9111
+// section 4.3.4)
+func (e *cachedResponse) refresh(h http.Header, received time.Time) {
+	for name, values := range storedHeaders(forwardableHeaders(h)) {
+		if name == "Content-Length" {
+			continue
+		}
+		e.Header[name] = values
+	}
+	e.Date = received.Add(-headerAge(h))
+}
+
+// response serves the stored response to req, or a 304 when req already
+// has it
+func (e *cachedResponse) response(req *http.Request, age time.Duration, status string) *http.Response {
+	notModified := e.notModified(req)
+	header := e.Header.Clone()
+	if notModified {
+		header = http.Header{}
+		for _, name := range []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"} {
+			for _, value := range e.Header.Values(name) {
+				header.Add(name, value)
+			}
+		}
+	}
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	header.Set(CacheHeader, status)
+
+	resp := &http.Response{
+		StatusCode:    e.StatusCode,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: -1,
+	}
+	switch {
+	case notModified:
+		resp.StatusCode = http.StatusNotModified
+	case bodyAllowed(http.MethodGet, e.StatusCode):
+		// HEAD gets the length of the body it does not get
+		resp.ContentLength = int64(len(e.Body))
+		setContentLength(header, resp.ContentLength)
+		if req.Method == http.MethodGet && len(e.Body) > 0 {
+			resp.Body = io.NopCloser(bytes.NewReader(e.Body))
+		}
+	}
+	return resp
+}
+
+// notModified evaluates the client's own preconditions against the stored
+// response (RFC 9110 section 13.2.2)
+func (e *cachedResponse) notModified(req *http.Request) bool {
+	if e.StatusCode != http.StatusOK {
+		return false
+	}
+	if ifNoneMatch := req.Header.Values("If-None-Match"); len(ifNoneMatch) > 0 {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		for _, value := range ifNoneMatch {
+			for _, candidate := range strings.Split(value, ",") {
+				candidate = strings.TrimSpace(candidate)
+				if candidate == "*" || (etag != "" && strings.TrimPrefix(candidate, "W/") == etag) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+// cachingBody keeps a copy of the body it relays and stores it once the
+// body was read in full. A body of known length is stored before its last
+// bytes are returned, so a client that got them finds it cached.
+type cachingBody struct {
+	io.ReadCloser
+	length int64 // -1 when unknown
+	buffer bytes.Buffer
+	store  func([]byte)
+	done   bool // stored, or too large to be
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done {
+		return n, err
+	}
+
+	b.buffer.Write(p[:n])
+	switch {
+	case err != nil && err != io.EOF, b.buffer.Len() > MaxCachedBodySize:
+		b.done = true
+		b.buffer = bytes.Buffer{}
+	case err == io.EOF || (b.length >= 0 && int64(b.buffer.Len()) == b.length):
+		b.done = true
+		b.store(b.buffer.Bytes())
+	}
+	return n, err
+}
+
+// CacheDirectives are the directives of Cache-Control headers by lowercase
+// name, with their unquoted arguments
+type CacheDirectives map[string]string
+
+// ParseCacheControl reads the directives of every Cache-Control header in h
+func ParseCacheControl(h http.Header) CacheDirectives {
+	directives := CacheDirectives{}
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(directive, "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(argument), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// Has reports whether the directive is present, with or without an argument
+func (d CacheDirectives) Has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// Seconds reads a delta-seconds argument (RFC 9111 section 1.2.2)
+func (d CacheDirectives) Seconds(name string) (time.Duration, bool) {
+	argument, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseUint(argument, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(min(seconds, math.MaxInt32)) * time.Second, true
+}
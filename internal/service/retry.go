@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RetriesHeader tells clients how often their request was retried
+const RetriesHeader = "X-Proxy-Retries"
+
+// IdempotencyKeyHeader lets clients have POST and PATCH requests retried
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// DefaultRetryBaseDelay is the first backoff when the customer's agent
+	// configuration sets no RetryDelay; it doubles with every retry
+	DefaultRetryBaseDelay = 100 * time.Millisecond
+	// MaxRetryDelay caps the backoff
+	MaxRetryDelay = 5 * time.Second
+
+	// Retries are budgeted per customer and replica: every request earns
+	// RetryBudgetRatio of a retry, up to RetryBudgetBurst saved, and every
+	// retry spends one, so an upstream that is down sees at most that much
+	// more traffic than it is sent
+	RetryBudgetRatio = 0.2
+	RetryBudgetBurst = 10
+)
+
+// retryPolicy is how often and how a customer's failed requests are tried
+// again
+type retryPolicy struct {
+	retries    int
+	baseDelay  time.Duration
+	otherAgent bool
+}
+
+// retryPolicy reads the retries from the proxy config, or from the
+// customer's stored agent configuration when the proxy config sets none.
+// The backoff starts at the agent configuration's RetryDelay.
+func (s *ProxyService) retryPolicy(customerID string, config *models.ProxyConfig) retryPolicy {
+	policy := retryPolicy{
+		retries:    config.RetryCount,
+		baseDelay:  DefaultRetryBaseDelay,
+		otherAgent: config.RetryOtherAgent,
+	}
+
+	// The built-in default configuration turns nothing on
+	if agentConfig := s.agentManager.GetCustomerConfig(customerID); agentConfig != nil && agentConfig.Revision > 0 {
+		if policy.retries == 0 {
+			policy.retries = agentConfig.RetryAttempts
+		}
+		if agentConfig.RetryDelay > 0 {
+			policy.baseDelay = agentConfig.RetryDelay
+		}
+	}
+	policy.retries = max(policy.retries, 0)
+	return policy
+}
+
+// retryable reports whether req may be sent again: idempotent requests
+// and, with an Idempotency-Key, POST and PATCH, as long as their body can be
+// sent again
+func retryable(req *http.Request, replayable bool) bool {
+	if !replayable {
+		return false
+	}
+	if idempotent(req.Method) {
+		return true
+	}
+	switch req.Method {
+	case http.MethodPost, http.MethodPatch:
+		return req.Header.Get(IdempotencyKeyHeader) != ""
+	}
+	return false
+}
+
+// ShouldRetry reports whether a failed attempt is worth another: it was
+// sent and got no response or a gateway error, and the deadline has not
+// passed. Requests that could not be sent, such as those without an agent
+// or upstream to go to, fail the same way the next time.
+func ShouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return errors.Is(err, ErrForwardFailed)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// BackoffDelay is how long to wait before retry number n, from 0: half of
+// baseDelay doubled n times, capped at MaxRetryDelay, plus a random share of
+// the other half
+func BackoffDelay(baseDelay time.Duration, n int) time.Duration {
+	delay := MaxRetryDelay
+	if n < 32 && baseDelay<<n > 0 && baseDelay<<n < MaxRetryDelay {
+		delay = baseDelay << n
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// backoff waits for the BackoffDelay of retry number n. It reports false
+// when ctx ended first.
+func backoff(ctx context.Context, baseDelay time.Duration, n int) bool {
+	timer := time.NewTimer(BackoffDelay(baseDelay, n))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retriedError is a request that failed after being retried
+type retriedError struct {
+	err     error
+	retries int
+}
+
+func (e *retriedError) Error() string { return e.err.Error() }
+func (e *retriedError) Unwrap() error { return e.err }
+
+// Retries returns how often the request that failed with err was retried
+func Retries(err error) int {
+	var retried *retriedError
+	if errors.As(err, &retried) {
+		return retried.retries
+	}
+	return 0
+}
+
+// retryBudget holds the retries a customer has saved up
+type retryBudget struct {
+	mutex  sync.Mutex
+	tokens float64
+}
+
+// retryBudget returns the customer's budget, which starts full
+func (s *ProxyService) retryBudget(customerID string) *retryBudget {
+	s.budgetMutex.Lock()
+	defer s.budgetMutex.Unlock()
+
+	budget, exists := s.retryBudgets[customerID]
+	if !exists {
+		budget = &retryBudget{tokens: RetryBudgetBurst}
+		s.retryBudgets[customerID] = budget
+	}
+	return budget
+}
+
+func (b *retryBudget) earn() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens = min(b.tokens+RetryBudgetRatio, RetryBudgetBurst)
+}
+
+func (b *retryBudget) spend() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type triedAgentsKey struct{}
+
+// triedAgents collects the agents earlier attempts of a request went to,
+// for retries that go to another one
+type triedAgents struct {
+	agentIDs []string
+}
+
+func withTriedAgents(ctx context.Context, tried *triedAgents) context.Context {
+	return context.WithValue(ctx, triedAgentsKey{}, tried)
+}
+
+func triedAgentsOf(ctx context.Context) *triedAgents {
+	tried, _ := ctx.Value(triedAgentsKey{}).(*triedAgents)
+	return tried
+}
+
+func (t *triedAgents) add(agentID string) {
+	if t != nil && !slices.Contains(t.agentIDs, agentID) {
+		t.agentIDs = append(t.agentIDs, agentID)
+	}
+}
+
+// untried filters out the agents already tried, returning agents itself
+// when that would leave none
+func (t *triedAgents) untried(agents []*agent.AgentConnection) []*agent.AgentConnection {
+	if t == nil || len(t.agentIDs) == 0 {
+		return agents
+	}
+
+	others := make([]*agent.AgentConnection, 0, len(agents))
+	for _, candidate := range agents {
+		if !slices.Contains(t.agentIDs, candidate.AgentID) {
+			others = append(others, candidate)
+		}
+	}
+	if len(others) == 0 {
+		return agents
+	}
+	return others
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"path"
+	"strings"
+
+	"proxy-service/internal/models"
+)
+
+// findRoute returns the first route matching method and path, or nil.
+// Patterns ending in "/**" match the prefix and everything below it, other
+// patterns use path.Match; a route without methods matches any method.
+func findRoute(routes []models.RouteConfig, method, requestPath string) *models.RouteConfig {
+	for i := range routes {
+		route := &routes[i]
+		if routeMatches(route.Path, requestPath) && methodMatches(route.Methods, method) {
+			return route
+		}
+	}
+	return nil
+}
+
+func routeMatches(pattern, requestPath string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return prefix == "" || requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+	}
+
+	matched, err := path.Match(pattern, requestPath)
+	return err == nil && matched
+}
+
+func methodMatches(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cloudflare"
+	"proxy-service/pkg/proxy"
+)
+
+// Routing modes, how requests reach a customer's upstream
+const (
+	// RoutingModeAgent relays requests through the customer's agents; it is
+	// the default
+	RoutingModeAgent = "agent"
+	// RoutingModeDirect sends requests straight to the proxy config's TargetURL
+	RoutingModeDirect = "direct"
+	// RoutingModeCloudflare sends requests to TargetURL through the
+	// Cloudflare tunnel
+	RoutingModeCloudflare = "cloudflare"
+)
+
+var (
+	ErrInvalidRoutingMode = fmt.Errorf("routing mode must be %s, %s or %s", RoutingModeAgent, RoutingModeDirect, RoutingModeCloudflare)
+	ErrNoTargetURL        = errors.New("no upstream URL is configured")
+	ErrTunnelUnavailable  = errors.New("cloudflare tunnel is not available")
+	// ErrForwardFailed is wrapped around the errors of requests that were
+	// sent, or may have been, and got no response
+	ErrForwardFailed = errors.New("failed to forward request")
+)
+
+// ValidRoutingMode reports whether mode is a routing mode; empty stands for
+// the default
+func ValidRoutingMode(mode string) bool {
+	switch mode {
+	case "", RoutingModeAgent, RoutingModeDirect, RoutingModeCloudflare:
+		return true
+	}
+	return false
+}
+
+// modeUnavailable marks a failure raised before the request was sent, so
+// the failover mode may still serve it
+type modeUnavailable struct {
+	err error
+}
+
+func (e *modeUnavailable) Error() string { return e.err.Error() }
+func (e *modeUnavailable) Unwrap() error { return e.err }
+
+func unavailable(err error) error {
+	return &modeUnavailable{err: err}
+}
+
+// routingModes is how a request is served, and what is tried when that fails
+type routingModes struct {
+	primary  string
+	failover string // empty for none
+}
+
+// routingModes resolves the modes of a request: the matching route's, else
+// the proxy config's. A request handed over by another replica is for its
+// agent only.
+func (s *ProxyService) routingModes(customerID string, config *models.ProxyConfig, req *http.Request) routingModes {
+	if _, pinned := pinnedAgent(req.Context()); pinned {
+		return routingModes{primary: RoutingModeAgent}
+	}
+
+	modes := routingModes{primary: config.RoutingMode, failover: config.FailoverMode}
+	if agentConfig := s.agentManager.GetCustomerConfig(customerID); agentConfig != nil {
+		if route := findRoute(agentConfig.Routes, req.Method, req.URL.Path); route != nil {
+			if route.RoutingMode != "" {
+				modes.primary = route.RoutingMode
+			}
+			if route.FailoverMode != "" {
+				modes.failover = route.FailoverMode
+			}
+		}
+	}
+
+	if modes.primary == "" {
+		modes.primary = RoutingModeAgent
+	}
+	if modes.failover == modes.primary {
+		modes.failover = ""
+	}
+	return modes
+}
+
+// RoutingMode returns the mode req is first tried with. Customers without a
+// proxy configuration are routed through agents, which refuse them.
+func (s *ProxyService) RoutingMode(ctx context.Context, customerID string, req *http.Request) string {
+	config, err := s.getProxyConfig(ctx, customerID)
+	if err != nil {
+		return RoutingModeAgent
+	}
+	return s.routingModes(customerID, config, req).primary
+}
+
+// SetTransportPool replaces the connection pools of the direct mode. It must
+// be called before requests are served.
+func (s *ProxyService) SetTransportPool(transports *proxy.TransportPool) {
+	s.transports.Close()
+	s.transports = transports
+}
+
+// RemoveCustomer lets go of the upstream connections and retry budget kept
+// for a customer that was removed
+func (s *ProxyService) RemoveCustomer(customerID string) {
+	s.transports.Remove(customerID)
+
+	s.budgetMutex.Lock()
+	delete(s.retryBudgets, customerID)
+	s.budgetMutex.Unlock()
+}
+
+// EnableCloudflareTunnel lets customers be routed through tunnel. It must be
+// called before requests are served.
+func (s *ProxyService) EnableCloudflareTunnel(tunnel *cloudflare.TunnelClient) {
+	s.tunnel = tunnel
+}
+
+// forwardVia serves req in one routing mode
+func (s *ProxyService) forwardVia(ctx context.Context, mode, customerID string, config *models.ProxyConfig, req *http.Request) (*http.Response, error) {
+	switch mode {
+	case RoutingModeAgent:
+		return s.forwardToAgent(ctx, customerID, config, req)
+	case RoutingModeDirect:
+		return s.forwardDirect(ctx, customerID, config, req)
+	case RoutingModeCloudflare:
+		return s.forwardThroughTunnel(ctx, customerID, config, req)
+	}
+	s.metrics.RecordError(customerID, "config_error")
+	return nil, unavailable(fmt.Errorf("%w, not %q", ErrInvalidRoutingMode, mode))
+}
+
+// shouldFailOver reports whether a request that failed with err is tried in
+// the failover mode. Requests that may have been sent are only tried again
+// when they are idempotent and their body can be sent again, and none is
+// once the deadline has passed.
+func shouldFailOver(ctx context.Context, err error, req *http.Request, replayable bool) bool {
+	if ctx.Err() != nil || errors.Is(err, agent.ErrInvalidSelector) {
+		return false
+	}
+	var notSent *modeUnavailable
+	if errors.As(err, &notSent) {
+		return true
+	}
+	return replayable && idempotent(req.Method)
+}
+
+// idempotent reports whether sending a request with method twice has the
+// same effect as sending it once (RFC 9110 section 9.2.2)
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads a body small enough to be held in memory, so the request
+// can be sent again. Larger or unknown-length bodies are left to be streamed
+// and the request cannot be replayed.
+func bufferBody(req *http.Request) (body []byte, replayable bool, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength < 0 || req.ContentLength > agentproto.MaxInlineBodySize {
+		return nil, false, nil
+	}
+
+	body, err = io.ReadAll(req.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Body.Close()
+	rewindBody(req, body)
+	return body, true, nil
+}
+
+// rewindBody makes req send body again
+func rewindBody(req *http.Request, body []byte) {
+	if body == nil {
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+}
+
+// forwardDirect sends req to the customer's upstream from this replica
+func (s *ProxyService) forwardDirect(ctx context.Context, customerID string, config *models.ProxyConfig, req *http.Request) (*http.Response, error) {
+	upstreamReq, err := upstreamRequest(ctx, config, req)
+	if err != nil {
+		s.metrics.RecordError(customerID, "routing_error")
+		return nil, err
+	}
+
+	transport, err := s.transports.Transport(customerID, upstreamReq.URL, config.UpstreamTLS)
+	if err != nil {
+		s.metrics.RecordError(customerID, "config_error")
+		return nil, unavailable(err)
+	}
+
+	// Redirects are passed on to the caller as they are
+	resp, err := transport.RoundTrip(upstreamReq)
+	if err != nil {
+		s.metrics.RecordError(customerID, "forward_error")
+		return nil, fmt.Errorf("%w: %w", ErrForwardFailed, err)
+	}
+	resp.Header = forwardableHeaders(resp.Header)
+	return resp, nil
+}
+
+// forwardThroughTunnel sends req to the customer's upstream through the
+// Cloudflare tunnel
+func (s *ProxyService) forwardThroughTunnel(ctx context.Context, customerID string, config *models.ProxyConfig, req *http.Request) (*http.Response, error) {
+	if s.tunnel == nil || !s.tunnel.Healthy() {
+		s.metrics.RecordError(customerID, "routing_error")
+		return nil, unavailable(ErrTunnelUnavailable)
+	}
+
+	upstreamReq, err := upstreamRequest(ctx, config, req)
+	if err != nil {
+		s.metrics.RecordError(customerID, "routing_error")
+		return nil, err
+	}
+	upstreamReq.Header.Set("CF-Customer-ID", customerID)
+
+	resp, err := s.tunnel.ForwardRequest(ctx, upstreamReq)
+	if err != nil {
+		s.metrics.RecordError(customerID, "forward_error")
+		return nil, fmt.Errorf("%w through tunnel: %w", ErrForwardFailed, err)
+	}
+	resp.Header = forwardableHeaders(resp.Header)
+	return resp, nil
+}
+
+// upstreamRequest addresses req to the customer's TargetURL: the request path
+// is appended to the target's and both queries are kept
+func upstreamRequest(ctx context.Context, config *models.ProxyConfig, req *http.Request) (*http.Request, error) {
+	target, err := url.Parse(config.TargetURL)
+	if config.TargetURL == "" || err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil, unavailable(ErrNoTargetURL)
+	}
+
+	upstreamURL := *target
+	upstreamURL.Path, upstreamURL.RawPath = joinURLPath(target, req.URL)
+	if req.URL.RawQuery != "" {
+		if upstreamURL.RawQuery != "" {
+			upstreamURL.RawQuery += "&"
+		}
+		upstreamURL.RawQuery += req.URL.RawQuery
+	}
+
+	upstreamReq := req.Clone(ctx)
+	upstreamReq.RequestURI = ""
+	upstreamReq.URL = &upstreamURL
+	upstreamReq.Host = target.Host
+	upstreamReq.Header = requestHeaders(req.Header)
+	return upstreamReq, nil
+}
+
+// joinURLPath appends the path of b to that of a as httputil.ReverseProxy
+// does: without cleaning it, so "//" and ".." reach the upstream as the
+// client sent them, and keeping escapes such as %2F
+func joinURLPath(a, b *url.URL) (path, rawPath string) {
+	aPath, bPath := a.EscapedPath(), b.EscapedPath()
+	switch aSlash, bSlash := strings.HasSuffix(aPath, "/"), strings.HasPrefix(bPath, "/"); {
+	case aSlash && bSlash:
+		return a.Path + strings.TrimPrefix(b.Path, "/"), aPath + bPath[1:]
+	case !aSlash && !bSlash:
+		return a.Path + "/" + b.Path, aPath + "/" + bPath
+	}
+	return a.Path + b.Path, aPath + bPath
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+)
+
+// AgentSelectorHeader lets a caller pick the agents for one request by
+// their labels, e.g. "X-Agent-Selector: datacenter=fra1". It overrides the
+// configured selectors and is never forwarded.
+const AgentSelectorHeader = "X-Agent-Selector"
+
+var ErrNoMatchingAgent = errors.New("no agent matches the selector")
+
+// agentRouting is which of the customer's agents may serve a request
+type agentRouting struct {
+	selector agent.Selector
+	// fallback routes to any agent when none matches the selector
+	fallback bool
+}
+
+// routingFor resolves the selector of a request: the header, else the one
+// of the matching route, else the proxy config's. req is nil for requests
+// that are not HTTP, which only use the proxy config.
+func (s *ProxyService) routingFor(customerID string, config *models.ProxyConfig, req *http.Request) (*agentRouting, error) {
+	expression := config.AgentSelector
+	fallback := config.SelectorFallback
+
+	if req != nil {
+		if agentConfig := s.agentManager.GetCustomerConfig(customerID); agentConfig != nil {
+			if route := findRoute(agentConfig.Routes, req.Method, req.URL.Path); route != nil {
+				if route.AgentSelector != "" {
+					expression = route.AgentSelector
+				}
+				if route.SelectorFallback != "" {
+					fallback = route.SelectorFallback
+				}
+			}
+		}
+		if header := req.Header.Get(AgentSelectorHeader); header != "" {
+			expression = header
+		}
+	}
+
+	selector, err := agent.ParseSelector(expression)
+	if err != nil {
+		return nil, err
+	}
+	return &agentRouting{
+		selector: selector,
+		fallback: fallback == agent.SelectorFallbackAny,
+	}, nil
+}
+
+// labelled filters agents down to those matching selector, returning agents
+// itself for the empty selector
+func labelled(agents []*agent.AgentConnection, selector agent.Selector) []*agent.AgentConnection {
+	if selector.Empty() {
+		return agents
+	}
+
+	matching := make([]*agent.AgentConnection, 0, len(agents))
+	for _, candidate := range agents {
+		if selector.Matches(candidate.Labels()) {
+			matching = append(matching, candidate)
+		}
+	}
+	return matching
+}
+
+// labelledLocations is labelled for agents connected to other replicas
+func labelledLocations(locations []agent.AgentLocation, selector agent.Selector) []agent.AgentLocation {
+	if selector.Empty() {
+		return locations
+	}
+
+	matching := make([]agent.AgentLocation, 0, len(locations))
+	for _, location := range locations {
+		if selector.Matches(location.Labels) {
+			matching = append(matching, location)
+		}
+	}
+	return matching
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"os"
 	"proxy-service/internal/config"
 	"proxy-service/internal/repository"
 	"proxy-service/internal/service/agent"
@@ -8,12 +9,14 @@ import (
 	"proxy-service/pkg/cloudflare"
 	"proxy-service/pkg/database"
 	"proxy-service/pkg/metrics"
+	"proxy-service/pkg/proxy"
 )
 
 type Services struct {
 	Auth    *AuthService
 	Proxy   *ProxyService
 	Metrics *MetricsService
+	Agents  *agent.AgentManager
 }
 
 type Deps struct {
@@ -22,6 +25,7 @@ type Deps struct {
 	Cache        *cache.RedisCache
 	Metrics      *metrics.MetricsCollector
 	TunnelClient *cloudflare.TunnelClient
+	AgentCA      *agent.CertificateAuthority // nil disables agent client certificates
 	cache        *cache.Cache
 }
 
@@ -31,16 +35,60 @@ func NewServices(deps Deps) *Services {
 	authRepo := repository.NewAuthRepository(db, deps.Cache)
 	// proxyRepo := repository.NewProxyRepository(db, deps.Cache)
 	metricsRepo := repository.NewMetricsRepository(db)
+	agentRepo := repository.NewAgentRepository(db)
+	commandRepo := repository.NewCommandRepository(db)
+	sessionRepo := repository.NewSessionRepository(db)
 
 	agentManager := agent.NewAgentManager(deps.Metrics, deps.cache)
+	agentManager.SetHandshakePolicy(agent.HandshakePolicy{
+		MinProtocolVersion: deps.Config.Agent.MinProtocolVersion,
+		Timeout:            deps.Config.Agent.HandshakeTimeout,
+	})
+	health := deps.Config.Agent.Health
+	agentManager.SetHealthPolicy(agent.HealthPolicy{
+		Window:            health.Window,
+		MinRequests:       health.MinRequests,
+		MaxErrorRate:      health.MaxErrorRate,
+		MaxTimeoutRate:    health.MaxTimeoutRate,
+		MaxLatencyP99:     health.MaxLatencyP99,
+		BaseEjection:      health.BaseEjection,
+		MaxEjection:       health.MaxEjection,
+		MaxEjectedPercent: health.MaxEjectedPercent,
+	})
+	agentManager.SetRegistry(agent.NewRegistry(agentRepo, deps.Cache))
+	agentManager.SetCommandLog(agent.NewCommandLog(commandRepo, deps.Cache))
+	agentManager.SetSessionHistory(agent.NewSessionHistory(sessionRepo))
+	agentManager.SetCredentialStore(agent.NewCredentialStore(deps.Cache, agent.CredentialPolicy{
+		TokenTTL:        deps.Config.Agent.ConnectTokenTTL,
+		RotationOverlap: deps.Config.Agent.CredentialOverlap,
+	}))
+
+	if deps.AgentCA != nil {
+		agentManager.SetCertificateAuthority(deps.AgentCA)
+	}
 
 	authService, _ := NewAuthService(authRepo, deps.Cache, deps.Config, deps.Metrics)
 	proxyService := NewProxyService(agentManager, deps.Cache, deps.Metrics)
+
+	if cluster := deps.Config.Cluster; cluster.AdvertiseAddress != "" {
+		replicaID := cluster.ReplicaID
+		if replicaID == "" {
+			replicaID, _ = os.Hostname()
+		}
+		directory := agent.NewDirectory(deps.Cache, agent.Replica{ID: replicaID, Address: cluster.AdvertiseAddress}, cluster.LeaseTTL)
+		agentManager.SetDirectory(directory)
+		proxyService.EnableCluster(directory, cluster.Secret)
+	}
+	proxyService.SetTransportPool(proxy.NewTransportPool(deps.Config.Proxy.Transport, deps.Metrics))
+	if deps.TunnelClient != nil {
+		proxyService.EnableCloudflareTunnel(deps.TunnelClient)
+	}
 	metricsService := NewMetricsService(metricsRepo, deps.Metrics)
 
 	return &Services{
 		Auth:    authService,
 		Proxy:   proxyService,
 		Metrics: metricsService,
+		Agents:  agentManager,
 	}
 }
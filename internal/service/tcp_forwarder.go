@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+)
+
+// defaultTCPDialTimeout bounds how long the agent may take to reach a target
+// when the customer has no timeout configured
+const defaultTCPDialTimeout = 30 * time.Second
+
+var ErrTCPTargetNotAllowed = errors.New("tcp target not allowed")
+
+// OpenTCPStream asks one of the customer's agents to connect to address,
+// which must be one of the customer's TCP targets
+func (s *ProxyService) OpenTCPStream(ctx context.Context, customerID, address string) (*agent.TunnelStream, *models.TCPTarget, error) {
+	config, err := s.getProxyConfig(ctx, customerID)
+	if err != nil {
+		s.metrics.RecordError(customerID, "config_error")
+		return nil, nil, fmt.Errorf("failed to get proxy config: %w", err)
+	}
+
+	target := findTCPTarget(config.TCPTargets, address)
+	if target == nil {
+		// Clients pick the address, so it is kept out of the labels
+		s.metrics.RecordTCPConnection(customerID, "unlisted", "not_allowed")
+		return nil, nil, fmt.Errorf("%w: %s", ErrTCPTargetNotAllowed, address)
+	}
+	label := tcpTargetLabel(target)
+
+	agentID, err := s.getAgentForCustomer(customerID, config, nil, agentproto.CapabilityTCPTunnels)
+	if err != nil {
+		s.metrics.RecordTCPConnection(customerID, label, "routing_error")
+		return nil, nil, fmt.Errorf("failed to get agent: %w", err)
+	}
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultTCPDialTimeout
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	response, err := s.agentManager.RouteRequest(dialCtx, agentID, &agent.ProxyRequest{ProxyRequest: agentproto.ProxyRequest{
+		Method:     http.MethodConnect,
+		Path:       target.Address,
+		CustomerID: customerID,
+		Tunnel:     true,
+	}})
+	if err != nil {
+		s.metrics.RecordTCPConnection(customerID, label, "forward_error")
+		return nil, nil, fmt.Errorf("failed to open tcp stream: %w", err)
+	}
+
+	if response.Tunnel == nil {
+		if response.BodyStream != nil {
+			response.BodyStream.Close()
+		}
+		s.metrics.RecordTCPConnection(customerID, label, "refused")
+		return nil, nil, fmt.Errorf("agent refused connection to %s with status %d", target.Address, response.StatusCode)
+	}
+
+	s.metrics.RecordTCPConnection(customerID, label, "opened")
+	return response.Tunnel.Stream(), target, nil
+}
+
+// PipeTCP copies bytes both ways between a client connection and an agent
+// stream, counting them per direction. It returns once both are closed.
+func (s *ProxyService) PipeTCP(customerID string, target *models.TCPTarget, client net.Conn, stream *agent.TunnelStream) {
+	label := tcpTargetLabel(target)
+	s.metrics.UpdateActiveTCPConnections(customerID, 1)
+	defer s.metrics.UpdateActiveTCPConnections(customerID, -1)
+
+	// Target to client
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		io.Copy(&countingWriter{w: client, count: func(n int) {
+			s.metrics.RecordTCPBytes(customerID, label, "target_to_client", n)
+		}}, stream)
+		client.Close()
+	}()
+
+	// Client to target
+	io.Copy(&countingWriter{w: stream, count: func(n int) {
+		s.metrics.RecordTCPBytes(customerID, label, "client_to_target", n)
+	}}, client)
+	stream.Close()
+
+	<-copied
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count func(n int)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		cw.count(n)
+	}
+	return n, err
+}
+
+// findTCPTarget returns the allowlisted target with the given address; host
+// names compare case-insensitively
+func findTCPTarget(targets []models.TCPTarget, address string) *models.TCPTarget {
+	for i := range targets {
+		if strings.EqualFold(targets[i].Address, address) {
+			return &targets[i]
+		}
+	}
+	return nil
+}
+
+func tcpTargetLabel(target *models.TCPTarget) string {
+	if target.Name != "" {
+		return target.Name
+	}
+	return target.Address
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// closeGracePeriod is how long the client gets to answer a close frame
+	// relayed from the agent before the socket is dropped
+	closeGracePeriod = 5 * time.Second
+	writeWait        = 10 * time.Second
+)
+
+// The agent runs its own handshake with the upstream, so these belong to
+// this hop only
+var webSocketHandshakeHeaders = []string{
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Accept",
+	"Sec-Websocket-Extensions",
+}
+
+// OpenTunnel asks an agent to open a WebSocket to the upstream for an upgrade
+// request. When the agent accepts, the returned tunnel is ready to relay and
+// the response carries the headers to upgrade the client with (including the
+// chosen subprotocol). Otherwise the tunnel is nil and the response is the
+// agent's refusal, to be passed on like any other response.
+func (s *ProxyService) OpenTunnel(ctx context.Context, req *http.Request) (*agent.Tunnel, *http.Response, error) {
+	customerID := ctx.Value("customer_id").(string)
+
+	config, err := s.getProxyConfig(ctx, customerID)
+	if err != nil {
+		s.metrics.RecordTunnelRejected(customerID, "config_error")
+		return nil, nil, fmt.Errorf("failed to get proxy config: %w", err)
+	}
+
+	headerPolicy := s.headerPolicy(ctx, customerID, config, req)
+	req = headerPolicy.rewriteRequest(req)
+
+	agentID, err := s.getAgentForCustomer(customerID, config, req, agentproto.CapabilityWebSocketTunnels)
+	if err != nil {
+		s.metrics.RecordTunnelRejected(customerID, "routing_error")
+		return nil, nil, fmt.Errorf("failed to get agent: %w", err)
+	}
+
+	headers := requestHeaders(req.Header)
+	for _, name := range webSocketHandshakeHeaders {
+		headers.Del(name)
+	}
+
+	proxyReq := &agent.ProxyRequest{ProxyRequest: agentproto.ProxyRequest{
+		Method:     req.Method,
+		Path:       req.URL.EscapedPath(),
+		RawQuery:   req.URL.RawQuery,
+		Headers:    headers,
+		CustomerID: customerID,
+		Tunnel:     true,
+	}}
+
+	// The timeout covers the upstream handshake, not the life of the tunnel
+	cancel := context.CancelFunc(func() {})
+	if timeout := s.requestTimeout(customerID, config, req); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	response, err := s.agentManager.RouteRequest(ctx, agentID, proxyReq)
+	if err != nil {
+		cancel()
+		s.metrics.RecordTunnelRejected(customerID, "forward_error")
+		return nil, nil, fmt.Errorf("failed to open tunnel: %w", err)
+	}
+
+	if response.Tunnel == nil {
+		if response.BodyStream != nil {
+			response.BodyStream = &cancelOnClose{ReadCloser: response.BodyStream, cancel: cancel}
+		} else {
+			cancel()
+		}
+		s.metrics.RecordTunnelRejected(customerID, "refused")
+		resp := s.createHTTPResponse(req.Method, &ProxyResponse{
+			StatusCode: response.StatusCode,
+			Headers:    response.Headers,
+			Body:       response.Body,
+			BodyStream: response.BodyStream,
+			Trailers:   response.Trailers,
+		})
+		headerPolicy.rewriteResponse(resp.Header)
+		return nil, resp, nil
+	}
+	cancel()
+
+	upgradeHeaders := forwardableHeaders(response.Headers)
+	for _, name := range webSocketHandshakeHeaders {
+		upgradeHeaders.Del(name)
+	}
+	upgradeHeaders.Del("Content-Length")
+	headerPolicy.rewriteResponse(upgradeHeaders)
+
+	return response.Tunnel, &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     upgradeHeaders,
+		Body:       http.NoBody,
+	}, nil
+}
+
+// RelayTunnel copies messages between an upgraded client and an agent tunnel
+// until either side closes, passing the close code on to the other side. It
+// closes both when done.
+func (s *ProxyService) RelayTunnel(customerID string, client *websocket.Conn, tunnel *agent.Tunnel) {
+	start := time.Now()
+	s.metrics.RecordTunnelOpened(customerID)
+	defer func() {
+		s.metrics.RecordTunnelClosed(customerID, time.Since(start))
+	}()
+	defer client.Close()
+
+	// Agent to client
+	relayed := make(chan struct{})
+	go func() {
+		defer close(relayed)
+		for {
+			messageType, data, err := tunnel.ReadMessage()
+			if err != nil {
+				code, text := closeStatus(err)
+				client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeWait))
+				// Wait for the client's close frame, but not forever
+				client.SetReadDeadline(time.Now().Add(closeGracePeriod))
+				return
+			}
+
+			if err := client.WriteMessage(messageType, data); err != nil {
+				tunnel.Close(websocket.CloseGoingAway, "client write failed")
+				return
+			}
+			s.metrics.RecordTunnelMessage(customerID, "agent_to_client")
+		}
+	}()
+
+	// Client to agent
+	for {
+		messageType, data, err := client.ReadMessage()
+		if err != nil {
+			code, text := closeStatus(err)
+			tunnel.Close(code, text)
+			break
+		}
+
+		if err := tunnel.WriteMessage(messageType, data); err != nil {
+			client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "agent unavailable"), time.Now().Add(writeWait))
+			tunnel.Close(websocket.CloseInternalServerErr, "")
+			break
+		}
+		s.metrics.RecordTunnelMessage(customerID, "client_to_agent")
+	}
+
+	<-relayed
+}
+
+// closeStatus maps the error that ended one side of a tunnel to the close
+// code for the other. 1006 (abnormal closure) can never be sent in a close
+// frame, so a vanished peer is reported as 1011.
+func closeStatus(err error) (int, string) {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+		return closeErr.Code, closeErr.Text
+	}
+	return websocket.CloseInternalServerErr, "peer connection lost"
+}
@@ -0,0 +1,122 @@
+package agentclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"proxy-service/pkg/agentproto"
+)
+
+// RequestCertificate generates a key and has the proxy sign a client
+// certificate for it at endpoint, e.g.
+// https://proxy.example.com/api/v1/agents/certificates. The agent proves who
+// it is with a bootstrap token, or, with an empty token, with the current
+// certificate httpClient presents. It returns the certificate and the key,
+// PEM encoded.
+func RequestCertificate(ctx context.Context, httpClient *http.Client, endpoint, bootstrapToken string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"bootstrap_token": bootstrapToken,
+		"csr":             string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("certificate request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, nil, fmt.Errorf("certificate request failed with status %d", resp.StatusCode)
+	}
+
+	var issued agentproto.AgentCertificate
+	if err := json.NewDecoder(resp.Body).Decode(&issued); err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate response: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(issued.Certificate), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// CertificateSource holds the agent's current client certificate so it can
+// be replaced while the client runs. Set GetClientCertificate of the
+// client's TLS config to its method of the same name.
+type CertificateSource struct {
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func NewCertificateSource(certPEM, keyPEM []byte) (*CertificateSource, error) {
+	source := &CertificateSource{}
+	if err := source.Set(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// Set replaces the certificate presented on the next connection
+func (s *CertificateSource) Set(certPEM, keyPEM []byte) error {
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid client certificate: %w", err)
+	}
+	if certificate.Leaf == nil {
+		if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return fmt.Errorf("invalid client certificate: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certificate = &certificate
+	return nil
+}
+
+// NotAfter is when the current certificate expires
+func (s *CertificateSource) NotAfter() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certificate.Leaf.NotAfter
+}
+
+func (s *CertificateSource) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certificate, nil
+}
+
+// hasClientCertificate reports whether the TLS config presents a client
+// certificate
+func hasClientCertificate(config *tls.Config) bool {
+	return config != nil && (len(config.Certificates) > 0 || config.GetClientCertificate != nil)
+}
@@ -0,0 +1,372 @@
+// Package agentclient is the reference implementation of the agent side of
+// /api/v1/agents/connect. A Client keeps one WebSocket to the proxy open,
+// serves the proxy requests it receives against a local upstream, reports
+// heartbeats and process metrics, and reconnects when the connection drops.
+package agentclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/logger"
+
+	"github.com/gorilla/websocket"
+)
+
+// Version is the agent software version reported in the hello
+const Version = "1.0.0"
+
+// errGoAway ends a session the proxy asked to move to another replica
+var errGoAway = errors.New("proxy sent goaway")
+
+// errRestart ends a session an operator asked to restart
+var errRestart = errors.New("restart requested")
+
+const (
+	DefaultHeartbeatInterval = 30 * time.Second
+	DefaultMetricsInterval   = 30 * time.Second
+	DefaultMinBackoff        = time.Second
+	DefaultMaxBackoff        = time.Minute
+
+	handshakeTimeout = 10 * time.Second
+	writeWait        = 10 * time.Second
+)
+
+// Config describes how to reach the proxy and the upstream to serve
+type Config struct {
+	// ServerURL is the proxy's agent endpoint, e.g.
+	// wss://proxy.example.com/api/v1/agents/connect
+	ServerURL  string
+	AgentID    string
+	CustomerID string
+	// APIKey is the customer's API key; it signs the connection token and
+	// is never sent
+	APIKey string
+	// CredentialID and Secret are the agent's own credential. When set they
+	// sign single-use connect tokens instead of the API key.
+	CredentialID string
+	Secret       string
+	// Upstream is the base URL requests are served against, e.g.
+	// http://localhost:8080
+	Upstream string
+	// Subprotocol selects the codec; empty means agent.SubprotocolBinary
+	Subprotocol string
+
+	// Intervals used until the proxy sends a config_update
+	HeartbeatInterval time.Duration
+	MetricsInterval   time.Duration
+
+	// Reconnect backoff bounds; each wait is jittered
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// TLSConfig may carry a client certificate, which authenticates the
+	// agent without an API key or credential
+	TLSConfig  *tls.Config
+	HTTPClient *http.Client
+	Logger     *logger.Logger
+}
+
+// Client is a long running agent. It is safe for concurrent use.
+type Client struct {
+	config     Config
+	httpClient *http.Client
+	dialer     *websocket.Dialer
+	logger     *logger.Logger
+	process    *processSampler
+	stats      *requestStats
+	errors     *errorLog
+	startedAt  time.Time
+
+	mutex        sync.RWMutex
+	agentConfig  *agentproto.AgentConfig
+	reconfigured chan struct{} // closed and replaced on every config change
+	connected    bool
+}
+
+// New validates the configuration and fills in defaults
+func New(config Config) (*Client, error) {
+	if config.ServerURL == "" || config.AgentID == "" || config.CustomerID == "" {
+		return nil, errors.New("server URL, agent ID and customer ID are required")
+	}
+	if config.APIKey == "" && (config.CredentialID == "" || config.Secret == "") && !hasClientCertificate(config.TLSConfig) {
+		return nil, errors.New("an API key, a credential ID and secret, or a client certificate are required")
+	}
+	if config.Upstream == "" {
+		return nil, errors.New("upstream is required")
+	}
+	if config.Subprotocol == "" {
+		config.Subprotocol = agentproto.SubprotocolBinary
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.MetricsInterval <= 0 {
+		config.MetricsInterval = DefaultMetricsInterval
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = DefaultMaxBackoff
+		if config.MaxBackoff < config.MinBackoff {
+			config.MaxBackoff = config.MinBackoff
+		}
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{
+			// Redirects are the caller's business, pass them on as they are
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	log := config.Logger
+	if log == nil {
+		log = logger.NewLogger()
+	}
+
+	return &Client{
+		config:     config,
+		httpClient: httpClient,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: handshakeTimeout,
+			TLSClientConfig:  config.TLSConfig,
+			Subprotocols:     []string{config.Subprotocol},
+		},
+		logger:       log,
+		process:      newProcessSampler(),
+		stats:        &requestStats{},
+		errors:       &errorLog{},
+		startedAt:    time.Now(),
+		reconfigured: make(chan struct{}),
+	}, nil
+}
+
+// Run keeps the agent connected until ctx is done, reconnecting with
+// jittered exponential backoff. It only returns ctx.Err().
+func (c *Client) Run(ctx context.Context) error {
+	backoff := c.config.MinBackoff
+	for {
+		connectedAt := time.Now()
+		err := c.runSession(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// The proxy replica is going away or an operator asked for a
+		// restart, connect again right away
+		if err == errGoAway || err == errRestart {
+			backoff = c.config.MinBackoff
+			continue
+		}
+
+		// A session that lasted a while was healthy, start over
+		if time.Since(connectedAt) > c.config.MaxBackoff {
+			backoff = c.config.MinBackoff
+		}
+
+		wait := jitter(backoff)
+		c.errors.record(fmt.Sprintf("disconnected: %v", err))
+		c.logger.Error("Agent disconnected, reconnecting",
+			"error", err,
+			"agent_id", c.config.AgentID,
+			"retry_in", wait.String())
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+// jitter spreads reconnects over [d/2, d) so agents cut off together do not
+// come back together
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// Connected reports whether the agent currently holds a connection
+func (c *Client) Connected() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.connected
+}
+
+// AgentConfig returns the last configuration pushed by the proxy, or nil
+// when none has arrived yet
+func (c *Client) AgentConfig() *agentproto.AgentConfig {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.agentConfig
+}
+
+func (c *Client) setConnected(connected bool) {
+	c.mutex.Lock()
+	c.connected = connected
+	c.mutex.Unlock()
+}
+
+// applyConfig stores a config_update; the intervals and limits it carries
+// take effect from the next tick or request. Invalid configurations are
+// refused and the previous one stays in place.
+func (c *Client) applyConfig(config *agentproto.AgentConfig) error {
+	if config.MaxConnections < 0 || config.RequestTimeout < 0 || config.HeartbeatInterval < 0 || config.Monitoring.MetricsInterval < 0 {
+		c.errors.record(fmt.Sprintf("refused configuration revision %d", config.Revision))
+		c.logger.Error("Refusing agent configuration",
+			"agent_id", c.config.AgentID,
+			"revision", config.Revision)
+		return errors.New("limits and intervals must not be negative")
+	}
+
+	c.mutex.Lock()
+	changed := c.agentConfig == nil || c.agentConfig.Revision != config.Revision || !c.agentConfig.LastUpdated.Equal(config.LastUpdated)
+	c.agentConfig = config
+	if changed {
+		close(c.reconfigured)
+		c.reconfigured = make(chan struct{})
+	}
+	c.mutex.Unlock()
+
+	if changed {
+		c.logger.Info("Applied agent configuration",
+			"agent_id", c.config.AgentID,
+			"revision", config.Revision,
+			"heartbeat_interval", config.HeartbeatInterval.String(),
+			"metrics_interval", config.Monitoring.MetricsInterval.String(),
+			"max_connections", config.MaxConnections)
+	}
+	return nil
+}
+
+// heartbeatInterval returns the current interval and a channel that is
+// closed once a new configuration may have changed it
+func (c *Client) heartbeatInterval() (time.Duration, <-chan struct{}) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.agentConfig != nil && c.agentConfig.HeartbeatInterval > 0 {
+		return c.agentConfig.HeartbeatInterval, c.reconfigured
+	}
+	return c.config.HeartbeatInterval, c.reconfigured
+}
+
+func (c *Client) metricsInterval() (time.Duration, <-chan struct{}) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.agentConfig != nil && c.agentConfig.Monitoring.MetricsInterval > 0 {
+		return c.agentConfig.Monitoring.MetricsInterval, c.reconfigured
+	}
+	return c.config.MetricsInterval, c.reconfigured
+}
+
+// requestLimits returns the per-request timeout and the number of requests
+// served at once; zero means unlimited
+func (c *Client) requestLimits() (time.Duration, int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.agentConfig == nil {
+		return 0, 0
+	}
+	return c.agentConfig.RequestTimeout, c.agentConfig.MaxConnections
+}
+
+// hello advertises what this agent implements. Tunnels are left out since
+// it does not relay them.
+func (c *Client) hello() agentproto.HelloPayload {
+	capabilities := []string{agentproto.CapabilityStreaming, agentproto.CapabilityCompression, agentproto.CapabilityCommands}
+	if c.config.Subprotocol == agentproto.SubprotocolBinary {
+		capabilities = append(capabilities, agentproto.CapabilityBinaryCodec)
+	}
+	return agentproto.HelloPayload{
+		ProtocolVersion: agentproto.ProtocolVersion,
+		AgentVersion:    Version,
+		Capabilities:    capabilities,
+	}
+}
+
+// dial opens the WebSocket with a freshly signed token
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	header := http.Header{}
+	header.Set("X-Agent-ID", c.config.AgentID)
+	header.Set("X-Customer-ID", c.config.CustomerID)
+	if token := c.token(); token != "" {
+		header.Set("X-Agent-Token", token)
+	}
+
+	conn, resp, err := c.dialer.DialContext(ctx, c.config.ServerURL, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("connect failed with status %d: %w", resp.StatusCode, err)
+		}
+		return nil, fmt.Errorf("connect failed: %w", err)
+	}
+	return conn, nil
+}
+
+// token signs the X-Agent-Token, with the agent's credential when it has one.
+// It is empty for agents that only authenticate with a client certificate.
+func (c *Client) token() string {
+	switch {
+	case c.config.Secret != "":
+		return agentproto.NewConnectToken(c.config.AgentID, c.config.CustomerID, c.config.CredentialID, c.config.Secret)
+	case c.config.APIKey != "":
+		return agentproto.SignToken(c.config.AgentID, c.config.CustomerID, c.config.APIKey, time.Now())
+	}
+	return ""
+}
+
+// runSession serves one connection. When the proxy sends a goaway it
+// returns errGoAway at once and leaves the old session to finish its
+// requests, so the next connection is dialed alongside.
+func (c *Client) runSession(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	s := newSession(c, conn)
+	c.setConnected(true)
+
+	c.logger.Info("Agent connected",
+		"agent_id", c.config.AgentID,
+		"customer_id", c.config.CustomerID,
+		"codec", s.codec.Name())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		c.setConnected(false)
+		if s.restarting() {
+			return errRestart
+		}
+		return err
+	case <-s.goAway:
+		c.setConnected(false)
+		return errGoAway
+	}
+}
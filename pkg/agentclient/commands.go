@@ -0,0 +1,155 @@
+package agentclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"proxy-service/pkg/agentproto"
+)
+
+const (
+	// maxGoroutineDump bounds the goroutine dump sent with diagnostics
+	maxGoroutineDump = 256 << 10
+	// recentErrorCount is how many errors diagnostics report
+	recentErrorCount = 20
+	// upstreamCheckTimeout bounds the upstream connectivity check
+	upstreamCheckTimeout = 5 * time.Second
+)
+
+// startCommand runs an operator command on its own goroutine and answers
+// with its result. A restart ends the session once the answer is sent.
+func (s *session) startCommand(msg *agentproto.WSMessage) {
+	var command agentproto.CommandPayload
+	if err := msg.Decode(&command); err != nil {
+		s.sendError(msg.RequestID, "invalid command format")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	if command.Deadline != nil {
+		ctx, cancel = withDeadline(ctx, cancel, *command.Deadline)
+	}
+
+	go func() {
+		defer cancel()
+		result := s.runCommand(ctx, &command)
+		if err := s.send(agentproto.MessageTypeCommandResult, msg.RequestID, result); err != nil {
+			return
+		}
+
+		s.client.logger.Info("Ran agent command",
+			"agent_id", s.client.config.AgentID,
+			"command", command.Command,
+			"error", result.Error)
+
+		if command.Command == agentproto.CommandRestart && result.Error == "" {
+			s.restartOnce.Do(func() { close(s.restart) })
+			s.endIfIdle()
+		}
+	}()
+}
+
+func (s *session) runCommand(ctx context.Context, command *agentproto.CommandPayload) *agentproto.CommandResultPayload {
+	c := s.client
+	switch command.Command {
+	case agentproto.CommandReloadConfig:
+		// The proxy pushes the configuration right before the command
+		if config := c.AgentConfig(); config != nil {
+			return &agentproto.CommandResultPayload{Message: fmt.Sprintf("running configuration revision %d", config.Revision)}
+		}
+		return &agentproto.CommandResultPayload{Message: "no configuration received"}
+	case agentproto.CommandRestart:
+		return &agentproto.CommandResultPayload{Message: "reconnecting once requests in flight are done"}
+	case agentproto.CommandDiagnostics:
+		return &agentproto.CommandResultPayload{Diagnostics: s.diagnostics(ctx)}
+	case agentproto.CommandSetLogLevel:
+		if err := c.logger.SetLevel(command.Level); err != nil {
+			return &agentproto.CommandResultPayload{Error: err.Error()}
+		}
+		return &agentproto.CommandResultPayload{Message: "log level set to " + command.Level}
+	default:
+		return &agentproto.CommandResultPayload{Error: fmt.Sprintf("unknown command %q", command.Command)}
+	}
+}
+
+// diagnostics collects what support needs to look into a misbehaving agent
+func (s *session) diagnostics(ctx context.Context) *agentproto.AgentDiagnostics {
+	c := s.client
+
+	var dump bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&dump, 2)
+	if dump.Len() > maxGoroutineDump {
+		dump.Truncate(maxGoroutineDump)
+	}
+
+	diagnostics := &agentproto.AgentDiagnostics{
+		AgentVersion:   Version,
+		Uptime:         time.Since(c.startedAt).Seconds(),
+		LogLevel:       c.logger.Level(),
+		Goroutines:     runtime.NumGoroutine(),
+		GoroutineDump:  dump.String(),
+		ActiveRequests: s.activeRequests(),
+		Upstreams:      []agentproto.UpstreamCheck{c.checkUpstream(ctx)},
+		RecentErrors:   c.errors.snapshot(),
+	}
+	if config := c.AgentConfig(); config != nil {
+		diagnostics.ConfigRevision = config.Revision
+	}
+	return diagnostics
+}
+
+// checkUpstream sends a GET to the upstream; any answer means it is
+// reachable
+func (c *Client) checkUpstream(ctx context.Context) agentproto.UpstreamCheck {
+	check := agentproto.UpstreamCheck{Target: c.config.Upstream}
+
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.config.Upstream, nil)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	check.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	resp.Body.Close()
+
+	check.Reachable = true
+	check.StatusCode = resp.StatusCode
+	return check
+}
+
+// errorLog keeps the latest errors the agent ran into for diagnostics
+type errorLog struct {
+	mu     sync.Mutex
+	errors []agentproto.AgentError
+}
+
+func (l *errorLog) record(message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.errors) == recentErrorCount {
+		copy(l.errors, l.errors[1:])
+		l.errors = l.errors[:recentErrorCount-1]
+	}
+	l.errors = append(l.errors, agentproto.AgentError{At: time.Now(), Message: message})
+}
+
+// snapshot returns the recorded errors, oldest first
+func (l *errorLog) snapshot() []agentproto.AgentError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]agentproto.AgentError{}, l.errors...)
+}
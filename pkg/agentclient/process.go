@@ -0,0 +1,55 @@
+package agentclient
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// processSampler turns cumulative process CPU time into a usage percentage
+// over the interval between samples
+type processSampler struct {
+	mu        sync.Mutex
+	lastCPU   time.Duration
+	lastWall  time.Time
+	supported bool
+}
+
+func newProcessSampler() *processSampler {
+	cpu, ok := processCPUTime()
+	return &processSampler{
+		lastCPU:   cpu,
+		lastWall:  time.Now(),
+		supported: ok,
+	}
+}
+
+// sample returns CPU usage in percent of one core since the previous sample
+// and the resident memory in bytes
+func (p *processSampler) sample() (float64, float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	usage := 0.0
+	now := time.Now()
+	if cpu, ok := processCPUTime(); ok && p.supported {
+		if wall := now.Sub(p.lastWall); wall > 0 {
+			usage = 100 * float64(cpu-p.lastCPU) / float64(wall)
+		}
+		p.lastCPU = cpu
+	}
+	p.lastWall = now
+
+	return usage, float64(residentMemory())
+}
+
+// residentMemory falls back to the memory the Go runtime holds from the OS
+// where the resident set size is not available
+func residentMemory() uint64 {
+	if rss, ok := processRSS(); ok {
+		return rss
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Sys
+}
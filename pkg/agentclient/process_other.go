@@ -0,0 +1,13 @@
+//go:build !unix
+
+package agentclient
+
+import "time"
+
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
+
+func processRSS() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,229 @@
+package agentclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy-service/pkg/agentproto"
+)
+
+// serve answers one proxy request from the upstream. Nothing is sent once
+// the proxy has canceled the request, since it discards late replies.
+func (s *session) serve(ctx context.Context, requestID string, req *agentproto.ProxyRequest, state *inflight) {
+	start := time.Now()
+
+	// Tunnels need an upstream that speaks WebSocket or raw TCP, which the
+	// reference agent does not relay
+	if req.Tunnel {
+		s.send(agentproto.MessageTypeProxyResponse, requestID, agentproto.ProxyResponse{StatusCode: http.StatusNotImplemented})
+		s.client.stats.record(time.Since(start), true)
+		return
+	}
+
+	upstreamReq, err := s.newUpstreamRequest(ctx, requestID, req, state)
+	if err != nil {
+		s.client.errors.record(err.Error())
+		s.sendError(requestID, err.Error())
+		s.client.stats.record(time.Since(start), true)
+		return
+	}
+
+	resp, err := s.client.httpClient.Do(upstreamReq)
+	if err != nil {
+		if ctx.Err() == nil {
+			s.client.errors.record(fmt.Sprintf("upstream request failed: %v", err))
+			s.sendError(requestID, fmt.Sprintf("upstream request failed: %v", err))
+		}
+		s.client.stats.record(time.Since(start), true)
+		return
+	}
+	defer resp.Body.Close()
+
+	err = s.writeResponse(ctx, requestID, resp, state)
+	s.client.stats.record(time.Since(start), err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	if err != nil && ctx.Err() == nil {
+		s.client.errors.record(fmt.Sprintf("failed to send response: %v", err))
+		s.client.logger.Error("Failed to send response",
+			"error", err,
+			"agent_id", s.client.config.AgentID,
+			"request_id", requestID)
+	}
+}
+
+func (s *session) newUpstreamRequest(ctx context.Context, requestID string, req *agentproto.ProxyRequest, state *inflight) (*http.Request, error) {
+	target := strings.TrimSuffix(s.client.config.Upstream, "/") + req.Path
+	if req.RawQuery != "" {
+		target += "?" + req.RawQuery
+	}
+
+	var body io.Reader = http.NoBody
+	contentLength := int64(0)
+	trailers := http.Header(req.Trailers)
+	switch {
+	case req.Streamed:
+		// Declared trailer names are filled in by the end frame
+		if trailers == nil {
+			trailers = http.Header{}
+		}
+		body = &requestBody{session: s, requestID: requestID, ctx: ctx, frames: state.body, trailers: trailers}
+		contentLength = -1
+		if length, err := strconv.ParseInt(http.Header(req.Headers).Get("Content-Length"), 10, 64); err == nil {
+			contentLength = length
+		}
+	case len(req.Body) > 0:
+		body = bytes.NewReader(req.Body)
+		contentLength = int64(len(req.Body))
+	}
+
+	upstreamReq, err := http.NewRequestWithContext(ctx, req.Method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	for name, values := range req.Headers {
+		for _, value := range values {
+			upstreamReq.Header.Add(name, value)
+		}
+	}
+	if host := upstreamReq.Header.Get("Host"); host != "" {
+		upstreamReq.Host = host
+	}
+	upstreamReq.ContentLength = contentLength
+	if len(trailers) > 0 {
+		upstreamReq.Trailer = trailers
+	}
+
+	return upstreamReq, nil
+}
+
+// writeResponse sends the upstream response inline when it is small and
+// complete, and streams it otherwise
+func (s *session) writeResponse(ctx context.Context, requestID string, resp *http.Response, state *inflight) error {
+	inline := resp.ContentLength >= 0 && resp.ContentLength <= agentproto.MaxInlineBodySize && len(resp.Trailer) == 0
+	if inline {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			s.sendError(requestID, fmt.Sprintf("failed to read upstream response: %v", err))
+			return err
+		}
+		return s.send(agentproto.MessageTypeProxyResponse, requestID, agentproto.ProxyResponse{
+			StatusCode: resp.StatusCode,
+			Headers:    resp.Header,
+			Body:       body,
+		})
+	}
+
+	declared := make(map[string][]string, len(resp.Trailer))
+	for name := range resp.Trailer {
+		declared[name] = nil
+	}
+	err := s.send(agentproto.MessageTypeProxyResponse, requestID, agentproto.ProxyResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header,
+		Trailers:   declared,
+		Streamed:   true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.writeBody(ctx, requestID, resp, state)
+}
+
+// writeBody streams the response body as start/data/end frames, never
+// running more than the window ahead of the proxy's acks
+func (s *session) writeBody(ctx context.Context, requestID string, resp *http.Response, state *inflight) error {
+	if err := s.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameStart, Size: resp.ContentLength}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, agentproto.BodyChunkSize)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			select {
+			case <-state.credits:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := s.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameData, Data: data}); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return s.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameEnd, Trailers: resp.Trailer})
+		}
+		if readErr != nil {
+			if ctx.Err() == nil {
+				s.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameEnd, Error: readErr.Error()})
+			}
+			return readErr
+		}
+	}
+}
+
+// requestBody reads a streamed request body from its body frames, acking
+// them in batches as the upstream consumes them
+type requestBody struct {
+	session   *session
+	requestID string
+	ctx       context.Context
+	frames    chan *agentproto.BodyFrame
+	trailers  http.Header
+	buf       []byte
+	unacked   int
+	err       error
+}
+
+func (r *requestBody) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		select {
+		case frame := <-r.frames:
+			switch frame.Frame {
+			case agentproto.BodyFrameData:
+				r.buf = frame.Data
+				r.ack()
+			case agentproto.BodyFrameEnd:
+				if frame.Error != "" {
+					r.err = fmt.Errorf("proxy aborted body: %s", frame.Error)
+				} else {
+					for name, values := range frame.Trailers {
+						r.trailers[name] = values
+					}
+					r.err = io.EOF
+				}
+			}
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *requestBody) ack() {
+	r.unacked++
+	if r.unacked < agentproto.StreamWindow/2 {
+		return
+	}
+
+	if err := r.session.send(agentproto.MessageTypeBodyChunk, r.requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameAck, Count: r.unacked}); err == nil {
+		r.unacked = 0
+	}
+}
@@ -0,0 +1,450 @@
+package agentclient
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"proxy-service/pkg/agentproto"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// session is one connection to the proxy. The reader goroutine dispatches
+// messages; requests are served on their own goroutines and share the
+// connection through a write lock.
+type session struct {
+	client *Client
+	conn   *websocket.Conn
+	codec  agentproto.Codec
+
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	requests map[string]*inflight
+
+	ctx    context.Context // canceled when the session ends
+	cancel context.CancelFunc
+
+	// goAway is closed when the proxy asks the agent to move; the session
+	// then ends as soon as its requests are done
+	goAway     chan struct{}
+	goAwayOnce sync.Once
+	// restart is closed when an operator asks for a restart; unlike a
+	// goaway the next connection is only dialed once this one has ended
+	restart     chan struct{}
+	restartOnce sync.Once
+	hangUpOnce  sync.Once
+}
+
+// inflight is the state of a request being served
+type inflight struct {
+	cancel context.CancelFunc
+	// body receives the request body frames when the body is streamed
+	body chan *agentproto.BodyFrame
+	// credits is the window for the response body
+	credits chan struct{}
+}
+
+func newSession(client *Client, conn *websocket.Conn) *session {
+	return &session{
+		client:   client,
+		conn:     conn,
+		codec:    agentproto.CodecForSubprotocol(conn.Subprotocol()),
+		requests: make(map[string]*inflight),
+		goAway:   make(chan struct{}),
+		restart:  make(chan struct{}),
+	}
+}
+
+// run serves the connection until it fails or ctx is done
+func (s *session) run(ctx context.Context) error {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	defer s.cancel()
+
+	// Closing the socket is what stops the reader
+	go func() {
+		<-s.ctx.Done()
+		s.conn.Close()
+	}()
+
+	// The hello has to be the first message on the connection
+	if err := s.send(agentproto.MessageTypeHello, "", s.client.hello()); err != nil {
+		return err
+	}
+
+	go s.heartbeatLoop()
+	go s.metricsLoop()
+
+	return s.readLoop()
+}
+
+// welcome applies the features the proxy agreed to
+func (s *session) welcome(welcome *agentproto.WelcomePayload) {
+	compression := false
+	for _, capability := range welcome.Capabilities {
+		if capability == agentproto.CapabilityCompression {
+			compression = true
+		}
+	}
+
+	s.writeMu.Lock()
+	s.conn.EnableWriteCompression(compression)
+	s.writeMu.Unlock()
+
+	s.client.logger.Info("Agent handshake completed",
+		"agent_id", s.client.config.AgentID,
+		"protocol_version", welcome.ProtocolVersion,
+		"capabilities", welcome.Capabilities)
+}
+
+func (s *session) send(messageType, requestID string, payload interface{}) error {
+	data, err := s.codec.Encode(agentproto.NewMessage(messageType, requestID, payload))
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := s.conn.WriteMessage(s.codec.FrameType(), data); err != nil {
+		// A failed write leaves the connection unusable; after hanging up
+		// the proxy's answer ends the session instead
+		if err != websocket.ErrCloseSent {
+			s.cancel()
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *session) readLoop() error {
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if messageType != s.codec.FrameType() {
+			continue
+		}
+
+		msg, err := s.codec.Decode(data)
+		if err != nil {
+			s.client.logger.Error("Failed to parse message", "error", err, "agent_id", s.client.config.AgentID)
+			continue
+		}
+
+		switch msg.Type {
+		case agentproto.MessageTypeProxyRequest:
+			s.startRequest(msg)
+		case agentproto.MessageTypeBodyChunk:
+			s.deliverBodyFrame(msg)
+		case agentproto.MessageTypeCancel:
+			s.cancelRequest(msg.RequestID)
+		case agentproto.MessageTypeCommand:
+			s.startCommand(msg)
+		case agentproto.MessageTypeWelcome:
+			var welcome agentproto.WelcomePayload
+			if err := msg.Decode(&welcome); err != nil {
+				s.client.logger.Error("Failed to decode welcome", "error", err, "agent_id", s.client.config.AgentID)
+				continue
+			}
+			s.welcome(&welcome)
+		case agentproto.MessageTypeConfig:
+			var config agentproto.ConfigUpdatePayload
+			if err := msg.Decode(&config); err != nil {
+				s.client.logger.Error("Failed to decode config update", "error", err, "agent_id", s.client.config.AgentID)
+				continue
+			}
+			ack := agentproto.ConfigAckPayload{Revision: config.Revision}
+			if err := s.client.applyConfig(&config); err != nil {
+				ack.Error = err.Error()
+			}
+			s.send(agentproto.MessageTypeConfigAck, "", ack)
+		case agentproto.MessageTypeGoAway:
+			var goAway agentproto.GoAwayPayload
+			if err := msg.Decode(&goAway); err != nil {
+				s.client.logger.Error("Failed to decode goaway", "error", err, "agent_id", s.client.config.AgentID)
+			}
+			s.client.logger.Info("Proxy asked agent to reconnect",
+				"agent_id", s.client.config.AgentID,
+				"reason", goAway.Reason)
+			s.goAwayOnce.Do(func() { close(s.goAway) })
+			s.endIfIdle()
+		default:
+			s.client.logger.Debug("Ignoring message",
+				zap.String("message_type", msg.Type),
+				zap.String("agent_id", s.client.config.AgentID))
+		}
+	}
+}
+
+// startRequest registers a proxy request before serving it, so body frames
+// and cancels that follow on the reader are never missed
+func (s *session) startRequest(msg *agentproto.WSMessage) {
+	var req agentproto.ProxyRequest
+	if err := msg.Decode(&req); err != nil {
+		s.sendError(msg.RequestID, "invalid request format")
+		return
+	}
+
+	timeout, maxRequests := s.client.requestLimits()
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	if req.Deadline != nil {
+		ctx, cancel = withDeadline(ctx, cancel, *req.Deadline)
+	}
+	if timeout > 0 {
+		ctx, cancel = withDeadline(ctx, cancel, time.Now().Add(timeout))
+	}
+
+	state := &inflight{
+		cancel:  cancel,
+		credits: make(chan struct{}, agentproto.StreamWindow),
+	}
+	for i := 0; i < agentproto.StreamWindow; i++ {
+		state.credits <- struct{}{}
+	}
+	if req.Streamed {
+		state.body = make(chan *agentproto.BodyFrame, agentproto.StreamWindow+2)
+	}
+
+	s.mu.Lock()
+	busy := maxRequests > 0 && len(s.requests) >= maxRequests
+	if !busy {
+		s.requests[msg.RequestID] = state
+	}
+	s.mu.Unlock()
+
+	if busy {
+		cancel()
+		go s.send(agentproto.MessageTypeProxyResponse, msg.RequestID, agentproto.ProxyResponse{StatusCode: http.StatusServiceUnavailable})
+		return
+	}
+
+	go func() {
+		defer s.finishRequest(msg.RequestID)
+		s.serve(ctx, msg.RequestID, &req, state)
+	}()
+}
+
+// withDeadline narrows ctx, chaining cancel so one call releases both
+func withDeadline(ctx context.Context, cancel context.CancelFunc, deadline time.Time) (context.Context, context.CancelFunc) {
+	narrowed, cancelNarrowed := context.WithDeadline(ctx, deadline)
+	return narrowed, func() {
+		cancelNarrowed()
+		cancel()
+	}
+}
+
+func (s *session) finishRequest(requestID string) {
+	s.mu.Lock()
+	state, exists := s.requests[requestID]
+	delete(s.requests, requestID)
+	s.mu.Unlock()
+
+	if exists {
+		state.cancel()
+	}
+	s.endIfIdle()
+}
+
+// endIfIdle ends a session the proxy sent away, or that is restarting, once
+// nothing is in flight
+func (s *session) endIfIdle() {
+	select {
+	case <-s.goAway:
+	case <-s.restart:
+	default:
+		return
+	}
+	if s.activeRequests() == 0 {
+		s.hangUp()
+	}
+}
+
+// hangUp closes the session with a close frame and lets the proxy's answer
+// end the reader, so whatever was sent last is read before the socket goes.
+// A proxy that does not answer is cut off after writeWait.
+func (s *session) hangUp() {
+	s.hangUpOnce.Do(func() {
+		s.writeMu.Lock()
+		err := s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(writeWait))
+		s.writeMu.Unlock()
+		if err != nil {
+			s.cancel()
+			return
+		}
+
+		go func() {
+			timer := time.NewTimer(writeWait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				s.cancel()
+			case <-s.ctx.Done():
+			}
+		}()
+	})
+}
+
+func (s *session) restarting() bool {
+	select {
+	case <-s.restart:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *session) cancelRequest(requestID string) {
+	s.mu.Lock()
+	state, exists := s.requests[requestID]
+	s.mu.Unlock()
+
+	if exists {
+		state.cancel()
+	}
+}
+
+func (s *session) activeRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func (s *session) deliverBodyFrame(msg *agentproto.WSMessage) {
+	s.mu.Lock()
+	state, exists := s.requests[msg.RequestID]
+	s.mu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	var frame agentproto.BodyFrame
+	if err := msg.Decode(&frame); err != nil {
+		s.client.logger.Error("Failed to decode body frame", "error", err, "agent_id", s.client.config.AgentID)
+		return
+	}
+
+	if frame.Frame == agentproto.BodyFrameAck {
+		for i := 0; i < frame.Count; i++ {
+			select {
+			case state.credits <- struct{}{}:
+			default:
+			}
+		}
+		return
+	}
+
+	if state.body == nil {
+		return
+	}
+	select {
+	case state.body <- &frame:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *session) sendError(requestID, message string) {
+	s.send(agentproto.MessageTypeError, requestID, agentproto.ErrorPayload{RequestID: requestID, Error: message})
+}
+
+// heartbeatLoop sends a heartbeat right away, which also fetches the
+// configuration, then on every interval
+func (s *session) heartbeatLoop() {
+	for {
+		err := s.send(agentproto.MessageTypeHeartbeat, "", agentproto.HeartbeatPayload{
+			Status:         "healthy",
+			ActiveRequests: s.activeRequests(),
+		})
+		if err != nil {
+			return
+		}
+
+		if !s.wait(s.client.heartbeatInterval) {
+			return
+		}
+	}
+}
+
+func (s *session) metricsLoop() {
+	connectedAt := time.Now()
+	for {
+		if !s.wait(s.client.metricsInterval) {
+			return
+		}
+
+		if err := s.send(agentproto.MessageTypeMetrics, "", s.client.collectMetrics(connectedAt)); err != nil {
+			return
+		}
+	}
+}
+
+// wait sleeps for the interval, starting over whenever the configuration
+// changes so a shorter interval applies at once. It reports false when the
+// session has ended.
+func (s *session) wait(interval func() (time.Duration, <-chan struct{})) bool {
+	for {
+		d, reconfigured := interval()
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+			return true
+		case <-reconfigured:
+			timer.Stop()
+		case <-s.ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// collectMetrics reports the process and the requests it has served
+func (c *Client) collectMetrics(connectedAt time.Time) *agentproto.AgentMetrics {
+	cpu, memory := c.process.sample()
+	processed, failed, latency := c.stats.snapshot()
+
+	return &agentproto.AgentMetrics{
+		ConnectionUptime:  time.Since(connectedAt).Seconds(),
+		RequestsProcessed: processed,
+		AverageLatency:    latency,
+		ErrorCount:        failed,
+		MemoryUsage:       memory,
+		CPUUsage:          cpu,
+		Uptime:            time.Since(c.startedAt).Seconds(),
+	}
+}
+
+// requestStats accumulates what metrics_update reports about requests
+type requestStats struct {
+	mu           sync.Mutex
+	processed    int64
+	errors       int64
+	totalLatency time.Duration
+}
+
+func (r *requestStats) record(latency time.Duration, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.processed++
+	r.totalLatency += latency
+	if failed {
+		r.errors++
+	}
+}
+
+// snapshot returns the request and error counts and the mean latency in
+// seconds
+func (r *requestStats) snapshot() (int64, int64, float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.processed == 0 {
+		return 0, r.errors, 0
+	}
+	return r.processed, r.errors, r.totalLatency.Seconds() / float64(r.processed)
+}
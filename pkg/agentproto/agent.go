@@ -0,0 +1,54 @@
+package agentproto
+
+import "time"
+
+// AgentMetrics is the payload of metrics_update
+type AgentMetrics struct {
+	ConnectionUptime  float64 `json:"connection_uptime"`
+	RequestsProcessed int64   `json:"requests_processed"`
+	AverageLatency    float64 `json:"average_latency"`
+	ErrorCount        int64   `json:"error_count"`
+	MemoryUsage       float64 `json:"memory_usage"`
+	CPUUsage          float64 `json:"cpu_usage"`
+	Uptime            float64 `json:"uptime"`
+}
+
+// AgentDiagnostics is the state an agent dumps for support
+type AgentDiagnostics struct {
+	AgentVersion  string  `json:"agent_version" bson:"agent_version"`
+	Uptime        float64 `json:"uptime" bson:"uptime"`
+	LogLevel      string  `json:"log_level" bson:"log_level"`
+	Goroutines    int     `json:"goroutines" bson:"goroutines"`
+	GoroutineDump string  `json:"goroutine_dump" bson:"goroutine_dump"`
+	// ConfigRevision is the configuration revision the agent runs
+	ConfigRevision int64           `json:"config_revision" bson:"config_revision"`
+	ActiveRequests int             `json:"active_requests" bson:"active_requests"`
+	Upstreams      []UpstreamCheck `json:"upstreams" bson:"upstreams"`
+	RecentErrors   []AgentError    `json:"recent_errors" bson:"recent_errors"`
+}
+
+// UpstreamCheck is the outcome of a request the agent made to an upstream
+type UpstreamCheck struct {
+	Target     string  `json:"target" bson:"target"`
+	Reachable  bool    `json:"reachable" bson:"reachable"`
+	StatusCode int     `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	LatencyMs  float64 `json:"latency_ms" bson:"latency_ms"`
+	Error      string  `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// AgentError is an error the agent ran into
+type AgentError struct {
+	At      time.Time `json:"at" bson:"at"`
+	Message string    `json:"message" bson:"message"`
+}
+
+// AgentCertificate is a client certificate the proxy signed for an agent.
+// Certificate holds the PEM and is only returned when the certificate is
+// issued.
+type AgentCertificate struct {
+	Serial      string    `json:"serial"`
+	AgentID     string    `json:"agent_id"`
+	CustomerID  string    `json:"customer_id"`
+	NotAfter    time.Time `json:"not_after"`
+	Certificate string    `json:"certificate,omitempty"`
+}
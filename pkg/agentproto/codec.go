@@ -0,0 +1,175 @@
+package agentproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// WebSocket subprotocols an agent may request to pick its codec. Agents that
+// request none get JSON, which is what every agent spoke before codecs.
+const (
+	SubprotocolJSON   = "proxy-agent.json.v1"
+	SubprotocolBinary = "proxy-agent.msgpack.v1"
+)
+
+// Subprotocols lists the supported subprotocols in server preference order,
+// ready for websocket.Upgrader.Subprotocols
+var Subprotocols = []string{SubprotocolBinary, SubprotocolJSON}
+
+// Codec turns protocol messages into WebSocket frames and back. Payloads are
+// encoded with the same codec as their envelope and decoded lazily by
+// WSMessage.Decode into the type the receiver expects.
+type Codec interface {
+	Name() string
+	// FrameType is the WebSocket message type the codec writes
+	FrameType() int
+	Encode(msg *WSMessage) ([]byte, error)
+	Decode(data []byte) (*WSMessage, error)
+	// Unmarshal decodes a payload produced by this codec
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec   Codec = jsonCodec{}
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// CodecForSubprotocol returns the codec negotiated during the upgrade
+func CodecForSubprotocol(subprotocol string) Codec {
+	if subprotocol == SubprotocolBinary {
+		return BinaryCodec
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+type jsonFrame struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+func (jsonCodec) Name() string   { return "json" }
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+func (c jsonCodec) Encode(msg *WSMessage) ([]byte, error) {
+	frame := jsonFrame{
+		Type:      msg.Type,
+		RequestID: msg.RequestID,
+		Timestamp: msg.Timestamp,
+	}
+
+	payload, err := msg.encodedPayload(c, json.Marshal)
+	if err != nil {
+		return nil, err
+	}
+	frame.Payload = payload
+
+	return json.Marshal(frame)
+}
+
+func (c jsonCodec) Decode(data []byte) (*WSMessage, error) {
+	var frame jsonFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, err
+	}
+
+	return &WSMessage{
+		Type:      frame.Type,
+		RequestID: frame.RequestID,
+		Timestamp: frame.Timestamp,
+		raw:       frame.Payload,
+		codec:     c,
+	}, nil
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// binaryCodec writes msgpack binary frames. The envelope is a fixed array of
+// type, request ID, unix-nano timestamp and payload; payload structs reuse
+// their json tags as msgpack keys, and []byte bodies travel as raw bytes
+// instead of base64 text.
+type binaryCodec struct{}
+
+type binaryFrame struct {
+	_msgpack  struct{} `msgpack:",as_array"`
+	Type      string
+	RequestID string
+	Timestamp int64
+	Payload   msgpack.RawMessage
+}
+
+func (binaryCodec) Name() string   { return "msgpack" }
+func (binaryCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (c binaryCodec) Encode(msg *WSMessage) ([]byte, error) {
+	payload, err := msg.encodedPayload(c, marshalMsgpack)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalMsgpack(&binaryFrame{
+		Type:      msg.Type,
+		RequestID: msg.RequestID,
+		Timestamp: msg.Timestamp.UnixNano(),
+		Payload:   payload,
+	})
+}
+
+func (c binaryCodec) Decode(data []byte) (*WSMessage, error) {
+	var frame binaryFrame
+	if err := c.Unmarshal(data, &frame); err != nil {
+		return nil, err
+	}
+
+	return &WSMessage{
+		Type:      frame.Type,
+		RequestID: frame.RequestID,
+		Timestamp: time.Unix(0, frame.Timestamp),
+		raw:       frame.Payload,
+		codec:     c,
+	}, nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodedPayload returns the payload bytes for codec c, reusing the raw bytes
+// of a received message when they are already in that encoding
+func (m *WSMessage) encodedPayload(c Codec, marshal func(interface{}) ([]byte, error)) ([]byte, error) {
+	if m.Payload == nil {
+		if m.raw != nil && m.codec == c {
+			return m.raw, nil
+		}
+		return nil, nil
+	}
+
+	data, err := marshal(m.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s payload: %w", m.Type, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,100 @@
+package agentproto
+
+import "time"
+
+// AgentConfig is the configuration the proxy pushes to agents in
+// config_update
+type AgentConfig struct {
+	CustomerID string `json:"customer_id"`
+	// AgentID is set when the configuration overrides the customer's for a
+	// single agent
+	AgentID string `json:"agent_id,omitempty"`
+	// Revision grows with every stored change of the customer's or agent's
+	// configuration; 0 is the built-in default
+	Revision          int64             `json:"revision"`
+	MaxConnections    int               `json:"max_connections"`
+	RequestTimeout    time.Duration     `json:"request_timeout"`
+	RetryAttempts     int               `json:"retry_attempts"`
+	RetryDelay        time.Duration     `json:"retry_delay"`
+	HeartbeatInterval time.Duration     `json:"heartbeat_interval"`
+	Features          AgentFeatures     `json:"features"`
+	Security          SecurityConfig    `json:"security"`
+	Routes            []RouteConfig     `json:"routes"`
+	Monitoring        MonitoringConfig  `json:"monitoring"`
+	Settings          map[string]string `json:"settings"`
+	LastUpdated       time.Time         `json:"last_updated"`
+}
+
+type AgentFeatures struct {
+	EnableCompression bool `json:"enable_compression"`
+	EnableCaching     bool `json:"enable_caching"`
+	EnableMetrics     bool `json:"enable_metrics"`
+}
+
+type SecurityConfig struct {
+	EnableTLS      bool            `json:"enable_tls"`
+	MinTLSVersion  string          `json:"min_tls_version"`
+	AllowedOrigins []string        `json:"allowed_origins"`
+	RateLimit      RateLimitConfig `json:"rate_limit"`
+}
+
+type RateLimitConfig struct {
+	Enabled    bool          `json:"enabled"`
+	Requests   int           `json:"requests"`
+	TimeWindow time.Duration `json:"time_window"`
+}
+
+type RouteConfig struct {
+	Path      string        `json:"path"`
+	Methods   []string      `json:"methods"`
+	RateLimit int           `json:"rate_limit"`
+	Timeout   time.Duration `json:"timeout"`
+	// CacheEnabled turns the response cache on or off for the route; nil
+	// leaves it to the proxy config
+	CacheEnabled *bool         `json:"cache_enabled,omitempty"`
+	CacheTTL     time.Duration `json:"cache_ttl"`
+	// CacheStaleTTL and CacheVary override the proxy config's for the route
+	CacheStaleTTL time.Duration `json:"cache_stale_ttl,omitempty"`
+	CacheVary     []string      `json:"cache_vary,omitempty"`
+	// AgentSelector limits the route to agents with matching labels, e.g.
+	// "region=eu,env!=staging"; it takes precedence over the proxy config's
+	AgentSelector string `json:"agent_selector,omitempty"`
+	// SelectorFallback is what happens when no agent matches: reject
+	// (default) or any
+	SelectorFallback string `json:"selector_fallback,omitempty"`
+	// RoutingMode and FailoverMode override the proxy config's for the route
+	RoutingMode  string `json:"routing_mode,omitempty"`
+	FailoverMode string `json:"failover_mode,omitempty"`
+	// HeaderPolicy rewrites headers after the proxy config's policy
+	HeaderPolicy *HeaderPolicy `json:"header_policy,omitempty"`
+}
+
+type MonitoringConfig struct {
+	MetricsInterval time.Duration `json:"metrics_interval"`
+	LogLevel        string        `json:"log_level"`
+	EnableTracing   bool          `json:"enable_tracing"`
+	SamplingRate    float64       `json:"sampling_rate"`
+}
+
+// HeaderPolicy rewrites headers on the way to the upstream and back
+type HeaderPolicy struct {
+	// Request and Response rules are applied in order
+	Request  []HeaderRule `bson:"request,omitempty" json:"request,omitempty"`
+	Response []HeaderRule `bson:"response,omitempty" json:"response,omitempty"`
+	// Strip lists request headers removed before forwarding on top of the
+	// proxy's own, such as Authorization; Keep forwards some of those anyway
+	Strip []string `bson:"strip,omitempty" json:"strip,omitempty"`
+	Keep  []string `bson:"keep,omitempty" json:"keep,omitempty"`
+}
+
+// HeaderRule is one change to a header
+type HeaderRule struct {
+	// Action is set, append, remove or rename
+	Action string `bson:"action" json:"action"`
+	Name   string `bson:"name" json:"name"`
+	// Value is set or appended, with ${customer_id}, ${client_ip} and
+	// ${request_id} replaced by the request's
+	Value string `bson:"value,omitempty" json:"value,omitempty"`
+	// To is the new name of a renamed header
+	To string `bson:"to,omitempty" json:"to,omitempty"`
+}
@@ -0,0 +1,40 @@
+package agentproto
+
+// Protocol versions. Agents open with a hello advertising their version and
+// capabilities, and the proxy answers with a welcome carrying what both
+// sides will use. Agents that predate the hello are ProtocolVersionLegacy and
+// get no optional features.
+const (
+	ProtocolVersionLegacy = 1
+	ProtocolVersion       = 2
+)
+
+// Capabilities an agent may advertise in its hello
+const (
+	// CapabilityStreaming: body_chunk frames and the cancel message
+	CapabilityStreaming = "streaming"
+	// CapabilityCompression: permessage-deflate on the agent socket
+	CapabilityCompression = "compression"
+	// CapabilityBinaryCodec: the msgpack codec
+	CapabilityBinaryCodec = "binary_codec"
+	// CapabilityWebSocketTunnels: tunnel requests with a WebSocket upgrade
+	CapabilityWebSocketTunnels = "websocket_tunnels"
+	// CapabilityTCPTunnels: tunnel requests with method CONNECT
+	CapabilityTCPTunnels = "tcp_tunnels"
+	// CapabilityCommands: the command message
+	CapabilityCommands = "commands"
+)
+
+// HelloPayload is the first message an agent sends
+type HelloPayload struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	AgentVersion    string   `json:"agent_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+}
+
+// WelcomePayload answers a hello with the protocol version and features
+// both sides support
+type WelcomePayload struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+}
@@ -0,0 +1,182 @@
+// Package agentproto is the protocol spoken between the proxy and its agents
+// over /api/v1/agents/connect: the message envelope and its codecs, the
+// payload of every message, the body frames of streamed requests and the
+// tokens agents connect with.
+package agentproto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Message types for WebSocket communication
+const (
+	MessageTypeProxyRequest  = "proxy_request"
+	MessageTypeProxyResponse = "proxy_response"
+	MessageTypeHeartbeat     = "heartbeat"
+	MessageTypeConfig        = "config_update"
+	MessageTypeMetrics       = "metrics_update"
+	MessageTypeError         = "error"
+	MessageTypeBodyChunk     = "body_chunk"
+	MessageTypeCancel        = "cancel"
+	MessageTypeHello         = "hello"
+	MessageTypeWelcome       = "welcome"
+	MessageTypeConfigAck     = "config_ack"
+	MessageTypeGoAway        = "goaway"
+	MessageTypeCommand       = "command"
+	MessageTypeCommandResult = "command_result"
+)
+
+// WSMessage is the envelope for every frame exchanged with an agent.
+// RequestID correlates responses with the request that produced them.
+// Outgoing messages carry a typed Payload that the connection's codec encodes;
+// received messages keep the encoded payload until Decode is called.
+type WSMessage struct {
+	Type      string
+	RequestID string
+	Payload   interface{}
+	Timestamp time.Time
+
+	raw   []byte
+	codec Codec
+}
+
+// ProxyRequest is the payload of proxy_request: a request the agent makes to
+// its upstream on behalf of the proxy
+type ProxyRequest struct {
+	Method string `json:"method"`
+	// Path is the escaped request path, RawQuery the query without "?"
+	Path       string              `json:"path"`
+	RawQuery   string              `json:"raw_query,omitempty"`
+	Headers    map[string][]string `json:"headers"`
+	Body       []byte              `json:"body,omitempty"`
+	CustomerID string              `json:"customer_id"`
+	// Trailers holds trailer values for inline bodies. For streamed bodies it
+	// only declares the names; the values follow in the "end" body frame.
+	Trailers map[string][]string `json:"trailers,omitempty"`
+	// Streamed is set when the body follows as body_chunk frames
+	Streamed bool `json:"streamed,omitempty"`
+	// Deadline is when the proxy gives up on the request; agents should
+	// abort upstream work past it. Nil means no deadline. For tunnels it only
+	// bounds the upstream handshake.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Tunnel asks the agent to open a WebSocket to the upstream, or with
+	// method CONNECT a TCP connection to the host:port in Path. The agent
+	// accepts with 101 (2xx for CONNECT) and then relays data as tunnel body
+	// frames, or answers with any other status to refuse.
+	Tunnel bool `json:"tunnel,omitempty"`
+}
+
+// ProxyResponse is the payload of proxy_response: the upstream's answer to a
+// proxy_request with the same request ID
+type ProxyResponse struct {
+	StatusCode int                 `json:"status_code"`
+	Headers    map[string][]string `json:"headers"`
+	Body       []byte              `json:"body,omitempty"`
+	Trailers   map[string][]string `json:"trailers,omitempty"`
+	Streamed   bool                `json:"streamed,omitempty"`
+}
+
+// ErrorPayload is sent by either side when a request cannot be served
+type ErrorPayload struct {
+	RequestID string `json:"request_id,omitempty"`
+	Error     string `json:"error"`
+}
+
+// CancelPayload tells the receiver to abandon the request named by the
+// envelope's RequestID; any reply still sent for it is discarded
+type CancelPayload struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// HeartbeatPayload is optional; agents that send an empty heartbeat are
+// treated as healthy with nothing in flight
+type HeartbeatPayload struct {
+	Status         string `json:"status,omitempty"`
+	ActiveRequests int    `json:"active_requests,omitempty"`
+}
+
+// ConfigAckPayload reports the config_update revision an agent applied, or
+// why it could not
+type ConfigAckPayload struct {
+	Revision int64  `json:"revision"`
+	Error    string `json:"error,omitempty"`
+}
+
+// GoAwayPayload tells an agent that the proxy replica it is connected to is
+// shutting down. The proxy sends it no new requests; the agent should
+// connect again, which lands it on another replica, and finish the requests
+// in flight on the old connection meanwhile. The old connection is closed by
+// Deadline at the latest.
+type GoAwayPayload struct {
+	Reason   string     `json:"reason,omitempty"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// Commands an operator can send to an agent
+const (
+	// CommandReloadConfig pushes the agent's configuration again and has it
+	// report the revision it runs
+	CommandReloadConfig = "reload_config"
+	// CommandRestart has the agent finish its requests, drop the connection
+	// and connect again
+	CommandRestart = "restart"
+	// CommandDiagnostics collects a goroutine dump, upstream connectivity
+	// checks and recent errors
+	CommandDiagnostics = "diagnostics"
+	// CommandSetLogLevel changes the agent's log level to debug, info, warn
+	// or error
+	CommandSetLogLevel = "set_log_level"
+)
+
+// CommandPayload asks an agent to run an operator command. The agent answers
+// with a command_result carrying the same request ID, before Deadline; a
+// later answer is discarded.
+type CommandPayload struct {
+	Command  string     `json:"command"`
+	Level    string     `json:"level,omitempty"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// CommandResultPayload is an agent's answer to a command; Error is set when
+// the command failed
+type CommandResultPayload struct {
+	Error       string            `json:"error,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Diagnostics *AgentDiagnostics `json:"diagnostics,omitempty"`
+}
+
+// Payload types of the remaining control messages
+type (
+	ConfigUpdatePayload  = AgentConfig
+	MetricsUpdatePayload = AgentMetrics
+)
+
+// NewMessage builds an envelope; the payload is encoded when it is sent
+func NewMessage(messageType, requestID string, payload interface{}) *WSMessage {
+	return &WSMessage{
+		Type:      messageType,
+		RequestID: requestID,
+		Payload:   payload,
+		Timestamp: time.Now(),
+	}
+}
+
+// Decode unmarshals the message payload into v
+func (m *WSMessage) Decode(v interface{}) error {
+	if len(m.raw) == 0 || m.codec == nil {
+		return fmt.Errorf("empty %s payload", m.Type)
+	}
+	return m.codec.Unmarshal(m.raw, v)
+}
+
+// NewRequestID returns a random ID for a request, message or record
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,40 @@
+package agentproto
+
+// Body frames travel as MessageTypeBodyChunk messages keyed by the request ID
+// of the proxy_request/proxy_response head they belong to. A streamed body is
+// always "start", zero or more "data" frames, then "end". The receiver hands
+// back "ack" frames as it consumes data, and a sender never has more than
+// StreamWindow data frames unacknowledged, so memory stays bounded on both
+// sides and a slow reader never stalls the shared connection.
+const (
+	BodyFrameStart = "start"
+	BodyFrameData  = "data"
+	BodyFrameEnd   = "end"
+	BodyFrameAck   = "ack"
+
+	// BodyChunkSize is the largest payload carried by one data frame
+	BodyChunkSize = 32 * 1024
+	// StreamWindow is the number of data frames a sender may have in flight
+	StreamWindow = 16
+	// MaxInlineBodySize is the largest body sent inside the head message;
+	// anything larger, or of unknown length, is streamed
+	MaxInlineBodySize = 64 * 1024
+)
+
+// BodyFrame is the payload of body_chunk
+type BodyFrame struct {
+	Frame string `json:"frame"`
+	Data  []byte `json:"data,omitempty"`
+	Size  int64  `json:"size,omitempty"`  // start: declared length, -1 when unknown
+	Count int    `json:"count,omitempty"` // ack: data frames consumed
+	Error string `json:"error,omitempty"` // end: set when the sender aborted
+
+	// end: trailer values, sent once the whole body has been read
+	Trailers map[string][]string `json:"trailers,omitempty"`
+
+	// Tunnels only: the WebSocket message type of a data frame, and the close
+	// code and reason of an end frame
+	MessageType int    `json:"message_type,omitempty"`
+	CloseCode   int    `json:"close_code,omitempty"`
+	CloseText   string `json:"close_text,omitempty"`
+}
@@ -0,0 +1,43 @@
+package agentproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// SignToken builds the X-Agent-Token an agent presents when connecting:
+// "<unix seconds>.<hex HMAC-SHA256 of agentID:customerID:seconds>", keyed
+// with the customer's API key
+func SignToken(agentID, customerID, apiKey string, issuedAt time.Time) string {
+	timestamp := issuedAt.Unix()
+	message := fmt.Sprintf("%s:%s:%d", agentID, customerID, timestamp)
+
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte(message))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	return fmt.Sprintf("%d.%s", timestamp, signature)
+}
+
+// SignConnectToken builds the X-Agent-Token of an agent holding a
+// credential: "<credential ID>.<unix seconds>.<nonce>.<hex HMAC-SHA256 of
+// agentID:customerID:credentialID:seconds:nonce>", keyed with the
+// credential's secret. The proxy accepts each nonce once.
+func SignConnectToken(agentID, customerID, credentialID, secret string, issuedAt time.Time, nonce string) string {
+	timestamp := issuedAt.Unix()
+	message := fmt.Sprintf("%s:%s:%s:%d:%s", agentID, customerID, credentialID, timestamp, nonce)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	return fmt.Sprintf("%s.%d.%s.%s", credentialID, timestamp, nonce, signature)
+}
+
+// NewConnectToken signs a connect token for now with a fresh nonce
+func NewConnectToken(agentID, customerID, credentialID, secret string) string {
+	return SignConnectToken(agentID, customerID, credentialID, secret, time.Now(), NewRequestID())
+}
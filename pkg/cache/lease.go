@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Leases are keys holding their owner's value until they expire. Only the
+// owner, identified by the exact value, may renew or release one, so a
+// stale holder cannot clobber a newer claim. Each lease can be indexed in a
+// set, which is pruned as leases lapse.
+
+var renewLeaseScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if current == false or current == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+	redis.call("SREM", KEYS[2], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+var pruneLeaseScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("SREM", KEYS[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// ClaimLease takes key for value, replacing any other holder, and adds
+// member to the index set
+func (c *RedisCache) ClaimLease(ctx context.Context, key, value, index, member string, ttl time.Duration) error {
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, value, ttl)
+		pipe.SAdd(ctx, index, member)
+		return nil
+	})
+	return err
+}
+
+// RenewLease extends a lease still held with value, or reclaims it if it
+// lapsed. It reports false when another holder has taken it over.
+func (c *RedisCache) RenewLease(ctx context.Context, key, value, index, member string, ttl time.Duration) (bool, error) {
+	renewed, err := renewLeaseScript.Run(ctx, c.client, []string{key}, value, ttl.Milliseconds()).Int()
+	if err != nil || renewed == 0 {
+		return false, err
+	}
+	// A lapsed lease may have been pruned from the index meanwhile
+	return true, c.client.SAdd(ctx, index, member).Err()
+}
+
+// ReleaseLease drops a lease held with value together with its index entry
+func (c *RedisCache) ReleaseLease(ctx context.Context, key, value, index, member string) (bool, error) {
+	released, err := releaseLeaseScript.Run(ctx, c.client, []string{key, index}, value, member).Int()
+	return released == 1, err
+}
+
+// LeaseMembers returns the index members whose lease is held, keyed by
+// member, and drops members whose lease has lapsed. leaseKey maps a member
+// to its lease key.
+func (c *RedisCache) LeaseMembers(ctx context.Context, index string, leaseKey func(member string) string) (map[string]string, error) {
+	members, err := c.client.SMembers(ctx, index).Result()
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(members))
+	for i, member := range members {
+		keys[i] = leaseKey(member)
+	}
+	values, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	held := make(map[string]string, len(members))
+	for i, value := range values {
+		if value, ok := value.(string); ok {
+			held[members[i]] = value
+			continue
+		}
+		if err := pruneLeaseScript.Run(ctx, c.client, []string{keys[i], index}, members[i]).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return held, nil
+}
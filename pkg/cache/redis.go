@@ -3,10 +3,12 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"proxy-service/internal/config"
 	"proxy-service/internal/models"
 	"proxy-service/pkg/jwt"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -16,6 +18,11 @@ type RedisCache struct {
 	client *redis.Client
 }
 
+// IsNotFound reports whether err means the key does not exist
+func IsNotFound(err error) bool {
+	return errors.Is(err, redis.Nil)
+}
+
 func NewRedisCache(cfg *config.RedisConfig) (*RedisCache, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr:         cfg.Address,
@@ -37,7 +44,19 @@ func NewRedisCache(cfg *config.RedisConfig) (*RedisCache, error) {
 	return &RedisCache{client: client}, nil
 }
 
+// Set stores strings and byte slices as they are, so Get returns them
+// unchanged, and anything else as JSON.
+//
+// Strings used to be stored JSON-encoded as well. Get and GetMany decode
+// values still stored that way, such as agent_config:* and agent_token:*
+// entries written before the change, so they read as they were meant to
+// until they are written again. No raw value starts with a quote.
 func (c *RedisCache) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	switch value.(type) {
+	case string, []byte:
+		return c.client.Set(ctx, key, value, expiration).Err()
+	}
+
 	data, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -46,13 +65,61 @@ func (c *RedisCache) Set(ctx context.Context, key string, value interface{}, exp
 }
 
 func (c *RedisCache) Get(ctx context.Context, key string) (string, error) {
-	return c.client.Get(ctx, key).Result()
+	value, err := c.client.Get(ctx, key).Result()
+	if err != nil {
+		return "", err
+	}
+	return decodeLegacyString(value), nil
+}
+
+// decodeLegacyString returns the string a value stored by the JSON-encoding
+// Set holds, and any other value as it is
+func decodeLegacyString(value string) string {
+	if !strings.HasPrefix(value, `"`) {
+		return value
+	}
+	var decoded string
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		return value
+	}
+	return decoded
+}
+
+// GetMany returns the values of the keys that exist, keyed by key
+func (c *RedisCache) GetMany(ctx context.Context, keys ...string) (map[string]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	values, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]string, len(keys))
+	for i, value := range values {
+		if value, ok := value.(string); ok {
+			found[keys[i]] = decodeLegacyString(value)
+		}
+	}
+	return found, nil
 }
 
 func (c *RedisCache) Delete(ctx context.Context, key string) error {
 	return c.client.Del(ctx, key).Err()
 }
 
+// ClaimOnce stores key unless it exists and reports whether this call
+// stored it, so only the first of any number of callers succeeds
+func (c *RedisCache) ClaimOnce(ctx context.Context, key string, expiration time.Duration) (bool, error) {
+	return c.client.SetNX(ctx, key, 1, expiration).Result()
+}
+
+// Take returns the value of key and deletes it, so only one caller ever
+// gets it
+func (c *RedisCache) Take(ctx context.Context, key string) (string, error) {
+	return c.client.GetDel(ctx, key).Result()
+}
+
 func (c *RedisCache) GetCustomer(ctx context.Context, key string) (*models.Customer, error) {
 	data, err := c.client.Get(ctx, "customer:"+key).Result()
 	if err != nil {
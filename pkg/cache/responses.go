@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Cached responses are stored under their own key. An index hash maps the
+// key of every response of a customer to its path, and each tag has a set
+// of the keys tagged with it, so responses can be purged by path prefix or
+// by tag. Entries that expired are dropped from the index as purges find
+// them; the index itself expires indexTTL after its last store.
+
+// StoreResponse stores value under key for ttl and indexes it under path and
+// in every tag set. indexTTL must not be shorter than any entry's ttl.
+func (c *RedisCache) StoreResponse(ctx context.Context, key, index, path string, tagSets []string, value []byte, ttl, indexTTL time.Duration) error {
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, value, ttl)
+		pipe.HSet(ctx, index, key, path)
+		pipe.Expire(ctx, index, indexTTL)
+		for _, tagSet := range tagSets {
+			pipe.SAdd(ctx, tagSet, key)
+			pipe.Expire(ctx, tagSet, indexTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// LoadResponse returns the response stored under key; IsNotFound reports
+// a response that is not cached
+func (c *RedisCache) LoadResponse(ctx context.Context, key string) ([]byte, error) {
+	return c.client.Get(ctx, key).Bytes()
+}
+
+// PurgeResponses deletes the indexed responses whose path starts with
+// pathPrefix, all of them for the empty prefix, and returns how many were
+// still cached
+func (c *RedisCache) PurgeResponses(ctx context.Context, index, pathPrefix string) (int64, error) {
+	paths, err := c.client.HGetAll(ctx, index).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	for key, path := range paths {
+		if strings.HasPrefix(path, pathPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	return c.purgeResponseKeys(ctx, index, keys, nil)
+}
+
+// PurgeResponseTag deletes the responses in tagSet and returns how many were
+// still cached
+func (c *RedisCache) PurgeResponseTag(ctx context.Context, index, tagSet string) (int64, error) {
+	keys, err := c.client.SMembers(ctx, tagSet).Result()
+	if err != nil {
+		return 0, err
+	}
+	return c.purgeResponseKeys(ctx, index, keys, []string{tagSet})
+}
+
+func (c *RedisCache) purgeResponseKeys(ctx context.Context, index string, keys, drop []string) (int64, error) {
+	if len(keys) == 0 && len(drop) == 0 {
+		return 0, nil
+	}
+
+	var deleted *redis.IntCmd
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(keys) > 0 {
+			deleted = pipe.Del(ctx, keys...)
+			pipe.HDel(ctx, index, keys...)
+		}
+		if len(drop) > 0 {
+			pipe.Del(ctx, drop...)
+		}
+		return nil
+	})
+	if err != nil || deleted == nil {
+		return 0, err
+	}
+	return deleted.Val(), nil
+}
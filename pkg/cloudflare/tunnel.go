@@ -42,8 +42,11 @@ type TunnelClient struct {
 func NewTunnelClient(config TunnelConfig, logger *logger.Logger) *TunnelClient {
 	return &TunnelClient{
 		config: config,
+		// Requests are bounded by their context, and redirects are passed on
 		httpClient: &http.Client{
-			Timeout: time.Second * 30,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
 			Transport: &http.Transport{
 				TLSClientConfig: &tls.Config{
 					MinVersion: tls.VersionTLS12,
@@ -206,8 +209,15 @@ func (c *TunnelClient) updateState(status string, err error) {
 	}
 }
 
+// Healthy reports whether the tunnel is connected and answering heartbeats
+func (c *TunnelClient) Healthy() bool {
+	c.state.mutex.RLock()
+	defer c.state.mutex.RUnlock()
+	return c.state.Status == "connected" || c.state.Status == "healthy"
+}
+
 func (c *TunnelClient) ForwardRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
-	if c.state.Status != "healthy" {
+	if !c.Healthy() {
 		return nil, fmt.Errorf("tunnel not healthy")
 	}
 
@@ -217,7 +227,9 @@ func (c *TunnelClient) ForwardRequest(ctx context.Context, req *http.Request) (*
 
 	// Add tunnel headers
 	proxyReq.Header.Set("CF-Tunnel-ID", c.config.ID)
-	proxyReq.Header.Set("CF-Customer-ID", c.config.CustomerID)
+	if c.config.CustomerID != "" {
+		proxyReq.Header.Set("CF-Customer-ID", c.config.CustomerID)
+	}
 
 	return c.httpClient.Do(proxyReq)
 }
@@ -54,14 +54,18 @@
 package logger
 
 import (
+	"fmt"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var defaultLogger *Logger
+// defaultLogger backs the package-level functions
+var defaultLogger = NewLogger()
 
 type Logger struct {
 	*zap.Logger
+	level zap.AtomicLevel
 }
 
 func NewLogger() *Logger {
@@ -76,7 +80,29 @@ func NewLogger() *Logger {
 
 	return &Logger{
 		Logger: logger,
+		level:  config.Level,
+	}
+}
+
+// SetLevel changes the minimum level logged: debug, info, warn or error
+func (l *Logger) SetLevel(level string) error {
+	switch level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	if l.level == (zap.AtomicLevel{}) {
+		return fmt.Errorf("logger was not built by NewLogger, its level is fixed")
+	}
+	return l.level.UnmarshalText([]byte(level))
+}
+
+// Level returns the minimum level logged, empty when it is not known
+func (l *Logger) Level() string {
+	if l.level == (zap.AtomicLevel{}) {
+		return ""
 	}
+	return l.level.String()
 }
 
 func Info(msg string, fields ...interface{}) {
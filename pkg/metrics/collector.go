@@ -28,6 +28,28 @@ type MetricsCollector struct {
 	agentUptime         *prometheus.GaugeVec
 	agentMemoryUsage    *prometheus.GaugeVec
 	agentCPUUsage       *prometheus.GaugeVec
+	agentLastHeartbeat  *prometheus.GaugeVec
+	agentHealthScore    *prometheus.GaugeVec
+	agentErrorRate      *prometheus.GaugeVec
+	agentTimeoutRate    *prometheus.GaugeVec
+	agentLatencyP99     *prometheus.GaugeVec
+	agentEjected        *prometheus.GaugeVec
+	agentEjections      *prometheus.CounterVec
+	tunnelsActive       *prometheus.GaugeVec
+	tunnelsTotal        *prometheus.CounterVec
+	tunnelMessages      *prometheus.CounterVec
+	tunnelDuration      *prometheus.HistogramVec
+	tcpConnections      *prometheus.CounterVec
+	tcpActive           *prometheus.GaugeVec
+	tcpBytes            *prometheus.CounterVec
+	upstreamPools       prometheus.Gauge
+	upstreamConns       *prometheus.GaugeVec
+	upstreamDials       *prometheus.CounterVec
+	upstreamRequests    *prometheus.CounterVec
+	upstreamEvictions   *prometheus.CounterVec
+	cacheRequests       *prometheus.CounterVec
+	cachePurged         *prometheus.CounterVec
+	retries             *prometheus.CounterVec
 }
 
 type ProxyHandler struct {
@@ -67,6 +89,21 @@ func NewMetricsCollector() *MetricsCollector {
 			},
 			[]string{"customer_id", "error_type"},
 		),
+		responseSize: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "proxy_response_size_bytes",
+				Help:    "Size of HTTP responses in bytes",
+				Buckets: prometheus.ExponentialBuckets(100, 10, 7),
+			},
+			[]string{"customer_id", "path"},
+		),
+		activeConnections: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_active_connections",
+				Help: "Number of active client connections",
+			},
+			[]string{"customer_id"},
+		),
 		// Add new auth metrics
 		authFailures: promauto.NewCounterVec(
 			prometheus.CounterOpts{
@@ -154,6 +191,184 @@ func NewMetricsCollector() *MetricsCollector {
 			},
 			[]string{"customer_id", "agent_id"},
 		),
+
+		agentLastHeartbeat: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_agent_last_heartbeat_timestamp_seconds",
+				Help: "Unix time of the last heartbeat received from an agent",
+			},
+			[]string{"customer_id", "agent_id"},
+		),
+
+		// Agent health is judged from the traffic the proxy routed to it
+		agentHealthScore: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_agent_health_score",
+				Help: "Agent health score from 0 to 100",
+			},
+			[]string{"customer_id", "agent_id"},
+		),
+
+		agentErrorRate: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_agent_error_rate",
+				Help: "Share of recent agent requests that failed",
+			},
+			[]string{"customer_id", "agent_id"},
+		),
+
+		agentTimeoutRate: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_agent_timeout_rate",
+				Help: "Share of recent agent requests that timed out",
+			},
+			[]string{"customer_id", "agent_id"},
+		),
+
+		agentLatencyP99: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_agent_latency_p99_seconds",
+				Help: "99th percentile latency of recent agent requests",
+			},
+			[]string{"customer_id", "agent_id"},
+		),
+
+		agentEjected: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_agent_ejected",
+				Help: "Whether an agent is ejected from routing (1) or not (0)",
+			},
+			[]string{"customer_id", "agent_id"},
+		),
+
+		agentEjections: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_agent_ejections_total",
+				Help: "Total number of times an agent was ejected from routing",
+			},
+			[]string{"customer_id", "agent_id"},
+		),
+
+		// WebSocket tunnels are long lived, so they are kept out of the request metrics
+		tunnelsActive: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_tunnels_active",
+				Help: "Number of open WebSocket tunnels",
+			},
+			[]string{"customer_id"},
+		),
+
+		tunnelsTotal: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_tunnels_total",
+				Help: "Total number of WebSocket tunnel attempts",
+			},
+			[]string{"customer_id", "result"},
+		),
+
+		tunnelMessages: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_tunnel_messages_total",
+				Help: "Total number of messages relayed through WebSocket tunnels",
+			},
+			[]string{"customer_id", "direction"},
+		),
+
+		tunnelDuration: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "proxy_tunnel_duration_seconds",
+				Help:    "WebSocket tunnel lifetime in seconds",
+				Buckets: []float64{1, 10, 60, 300, 900, 3600, 14400},
+			},
+			[]string{"customer_id"},
+		),
+
+		tcpConnections: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_tcp_connections_total",
+				Help: "Total number of forwarded TCP connection attempts",
+			},
+			[]string{"customer_id", "target", "result"},
+		),
+
+		tcpActive: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_tcp_connections_active",
+				Help: "Number of open forwarded TCP connections",
+			},
+			[]string{"customer_id"},
+		),
+
+		tcpBytes: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_tcp_bytes_total",
+				Help: "Total number of bytes relayed over forwarded TCP connections",
+			},
+			[]string{"customer_id", "target", "direction"},
+		),
+
+		upstreamPools: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "proxy_upstream_pools",
+				Help: "Number of connection pools kept to direct upstreams",
+			},
+		),
+
+		upstreamConns: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_upstream_connections_open",
+				Help: "Number of open connections to direct upstreams",
+			},
+			[]string{"customer_id", "upstream"},
+		),
+
+		upstreamDials: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_upstream_dials_total",
+				Help: "Total number of connections dialed to direct upstreams",
+			},
+			[]string{"customer_id", "upstream", "result"},
+		),
+
+		upstreamRequests: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_upstream_requests_total",
+				Help: "Total number of requests sent to direct upstreams, by whether they reused a connection",
+			},
+			[]string{"customer_id", "upstream", "connection"},
+		),
+
+		upstreamEvictions: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_upstream_pool_evictions_total",
+				Help: "Total number of upstream connection pools evicted",
+			},
+			[]string{"reason"},
+		),
+
+		cacheRequests: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_cache_requests_total",
+				Help: "Total number of requests on cached routes, by how the response cache served them",
+			},
+			[]string{"customer_id", "result"},
+		),
+
+		cachePurged: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_cache_purged_total",
+				Help: "Total number of cached responses purged",
+			},
+			[]string{"customer_id"},
+		),
+
+		retries: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_request_retries_total",
+				Help: "Total number of failed requests retried, and of retries the retry budget refused",
+			},
+			[]string{"customer_id", "result"},
+		),
 	}
 	return mc
 }
@@ -255,7 +470,7 @@ func (c *MetricsCollector) RecordAgentConnection(customerID string) {
 }
 
 func (c *MetricsCollector) RecordAgentDisconnection(customerID string) {
-	c.agentDisconnections.WithLabelValues(customerID).Inc()
+	c.agentDisconnections.WithLabelValues(customerID, "disconnected").Inc()
 }
 
 func (c *MetricsCollector) RecordAgentRequest(customerID, agentID string, status int) {
@@ -283,7 +498,7 @@ func (c *MetricsCollector) UpdateAgentCPUUsage(customerID, agentID string, perce
 }
 
 func (c *MetricsCollector) RecordAgentHeartbeat(customerID, agentID string) {
-	c.agentConnections.WithLabelValues(customerID, agentID).Set(1)
+	c.agentLastHeartbeat.WithLabelValues(customerID, agentID).SetToCurrentTime()
 }
 
 func (c *MetricsCollector) UpdateAgentMetrics(customerID, agentID string, metrics *models.AgentMetrics) {
@@ -291,3 +506,103 @@ func (c *MetricsCollector) UpdateAgentMetrics(customerID, agentID string, metric
 	c.agentCPUUsage.WithLabelValues(customerID, agentID).Set(metrics.CPUUsage)
 	c.agentUptime.WithLabelValues(customerID, agentID).Set(metrics.Uptime)
 }
+
+// UpdateAgentHealth publishes the health of an agent; latencyP99 is in
+// seconds
+func (c *MetricsCollector) UpdateAgentHealth(customerID, agentID string, score, errorRate, timeoutRate, latencyP99 float64, ejected bool) {
+	c.agentHealthScore.WithLabelValues(customerID, agentID).Set(score)
+	c.agentErrorRate.WithLabelValues(customerID, agentID).Set(errorRate)
+	c.agentTimeoutRate.WithLabelValues(customerID, agentID).Set(timeoutRate)
+	c.agentLatencyP99.WithLabelValues(customerID, agentID).Set(latencyP99)
+	value := 0.0
+	if ejected {
+		value = 1
+	}
+	c.agentEjected.WithLabelValues(customerID, agentID).Set(value)
+}
+
+func (c *MetricsCollector) RecordAgentEjection(customerID, agentID string) {
+	c.agentEjections.WithLabelValues(customerID, agentID).Inc()
+}
+
+// RemoveAgentHealth drops the health gauges of an agent that disconnected
+func (c *MetricsCollector) RemoveAgentHealth(customerID, agentID string) {
+	for _, gauge := range []*prometheus.GaugeVec{c.agentHealthScore, c.agentErrorRate, c.agentTimeoutRate, c.agentLatencyP99, c.agentEjected} {
+		gauge.DeleteLabelValues(customerID, agentID)
+	}
+}
+
+// RecordTunnelOpened counts a tunnel that was accepted by the agent and
+// upgraded on the client side
+func (c *MetricsCollector) RecordTunnelOpened(customerID string) {
+	c.tunnelsTotal.WithLabelValues(customerID, "opened").Inc()
+	c.tunnelsActive.WithLabelValues(customerID).Inc()
+}
+
+// RecordTunnelRejected counts a tunnel attempt that never got upgraded
+func (c *MetricsCollector) RecordTunnelRejected(customerID, reason string) {
+	c.tunnelsTotal.WithLabelValues(customerID, reason).Inc()
+}
+
+func (c *MetricsCollector) RecordTunnelClosed(customerID string, duration time.Duration) {
+	c.tunnelsActive.WithLabelValues(customerID).Dec()
+	c.tunnelDuration.WithLabelValues(customerID).Observe(duration.Seconds())
+}
+
+func (c *MetricsCollector) RecordTunnelMessage(customerID, direction string) {
+	c.tunnelMessages.WithLabelValues(customerID, direction).Inc()
+}
+
+// RecordTCPConnection counts a forwarding attempt; result is "opened" for a
+// connection that reached its target
+func (c *MetricsCollector) RecordTCPConnection(customerID, target, result string) {
+	c.tcpConnections.WithLabelValues(customerID, target, result).Inc()
+}
+
+func (c *MetricsCollector) UpdateActiveTCPConnections(customerID string, delta int) {
+	c.tcpActive.WithLabelValues(customerID).Add(float64(delta))
+}
+
+func (c *MetricsCollector) RecordTCPBytes(customerID, target, direction string, n int) {
+	c.tcpBytes.WithLabelValues(customerID, target, direction).Add(float64(n))
+}
+
+func (c *MetricsCollector) SetUpstreamPools(n int) {
+	c.upstreamPools.Set(float64(n))
+}
+
+func (c *MetricsCollector) UpdateUpstreamConnections(customerID, upstream string, delta int) {
+	c.upstreamConns.WithLabelValues(customerID, upstream).Add(float64(delta))
+}
+
+// RecordUpstreamDial counts a connection attempt; result is "opened" for a
+// connection that was established
+func (c *MetricsCollector) RecordUpstreamDial(customerID, upstream, result string) {
+	c.upstreamDials.WithLabelValues(customerID, upstream, result).Inc()
+}
+
+// RecordUpstreamRequest counts a request by whether it was sent on a
+// "reused" or a "new" connection
+func (c *MetricsCollector) RecordUpstreamRequest(customerID, upstream, connection string) {
+	c.upstreamRequests.WithLabelValues(customerID, upstream, connection).Inc()
+}
+
+func (c *MetricsCollector) RecordUpstreamPoolEviction(reason string) {
+	c.upstreamEvictions.WithLabelValues(reason).Inc()
+}
+
+// RecordCacheRequest counts a request on a cached route; result is hit,
+// miss, stale, revalidated or bypass
+func (c *MetricsCollector) RecordCacheRequest(customerID, result string) {
+	c.cacheRequests.WithLabelValues(customerID, result).Inc()
+}
+
+func (c *MetricsCollector) RecordCachePurge(customerID string, purged int64) {
+	c.cachePurged.WithLabelValues(customerID).Add(float64(purged))
+}
+
+// RecordRetry counts a retry; result is "retried", or "budget_exhausted"
+// when the customer's retry budget refused it
+func (c *MetricsCollector) RecordRetry(customerID, result string) {
+	c.retries.WithLabelValues(customerID, result).Inc()
+}
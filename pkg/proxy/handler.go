@@ -1,45 +1,89 @@
 package proxy
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"proxy-service/internal/config"
 	"proxy-service/pkg/metrics"
+	"strings"
 	"time"
 )
 
 type ProxyHandler struct {
-	config  *config.Config
-	metrics *metrics.MetricsCollector
+	config     *config.Config
+	metrics    *metrics.MetricsCollector
+	target     *url.URL
+	transports *TransportPool
+	proxy      *httputil.ReverseProxy
 }
 
-func NewProxyHandler(config *config.Config, metrics *metrics.MetricsCollector) *ProxyHandler {
-	return &ProxyHandler{
-		config:  config,
-		metrics: metrics,
+// NewProxyHandler proxies to Proxy.TargetHost, a URL or a bare host that is
+// reached over https, on connections shared through transports
+func NewProxyHandler(config *config.Config, metrics *metrics.MetricsCollector, transports *TransportPool) (*ProxyHandler, error) {
+	target, err := parseTarget(config.Proxy.TargetHost)
+	if err != nil {
+		return nil, err
 	}
-}
-
-func (h *ProxyHandler) Handle(writer http.ResponseWriter, request *http.Request) {
-	start := time.Now()
-	customerID := request.Context().Value("customer_id").(string)
 
-	director := func(req *http.Request) {
-		req.URL.Scheme = "https"
-		req.URL.Host = h.config.Proxy.TargetHost
-		req.Host = h.config.Proxy.TargetHost
+	h := &ProxyHandler{
+		config:     config,
+		metrics:    metrics,
+		target:     target,
+		transports: transports,
 	}
-
-	proxy := &httputil.ReverseProxy{
-		Director: director,
+	h.proxy = &httputil.ReverseProxy{
+		Rewrite: func(req *httputil.ProxyRequest) {
+			req.SetURL(h.target)
+		},
+		Transport: roundTripperFunc(h.roundTrip),
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			h.metrics.RecordError(customerID, "proxy_error")
+			h.metrics.RecordError(customerOf(r), "proxy_error")
 			http.Error(w, err.Error(), http.StatusBadGateway)
 		},
 	}
+	return h, nil
+}
 
-	proxy.ServeHTTP(writer, request)
+func (h *ProxyHandler) Handle(writer http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+	customerID := customerOf(request)
+
+	h.proxy.ServeHTTP(writer, request)
 
 	duration := time.Since(start)
 	h.metrics.RecordRequestDuration(customerID, request.URL.Path, request.Method, duration)
 }
+
+// roundTrip sends a request on the customer's pool for the target
+func (h *ProxyHandler) roundTrip(req *http.Request) (*http.Response, error) {
+	transport, err := h.transports.Transport(customerOf(req), h.target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func customerOf(req *http.Request) string {
+	customerID, _ := req.Context().Value("customer_id").(string)
+	return customerID
+}
+
+// parseTarget accepts a URL or a bare host, which defaults to https
+func parseTarget(targetHost string) (*url.URL, error) {
+	if !strings.Contains(targetHost, "://") {
+		targetHost = "https://" + targetHost
+	}
+	target, err := url.Parse(targetHost)
+	if err != nil || target.Host == "" {
+		return nil, fmt.Errorf("invalid proxy target host %q", targetHost)
+	}
+	return target, nil
+}
@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-service/internal/config"
+	"proxy-service/internal/models"
+	"proxy-service/pkg/metrics"
+)
+
+// Defaults for the zero values of config.UpstreamTransportConfig
+const (
+	DefaultMaxIdleConnsPerHost = 64
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultKeepAlive           = 30 * time.Second
+	DefaultDialTimeout         = 10 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+	DefaultPoolIdleTimeout     = 10 * time.Minute
+)
+
+// Reasons a pool is evicted
+const (
+	evictedIdle         = "idle"
+	evictedRemoved      = "removed"
+	evictedReconfigured = "reconfigured"
+)
+
+var ErrInvalidUpstreamTLS = errors.New("invalid upstream TLS settings")
+
+// PoolStats describes the pool kept to one upstream of a customer
+type PoolStats struct {
+	CustomerID string
+	Upstream   string
+	OpenConns  int64
+	LastUsed   time.Time
+}
+
+// TransportPool shares one tuned transport, and with it the keep-alive
+// connections, per customer and upstream. Pools unused for a while are
+// evicted, as are those of customers that are removed. It is safe for
+// concurrent use.
+type TransportPool struct {
+	config  config.UpstreamTransportConfig
+	metrics *metrics.MetricsCollector
+
+	mutex sync.Mutex
+	pools map[poolKey]*upstreamPool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type poolKey struct {
+	customerID string
+	upstream   string // scheme://host
+}
+
+type upstreamPool struct {
+	transport   *http.Transport
+	fingerprint string // of the TLS settings the transport was built with
+	openConns   atomic.Int64
+	lastUsed    atomic.Int64 // unix nanoseconds
+}
+
+func NewTransportPool(transportConfig config.UpstreamTransportConfig, metrics *metrics.MetricsCollector) *TransportPool {
+	if transportConfig.MaxIdleConnsPerHost <= 0 {
+		transportConfig.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if transportConfig.IdleConnTimeout <= 0 {
+		transportConfig.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if transportConfig.KeepAlive <= 0 {
+		transportConfig.KeepAlive = DefaultKeepAlive
+	}
+	if transportConfig.DialTimeout <= 0 {
+		transportConfig.DialTimeout = DefaultDialTimeout
+	}
+	if transportConfig.TLSHandshakeTimeout <= 0 {
+		transportConfig.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
+	if transportConfig.PoolIdleTimeout <= 0 {
+		transportConfig.PoolIdleTimeout = DefaultPoolIdleTimeout
+	}
+
+	p := &TransportPool{
+		config:  transportConfig,
+		metrics: metrics,
+		pools:   make(map[poolKey]*upstreamPool),
+		done:    make(chan struct{}),
+	}
+	go p.evictIdle()
+	return p
+}
+
+// Transport returns the round tripper for requests of customerID to target,
+// creating its pool on first use. A pool built with other TLS settings is
+// replaced.
+func (p *TransportPool) Transport(customerID string, target *url.URL, upstreamTLS *models.UpstreamTLS) (http.RoundTripper, error) {
+	key := poolKey{customerID: customerID, upstream: target.Scheme + "://" + target.Host}
+	fingerprint := tlsFingerprint(upstreamTLS)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pool, exists := p.pools[key]
+	if exists && pool.fingerprint != fingerprint {
+		p.evictLocked(key, evictedReconfigured)
+		exists = false
+	}
+	if !exists {
+		tlsConfig, err := clientTLSConfig(upstreamTLS)
+		if err != nil {
+			return nil, err
+		}
+		pool = p.newPool(key, tlsConfig, fingerprint)
+		p.pools[key] = pool
+		p.metrics.SetUpstreamPools(len(p.pools))
+	}
+	pool.lastUsed.Store(time.Now().UnixNano())
+
+	return &pooledTransport{pool: pool, key: key, metrics: p.metrics}, nil
+}
+
+// Remove evicts every pool of a customer that was removed
+func (p *TransportPool) Remove(customerID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key := range p.pools {
+		if key.customerID == customerID {
+			p.evictLocked(key, evictedRemoved)
+		}
+	}
+}
+
+// Stats describes every pool kept
+func (p *TransportPool) Stats() []PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := make([]PoolStats, 0, len(p.pools))
+	for key, pool := range p.pools {
+		stats = append(stats, PoolStats{
+			CustomerID: key.customerID,
+			Upstream:   key.upstream,
+			OpenConns:  pool.openConns.Load(),
+			LastUsed:   time.Unix(0, pool.lastUsed.Load()),
+		})
+	}
+	return stats
+}
+
+// Close evicts every pool and stops the idle eviction
+func (p *TransportPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		for key := range p.pools {
+			p.evictLocked(key, evictedRemoved)
+		}
+	})
+}
+
+// evictLocked drops a pool and closes its idle connections; requests in
+// flight finish on theirs. p.mutex must be held.
+func (p *TransportPool) evictLocked(key poolKey, reason string) {
+	pool := p.pools[key]
+	delete(p.pools, key)
+	pool.transport.CloseIdleConnections()
+	p.metrics.RecordUpstreamPoolEviction(reason)
+	p.metrics.SetUpstreamPools(len(p.pools))
+}
+
+// evictIdle periodically evicts the pools that were not used for
+// PoolIdleTimeout
+func (p *TransportPool) evictIdle() {
+	interval := p.config.PoolIdleTimeout / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			cutoff := time.Now().Add(-p.config.PoolIdleTimeout).UnixNano()
+			p.mutex.Lock()
+			for key, pool := range p.pools {
+				if pool.lastUsed.Load() < cutoff {
+					p.evictLocked(key, evictedIdle)
+				}
+			}
+			p.mutex.Unlock()
+		}
+	}
+}
+
+func (p *TransportPool) newPool(key poolKey, tlsConfig *tls.Config, fingerprint string) *upstreamPool {
+	pool := &upstreamPool{fingerprint: fingerprint}
+	dialer := &net.Dialer{
+		Timeout:   p.config.DialTimeout,
+		KeepAlive: p.config.KeepAlive,
+	}
+
+	pool.transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				p.metrics.RecordUpstreamDial(key.customerID, key.upstream, "error")
+				return nil, err
+			}
+			p.metrics.RecordUpstreamDial(key.customerID, key.upstream, "opened")
+			pool.openConns.Add(1)
+			p.metrics.UpdateUpstreamConnections(key.customerID, key.upstream, 1)
+			return &countedConn{Conn: conn, closed: func() {
+				pool.openConns.Add(-1)
+				p.metrics.UpdateUpstreamConnections(key.customerID, key.upstream, -1)
+			}}, nil
+		},
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   p.config.TLSHandshakeTimeout,
+		ForceAttemptHTTP2:     !p.config.DisableHTTP2,
+		MaxIdleConns:          p.config.MaxIdleConnsPerHost,
+		MaxIdleConnsPerHost:   p.config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       p.config.MaxConnsPerHost,
+		IdleConnTimeout:       p.config.IdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+		// Compressed bodies are passed on as they are
+		DisableCompression: true,
+	}
+	if p.config.DisableHTTP2 {
+		// A non-nil empty map is what turns HTTP/2 off
+		pool.transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return pool
+}
+
+// pooledTransport sends requests on its pool's transport and counts how
+// often connections are reused
+type pooledTransport struct {
+	pool    *upstreamPool
+	key     poolKey
+	metrics *metrics.MetricsCollector
+}
+
+func (t *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.pool.lastUsed.Store(time.Now().UnixNano())
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connection := "new"
+			if info.Reused {
+				connection = "reused"
+			}
+			t.metrics.RecordUpstreamRequest(t.key.customerID, t.key.upstream, connection)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.pool.transport.RoundTrip(req)
+}
+
+// countedConn reports once that it was closed
+type countedConn struct {
+	net.Conn
+	closeOnce sync.Once
+	closed    func()
+}
+
+func (c *countedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.closed)
+	return err
+}
+
+// clientTLSConfig builds the TLS configuration for an upstream; nil settings
+// use the system roots and the target's host
+func clientTLSConfig(upstreamTLS *models.UpstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if upstreamTLS == nil {
+		return tlsConfig, nil
+	}
+
+	tlsConfig.ServerName = upstreamTLS.ServerName
+	if upstreamTLS.CACert != "" {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM([]byte(upstreamTLS.CACert)) {
+			return nil, fmt.Errorf("%w: no certificate found in CA bundle", ErrInvalidUpstreamTLS)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if upstreamTLS.ClientCert != "" || upstreamTLS.ClientKey != "" {
+		certificate, err := tls.X509KeyPair([]byte(upstreamTLS.ClientCert), []byte(upstreamTLS.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidUpstreamTLS, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// tlsFingerprint tells TLS settings apart without keeping the key around
+func tlsFingerprint(upstreamTLS *models.UpstreamTLS) string {
+	if upstreamTLS == nil {
+		return ""
+	}
+	hash := sha256.New()
+	for _, field := range []string{upstreamTLS.CACert, upstreamTLS.ServerName, upstreamTLS.ClientCert, upstreamTLS.ClientKey} {
+		fmt.Fprintf(hash, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
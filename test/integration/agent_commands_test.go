@@ -0,0 +1,378 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"proxy-service/internal/middleware"
+	"proxy-service/internal/models"
+	"proxy-service/internal/repository"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubCommandStore keeps agent commands in memory
+type stubCommandStore struct {
+	mu       sync.Mutex
+	commands map[string]models.AgentCommand
+}
+
+func newStubCommandStore() *stubCommandStore {
+	return &stubCommandStore{commands: make(map[string]models.AgentCommand)}
+}
+
+func (s *stubCommandStore) CreateCommand(ctx context.Context, command *models.AgentCommand) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.commands[command.ID]; exists {
+		return repository.ErrAlreadyExists
+	}
+	s.commands[command.ID] = *command
+	return nil
+}
+
+func (s *stubCommandStore) GetCommand(ctx context.Context, commandID string) (*models.AgentCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	command, exists := s.commands[commandID]
+	if !exists {
+		return nil, repository.ErrNotFound
+	}
+	return &command, nil
+}
+
+func (s *stubCommandStore) GetCommandsByAgent(ctx context.Context, agentID string, limit int) ([]*models.AgentCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var commands []*models.AgentCommand
+	for _, command := range s.commands {
+		if command.AgentID == agentID {
+			command := command
+			commands = append(commands, &command)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].CreatedAt.After(commands[j].CreatedAt) })
+	if len(commands) > limit {
+		commands = commands[:limit]
+	}
+	return commands, nil
+}
+
+func (s *stubCommandStore) CompleteCommand(ctx context.Context, command *models.AgentCommand) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, exists := s.commands[command.ID]
+	if !exists || stored.Status != agent.CommandPending {
+		return repository.ErrNotFound
+	}
+	stored.Status = command.Status
+	stored.Result = command.Result
+	stored.Error = command.Error
+	stored.CompletedAt = command.CompletedAt
+	s.commands[command.ID] = stored
+	return nil
+}
+
+// commandAdminToken guards the command API in tests
+const commandAdminToken = "operator-secret"
+
+// commandEnv serves the operator command API next to an agent endpoint that
+// admits any agent
+type commandEnv struct {
+	*proxyEnv
+	apiURL string
+	store  *stubCommandStore
+}
+
+func newCommandEnv(t *testing.T) *commandEnv {
+	t.Helper()
+	store := newStubCommandStore()
+	env := newProxyEnvWithEndpoint(t, func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler {
+		manager.SetCommandLog(agent.NewCommandLog(store, redisCache))
+		handler := newTestAgentHandler(manager, redisCache)
+
+		upgrader := websocket.Upgrader{Subprotocols: agentproto.Subprotocols}
+		connect := func(c *gin.Context) {
+			conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+			if err != nil {
+				return
+			}
+			manager.RegisterAgent(context.Background(), c.GetHeader("X-Agent-ID"), testCustomerID, conn)
+		}
+		// Fake agents dial the root, the reference agent the connect path
+		router := gin.New()
+		router.GET("/", connect)
+		router.GET("/api/v1/agents/connect", connect)
+		admin := router.Group("/admin/v1", middleware.AdminToken(commandAdminToken))
+		admin.POST("/customers/:customer_id/agents/:agent_id/commands", handler.HandleIssueCommand)
+		admin.GET("/customers/:customer_id/agents/:agent_id/commands", handler.HandleListCommands)
+		admin.GET("/customers/:customer_id/agents/:agent_id/commands/:command_id", handler.HandleGetCommand)
+		return router
+	})
+	t.Cleanup(env.manager.Close)
+	return &commandEnv{
+		proxyEnv: env,
+		apiURL:   "http" + strings.TrimPrefix(env.agentURL, "ws") + "/admin/v1/customers/" + testCustomerID + "/agents",
+		store:    store,
+	}
+}
+
+// do sends a request to the command API with the given admin token
+func (env *commandEnv) do(t *testing.T, method, path, token string, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, env.apiURL+path, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+// issue posts a command and returns the status and the pending command
+func (env *commandEnv) issue(t *testing.T, agentID string, body map[string]string) (int, *models.AgentCommand) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	resp := env.do(t, http.MethodPost, "/"+agentID+"/commands", commandAdminToken, data)
+	defer resp.Body.Close()
+
+	var command models.AgentCommand
+	if resp.StatusCode == http.StatusAccepted {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&command))
+	}
+	return resp.StatusCode, &command
+}
+
+func (env *commandEnv) get(t *testing.T, path string, out interface{}) int {
+	t.Helper()
+	resp := env.do(t, http.MethodGet, path, commandAdminToken, nil)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+// run issues a command and waits for its outcome
+func (env *commandEnv) run(t *testing.T, agentID string, body map[string]string) *models.AgentCommand {
+	t.Helper()
+	status, issued := env.issue(t, agentID, body)
+	require.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, agent.CommandPending, issued.Status)
+
+	var command models.AgentCommand
+	require.Eventually(t, func() bool {
+		require.Equal(t, http.StatusOK, env.get(t, "/"+agentID+"/commands/"+issued.ID, &command))
+		return command.Status != agent.CommandPending
+	}, 5*time.Second, 10*time.Millisecond)
+	return &command
+}
+
+func TestDiagnosticsCommand(t *testing.T) {
+	env := newCommandEnv(t)
+	upstream := newEchoUpstream(t)
+	startAgentClient(t, env.proxyEnv, "reference-agent", testAPIKey, upstream.URL)
+	waitForAgent(t, env.proxyEnv, "reference-agent")
+
+	command := env.run(t, "reference-agent", map[string]string{"command": agentproto.CommandDiagnostics})
+	require.Equal(t, agent.CommandSucceeded, command.Status, command.Error)
+	require.NotNil(t, command.CompletedAt)
+	require.NotNil(t, command.Result)
+	diagnostics := command.Result.Diagnostics
+	require.NotNil(t, diagnostics)
+	assert.Positive(t, diagnostics.Goroutines)
+	assert.Contains(t, diagnostics.GoroutineDump, "goroutine ")
+	assert.Equal(t, "info", diagnostics.LogLevel)
+	require.Len(t, diagnostics.Upstreams, 1)
+	assert.Equal(t, upstream.URL, diagnostics.Upstreams[0].Target)
+	assert.True(t, diagnostics.Upstreams[0].Reachable)
+	assert.Equal(t, http.StatusCreated, diagnostics.Upstreams[0].StatusCode)
+
+	// The result is kept for later review
+	stored, err := env.store.GetCommand(context.Background(), command.ID)
+	require.NoError(t, err)
+	assert.Equal(t, agent.CommandSucceeded, stored.Status)
+	assert.NotNil(t, stored.Result.Diagnostics)
+}
+
+func TestDiagnosticsReportRecentErrors(t *testing.T) {
+	env := newCommandEnv(t)
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstreamURL := upstream.URL
+	upstream.Close()
+	startAgentClient(t, env.proxyEnv, "reference-agent", testAPIKey, upstreamURL)
+	waitForAgent(t, env.proxyEnv, "reference-agent")
+
+	status, _ := selectedBy(t, env.proxyURL, "/api/v1/items", "")
+	assert.Equal(t, http.StatusBadGateway, status)
+
+	command := env.run(t, "reference-agent", map[string]string{"command": agentproto.CommandDiagnostics})
+	require.Equal(t, agent.CommandSucceeded, command.Status, command.Error)
+	diagnostics := command.Result.Diagnostics
+	assert.False(t, diagnostics.Upstreams[0].Reachable)
+	assert.NotEmpty(t, diagnostics.Upstreams[0].Error)
+	require.NotEmpty(t, diagnostics.RecentErrors)
+	assert.Contains(t, diagnostics.RecentErrors[len(diagnostics.RecentErrors)-1].Message, "upstream request failed")
+}
+
+func TestSetLogLevelCommand(t *testing.T) {
+	env := newCommandEnv(t)
+	startAgentClient(t, env.proxyEnv, "reference-agent", testAPIKey, newEchoUpstream(t).URL)
+	waitForAgent(t, env.proxyEnv, "reference-agent")
+
+	command := env.run(t, "reference-agent", map[string]string{"command": agentproto.CommandSetLogLevel, "level": "debug"})
+	require.Equal(t, agent.CommandSucceeded, command.Status, command.Error)
+	assert.Equal(t, "debug", command.Level)
+
+	command = env.run(t, "reference-agent", map[string]string{"command": agentproto.CommandDiagnostics})
+	require.Equal(t, agent.CommandSucceeded, command.Status)
+	assert.Equal(t, "debug", command.Result.Diagnostics.LogLevel)
+
+	status, _ := env.issue(t, "reference-agent", map[string]string{"command": agentproto.CommandSetLogLevel, "level": "verbose"})
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = env.issue(t, "reference-agent", map[string]string{"command": "format_disk"})
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = env.issue(t, "reference-agent", map[string]string{"command": agentproto.CommandDiagnostics, "timeout": "1h"})
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestReloadConfigCommand(t *testing.T) {
+	env := newCommandEnv(t)
+	client := startAgentClient(t, env.proxyEnv, "reference-agent", testAPIKey, newEchoUpstream(t).URL)
+	waitForAgent(t, env.proxyEnv, "reference-agent")
+
+	stored, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{MaxConnections: 3})
+	require.NoError(t, err)
+	waitForRevision(t, client, stored.Revision)
+
+	command := env.run(t, "reference-agent", map[string]string{"command": agentproto.CommandReloadConfig})
+	require.Equal(t, agent.CommandSucceeded, command.Status, command.Error)
+	assert.Contains(t, command.Result.Message, "revision")
+}
+
+func TestRestartCommandReconnectsAgent(t *testing.T) {
+	env := newCommandEnv(t)
+	startAgentClient(t, env.proxyEnv, "reference-agent", testAPIKey, newEchoUpstream(t).URL)
+	waitForAgent(t, env.proxyEnv, "reference-agent")
+	before := env.manager.GetCustomerAgents(testCustomerID)
+	require.Len(t, before, 1)
+
+	command := env.run(t, "reference-agent", map[string]string{"command": agentproto.CommandRestart})
+	require.Equal(t, agent.CommandSucceeded, command.Status, command.Error)
+
+	require.Eventually(t, func() bool {
+		after := env.manager.GetCustomerAgents(testCustomerID)
+		return len(after) == 1 && after[0] != before[0]
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCommandTimesOut(t *testing.T) {
+	env := newCommandEnv(t)
+	// The fake agent advertises commands but never answers them
+	env.connectAgent(t, testAgentID, "", echoResponder)
+
+	command := env.run(t, testAgentID, map[string]string{"command": agentproto.CommandDiagnostics, "timeout": "100ms"})
+	assert.Equal(t, agent.CommandTimedOut, command.Status)
+	assert.NotEmpty(t, command.Error)
+}
+
+func TestCommandToAgentWithoutCommandSupport(t *testing.T) {
+	env := newCommandEnv(t)
+	env.connectAgentWithHello(t, testAgentID, "", &agentproto.HelloPayload{
+		ProtocolVersion: agentproto.ProtocolVersion,
+		Capabilities:    []string{agentproto.CapabilityStreaming},
+	}, echoResponder)
+
+	command := env.run(t, testAgentID, map[string]string{"command": agentproto.CommandRestart})
+	assert.Equal(t, agent.CommandFailed, command.Status)
+	assert.Equal(t, agent.ErrCommandsUnsupported.Error(), command.Error)
+}
+
+func TestCommandHistory(t *testing.T) {
+	env := newCommandEnv(t)
+	startAgentClient(t, env.proxyEnv, "reference-agent", testAPIKey, newEchoUpstream(t).URL)
+	waitForAgent(t, env.proxyEnv, "reference-agent")
+
+	first := env.run(t, "reference-agent", map[string]string{"command": agentproto.CommandSetLogLevel, "level": "warn"})
+	second := env.run(t, "reference-agent", map[string]string{"command": agentproto.CommandReloadConfig})
+
+	var listed struct {
+		Commands []models.AgentCommand `json:"commands"`
+	}
+	require.Equal(t, http.StatusOK, env.get(t, "/reference-agent/commands", &listed))
+	require.Len(t, listed.Commands, 2)
+	assert.Equal(t, second.ID, listed.Commands[0].ID)
+	assert.Equal(t, first.ID, listed.Commands[1].ID)
+
+	var command models.AgentCommand
+	assert.Equal(t, http.StatusNotFound, env.get(t, "/other-agent/commands/"+first.ID, &command))
+	assert.Equal(t, http.StatusNotFound, env.get(t, "/reference-agent/commands/unknown", &command))
+
+	status, _ := env.issue(t, "absent-agent", map[string]string{"command": agentproto.CommandDiagnostics})
+	assert.Equal(t, http.StatusConflict, status)
+}
+
+func TestCommandsRequireAdminToken(t *testing.T) {
+	env := newCommandEnv(t)
+	startAgentClient(t, env.proxyEnv, "reference-agent", testAPIKey, newEchoUpstream(t).URL)
+	waitForAgent(t, env.proxyEnv, "reference-agent")
+
+	data, err := json.Marshal(map[string]string{"command": agentproto.CommandDiagnostics})
+	require.NoError(t, err)
+	for _, token := range []string{"", "customer-token"} {
+		resp := env.do(t, http.MethodPost, "/reference-agent/commands", token, data)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = env.do(t, http.MethodGet, "/reference-agent/commands", token, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	var listed struct {
+		Commands []models.AgentCommand `json:"commands"`
+	}
+	require.Equal(t, http.StatusOK, env.get(t, "/reference-agent/commands", &listed))
+	assert.Empty(t, listed.Commands)
+}
+
+func TestCommandReachesAgentOnOtherReplica(t *testing.T) {
+	_, replicaA, replicaB := newCluster(t)
+	store := newStubCommandStore()
+	for _, replica := range []*replicaEnv{replicaA, replicaB} {
+		replica.manager.SetCommandLog(agent.NewCommandLog(store, replica.cache))
+		t.Cleanup(replica.manager.Close)
+	}
+
+	startAgentClient(t, replicaA.proxyEnv, "reference-agent", testAPIKey, newEchoUpstream(t).URL)
+	waitForAgent(t, replicaA.proxyEnv, "reference-agent")
+	waitForLocations(t, replicaB, 1)
+
+	issued, err := replicaB.manager.IssueCommand(context.Background(), testCustomerID, "reference-agent", agentproto.CommandSetLogLevel, "error", time.Second)
+	require.NoError(t, err)
+
+	log := replicaB.manager.CommandLog()
+	require.Eventually(t, func() bool {
+		command, err := log.Get(context.Background(), testCustomerID, issued.ID)
+		require.NoError(t, err)
+		return command.Status == agent.CommandSucceeded
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = replicaB.manager.IssueCommand(context.Background(), testCustomerID, "absent-agent", agentproto.CommandDiagnostics, "", 0)
+	assert.ErrorIs(t, err, agent.ErrAgentNotConnected)
+}
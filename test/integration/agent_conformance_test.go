@@ -0,0 +1,307 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"proxy-service/pkg/agentproto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Conformance suite for the agent round trip: whatever the caller sends must
+// reach the agent unchanged apart from hop-by-hop headers, and whatever the
+// agent answers must reach the caller the same way.
+
+func echoResponder(req *receivedRequest) *fakeResponse {
+	return &fakeResponse{
+		Status:  http.StatusOK,
+		Headers: http.Header{"Content-Type": {"application/octet-stream"}},
+		Body:    req.FullBody,
+	}
+}
+
+func TestConformanceMethodPathAndQuery(t *testing.T) {
+	env := newProxyEnv(t, echoResponder)
+
+	req, err := http.NewRequest(http.MethodDelete, env.proxyURL+"/api/v1/items/a%2Fb?x=1&x=2&empty=&q=a+b", nil)
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	got := env.agent.next(t)
+	assert.Equal(t, http.MethodDelete, got.Method)
+	assert.Equal(t, "/api/v1/items/a%2Fb", got.Path)
+	assert.Equal(t, "x=1&x=2&empty=&q=a+b", got.RawQuery)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestConformanceRequestHeaders(t *testing.T) {
+	env := newProxyEnv(t, echoResponder)
+
+	req, err := http.NewRequest(http.MethodGet, env.proxyURL+"/api/v1/headers", nil)
+	require.NoError(t, err)
+	req.Header.Add("X-Multi", "one")
+	req.Header.Add("X-Multi", "two")
+	req.Header.Set("Connection", "X-Per-Hop")
+	req.Header.Set("X-Per-Hop", "secret")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	got := http.Header(env.agent.next(t).Headers)
+	assert.Equal(t, []string{"one", "two"}, got.Values("X-Multi"))
+	for _, name := range []string{"Connection", "X-Per-Hop", "Keep-Alive", "Te", "Proxy-Authorization", "Transfer-Encoding"} {
+		assert.Empty(t, got.Values(name), name)
+	}
+}
+
+func TestConformanceResponseHeaders(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{
+			Status: http.StatusCreated,
+			Headers: http.Header{
+				"Set-Cookie":        {"a=1", "b=2"},
+				"Connection":        {"X-Agent-Hop"},
+				"X-Agent-Hop":       {"1"},
+				"Transfer-Encoding": {"chunked"},
+				"Content-Length":    {"999"},
+			},
+			Body: []byte("created"),
+		}
+	})
+
+	resp, err := http.Post(env.proxyURL+"/api/v1/things", "text/plain", strings.NewReader("x"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, []string{"a=1", "b=2"}, resp.Header.Values("Set-Cookie"))
+	assert.Empty(t, resp.Header.Get("X-Agent-Hop"))
+	assert.Equal(t, int64(len("created")), resp.ContentLength)
+	assert.Equal(t, "created", string(body))
+}
+
+func TestConformanceInlineBody(t *testing.T) {
+	env := newProxyEnv(t, echoResponder)
+
+	payload := `{"name":"widget","tags":["a","b"]}`
+	resp, err := http.Post(env.proxyURL+"/api/v1/widgets", "application/json", strings.NewReader(payload))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	got := env.agent.next(t)
+	assert.False(t, got.Streamed)
+	assert.Equal(t, payload, string(got.FullBody))
+	assert.Equal(t, fmt.Sprint(len(payload)), http.Header(got.Headers).Get("Content-Length"))
+	assert.Equal(t, payload, string(body))
+	assert.Equal(t, int64(len(payload)), resp.ContentLength)
+}
+
+func TestConformanceEmptyPost(t *testing.T) {
+	env := newProxyEnv(t, echoResponder)
+
+	resp, err := http.Post(env.proxyURL+"/api/v1/ping", "text/plain", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	got := env.agent.next(t)
+	assert.Empty(t, got.FullBody)
+	assert.Equal(t, "0", http.Header(got.Headers).Get("Content-Length"))
+}
+
+func TestConformanceStreamedBodies(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		resp := echoResponder(req)
+		resp.Stream = true
+		return resp
+	})
+
+	payload := make([]byte, 3<<20+17)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+
+	// Hiding the length forces chunked transfer encoding
+	req, err := http.NewRequest(http.MethodPut, env.proxyURL+"/api/v1/export", io.MultiReader(bytes.NewReader(payload)))
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	got := env.agent.next(t)
+	assert.True(t, got.Streamed)
+	assert.Empty(t, http.Header(got.Headers).Get("Content-Length"))
+	assert.Empty(t, http.Header(got.Headers).Get("Transfer-Encoding"))
+	assert.True(t, bytes.Equal(payload, got.FullBody), "request body mismatch")
+	assert.True(t, bytes.Equal(payload, body), "response body mismatch")
+}
+
+func TestConformanceKnownLengthStreamedBody(t *testing.T) {
+	env := newProxyEnv(t, echoResponder)
+
+	payload := bytes.Repeat([]byte("0123456789"), 100000)
+	resp, err := http.Post(env.proxyURL+"/api/v1/upload", "application/octet-stream", bytes.NewReader(payload))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, err)
+
+	got := env.agent.next(t)
+	assert.True(t, got.Streamed)
+	assert.Equal(t, fmt.Sprint(len(payload)), http.Header(got.Headers).Get("Content-Length"))
+	assert.True(t, bytes.Equal(payload, got.FullBody))
+}
+
+// trailerReader fills in the request trailers once the body is exhausted
+type trailerReader struct {
+	r       io.Reader
+	req     *http.Request
+	trailer string
+}
+
+func (tr *trailerReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if err == io.EOF {
+		tr.req.Trailer.Set("X-Checksum", tr.trailer)
+	}
+	return n, err
+}
+
+func TestConformanceTrailers(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streamed=%v", stream), func(t *testing.T) {
+			env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+				return &fakeResponse{
+					Status:   http.StatusOK,
+					Body:     []byte("with trailers"),
+					Trailers: http.Header{"X-Result": {"ok"}},
+					Stream:   stream,
+				}
+			})
+
+			body := bytes.Repeat([]byte("t"), 128<<10)
+			req, err := http.NewRequest(http.MethodPost, env.proxyURL+"/api/v1/trailers", nil)
+			require.NoError(t, err)
+			req.Trailer = http.Header{"X-Checksum": nil}
+			req.Body = io.NopCloser(&trailerReader{r: bytes.NewReader(body), req: req, trailer: "abc123"})
+			req.ContentLength = -1
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			respBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			got := env.agent.next(t)
+			assert.Equal(t, []string{"abc123"}, http.Header(got.Trailers).Values("X-Checksum"))
+			assert.Equal(t, "with trailers", string(respBody))
+			assert.Equal(t, "ok", resp.Trailer.Get("X-Result"))
+		})
+	}
+}
+
+func TestConformanceBodilessResponses(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		if req.Method == http.MethodHead {
+			return &fakeResponse{
+				Status:  http.StatusOK,
+				Headers: http.Header{"Content-Length": {"1234"}},
+			}
+		}
+		return &fakeResponse{
+			Status: http.StatusNoContent,
+			Body:   []byte("must not be sent"),
+		}
+	})
+
+	resp, err := http.Head(env.proxyURL + "/api/v1/file")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int64(1234), resp.ContentLength)
+
+	resp, err = http.Get(env.proxyURL + "/api/v1/nothing")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+}
+
+func TestConformanceConcurrentRequests(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Body: []byte(req.RawQuery)}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			query := fmt.Sprintf("n=%d", i)
+			resp, err := http.Get(env.proxyURL + "/api/v1/concurrent?" + query)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, query, string(body))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConformanceCodecs(t *testing.T) {
+	for _, subprotocol := range []string{agentproto.SubprotocolJSON, agentproto.SubprotocolBinary} {
+		t.Run(subprotocol, func(t *testing.T) {
+			env := newProxyEnvWithCodec(t, subprotocol, func(req *receivedRequest) *fakeResponse {
+				resp := echoResponder(req)
+				resp.Headers.Set("X-Query", req.RawQuery)
+				resp.Trailers = http.Header{"X-Result": {"ok"}}
+				resp.Stream = len(req.FullBody) > agentproto.MaxInlineBodySize
+				return resp
+			})
+
+			for _, size := range []int{0, 1 << 10, 1 << 20} {
+				payload := make([]byte, size)
+				_, err := rand.Read(payload)
+				require.NoError(t, err)
+
+				resp, err := http.Post(env.proxyURL+"/api/v1/codec?size="+fmt.Sprint(size), "application/octet-stream", bytes.NewReader(payload))
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				require.NoError(t, err)
+
+				got := env.agent.next(t)
+				assert.Equal(t, "/api/v1/codec", got.Path)
+				assert.True(t, bytes.Equal(payload, got.FullBody), "request body mismatch at %d bytes", size)
+				assert.True(t, bytes.Equal(payload, body), "response body mismatch at %d bytes", size)
+				assert.Equal(t, "size="+fmt.Sprint(size), resp.Header.Get("X-Query"))
+				assert.Equal(t, "ok", resp.Trailer.Get("X-Result"))
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHealthPolicy judges agents after a handful of requests and ejects
+// them briefly
+var testHealthPolicy = agent.HealthPolicy{
+	Window:         time.Minute,
+	MinRequests:    4,
+	MaxErrorRate:   0.5,
+	MaxTimeoutRate: 0.5,
+	BaseEjection:   300 * time.Millisecond,
+	MaxEjection:    2 * time.Second,
+}
+
+func statusResponder(status int) fakeResponder {
+	return func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{Status: status, Body: []byte(http.StatusText(status))}
+	}
+}
+
+// newHealthEnv connects agent-good answering 200 and agent-bad answering 502
+func newHealthEnv(t *testing.T) *proxyEnv {
+	t.Helper()
+	env := newEmptyProxyEnv(t)
+	env.manager.SetHealthPolicy(testHealthPolicy)
+	t.Cleanup(env.manager.Close)
+	env.connectAgent(t, "agent-good", "", nameResponder("agent-good"))
+	env.connectAgent(t, "agent-bad", "", statusResponder(http.StatusBadGateway))
+	return env
+}
+
+// routeTo sends requests straight to one agent
+func routeTo(t *testing.T, env *proxyEnv, agentID string, n int, timeout time.Duration) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		env.manager.RouteRequest(ctx, agentID, &agent.ProxyRequest{ProxyRequest: agentproto.ProxyRequest{
+			Method:     http.MethodGet,
+			Path:       "/api/v1/items",
+			CustomerID: testCustomerID,
+		}})
+		cancel()
+	}
+}
+
+func agentHealth(t *testing.T, env *proxyEnv, agentID string) *agent.AgentHealth {
+	t.Helper()
+	health, ok := env.manager.AgentHealth(agentID)
+	require.True(t, ok, agentID)
+	return health
+}
+
+func TestFailingAgentIsEjectedAndReadmitted(t *testing.T) {
+	env := newHealthEnv(t)
+
+	// Round robin sends every other request to agent-bad until it is ejected
+	statuses := make(map[int]int)
+	for i := 0; i < 8; i++ {
+		status, _ := selectedBy(t, env.proxyURL, "/api/v1/items", "")
+		statuses[status]++
+	}
+	assert.Equal(t, map[int]int{http.StatusOK: 4, http.StatusBadGateway: 4}, statuses)
+
+	health := agentHealth(t, env, "agent-bad")
+	assert.Equal(t, agent.HealthEjected, health.Status)
+	assert.Zero(t, health.Score)
+	assert.Equal(t, 1.0, health.ErrorRate)
+	assert.Equal(t, 1, health.Ejections)
+	require.NotNil(t, health.EjectedUntil)
+
+	good := agentHealth(t, env, "agent-good")
+	assert.Equal(t, agent.HealthHealthy, good.Status)
+	assert.Equal(t, 100.0, good.Score)
+	assert.Equal(t, 4, good.Requests)
+
+	assert.Equal(t, map[string]int{"agent-good": 4}, servedAgents(t, env.proxyURL, "/api/v1/items", "", 4))
+
+	// Readmitted agents start over with a clean record
+	require.Eventually(t, func() bool {
+		return agentHealth(t, env, "agent-bad").Status == agent.HealthHealthy
+	}, 2*time.Second, 20*time.Millisecond)
+	health = agentHealth(t, env, "agent-bad")
+	assert.Zero(t, health.Requests)
+	assert.Equal(t, 100.0, health.Score)
+
+	statuses = make(map[int]int)
+	for i := 0; i < 2; i++ {
+		status, _ := selectedBy(t, env.proxyURL, "/api/v1/items", "")
+		statuses[status]++
+	}
+	assert.Equal(t, map[int]int{http.StatusOK: 1, http.StatusBadGateway: 1}, statuses)
+}
+
+func TestRepeatedEjectionsBackOff(t *testing.T) {
+	env := newHealthEnv(t)
+
+	ejectedFor := func() time.Duration {
+		start := time.Now()
+		routeTo(t, env, "agent-bad", testHealthPolicy.MinRequests, time.Second)
+		health := agentHealth(t, env, "agent-bad")
+		require.Equal(t, agent.HealthEjected, health.Status)
+		return health.EjectedUntil.Sub(start)
+	}
+
+	first := ejectedFor()
+	assert.GreaterOrEqual(t, first, testHealthPolicy.BaseEjection)
+	assert.Less(t, first, 2*testHealthPolicy.BaseEjection)
+
+	require.Eventually(t, func() bool {
+		return agentHealth(t, env, "agent-bad").Status == agent.HealthHealthy
+	}, 2*time.Second, 10*time.Millisecond)
+
+	second := ejectedFor()
+	assert.GreaterOrEqual(t, second, 2*testHealthPolicy.BaseEjection)
+	assert.Equal(t, 2, agentHealth(t, env, "agent-bad").Ejections)
+}
+
+func TestTimingOutAgentIsEjected(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	env.manager.SetHealthPolicy(testHealthPolicy)
+	t.Cleanup(env.manager.Close)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	env.connectAgent(t, "agent-good", "", nameResponder("agent-good"))
+	env.connectAgent(t, "agent-slow", "", blockingResponder(release))
+
+	routeTo(t, env, "agent-slow", testHealthPolicy.MinRequests, 20*time.Millisecond)
+
+	health := agentHealth(t, env, "agent-slow")
+	assert.Equal(t, agent.HealthEjected, health.Status)
+	assert.Equal(t, 1.0, health.TimeoutRate)
+	assert.Zero(t, health.ErrorRate)
+	assert.Equal(t, map[string]int{"agent-good": 3}, servedAgents(t, env.proxyURL, "/api/v1/items", "", 3))
+}
+
+func TestSlowAgentIsEjectedByLatency(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	policy := testHealthPolicy
+	policy.MaxLatencyP99 = 20 * time.Millisecond
+	env.manager.SetHealthPolicy(policy)
+	t.Cleanup(env.manager.Close)
+	env.connectAgent(t, "agent-good", "", nameResponder("agent-good"))
+	env.connectAgent(t, "agent-slow", "", func(req *receivedRequest) *fakeResponse {
+		time.Sleep(50 * time.Millisecond)
+		return &fakeResponse{Status: http.StatusOK}
+	})
+
+	routeTo(t, env, "agent-slow", policy.MinRequests, time.Second)
+
+	health := agentHealth(t, env, "agent-slow")
+	assert.Equal(t, agent.HealthEjected, health.Status)
+	assert.Zero(t, health.ErrorRate)
+	assert.GreaterOrEqual(t, health.LatencyP99, 50.0)
+}
+
+func TestEjectionKeepsPartOfThePool(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	env.manager.SetHealthPolicy(testHealthPolicy)
+	t.Cleanup(env.manager.Close)
+	env.connectAgent(t, testAgentID, "", statusResponder(http.StatusServiceUnavailable))
+
+	// Ejecting the only agent would leave the customer with none
+	routeTo(t, env, testAgentID, 2*testHealthPolicy.MinRequests, time.Second)
+
+	health := agentHealth(t, env, testAgentID)
+	assert.Equal(t, agent.HealthHealthy, health.Status)
+	assert.Equal(t, 1.0, health.ErrorRate)
+	assert.Zero(t, health.Score)
+	assert.Zero(t, health.Ejections)
+
+	status, _ := selectedBy(t, env.proxyURL, "/api/v1/items", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestAgentHealthEndpoint(t *testing.T) {
+	var api *httptest.Server
+	env := newProxyEnvWithEndpoint(t, func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler {
+		manager.SetHealthPolicy(testHealthPolicy)
+		handler := newTestAgentHandler(manager, redisCache)
+		router := gin.New()
+		group := router.Group("/api/v1/agents", func(c *gin.Context) {
+			c.Set("customer_id", c.GetHeader("X-Customer-ID"))
+		})
+		group.GET("/health", handler.HandleAgentHealth)
+		group.GET("/:agent_id/health", handler.HandleAgentHealth)
+		api = httptest.NewServer(router)
+		t.Cleanup(api.Close)
+
+		upgrader := websocket.Upgrader{Subprotocols: agentproto.Subprotocols}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			manager.RegisterAgent(context.Background(), r.Header.Get("X-Agent-ID"), testCustomerID, conn)
+		})
+	})
+	t.Cleanup(env.manager.Close)
+	env.connectAgent(t, "agent-good", "", nameResponder("agent-good"))
+	env.connectAgent(t, "agent-bad", "", statusResponder(http.StatusBadGateway))
+	routeTo(t, env, "agent-bad", testHealthPolicy.MinRequests, time.Second)
+	routeTo(t, env, "agent-good", 2, time.Second)
+
+	get := func(path, customerID string, out interface{}) int {
+		req, err := http.NewRequest(http.MethodGet, api.URL+"/api/v1/agents"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Customer-ID", customerID)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if out != nil && resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+
+	var listed struct {
+		Agents []agent.AgentHealth `json:"agents"`
+	}
+	require.Equal(t, http.StatusOK, get("/health", testCustomerID, &listed))
+	require.Len(t, listed.Agents, 2)
+	assert.Equal(t, "agent-bad", listed.Agents[0].AgentID)
+	assert.Equal(t, agent.HealthEjected, listed.Agents[0].Status)
+	assert.Equal(t, "agent-good", listed.Agents[1].AgentID)
+	assert.Equal(t, 100.0, listed.Agents[1].Score)
+	assert.Equal(t, 2, listed.Agents[1].Requests)
+
+	var single map[string]interface{}
+	require.Equal(t, http.StatusOK, get("/agent-bad/health", testCustomerID, &single))
+	assert.Equal(t, agent.HealthEjected, single["status"])
+	assert.Contains(t, single, "ejected_until")
+	assert.Contains(t, single, "latency_p99_ms")
+
+	require.Equal(t, http.StatusOK, get("/health?agent_id=agent-good", testCustomerID, &single))
+	assert.Equal(t, agent.HealthHealthy, single["status"])
+
+	assert.Equal(t, http.StatusNotFound, get("/agent-good/health", "other-customer", nil))
+	assert.Equal(t, http.StatusNotFound, get("/agent-gone/health", testCustomerID, nil))
+}
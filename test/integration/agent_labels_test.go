@@ -0,0 +1,210 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+	"proxy-service/internal/service/agent"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// labelAgents stores agents of the test customer with their labels
+func labelAgents(t *testing.T, store *stubAgentStore, labels map[string]map[string]string) {
+	t.Helper()
+	for agentID, agentLabels := range labels {
+		require.NoError(t, store.CreateAgent(context.Background(), &models.Agent{
+			ID:         agentID,
+			CustomerID: testCustomerID,
+			Status:     agent.AgentStatusActive,
+			Labels:     agentLabels,
+		}))
+	}
+}
+
+// newLabelledEnv connects agent-eu (region=eu, env=prod), agent-us
+// (region=us, env=prod) and agent-staging (region=eu, env=staging)
+func newLabelledEnv(t *testing.T) (*proxyEnv, *agent.Registry) {
+	t.Helper()
+	env := newEmptyProxyEnv(t)
+	store := newStubAgentStore()
+	labelAgents(t, store, map[string]map[string]string{
+		"agent-eu":      {"region": "eu", "env": "prod"},
+		"agent-us":      {"region": "us", "env": "prod"},
+		"agent-staging": {"region": "eu", "env": "staging"},
+	})
+	registry := agent.NewRegistry(store, env.cache)
+	env.manager.SetRegistry(registry)
+	t.Cleanup(env.manager.Close)
+
+	for _, id := range []string{"agent-eu", "agent-us", "agent-staging"} {
+		env.connectAgent(t, id, "", nameResponder(id))
+	}
+	return env, registry
+}
+
+// selectedBy sends a GET with an optional selector header and returns the
+// status and body
+func selectedBy(t *testing.T, proxyURL, path, selector string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, proxyURL+path, nil)
+	require.NoError(t, err)
+	if selector != "" {
+		req.Header.Set(service.AgentSelectorHeader, selector)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+// servedAgents sends n requests and collects which agents answered
+func servedAgents(t *testing.T, proxyURL, path, selector string, n int) map[string]int {
+	t.Helper()
+	served := make(map[string]int)
+	for i := 0; i < n; i++ {
+		status, body := selectedBy(t, proxyURL, path, selector)
+		require.Equal(t, http.StatusOK, status, body)
+		served[body]++
+	}
+	return served
+}
+
+func TestProxyConfigSelectorLimitsAgents(t *testing.T) {
+	env, _ := newLabelledEnv(t)
+	env.setProxyConfig(t, &models.ProxyConfig{AgentSelector: "region=eu"})
+
+	served := servedAgents(t, env.proxyURL, "/api/v1/items", "", 6)
+	assert.Equal(t, map[string]int{"agent-eu": 3, "agent-staging": 3}, served)
+}
+
+func TestRouteSelectorOverridesProxyConfig(t *testing.T) {
+	env, _ := newLabelledEnv(t)
+	env.setProxyConfig(t, &models.ProxyConfig{AgentSelector: "region=eu"})
+	_, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{
+		Routes: []models.RouteConfig{{Path: "/api/v1/us/**", AgentSelector: "region=us"}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]int{"agent-us": 3}, servedAgents(t, env.proxyURL, "/api/v1/us/items", "", 3))
+	assert.Equal(t, map[string]int{"agent-eu": 2, "agent-staging": 2}, servedAgents(t, env.proxyURL, "/api/v1/items", "", 4))
+}
+
+func TestSelectorHeaderOverridesConfig(t *testing.T) {
+	env, _ := newLabelledEnv(t)
+	env.setProxyConfig(t, &models.ProxyConfig{AgentSelector: "region=us"})
+
+	assert.Equal(t, map[string]int{"agent-eu": 3}, servedAgents(t, env.proxyURL, "/api/v1/items", "region=eu,env!=staging", 3))
+
+	status, _ := selectedBy(t, env.proxyURL, "/api/v1/items", "region=e u")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestSelectorHeaderIsNotForwarded(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	fake := env.connectAgent(t, testAgentID, "", echoResponder)
+
+	status, _ := selectedBy(t, env.proxyURL, "/api/v1/items", "!region")
+	require.Equal(t, http.StatusOK, status)
+	got := fake.next(t)
+	assert.Empty(t, http.Header(got.Headers).Values(service.AgentSelectorHeader))
+}
+
+func TestSelectorFallback(t *testing.T) {
+	env, _ := newLabelledEnv(t)
+
+	env.setProxyConfig(t, &models.ProxyConfig{AgentSelector: "region=ap"})
+	status, body := selectedBy(t, env.proxyURL, "/api/v1/items", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status, body)
+
+	env.setProxyConfig(t, &models.ProxyConfig{AgentSelector: "region=ap", SelectorFallback: agent.SelectorFallbackAny})
+	served := servedAgents(t, env.proxyURL, "/api/v1/items", "", 3)
+	assert.Equal(t, map[string]int{"agent-eu": 1, "agent-staging": 1, "agent-us": 1}, served)
+
+	// The route's fallback wins over the proxy config's
+	_, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{
+		Routes: []models.RouteConfig{{Path: "/api/v1/strict/**", SelectorFallback: agent.SelectorFallbackReject}},
+	})
+	require.NoError(t, err)
+	status, _ = selectedBy(t, env.proxyURL, "/api/v1/strict/items", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestChangedLabelsReroute(t *testing.T) {
+	env, registry := newLabelledEnv(t)
+	env.setProxyConfig(t, &models.ProxyConfig{AgentSelector: "region=us"})
+	require.Equal(t, map[string]int{"agent-us": 2}, servedAgents(t, env.proxyURL, "/api/v1/items", "", 2))
+
+	_, err := registry.Update(context.Background(), testCustomerID, "agent-eu", &models.Agent{
+		Labels: map[string]string{"region": "us", "env": "prod"},
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return servedAgents(t, env.proxyURL, "/api/v1/items", "", 4)["agent-eu"] == 2
+	}, 2*time.Second, 20*time.Millisecond)
+
+	_, err = registry.Update(context.Background(), testCustomerID, "agent-eu", &models.Agent{
+		Labels: map[string]string{"region": "eu us"},
+	})
+	assert.ErrorIs(t, err, agent.ErrInvalidLabels)
+}
+
+func TestSelectorReachesMatchingAgentOnOtherReplica(t *testing.T) {
+	_, replicaA, replicaB := newCluster(t)
+	store := newStubAgentStore()
+	labelAgents(t, store, map[string]map[string]string{
+		"agent-eu": {"region": "eu"},
+		"agent-us": {"region": "us"},
+	})
+	for _, replica := range []*replicaEnv{replicaA, replicaB} {
+		replica.manager.SetRegistry(agent.NewRegistry(store, replica.cache))
+		t.Cleanup(replica.manager.Close)
+	}
+
+	replicaA.connectAgent(t, "agent-eu", "", nameResponder("agent-eu"))
+	replicaB.connectAgent(t, "agent-us", "", nameResponder("agent-us"))
+	locations := waitForLocations(t, replicaB, 2)
+	assert.Equal(t, map[string]string{"region": "eu"}, locations[0].Labels)
+
+	// replica-b holds a customer agent, but not one in the eu
+	assert.Equal(t, map[string]int{"agent-eu": 2}, servedAgents(t, replicaB.proxyURL, "/api/v1/items", "region=eu", 2))
+	assert.Equal(t, map[string]int{"agent-us": 2}, servedAgents(t, replicaB.proxyURL, "/api/v1/items", "region=us", 2))
+	assert.Equal(t, map[string]int{"agent-us": 2}, servedAgents(t, replicaA.proxyURL, "/api/v1/items", "region=us", 2))
+
+	status, _ := selectedBy(t, replicaA.proxyURL, "/api/v1/items", "region=ap")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestConfigRejectsInvalidRouteSelector(t *testing.T) {
+	_, url := newConfigEnv(t)
+
+	for _, route := range []models.RouteConfig{
+		{Path: "/api/**", AgentSelector: "region="},
+		{Path: "/api/**", SelectorFallback: "nearest"},
+	} {
+		data, err := json.Marshal(&models.AgentConfig{Routes: []models.RouteConfig{route}})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.True(t, strings.Contains(string(body), "route /api/**"), string(body))
+	}
+}
@@ -0,0 +1,241 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// managementEnv runs the real agent endpoint with the agent management API,
+// authenticated as the test customer, over an in-memory agent store
+type managementEnv struct {
+	*credentialEnv
+	store *stubAgentStore
+}
+
+func newManagementEnv(t *testing.T) *managementEnv {
+	t.Helper()
+	store := newStubAgentStore()
+	env := newProxyEnvOnRedis(t, miniredis.RunT(t), func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler {
+		manager.SetRegistry(agent.NewRegistry(store, redisCache))
+		manager.SetCredentialStore(agent.NewCredentialStore(redisCache, agent.CredentialPolicy{}))
+
+		handler := newTestAgentHandler(manager, redisCache)
+		router := gin.New()
+		router.GET("/api/v1/agents/connect", handler.HandleConnection)
+		api := router.Group("/api/v1/agents", func(c *gin.Context) {
+			c.Set("customer_id", testCustomerID)
+		})
+		api.GET("", handler.HandleListAgents)
+		api.POST("", handler.HandleAgentRegistration)
+		api.GET("/:agent_id", handler.HandleGetAgent)
+		api.PATCH("/:agent_id", handler.HandleUpdateAgent)
+		api.DELETE("/:agent_id", handler.HandleDeleteAgent)
+		api.POST("/:agent_id/disable", handler.HandleDisableAgent)
+		api.POST("/:agent_id/enable", handler.HandleEnableAgent)
+		api.POST("/credentials", handler.HandleIssueCredential)
+		api.GET("/credentials", handler.HandleListCredentials)
+		return router
+	})
+	t.Cleanup(env.manager.Close)
+	return &managementEnv{
+		credentialEnv: &credentialEnv{
+			proxyEnv: env,
+			apiURL:   "http" + strings.TrimPrefix(env.agentURL, "ws") + "/api/v1/agents",
+		},
+		store: store,
+	}
+}
+
+// do sends a management request and decodes the response into out, if given
+func (env *managementEnv) do(t *testing.T, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+	req, err := http.NewRequest(method, env.apiURL+path, bytes.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+func (env *managementEnv) dialWithAPIKey(t *testing.T, agentID string) (*websocket.Conn, int) {
+	t.Helper()
+	return env.dial(t, agentID, agentproto.SignToken(agentID, testCustomerID, testAPIKey, time.Now()))
+}
+
+func TestAgentManagementCreateListGet(t *testing.T) {
+	env := newManagementEnv(t)
+
+	var created models.Agent
+	status := env.do(t, http.MethodPost, "", map[string]interface{}{
+		"name":     "warehouse",
+		"metadata": map[string]interface{}{"site": "berlin"},
+	}, &created)
+	require.Equal(t, http.StatusCreated, status)
+	assert.NotEmpty(t, created.ID)
+	assert.Equal(t, testCustomerID, created.CustomerID)
+	assert.Equal(t, agent.AgentStatusActive, created.Status)
+	assert.Equal(t, agent.StatusDisconnected, created.ConnectionStatus)
+
+	var named models.Agent
+	status = env.do(t, http.MethodPost, "", map[string]interface{}{"id": "edge-1", "name": "edge"}, &named)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "edge-1", named.ID)
+
+	assert.Equal(t, http.StatusConflict, env.do(t, http.MethodPost, "", map[string]interface{}{"id": "edge-1"}, nil))
+	assert.Equal(t, http.StatusBadRequest, env.do(t, http.MethodPost, "", map[string]interface{}{"status": "paused"}, nil))
+
+	var listed struct {
+		Agents []models.Agent `json:"agents"`
+	}
+	require.Equal(t, http.StatusOK, env.do(t, http.MethodGet, "", nil, &listed))
+	assert.Len(t, listed.Agents, 2)
+
+	var fetched models.Agent
+	require.Equal(t, http.StatusOK, env.do(t, http.MethodGet, "/"+created.ID, nil, &fetched))
+	assert.Equal(t, "warehouse", fetched.Name)
+	assert.Equal(t, "berlin", fetched.Metadata["site"])
+}
+
+func TestAgentManagementUpdate(t *testing.T) {
+	env := newManagementEnv(t)
+	require.Equal(t, http.StatusCreated, env.do(t, http.MethodPost, "", map[string]interface{}{"id": "edge-1", "name": "edge"}, nil))
+
+	var updated models.Agent
+	status := env.do(t, http.MethodPatch, "/edge-1", map[string]interface{}{
+		"name":        "edge renamed",
+		"permissions": []string{"proxy"},
+	}, &updated)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "edge renamed", updated.Name)
+	assert.Equal(t, []string{"proxy"}, updated.Permissions)
+	assert.Equal(t, agent.AgentStatusActive, updated.Status)
+}
+
+func TestAgentManagementHidesOtherCustomers(t *testing.T) {
+	env := newManagementEnv(t)
+	require.NoError(t, env.store.CreateAgent(context.Background(), &models.Agent{ID: "foreign", CustomerID: "other-customer", Status: agent.AgentStatusActive}))
+
+	assert.Equal(t, http.StatusNotFound, env.do(t, http.MethodGet, "/foreign", nil, nil))
+	assert.Equal(t, http.StatusNotFound, env.do(t, http.MethodPatch, "/foreign", map[string]interface{}{"name": "x"}, nil))
+	assert.Equal(t, http.StatusNotFound, env.do(t, http.MethodPost, "/foreign/disable", nil, nil))
+	assert.Equal(t, http.StatusNotFound, env.do(t, http.MethodDelete, "/foreign", nil, nil))
+
+	var listed struct {
+		Agents []models.Agent `json:"agents"`
+	}
+	require.Equal(t, http.StatusOK, env.do(t, http.MethodGet, "", nil, &listed))
+	assert.Empty(t, listed.Agents)
+
+	// The foreign agent cannot connect as one of the test customer's either
+	_, status := env.dialWithAPIKey(t, "foreign")
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestDisabledAgentIsDisconnectedAndRefused(t *testing.T) {
+	env := newManagementEnv(t)
+	conn, status := env.dialWithAPIKey(t, testAgentID)
+	require.NotNil(t, conn, "status %d", status)
+
+	require.Equal(t, http.StatusOK, env.do(t, http.MethodPost, "/"+testAgentID+"/disable", nil, nil))
+	assert.Equal(t, websocket.ClosePolicyViolation, waitForClose(t, conn))
+
+	// The token validated a moment ago is not reused for a disabled agent
+	_, status = env.dialWithAPIKey(t, testAgentID)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	var enabled models.Agent
+	require.Equal(t, http.StatusOK, env.do(t, http.MethodPost, "/"+testAgentID+"/enable", nil, &enabled))
+	assert.Equal(t, agent.AgentStatusActive, enabled.Status)
+	require.Eventually(t, func() bool {
+		return env.manager.GetAgentStatus(testAgentID) == ""
+	}, 2*time.Second, 10*time.Millisecond)
+
+	conn, status = env.dialWithAPIKey(t, testAgentID)
+	assert.NotNil(t, conn, "status %d", status)
+}
+
+func TestDeletedAgentIsDisconnected(t *testing.T) {
+	env := newManagementEnv(t)
+	conn, status := env.dialWithAPIKey(t, testAgentID)
+	require.NotNil(t, conn, "status %d", status)
+
+	require.Equal(t, http.StatusOK, env.do(t, http.MethodDelete, "/"+testAgentID, nil, nil))
+	assert.Equal(t, websocket.ClosePolicyViolation, waitForClose(t, conn))
+	assert.Equal(t, http.StatusNotFound, env.do(t, http.MethodGet, "/"+testAgentID, nil, nil))
+
+	_, status = env.dialWithAPIKey(t, testAgentID)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestRecreatedAgentStartsWithoutCredentials(t *testing.T) {
+	env := newManagementEnv(t)
+	env.issueCredential(t, testAgentID, "")
+	conn, status := env.dial(t, testAgentID, agentproto.SignToken(testAgentID, testCustomerID, testAPIKey, time.Now()))
+	require.Nil(t, conn)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	require.Equal(t, http.StatusOK, env.do(t, http.MethodDelete, "/"+testAgentID, nil, nil))
+	require.Equal(t, http.StatusCreated, env.do(t, http.MethodPost, "", map[string]interface{}{"id": testAgentID}, nil))
+
+	// The new agent is not enrolled: it connects with the API key and its
+	// first credential is the only one it has
+	assert.Empty(t, env.listCredentials(t, testAgentID))
+	conn, status = env.dialWithAPIKey(t, testAgentID)
+	require.NotNil(t, conn, "status %d", status)
+
+	credential := env.issueCredential(t, testAgentID, "")
+	listed := env.listCredentials(t, testAgentID)
+	require.Len(t, listed, 1)
+	assert.Equal(t, credential.ID, listed[0].ID)
+}
+
+func TestAgentConnectionStatusIsPersisted(t *testing.T) {
+	env := newManagementEnv(t)
+	require.Equal(t, http.StatusCreated, env.do(t, http.MethodPost, "", map[string]interface{}{"id": testAgentID}, nil))
+
+	before := time.Now()
+	conn, status := env.dialWithAPIKey(t, testAgentID)
+	require.NotNil(t, conn, "status %d", status)
+
+	var stored models.Agent
+	require.Eventually(t, func() bool {
+		env.do(t, http.MethodGet, "/"+testAgentID, nil, &stored)
+		return stored.ConnectionStatus == agent.StatusConnected
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.False(t, stored.LastConnected.Before(before))
+	assert.False(t, stored.LastSeen.Before(before))
+	assert.NotEmpty(t, stored.Version)
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		env.do(t, http.MethodGet, "/"+testAgentID, nil, &stored)
+		return stored.ConnectionStatus == agent.StatusDisconnected
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.False(t, stored.LastConnected.Before(before))
+}
@@ -0,0 +1,285 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/repository"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubSessionStore keeps agent sessions in memory
+type stubSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]models.AgentSession
+}
+
+func newStubSessionStore() *stubSessionStore {
+	return &stubSessionStore{sessions: make(map[string]models.AgentSession)}
+}
+
+func (s *stubSessionStore) CreateSession(ctx context.Context, session *models.AgentSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.sessions[session.ID]; exists {
+		return repository.ErrAlreadyExists
+	}
+	s.sessions[session.ID] = *session
+	return nil
+}
+
+func (s *stubSessionStore) EndSession(ctx context.Context, session *models.AgentSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, exists := s.sessions[session.ID]
+	if !exists || stored.DisconnectedAt != nil {
+		return repository.ErrNotFound
+	}
+	stored.DisconnectedAt = session.DisconnectedAt
+	stored.DisconnectReason = session.DisconnectReason
+	stored.RequestsServed = session.RequestsServed
+	s.sessions[session.ID] = stored
+	return nil
+}
+
+func (s *stubSessionStore) ListSessions(ctx context.Context, query models.AgentSessionQuery) ([]*models.AgentSession, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matching []*models.AgentSession
+	for _, session := range s.sessions {
+		if session.CustomerID != query.CustomerID || (query.AgentID != "" && session.AgentID != query.AgentID) {
+			continue
+		}
+		if !query.To.IsZero() && session.ConnectedAt.After(query.To) {
+			continue
+		}
+		if !query.From.IsZero() && session.DisconnectedAt != nil && session.DisconnectedAt.Before(query.From) {
+			continue
+		}
+		session := session
+		matching = append(matching, &session)
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ConnectedAt.After(matching[j].ConnectedAt) })
+
+	start := (query.Page - 1) * query.PageSize
+	if start > len(matching) {
+		start = len(matching)
+	}
+	end := start + query.PageSize
+	if end > len(matching) {
+		end = len(matching)
+	}
+	return matching[start:end], int64(len(matching)), nil
+}
+
+// sessionEnv records sessions of agents connecting to its root and serves the
+// session API for the test customer
+type sessionEnv struct {
+	*proxyEnv
+	apiURL string
+	store  *stubSessionStore
+}
+
+func newSessionEnv(t *testing.T) *sessionEnv {
+	t.Helper()
+	store := newStubSessionStore()
+	env := newProxyEnvWithEndpoint(t, func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler {
+		manager.SetSessionHistory(agent.NewSessionHistory(store))
+		handler := newTestAgentHandler(manager, redisCache)
+
+		upgrader := websocket.Upgrader{Subprotocols: agentproto.Subprotocols}
+		router := gin.New()
+		router.GET("/", func(c *gin.Context) {
+			conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+			if err != nil {
+				return
+			}
+			ctx := agent.WithRemoteAddr(context.Background(), "203.0.113.7")
+			manager.RegisterAgent(ctx, c.GetHeader("X-Agent-ID"), testCustomerID, conn)
+		})
+		api := router.Group("/api/v1/agents", func(c *gin.Context) {
+			c.Set("customer_id", testCustomerID)
+		})
+		api.GET("/sessions", handler.HandleListSessions)
+		api.GET("/:agent_id/sessions", handler.HandleListSessions)
+		return router
+	})
+	return &sessionEnv{
+		proxyEnv: env,
+		apiURL:   "http" + strings.TrimPrefix(env.agentURL, "ws") + "/api/v1/agents",
+		store:    store,
+	}
+}
+
+func (env *sessionEnv) list(t *testing.T, path string, query url.Values) (int, *models.AgentSessionPage) {
+	t.Helper()
+	resp, err := http.Get(env.apiURL + path + "?" + query.Encode())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var page models.AgentSessionPage
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	}
+	return resp.StatusCode, &page
+}
+
+// endedSession waits until the only session of agentID has ended
+func (env *sessionEnv) endedSession(t *testing.T, agentID string) *models.AgentSession {
+	t.Helper()
+	var session *models.AgentSession
+	require.Eventually(t, func() bool {
+		status, page := env.list(t, "/"+agentID+"/sessions", nil)
+		require.Equal(t, http.StatusOK, status)
+		if len(page.Sessions) == 0 {
+			return false
+		}
+		session = page.Sessions[len(page.Sessions)-1]
+		return session.DisconnectedAt != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return session
+}
+
+func TestSessionIsRecorded(t *testing.T) {
+	env := newSessionEnv(t)
+	fake := env.connectAgent(t, testAgentID, "", echoResponder)
+
+	status, page := env.list(t, "/sessions", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, page.Sessions, 1)
+	session := page.Sessions[0]
+	assert.Equal(t, testAgentID, session.AgentID)
+	assert.Equal(t, testCustomerID, session.CustomerID)
+	assert.Equal(t, "203.0.113.7", session.RemoteAddr)
+	assert.Equal(t, "fake", session.AgentVersion)
+	assert.Equal(t, agentproto.ProtocolVersion, session.ProtocolVersion)
+	assert.Nil(t, session.DisconnectedAt)
+	assert.Empty(t, session.DisconnectReason)
+
+	for i := 0; i < 3; i++ {
+		status, _ := selectedBy(t, env.proxyURL, "/api/v1/items", "")
+		require.Equal(t, http.StatusOK, status)
+	}
+
+	require.NoError(t, fake.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second)))
+
+	session = env.endedSession(t, testAgentID)
+	assert.Equal(t, agent.DisconnectClientClose, session.DisconnectReason)
+	assert.EqualValues(t, 3, session.RequestsServed)
+	assert.False(t, session.DisconnectedAt.Before(session.ConnectedAt))
+}
+
+func TestSessionEndReasons(t *testing.T) {
+	t.Run("lost connection", func(t *testing.T) {
+		env := newSessionEnv(t)
+		fake := env.connectAgent(t, testAgentID, "", echoResponder)
+		fake.conn.Close()
+		assert.Equal(t, agent.DisconnectConnectionLost, env.endedSession(t, testAgentID).DisconnectReason)
+	})
+
+	t.Run("takeover", func(t *testing.T) {
+		env := newSessionEnv(t)
+		env.connectAgent(t, testAgentID, "", echoResponder)
+		env.connectAgent(t, testAgentID, "", echoResponder)
+
+		// The replaced session is the older one
+		session := env.endedSession(t, testAgentID)
+		assert.Equal(t, agent.DisconnectTakeover, session.DisconnectReason)
+		_, page := env.list(t, "/"+testAgentID+"/sessions", nil)
+		require.Len(t, page.Sessions, 2)
+		assert.Nil(t, page.Sessions[0].DisconnectedAt)
+	})
+
+	t.Run("server shutdown", func(t *testing.T) {
+		env := newSessionEnv(t)
+		env.connectAgent(t, testAgentID, "", echoResponder)
+		env.manager.Close()
+		assert.Equal(t, agent.DisconnectShutdown, env.endedSession(t, testAgentID).DisconnectReason)
+	})
+
+	t.Run("deregistered", func(t *testing.T) {
+		env := newSessionEnv(t)
+		env.connectAgent(t, testAgentID, "", echoResponder)
+		require.NoError(t, env.manager.DeregisterAgent(context.Background(), testAgentID, testCustomerID))
+		assert.Equal(t, agent.DisconnectDeregistered, env.endedSession(t, testAgentID).DisconnectReason)
+	})
+}
+
+func TestSessionListing(t *testing.T) {
+	env := newSessionEnv(t)
+	ctx := context.Background()
+	base := time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		t := base.Add(time.Duration(minutes) * time.Minute)
+		return &t
+	}
+	require.NoError(t, env.store.CreateSession(ctx, &models.AgentSession{ID: "other", CustomerID: "other-customer", AgentID: "agent-a", ConnectedAt: *at(0)}))
+	for _, session := range []models.AgentSession{
+		{ID: "s1", AgentID: "agent-a", ConnectedAt: *at(-120), DisconnectedAt: at(-30), DisconnectReason: agent.DisconnectHeartbeatTimeout},
+		{ID: "s2", AgentID: "agent-a", ConnectedAt: *at(10)},
+		{ID: "s3", AgentID: "agent-b", ConnectedAt: *at(-60), DisconnectedAt: at(20), DisconnectReason: agent.DisconnectShutdown},
+		{ID: "s4", AgentID: "agent-b", ConnectedAt: *at(30), DisconnectedAt: at(40), DisconnectReason: agent.DisconnectClientClose},
+	} {
+		session.CustomerID = testCustomerID
+		require.NoError(t, env.store.CreateSession(ctx, &session))
+	}
+	ids := func(page *models.AgentSessionPage) []string {
+		var ids []string
+		for _, session := range page.Sessions {
+			ids = append(ids, session.ID)
+		}
+		return ids
+	}
+
+	status, page := env.list(t, "/sessions", nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"s4", "s2", "s3", "s1"}, ids(page))
+	assert.EqualValues(t, 4, page.Total)
+	assert.Equal(t, 1, page.Page)
+	assert.Equal(t, agent.DefaultSessionPageSize, page.PageSize)
+
+	_, page = env.list(t, "/sessions", url.Values{"page": {"2"}, "page_size": {"3"}})
+	assert.Equal(t, []string{"s1"}, ids(page))
+	assert.EqualValues(t, 4, page.Total)
+
+	_, page = env.list(t, "/agent-a/sessions", nil)
+	assert.Equal(t, []string{"s2", "s1"}, ids(page))
+	_, page = env.list(t, "/sessions", url.Values{"agent_id": {"agent-b"}})
+	assert.Equal(t, []string{"s4", "s3"}, ids(page))
+
+	// Who was connected at 03:00?
+	instant := base.Format(time.RFC3339)
+	_, page = env.list(t, "/sessions", url.Values{"from": {instant}, "to": {instant}})
+	assert.Equal(t, []string{"s3"}, ids(page))
+
+	// Sessions still open reach into any later range
+	_, page = env.list(t, "/agent-a/sessions", url.Values{"from": {at(60).Format(time.RFC3339)}})
+	assert.Equal(t, []string{"s2"}, ids(page))
+
+	for _, query := range []url.Values{
+		{"from": {"yesterday"}},
+		{"from": {at(10).Format(time.RFC3339)}, "to": {instant}},
+		{"page": {"0"}},
+		{"page_size": {"many"}},
+		{"page_size": {"100000"}},
+	} {
+		status, _ := env.list(t, "/sessions", query)
+		assert.Equal(t, http.StatusBadRequest, status, query.Encode())
+	}
+}
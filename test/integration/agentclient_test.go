@@ -0,0 +1,364 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"proxy-service/internal/config"
+	agenthandler "proxy-service/internal/handler/agent"
+	"proxy-service/internal/models"
+	"proxy-service/internal/repository"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentclient"
+	"proxy-service/pkg/cache"
+	"proxy-service/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAPIKey = "customer-api-key"
+
+// stubAgentAuth knows one active customer
+type stubAgentAuth struct{}
+
+func (stubAgentAuth) GetCustomer(ctx context.Context, customerID string) (*models.Customer, error) {
+	if customerID != testCustomerID {
+		return nil, errors.New("customer not found")
+	}
+	return &models.Customer{ID: testCustomerID, APIKey: testAPIKey, Status: "active"}, nil
+}
+
+// stubAgentStore keeps agents in memory. Agents it has not seen are active
+// agents of the test customer, so tests can connect any agent ID.
+type stubAgentStore struct {
+	mu      sync.Mutex
+	agents  map[string]*models.Agent
+	deleted map[string]bool
+}
+
+func newStubAgentStore() *stubAgentStore {
+	return &stubAgentStore{agents: make(map[string]*models.Agent), deleted: make(map[string]bool)}
+}
+
+// agent returns the stored agent, materialising an unseen one; the caller
+// holds mu
+func (s *stubAgentStore) agent(agentID string) (*models.Agent, error) {
+	if s.deleted[agentID] {
+		return nil, repository.ErrNotFound
+	}
+	stored, ok := s.agents[agentID]
+	if !ok {
+		stored = &models.Agent{ID: agentID, CustomerID: testCustomerID, Status: agent.AgentStatusActive}
+		s.agents[agentID] = stored
+	}
+	return stored, nil
+}
+
+func (s *stubAgentStore) CreateAgent(ctx context.Context, created *models.Agent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.agents[created.ID]; ok {
+		return repository.ErrAlreadyExists
+	}
+	stored := *created
+	s.agents[created.ID] = &stored
+	delete(s.deleted, created.ID)
+	return nil
+}
+
+func (s *stubAgentStore) GetAgent(ctx context.Context, agentID string) (*models.Agent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, err := s.agent(agentID)
+	if err != nil {
+		return nil, err
+	}
+	copied := *stored
+	return &copied, nil
+}
+
+func (s *stubAgentStore) GetAgentsByCustomer(ctx context.Context, customerID string) ([]*models.Agent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var agents []*models.Agent
+	for _, stored := range s.agents {
+		if stored.CustomerID == customerID {
+			copied := *stored
+			agents = append(agents, &copied)
+		}
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents, nil
+}
+
+func (s *stubAgentStore) update(agentID string, apply func(*models.Agent)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, err := s.agent(agentID)
+	if err != nil {
+		return err
+	}
+	apply(stored)
+	stored.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *stubAgentStore) UpdateAgentDetails(ctx context.Context, changed *models.Agent) error {
+	return s.update(changed.ID, func(stored *models.Agent) {
+		stored.Name = changed.Name
+		stored.Metadata = changed.Metadata
+		stored.Permissions = changed.Permissions
+		stored.Labels = changed.Labels
+	})
+}
+
+func (s *stubAgentStore) UpdateAgentStatus(ctx context.Context, agentID, status string) error {
+	return s.update(agentID, func(stored *models.Agent) { stored.Status = status })
+}
+
+func (s *stubAgentStore) RecordConnect(ctx context.Context, agentID, status, version string, at time.Time) error {
+	return s.update(agentID, func(stored *models.Agent) {
+		stored.ConnectionStatus = status
+		stored.Version = version
+		stored.LastConnected = at
+		stored.LastSeen = at
+	})
+}
+
+func (s *stubAgentStore) UpdateConnectionStatus(ctx context.Context, agentID, status string, at time.Time) error {
+	return s.update(agentID, func(stored *models.Agent) {
+		stored.ConnectionStatus = status
+		stored.LastSeen = at
+	})
+}
+
+func (s *stubAgentStore) TouchAgent(ctx context.Context, agentID string, at time.Time) error {
+	return s.update(agentID, func(stored *models.Agent) { stored.LastSeen = at })
+}
+
+func (s *stubAgentStore) DeleteAgent(ctx context.Context, agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.agent(agentID); err != nil {
+		return err
+	}
+	delete(s.agents, agentID)
+	s.deleted[agentID] = true
+	return nil
+}
+
+// newTestAgentHandler builds the agent handler for the test customer, giving
+// the manager an in-memory agent registry unless it has one
+func newTestAgentHandler(manager *agent.AgentManager, redisCache *cache.RedisCache) *agenthandler.AgentHandler {
+	if manager.Registry() == nil {
+		manager.SetRegistry(agent.NewRegistry(newStubAgentStore(), redisCache))
+	}
+	return agenthandler.NewAgentHandler(manager, stubAgentAuth{}, redisCache, &config.Config{}, sharedCollector(), logger.NewLogger())
+}
+
+// newAgentHandlerEnv runs the proxy with the real agent endpoint, including
+// credential checks
+func newAgentHandlerEnv(t *testing.T) *proxyEnv {
+	t.Helper()
+	return newProxyEnvWithEndpoint(t, func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler {
+		handler := newTestAgentHandler(manager, redisCache)
+		router := gin.New()
+		router.GET("/api/v1/agents/connect", handler.HandleConnection)
+		return router
+	})
+}
+
+// startAgentClient runs the reference agent against upstream until the test ends
+func startAgentClient(t *testing.T, env *proxyEnv, agentID, apiKey, upstream string) *agentclient.Client {
+	t.Helper()
+	client, err := agentclient.New(agentclient.Config{
+		ServerURL:       env.agentURL + "/api/v1/agents/connect",
+		AgentID:         agentID,
+		CustomerID:      testCustomerID,
+		APIKey:          apiKey,
+		Upstream:        upstream,
+		MetricsInterval: 50 * time.Millisecond,
+		MinBackoff:      10 * time.Millisecond,
+		MaxBackoff:      50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return client
+}
+
+func waitForAgent(t *testing.T, env *proxyEnv, agentID string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return env.manager.GetAgentStatus(agentID) == "connected"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func newEchoUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Upstream-Path", r.URL.Path)
+		w.Header().Set("X-Upstream-Query", r.URL.RawQuery)
+		w.Header().Set("X-Upstream-Method", r.Method)
+		w.Header().Set("X-Upstream-Test", r.Header.Get("X-Test"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestAgentClientServesRequests(t *testing.T) {
+	env := newAgentHandlerEnv(t)
+	upstream := newEchoUpstream(t)
+	startAgentClient(t, env, "reference-agent", testAPIKey, upstream.URL)
+	waitForAgent(t, env, "reference-agent")
+
+	req, err := http.NewRequest(http.MethodPut, env.proxyURL+"/api/v1/items/1?q=x", strings.NewReader("small"))
+	require.NoError(t, err)
+	req.Header.Set("X-Test", "header")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "small", string(body))
+	assert.Equal(t, "/api/v1/items/1", resp.Header.Get("X-Upstream-Path"))
+	assert.Equal(t, "q=x", resp.Header.Get("X-Upstream-Query"))
+	assert.Equal(t, http.MethodPut, resp.Header.Get("X-Upstream-Method"))
+	assert.Equal(t, "header", resp.Header.Get("X-Upstream-Test"))
+
+	// Large enough to be streamed both ways under the flow control window
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	resp, err = http.Post(env.proxyURL+"/api/v1/upload", "application/octet-stream", bytes.NewReader(large))
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, len(large), len(body))
+	assert.True(t, bytes.Equal(large, body))
+}
+
+func TestAgentClientCancelsUpstreamRequests(t *testing.T) {
+	env := newAgentHandlerEnv(t)
+	canceled := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	startAgentClient(t, env, "reference-agent", testAPIKey, upstream.URL)
+	waitForAgent(t, env, "reference-agent")
+
+	client := &http.Client{Timeout: 200 * time.Millisecond}
+	_, err := client.Get(env.proxyURL + "/api/v1/slow")
+	require.Error(t, err)
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not canceled")
+	}
+}
+
+func TestAgentClientRejectedWithWrongKey(t *testing.T) {
+	env := newAgentHandlerEnv(t)
+	upstream := newEchoUpstream(t)
+	client := startAgentClient(t, env, "reference-agent", "wrong-key", upstream.URL)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, client.Connected())
+	assert.Empty(t, env.manager.GetAgentStatus("reference-agent"))
+}
+
+func TestAgentClientReportsHealthAndAppliesConfig(t *testing.T) {
+	env := newAgentHandlerEnv(t)
+	pushed := &models.AgentConfig{
+		CustomerID:        testCustomerID,
+		MaxConnections:    4,
+		HeartbeatInterval: 50 * time.Millisecond,
+		Monitoring:        models.MonitoringConfig{MetricsInterval: 50 * time.Millisecond},
+		LastUpdated:       time.Now(),
+	}
+	data, err := json.Marshal(pushed)
+	require.NoError(t, err)
+	require.NoError(t, env.cache.Set(context.Background(), "agent_config:"+testCustomerID, string(data), time.Minute))
+
+	upstream := newEchoUpstream(t)
+	client := startAgentClient(t, env, "health-agent", testAPIKey, upstream.URL)
+	waitForAgent(t, env, "health-agent")
+
+	require.Eventually(t, func() bool {
+		applied := client.AgentConfig()
+		return applied != nil && applied.HeartbeatInterval == pushed.HeartbeatInterval && applied.MaxConnections == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	labels := map[string]string{"customer_id": testCustomerID, "agent_id": "health-agent"}
+	require.Eventually(t, func() bool {
+		return metricValue(t, "proxy_agent_memory_bytes", labels) > 0 &&
+			metricValue(t, "proxy_agent_uptime_seconds", labels) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Heartbeats keep coming at the pushed interval
+	first := metricValue(t, "proxy_agent_last_heartbeat_timestamp_seconds", labels)
+	require.Greater(t, first, 0.0)
+	require.Eventually(t, func() bool {
+		return metricValue(t, "proxy_agent_last_heartbeat_timestamp_seconds", labels) > first
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAgentClientReconnects(t *testing.T) {
+	env := newAgentHandlerEnv(t)
+	upstream := newEchoUpstream(t)
+	startAgentClient(t, env, "reconnecting-agent", testAPIKey, upstream.URL)
+	waitForAgent(t, env, "reconnecting-agent")
+
+	agents := env.manager.GetCustomerAgents(testCustomerID)
+	require.Len(t, agents, 1)
+	dropped := agents[0]
+	dropped.Close()
+
+	require.Eventually(t, func() bool {
+		agents := env.manager.GetCustomerAgents(testCustomerID)
+		return len(agents) == 1 && agents[0] != dropped
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp, err := http.Get(env.proxyURL + "/api/v1/after-reconnect")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
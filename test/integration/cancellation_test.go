@@ -0,0 +1,118 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"proxy-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingResponder holds every request until release is closed
+func blockingResponder(release <-chan struct{}) fakeResponder {
+	return func(req *receivedRequest) *fakeResponse {
+		<-release
+		return &fakeResponse{Status: http.StatusOK, Body: []byte("late")}
+	}
+}
+
+func waitCanceled(t *testing.T, a *fakeAgent, requestID string) {
+	t.Helper()
+	select {
+	case id := <-a.canceled:
+		assert.Equal(t, requestID, id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent was not told to cancel")
+	}
+}
+
+func TestCancelOnClientDisconnect(t *testing.T) {
+	release := make(chan struct{})
+	env := newProxyEnv(t, blockingResponder(release))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, env.proxyURL+"/api/v1/slow", nil)
+	require.NoError(t, err)
+
+	_, err = http.DefaultClient.Do(req)
+	require.Error(t, err)
+
+	got := env.agent.next(t)
+	waitCanceled(t, env.agent, got.RequestID)
+
+	// The late reply is discarded and the connection keeps serving
+	close(release)
+	resp, err := http.Get(env.proxyURL + "/api/v1/after")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestDeadlineFromProxyConfig(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	env := newProxyEnv(t, blockingResponder(release))
+	env.setProxyConfig(t, &models.ProxyConfig{Timeout: 1})
+
+	start := time.Now()
+	resp, err := http.Get(env.proxyURL + "/api/v1/slow")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	got := env.agent.next(t)
+	require.NotNil(t, got.Deadline)
+	assert.WithinDuration(t, start.Add(time.Second), *got.Deadline, 500*time.Millisecond)
+	waitCanceled(t, env.agent, got.RequestID)
+}
+
+func TestDeadlineFromRoute(t *testing.T) {
+	env := newProxyEnv(t, echoResponder)
+
+	// Without a customer timeout the default route's 30s applies
+	start := time.Now()
+	resp, err := http.Get(env.proxyURL + "/api/v1/route")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	got := env.agent.next(t)
+	require.NotNil(t, got.Deadline)
+	assert.WithinDuration(t, start.Add(30*time.Second), *got.Deadline, time.Second)
+
+	// The tighter customer timeout wins
+	env.setProxyConfig(t, &models.ProxyConfig{Timeout: 5})
+	start = time.Now()
+	resp, err = http.Get(env.proxyURL + "/api/v1/route")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	got = env.agent.next(t)
+	require.NotNil(t, got.Deadline)
+	assert.WithinDuration(t, start.Add(5*time.Second), *got.Deadline, time.Second)
+}
+
+func TestCancelAbandonedResponseStream(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{
+			Status: http.StatusOK,
+			Body:   bytes.Repeat([]byte("x"), 4<<20),
+			Stream: true,
+		}
+	})
+
+	resp, err := http.Get(env.proxyURL + "/api/v1/download")
+	require.NoError(t, err)
+	_, err = io.ReadFull(resp.Body, make([]byte, 64<<10))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	got := env.agent.next(t)
+	waitCanceled(t, env.agent, got.RequestID)
+}
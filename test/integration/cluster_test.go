@@ -0,0 +1,228 @@
+package integration
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-service/internal/config"
+	"proxy-service/internal/handler"
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testReplicaSecret = "replica-secret"
+
+// replicaEnv is one proxy replica of a cluster sharing a Redis
+type replicaEnv struct {
+	*proxyEnv
+	internalURL string
+	directory   *agent.Directory
+}
+
+// newCluster starts two replicas sharing one Redis, each with its own agent
+// endpoint and internal endpoint
+func newCluster(t *testing.T) (*miniredis.Miniredis, *replicaEnv, *replicaEnv) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return mr, newReplica(t, mr, "replica-a", testReplicaSecret), newReplica(t, mr, "replica-b", testReplicaSecret)
+}
+
+func newReplica(t *testing.T, mr *miniredis.Miniredis, replicaID, secret string) *replicaEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	redisCache, err := cache.NewRedisCache(&config.RedisConfig{Address: mr.Addr()})
+	require.NoError(t, err)
+
+	var managerCache cache.Cache = agentConfigCache{redisCache}
+	manager := agent.NewAgentManager(sharedCollector(), &managerCache)
+	manager.SetHandshakePolicy(agent.HandshakePolicy{Timeout: testHandshakeTimeout})
+	proxyService := service.NewProxyService(manager, redisCache, sharedCollector())
+	proxyHandler := handler.NewProxyHandler(proxyService, redisCache)
+	replicaHandler := handler.NewReplicaHandler(proxyService, proxyHandler)
+
+	internalRouter := gin.New()
+	internalRouter.Any("/*path", replicaHandler.HandleRequest)
+	internalServer := httptest.NewServer(internalRouter)
+	t.Cleanup(internalServer.Close)
+
+	directory := agent.NewDirectory(redisCache, agent.Replica{ID: replicaID, Address: internalServer.URL}, time.Minute)
+	manager.SetDirectory(directory)
+	proxyService.EnableCluster(directory, secret)
+
+	router := gin.New()
+	router.Any("/api/v1/*path", func(c *gin.Context) {
+		c.Set("customer_id", testCustomerID)
+	}, proxyHandler.HandleRequest)
+	proxyServer := httptest.NewServer(router)
+	t.Cleanup(proxyServer.Close)
+
+	upgrader := websocket.Upgrader{Subprotocols: agentproto.Subprotocols}
+	agentServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		manager.RegisterAgent(context.Background(), r.Header.Get("X-Agent-ID"), testCustomerID, conn)
+	}))
+	t.Cleanup(agentServer.Close)
+
+	env := &proxyEnv{
+		proxyURL: proxyServer.URL,
+		agentURL: "ws" + strings.TrimPrefix(agentServer.URL, "http"),
+		manager:  manager,
+		proxy:    proxyService,
+		cache:    redisCache,
+	}
+	env.setProxyConfig(t, &models.ProxyConfig{})
+
+	return &replicaEnv{proxyEnv: env, internalURL: internalServer.URL, directory: directory}
+}
+
+func waitForLocations(t *testing.T, replica *replicaEnv, count int) []agent.AgentLocation {
+	t.Helper()
+	var locations []agent.AgentLocation
+	require.Eventually(t, func() bool {
+		var err error
+		locations, err = replica.directory.CustomerAgents(context.Background(), testCustomerID)
+		return err == nil && len(locations) == count
+	}, 2*time.Second, 10*time.Millisecond)
+	return locations
+}
+
+func TestRequestIsForwardedToReplicaHoldingAgent(t *testing.T) {
+	_, holder, other := newCluster(t)
+	fake := holder.connectAgent(t, testAgentID, "", echoResponder)
+
+	locations := waitForLocations(t, other, 1)
+	assert.Equal(t, "replica-a", locations[0].ReplicaID)
+	assert.Equal(t, holder.internalURL, locations[0].Address)
+
+	req, err := http.NewRequest(http.MethodPost, other.proxyURL+"/api/v1/orders?page=2", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set("X-Test", "kept")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "payload", string(body))
+
+	got := fake.next(t)
+	assert.Equal(t, http.MethodPost, got.Method)
+	assert.Equal(t, "/api/v1/orders", got.Path)
+	assert.Equal(t, "page=2", got.RawQuery)
+	headers := http.Header(got.Headers)
+	assert.Equal(t, "kept", headers.Get("X-Test"))
+	for _, name := range service.ReplicaHeaders {
+		assert.Empty(t, headers.Values(name), name)
+	}
+}
+
+func TestTunnelIsForwardedToReplicaHoldingAgent(t *testing.T) {
+	_, holder, other := newCluster(t)
+	fake := holder.connectAgent(t, testAgentID, "", acceptTunnel)
+	waitForLocations(t, other, 1)
+
+	conn := dialTunnel(t, other.proxyEnv, http.Header{"Sec-Websocket-Protocol": {"chat"}})
+	assert.Equal(t, "chat", conn.Subprotocol())
+	assert.True(t, fake.next(t).Tunnel)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+	messageType, payload, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.Equal(t, "ping", string(payload))
+}
+
+func TestReplicaEndpointRejectsWrongSecret(t *testing.T) {
+	mr := miniredis.RunT(t)
+	holder := newReplica(t, mr, "replica-a", testReplicaSecret)
+	intruder := newReplica(t, mr, "replica-b", "wrong-secret")
+	holder.connectAgent(t, testAgentID, "", echoResponder)
+	waitForLocations(t, intruder, 1)
+
+	resp, err := http.Get(intruder.proxyURL + "/api/v1/orders")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Nor is the internal endpoint open to callers without a token
+	req, err := http.NewRequest(http.MethodGet, holder.internalURL+"/api/v1/orders", nil)
+	require.NoError(t, err)
+	req.Header.Set(service.ReplicaCustomerHeader, testCustomerID)
+	req.Header.Set(service.ReplicaAgentHeader, testAgentID)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestDisconnectedAgentLeavesDirectory(t *testing.T) {
+	_, holder, other := newCluster(t)
+	fake := holder.connectAgent(t, testAgentID, "", echoResponder)
+	waitForLocations(t, other, 1)
+
+	fake.conn.Close()
+	waitForLocations(t, other, 0)
+
+	resp, err := http.Get(other.proxyURL + "/api/v1/orders")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestLapsedLeaseDropsAgent(t *testing.T) {
+	mr, holder, other := newCluster(t)
+	holder.connectAgent(t, testAgentID, "", echoResponder)
+	waitForLocations(t, other, 1)
+
+	// The holder stops renewing, as if it had died
+	mr.FastForward(2 * time.Minute)
+	waitForLocations(t, other, 0)
+
+	// A renewal by the live connection brings the agent back
+	conns := holder.manager.GetCustomerAgents(testCustomerID)
+	require.Len(t, conns, 1)
+	holder.manager.RenewLease(conns[0])
+	waitForLocations(t, other, 1)
+}
+
+func TestReconnectElsewhereClosesStaleConnection(t *testing.T) {
+	_, first, second := newCluster(t)
+	first.connectAgent(t, testAgentID, "", echoResponder)
+	conns := first.manager.GetCustomerAgents(testCustomerID)
+	require.Len(t, conns, 1)
+	stale := conns[0]
+
+	second.connectAgent(t, testAgentID, "", echoResponder)
+	require.Eventually(t, func() bool {
+		locations, err := first.directory.CustomerAgents(context.Background(), testCustomerID)
+		return err == nil && len(locations) == 1 && locations[0].ReplicaID == "replica-b"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	first.manager.RenewLease(stale)
+	require.Eventually(t, func() bool {
+		return first.manager.GetAgentStatus(testAgentID) != "connected"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The stale connection going away leaves the new lease in place
+	locations := waitForLocations(t, first, 1)
+	assert.Equal(t, "replica-b", locations[0].ReplicaID)
+}
@@ -0,0 +1,182 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentclient"
+	"proxy-service/pkg/cache"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type configStatus struct {
+	CustomerID string                `json:"customer_id"`
+	Revision   int64                 `json:"revision"`
+	Agents     []agent.ConfigRollout `json:"agents"`
+}
+
+// newConfigEnv runs the real agent endpoint together with the config API,
+// authenticated as the test customer
+func newConfigEnv(t *testing.T) (*proxyEnv, string) {
+	t.Helper()
+	env := newProxyEnvWithEndpoint(t, func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler {
+		handler := newTestAgentHandler(manager, redisCache)
+		router := gin.New()
+		router.GET("/api/v1/agents/connect", handler.HandleConnection)
+		api := router.Group("/api/v1/agents", func(c *gin.Context) {
+			c.Set("customer_id", testCustomerID)
+		})
+		api.GET("/config", handler.HandleGetConfig)
+		api.PUT("/config", handler.HandleUpdateConfig)
+		api.GET("/config/status", handler.HandleConfigStatus)
+		return router
+	})
+	return env, "http" + strings.TrimPrefix(env.agentURL, "ws") + "/api/v1/agents/config"
+}
+
+func putConfig(t *testing.T, url string, config *models.AgentConfig) *models.AgentConfig {
+	t.Helper()
+	data, err := json.Marshal(config)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var stored models.AgentConfig
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stored))
+	return &stored
+}
+
+func getConfigStatus(t *testing.T, url string) *configStatus {
+	t.Helper()
+	resp, err := http.Get(url + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var status configStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	return &status
+}
+
+func waitForRevision(t *testing.T, client *agentclient.Client, revision int64) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		applied := client.AgentConfig()
+		return applied != nil && applied.Revision == revision
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConfigChangesArePushedAndAcknowledged(t *testing.T) {
+	env, url := newConfigEnv(t)
+	upstream := newEchoUpstream(t)
+	first := startAgentClient(t, env, "agent-a", testAPIKey, upstream.URL)
+	second := startAgentClient(t, env, "agent-b", testAPIKey, upstream.URL)
+	waitForAgent(t, env, "agent-a")
+	waitForAgent(t, env, "agent-b")
+
+	stored := putConfig(t, url, &models.AgentConfig{MaxConnections: 7, RequestTimeout: time.Second})
+	assert.Equal(t, testCustomerID, stored.CustomerID)
+	require.Greater(t, stored.Revision, int64(0))
+
+	// Well ahead of the 30s heartbeat, so the change was pushed
+	waitForRevision(t, first, stored.Revision)
+	waitForRevision(t, second, stored.Revision)
+	assert.Equal(t, 7, first.AgentConfig().MaxConnections)
+
+	require.Eventually(t, func() bool {
+		status := getConfigStatus(t, url)
+		if len(status.Agents) != 2 {
+			return false
+		}
+		for _, rollout := range status.Agents {
+			if !rollout.InSync {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	status := getConfigStatus(t, url)
+	assert.Equal(t, stored.Revision, status.Revision)
+	for _, rollout := range status.Agents {
+		assert.Equal(t, stored.Revision, rollout.DesiredRevision)
+		require.NotNil(t, rollout.AppliedRevision)
+		assert.Equal(t, stored.Revision, *rollout.AppliedRevision)
+		assert.NotNil(t, rollout.AppliedAt)
+	}
+}
+
+func TestAgentConfigOverride(t *testing.T) {
+	env, url := newConfigEnv(t)
+	upstream := newEchoUpstream(t)
+	first := startAgentClient(t, env, "agent-a", testAPIKey, upstream.URL)
+	second := startAgentClient(t, env, "agent-b", testAPIKey, upstream.URL)
+	waitForAgent(t, env, "agent-a")
+	waitForAgent(t, env, "agent-b")
+
+	shared := putConfig(t, url, &models.AgentConfig{MaxConnections: 10})
+	override := putConfig(t, url+"?agent_id=agent-b", &models.AgentConfig{MaxConnections: 2})
+	assert.Equal(t, "agent-b", override.AgentID)
+	assert.Greater(t, override.Revision, shared.Revision)
+
+	waitForRevision(t, first, shared.Revision)
+	waitForRevision(t, second, override.Revision)
+	assert.Equal(t, 2, second.AgentConfig().MaxConnections)
+
+	// A new shared revision leaves the overridden agent alone
+	updated := putConfig(t, url, &models.AgentConfig{MaxConnections: 20})
+	waitForRevision(t, first, updated.Revision)
+	assert.Equal(t, override.Revision, second.AgentConfig().Revision)
+
+	resp, err := http.Get(url + "?agent_id=agent-b")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var effective models.AgentConfig
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&effective))
+	assert.Equal(t, override.Revision, effective.Revision)
+
+	require.Eventually(t, func() bool {
+		status := getConfigStatus(t, url)
+		return len(status.Agents) == 2 &&
+			status.Agents[0].DesiredRevision == updated.Revision && status.Agents[0].InSync &&
+			status.Agents[1].DesiredRevision == override.Revision && status.Agents[1].InSync
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRefusedConfigIsReported(t *testing.T) {
+	env, url := newConfigEnv(t)
+	upstream := newEchoUpstream(t)
+	client := startAgentClient(t, env, "agent-a", testAPIKey, upstream.URL)
+	waitForAgent(t, env, "agent-a")
+
+	good := putConfig(t, url, &models.AgentConfig{MaxConnections: 5})
+	waitForRevision(t, client, good.Revision)
+
+	bad := putConfig(t, url, &models.AgentConfig{MaxConnections: -1})
+	require.Eventually(t, func() bool {
+		status := getConfigStatus(t, url)
+		return len(status.Agents) == 1 && status.Agents[0].Error != ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rollout := getConfigStatus(t, url).Agents[0]
+	assert.False(t, rollout.InSync)
+	assert.Equal(t, bad.Revision, rollout.DesiredRevision)
+	require.NotNil(t, rollout.AppliedRevision)
+	assert.Equal(t, good.Revision, *rollout.AppliedRevision)
+	assert.Equal(t, good.Revision, client.AgentConfig().Revision)
+}
@@ -0,0 +1,339 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentclient"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// credentialEnv runs the real agent endpoint with the credential API,
+// authenticated as the test customer
+type credentialEnv struct {
+	*proxyEnv
+	// apiURL is the base of the agent API, e.g. <apiURL>/credentials
+	apiURL string
+}
+
+func newCredentialEnv(t *testing.T, mr *miniredis.Miniredis) *credentialEnv {
+	t.Helper()
+	env := newProxyEnvOnRedis(t, mr, func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler {
+		manager.SetCredentialStore(agent.NewCredentialStore(redisCache, agent.CredentialPolicy{}))
+
+		handler := newTestAgentHandler(manager, redisCache)
+		router := gin.New()
+		router.GET("/api/v1/agents/connect", handler.HandleConnection)
+		router.POST("/api/v1/agents/token", handler.HandleConnectToken)
+		api := router.Group("/api/v1/agents", func(c *gin.Context) {
+			c.Set("customer_id", testCustomerID)
+		})
+		api.POST("/credentials", handler.HandleIssueCredential)
+		api.GET("/credentials", handler.HandleListCredentials)
+		api.DELETE("/credentials", handler.HandleRevokeCredential)
+		return router
+	})
+	t.Cleanup(env.manager.Close)
+	return &credentialEnv{
+		proxyEnv: env,
+		apiURL:   "http" + strings.TrimPrefix(env.agentURL, "ws") + "/api/v1/agents",
+	}
+}
+
+// issueCredential issues a credential to the agent; an empty overlap keeps
+// the default
+func (env *credentialEnv) issueCredential(t *testing.T, agentID, overlap string) *models.AgentCredential {
+	t.Helper()
+	url := env.apiURL + "/credentials?agent_id=" + agentID
+	if overlap != "" {
+		url += "&overlap=" + overlap
+	}
+	resp, err := http.Post(url, "application/json", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var credential models.AgentCredential
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&credential))
+	require.NotEmpty(t, credential.Secret)
+	return &credential
+}
+
+func (env *credentialEnv) listCredentials(t *testing.T, agentID string) []models.AgentCredential {
+	t.Helper()
+	resp, err := http.Get(env.apiURL + "/credentials?agent_id=" + agentID)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var listed struct {
+		Credentials []models.AgentCredential `json:"credentials"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	return listed.Credentials
+}
+
+func (env *credentialEnv) revokeCredential(t *testing.T, agentID, credentialID string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodDelete, env.apiURL+"/credentials?agent_id="+agentID+"&credential_id="+credentialID, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// dial connects as agentID with the given X-Agent-Token. It returns the
+// connection, once registered, or the status the endpoint refused it with.
+func (env *credentialEnv) dial(t *testing.T, agentID, token string) (*websocket.Conn, int) {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(env.agentURL+"/api/v1/agents/connect", http.Header{
+		"X-Agent-ID":    {agentID},
+		"X-Customer-ID": {testCustomerID},
+		"X-Agent-Token": {token},
+	})
+	if err != nil {
+		require.NotNil(t, resp, "dial failed: %v", err)
+		return nil, resp.StatusCode
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	hello, err := agentproto.CodecForSubprotocol("").Encode(agentproto.NewMessage(agentproto.MessageTypeHello, "", fullHello()))
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, hello))
+	waitForAgent(t, env.proxyEnv, agentID)
+	return conn, http.StatusSwitchingProtocols
+}
+
+// waitForClose reads until the proxy closes the connection and returns the
+// close code
+func waitForClose(t *testing.T, conn *websocket.Conn) int {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			require.True(t, ok, "connection failed without a close frame: %v", err)
+			return closeErr.Code
+		}
+	}
+}
+
+func TestAgentConnectsWithIssuedCredential(t *testing.T) {
+	env := newCredentialEnv(t, miniredis.RunT(t))
+	credential := env.issueCredential(t, testAgentID, "")
+	assert.Equal(t, testAgentID, credential.AgentID)
+	assert.Equal(t, testCustomerID, credential.CustomerID)
+
+	upstream := newEchoUpstream(t)
+	client, err := agentclient.New(agentclient.Config{
+		ServerURL:    env.agentURL + "/api/v1/agents/connect",
+		AgentID:      testAgentID,
+		CustomerID:   testCustomerID,
+		CredentialID: credential.ID,
+		Secret:       credential.Secret,
+		Upstream:     upstream.URL,
+		MinBackoff:   10 * time.Millisecond,
+		MaxBackoff:   50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	waitForAgent(t, env.proxyEnv, testAgentID)
+
+	resp, err := http.Get(env.proxyURL + "/api/v1/hello")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/api/v1/hello", resp.Header.Get("X-Upstream-Path"))
+
+	// The secret is only shown when the credential is issued
+	listed := env.listCredentials(t, testAgentID)
+	require.Len(t, listed, 1)
+	assert.Equal(t, credential.ID, listed[0].ID)
+	assert.Empty(t, listed[0].Secret)
+}
+
+func TestEnrolledAgentCannotUseAPIKey(t *testing.T) {
+	env := newCredentialEnv(t, miniredis.RunT(t))
+
+	// Before enrolment the API key still works
+	conn, status := env.dial(t, testAgentID, agentproto.SignToken(testAgentID, testCustomerID, testAPIKey, time.Now()))
+	require.NotNil(t, conn, "status %d", status)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return env.manager.GetAgentStatus(testAgentID) == ""
+	}, 2*time.Second, 10*time.Millisecond)
+
+	env.issueCredential(t, testAgentID, "")
+	_, status = env.dial(t, testAgentID, agentproto.SignToken(testAgentID, testCustomerID, testAPIKey, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// Revoking every credential does not bring the API key back
+	assert.Equal(t, http.StatusOK, env.revokeCredential(t, testAgentID, ""))
+	_, status = env.dial(t, testAgentID, agentproto.SignToken(testAgentID, testCustomerID, testAPIKey, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestConnectTokenIsSingleUse(t *testing.T) {
+	env := newCredentialEnv(t, miniredis.RunT(t))
+	credential := env.issueCredential(t, testAgentID, "")
+
+	token := agentproto.NewConnectToken(testAgentID, testCustomerID, credential.ID, credential.Secret)
+	conn, status := env.dial(t, testAgentID, token)
+	require.NotNil(t, conn, "status %d", status)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return env.manager.GetAgentStatus(testAgentID) == ""
+	}, 2*time.Second, 10*time.Millisecond)
+
+	_, status = env.dial(t, testAgentID, token)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestInvalidConnectTokensAreRefused(t *testing.T) {
+	env := newCredentialEnv(t, miniredis.RunT(t))
+	credential := env.issueCredential(t, testAgentID, "")
+
+	tokens := map[string]string{
+		"expired":       agentproto.SignConnectToken(testAgentID, testCustomerID, credential.ID, credential.Secret, time.Now().Add(-agent.DefaultConnectTokenTTL-time.Minute), "nonce-1"),
+		"future":        agentproto.SignConnectToken(testAgentID, testCustomerID, credential.ID, credential.Secret, time.Now().Add(time.Hour), "nonce-2"),
+		"wrong secret":  agentproto.NewConnectToken(testAgentID, testCustomerID, credential.ID, "not-the-secret"),
+		"unknown":       agentproto.NewConnectToken(testAgentID, testCustomerID, "unknown", credential.Secret),
+		"another agent": agentproto.NewConnectToken("agent-2", testCustomerID, credential.ID, credential.Secret),
+	}
+	for name, token := range tokens {
+		t.Run(name, func(t *testing.T) {
+			agentID := testAgentID
+			if name == "another agent" {
+				agentID = "agent-2"
+			}
+			_, status := env.dial(t, agentID, token)
+			assert.Equal(t, http.StatusUnauthorized, status)
+		})
+	}
+}
+
+func TestRotationKeepsPreviousCredentialForOverlap(t *testing.T) {
+	env := newCredentialEnv(t, miniredis.RunT(t))
+	first := env.issueCredential(t, testAgentID, "")
+	second := env.issueCredential(t, testAgentID, "1h")
+
+	listed := env.listCredentials(t, testAgentID)
+	require.Len(t, listed, 2)
+	require.NotNil(t, listed[0].ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *listed[0].ExpiresAt, time.Minute)
+	assert.Nil(t, listed[1].ExpiresAt)
+
+	// Both credentials connect while the rotation overlaps
+	for _, credential := range []*models.AgentCredential{first, second} {
+		conn, status := env.dial(t, testAgentID, agentproto.NewConnectToken(testAgentID, testCustomerID, credential.ID, credential.Secret))
+		require.NotNil(t, conn, "status %d", status)
+		conn.Close()
+		require.Eventually(t, func() bool {
+			return env.manager.GetAgentStatus(testAgentID) == ""
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+
+	// A rotation without overlap retires the previous credentials at once
+	third := env.issueCredential(t, testAgentID, "0s")
+	listed = env.listCredentials(t, testAgentID)
+	require.Len(t, listed, 1)
+	assert.Equal(t, third.ID, listed[0].ID)
+
+	_, status := env.dial(t, testAgentID, agentproto.NewConnectToken(testAgentID, testCustomerID, second.ID, second.Secret))
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestRevokingCredentialClosesSession(t *testing.T) {
+	env := newCredentialEnv(t, miniredis.RunT(t))
+	credential := env.issueCredential(t, testAgentID, "")
+	other := env.issueCredential(t, testAgentID, "1h")
+
+	conn, status := env.dial(t, testAgentID, agentproto.NewConnectToken(testAgentID, testCustomerID, credential.ID, credential.Secret))
+	require.NotNil(t, conn, "status %d", status)
+
+	// Revoking a credential that did not authenticate the session keeps it
+	assert.Equal(t, http.StatusOK, env.revokeCredential(t, testAgentID, other.ID))
+	assert.Equal(t, agent.StatusConnected, env.manager.GetAgentStatus(testAgentID))
+
+	assert.Equal(t, http.StatusOK, env.revokeCredential(t, testAgentID, credential.ID))
+	assert.Equal(t, websocket.ClosePolicyViolation, waitForClose(t, conn))
+	assert.Empty(t, env.listCredentials(t, testAgentID))
+
+	_, status = env.dial(t, testAgentID, agentproto.NewConnectToken(testAgentID, testCustomerID, credential.ID, credential.Secret))
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, http.StatusNotFound, env.revokeCredential(t, testAgentID, credential.ID))
+}
+
+func TestRevocationClosesSessionOnOtherReplica(t *testing.T) {
+	mr := miniredis.RunT(t)
+	issuer := newCredentialEnv(t, mr)
+	holder := newCredentialEnv(t, mr)
+	credential := issuer.issueCredential(t, testAgentID, "")
+
+	conn, status := holder.dial(t, testAgentID, agentproto.NewConnectToken(testAgentID, testCustomerID, credential.ID, credential.Secret))
+	require.NotNil(t, conn, "status %d", status)
+
+	assert.Equal(t, http.StatusOK, issuer.revokeCredential(t, testAgentID, credential.ID))
+	assert.Equal(t, websocket.ClosePolicyViolation, waitForClose(t, conn))
+}
+
+func TestConnectTokenEndpoint(t *testing.T) {
+	env := newCredentialEnv(t, miniredis.RunT(t))
+	credential := env.issueCredential(t, testAgentID, "")
+
+	exchange := func(secret string) *http.Response {
+		body, err := json.Marshal(map[string]string{"credential_id": credential.ID, "secret": secret})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, env.apiURL+"/token", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Agent-ID", testAgentID)
+		req.Header.Set("X-Customer-ID", testCustomerID)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := exchange("not-the-secret")
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = exchange(credential.Secret)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var issued struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&issued))
+	assert.WithinDuration(t, time.Now().Add(agent.DefaultConnectTokenTTL), issued.ExpiresAt, time.Minute)
+
+	conn, status := env.dial(t, testAgentID, issued.Token)
+	require.NotNil(t, conn, "status %d", status)
+}
@@ -0,0 +1,227 @@
+package integration
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentclient"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// heldResponder answers once release is closed
+func heldResponder(release <-chan struct{}) fakeResponder {
+	return func(req *receivedRequest) *fakeResponse {
+		<-release
+		return &fakeResponse{Status: http.StatusOK, Body: []byte("finished")}
+	}
+}
+
+// getAsync issues a GET and delivers the response, or nil if it failed
+func getAsync(url string) <-chan *http.Response {
+	result := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			result <- nil
+			return
+		}
+		result <- resp
+	}()
+	return result
+}
+
+func drainAsync(manager *agent.AgentManager, timeout time.Duration) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		result <- manager.Drain(ctx)
+	}()
+	return result
+}
+
+func TestDrainWaitsForInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	env := newProxyEnv(t, heldResponder(release))
+
+	inFlight := getAsync(env.proxyURL + "/api/v1/slow")
+	env.agent.next(t)
+
+	drained := drainAsync(env.manager, 5*time.Second)
+
+	select {
+	case goAway := <-env.agent.goAway:
+		assert.NotEmpty(t, goAway.Reason)
+		require.NotNil(t, goAway.Deadline)
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent was not sent a goaway")
+	}
+	assert.Equal(t, agent.StatusDraining, env.manager.GetAgentStatus(testAgentID))
+
+	// The draining agent takes no new requests
+	resp, err := http.Get(env.proxyURL + "/api/v1/new")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	resp = <-inFlight
+	require.NotNil(t, resp)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "finished", string(body))
+
+	require.NoError(t, <-drained)
+	require.Eventually(t, func() bool {
+		return env.manager.GetAgentStatus(testAgentID) == ""
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestDrainDeadlineCutsRequests(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	env := newProxyEnv(t, heldResponder(release))
+
+	inFlight := getAsync(env.proxyURL + "/api/v1/stuck")
+	env.agent.next(t)
+
+	err := <-drainAsync(env.manager, 200*time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	resp := <-inFlight
+	require.NotNil(t, resp)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestDrainingReplicaTurnsAgentsAway(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	require.NoError(t, <-drainAsync(env.manager, time.Second))
+
+	conn, _, err := websocket.DefaultDialer.Dial(env.agentURL, http.Header{"X-Agent-ID": {testAgentID}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got %v", err)
+	assert.Empty(t, env.manager.GetAgentStatus(testAgentID))
+}
+
+func TestCloseStopsManager(t *testing.T) {
+	env := newProxyEnv(t, echoResponder)
+	env.manager.Close()
+
+	require.Eventually(t, func() bool {
+		return env.manager.GetAgentStatus(testAgentID) == ""
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+// newAgentBalancer hands the first agent connection to first and every later
+// one to second, like a load balancer that stopped sending to a replica
+func newAgentBalancer(t *testing.T, first, second *replicaEnv) string {
+	t.Helper()
+	var dials int32
+	targets := make([]*url.URL, 2)
+	for i, replica := range []*replicaEnv{first, second} {
+		target, err := url.Parse("http" + strings.TrimPrefix(replica.agentURL, "ws"))
+		require.NoError(t, err)
+		targets[i] = target
+	}
+
+	balancer := httptest.NewServer(&httputil.ReverseProxy{
+		Rewrite: func(out *httputil.ProxyRequest) {
+			target := targets[1]
+			if atomic.AddInt32(&dials, 1) == 1 {
+				target = targets[0]
+			}
+			out.SetURL(target)
+		},
+	})
+	t.Cleanup(balancer.Close)
+	return "ws" + strings.TrimPrefix(balancer.URL, "http")
+}
+
+func TestAgentClientMovesToAnotherReplicaOnGoAway(t *testing.T) {
+	_, draining, remaining := newCluster(t)
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/slow" {
+			<-release
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	t.Cleanup(upstream.Close)
+
+	// A backoff far beyond the test proves the move does not wait for it
+	client, err := agentclient.New(agentclient.Config{
+		ServerURL:  newAgentBalancer(t, draining, remaining),
+		AgentID:    testAgentID,
+		CustomerID: testCustomerID,
+		APIKey:     testAPIKey,
+		Upstream:   upstream.URL,
+		MinBackoff: time.Minute,
+		MaxBackoff: time.Minute,
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	waitForAgent(t, draining.proxyEnv, testAgentID)
+
+	inFlight := getAsync(draining.proxyURL + "/api/v1/slow")
+	require.Eventually(t, func() bool {
+		conns := draining.manager.GetCustomerAgents(testCustomerID)
+		return len(conns) == 1 && conns[0].InFlight() == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	drained := drainAsync(draining.manager, 5*time.Second)
+	waitForAgent(t, remaining.proxyEnv, testAgentID)
+
+	// The draining replica hands new requests to the agent's new replica
+	resp, err := http.Get(draining.proxyURL + "/api/v1/fast")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/api/v1/fast", string(body))
+
+	// The old connection still finishes what it had started
+	close(release)
+	resp = <-inFlight
+	require.NotNil(t, resp)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, <-drained)
+
+	assert.Equal(t, agent.StatusConnected, remaining.manager.GetAgentStatus(testAgentID))
+	assert.True(t, client.Connected())
+}
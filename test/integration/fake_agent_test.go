@@ -0,0 +1,485 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"proxy-service/internal/config"
+	"proxy-service/internal/handler"
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+	"proxy-service/pkg/metrics"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testCustomerID = "customer-1"
+	testAgentID    = "agent-1"
+)
+
+var (
+	collectorOnce sync.Once
+	collector     *metrics.MetricsCollector
+)
+
+// sharedCollector returns a single collector for the whole test binary,
+// since the collector registers its metrics globally
+func sharedCollector() *metrics.MetricsCollector {
+	collectorOnce.Do(func() {
+		collector = metrics.NewMetricsCollector()
+	})
+	return collector
+}
+
+// receivedRequest is what the fake agent saw, with any streamed body joined
+type receivedRequest struct {
+	agentproto.ProxyRequest
+	RequestID string
+	FullBody  []byte
+}
+
+type fakeResponse struct {
+	Status   int
+	Headers  http.Header
+	Body     []byte
+	Trailers http.Header
+	Stream   bool
+}
+
+type fakeResponder func(req *receivedRequest) *fakeResponse
+
+// fakeAgent speaks the agent side of the WebSocket protocol
+type fakeAgent struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	codec    agentproto.Codec
+	respond  fakeResponder
+	received chan *receivedRequest
+	canceled chan string
+	// closed receives the end frame of every tunnel the proxy closes
+	closed chan *agentproto.BodyFrame
+	// welcome receives the proxy's answer to the hello
+	welcome chan *agentproto.WelcomePayload
+	// goAway receives the proxy's goaway
+	goAway chan *agentproto.GoAwayPayload
+
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	inbound  map[string]*receivedRequest
+	outbound map[string]chan struct{}
+	tunnels  map[string]bool
+	// targets holds the TCP connection behind each accepted CONNECT
+	targets map[string]net.Conn
+}
+
+type proxyEnv struct {
+	proxyURL string
+	agentURL string
+	agent    *fakeAgent
+	manager  *agent.AgentManager
+	proxy    *service.ProxyService
+	cache    *cache.RedisCache
+}
+
+func newProxyEnv(t *testing.T, respond fakeResponder) *proxyEnv {
+	t.Helper()
+	return newProxyEnvWithCodec(t, "", respond)
+}
+
+// newProxyEnvWithCodec connects the fake agent asking for the given
+// subprotocol; an empty one behaves like an agent that predates codecs
+func newProxyEnvWithCodec(t *testing.T, subprotocol string, respond fakeResponder) *proxyEnv {
+	t.Helper()
+	env := newEmptyProxyEnv(t)
+	env.agent = env.connectAgent(t, testAgentID, subprotocol, respond)
+	return env
+}
+
+// newEmptyProxyEnv starts the proxy and the agent endpoint without agents
+func newEmptyProxyEnv(t *testing.T) *proxyEnv {
+	t.Helper()
+	return newProxyEnvWithEndpoint(t, func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler {
+		upgrader := websocket.Upgrader{Subprotocols: agentproto.Subprotocols}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			manager.RegisterAgent(context.Background(), r.Header.Get("X-Agent-ID"), testCustomerID, conn)
+		})
+	})
+}
+
+// agentConfigCache lets the manager keep agent configs in the test Redis
+type agentConfigCache struct {
+	*cache.RedisCache
+}
+
+func (c agentConfigCache) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	return c.RedisCache.Set(ctx, key, value, expiration)
+}
+
+// newProxyEnvWithEndpoint starts the proxy with the given agent endpoint
+func newProxyEnvWithEndpoint(t *testing.T, endpoint func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler) *proxyEnv {
+	t.Helper()
+	return newProxyEnvOnRedis(t, miniredis.RunT(t), endpoint)
+}
+
+// newProxyEnvOnRedis is newProxyEnvWithEndpoint for proxies sharing a Redis
+func newProxyEnvOnRedis(t *testing.T, mr *miniredis.Miniredis, endpoint func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler) *proxyEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	redisCache, err := cache.NewRedisCache(&config.RedisConfig{Address: mr.Addr()})
+	require.NoError(t, err)
+
+	var managerCache cache.Cache = agentConfigCache{redisCache}
+	manager := agent.NewAgentManager(sharedCollector(), &managerCache)
+	manager.SetHandshakePolicy(agent.HandshakePolicy{Timeout: testHandshakeTimeout})
+	proxyService := service.NewProxyService(manager, redisCache, sharedCollector())
+	proxyHandler := handler.NewProxyHandler(proxyService, redisCache)
+
+	router := gin.New()
+	router.Any("/api/v1/*path", func(c *gin.Context) {
+		c.Set("customer_id", testCustomerID)
+	}, proxyHandler.HandleRequest)
+	proxyServer := httptest.NewServer(router)
+	t.Cleanup(proxyServer.Close)
+
+	agentServer := httptest.NewServer(endpoint(manager, redisCache))
+	t.Cleanup(agentServer.Close)
+
+	env := &proxyEnv{
+		proxyURL: proxyServer.URL,
+		agentURL: "ws" + strings.TrimPrefix(agentServer.URL, "http"),
+		manager:  manager,
+		proxy:    proxyService,
+		cache:    redisCache,
+	}
+	env.setProxyConfig(t, &models.ProxyConfig{})
+	return env
+}
+
+func (env *proxyEnv) setProxyConfig(t *testing.T, proxyConfig *models.ProxyConfig) {
+	t.Helper()
+	proxyConfig.CustomerID = testCustomerID
+	require.NoError(t, env.cache.SetProxyConfig(context.Background(), testCustomerID, proxyConfig, time.Hour))
+}
+
+// testHandshakeTimeout keeps agents that send no hello from holding up tests
+const testHandshakeTimeout = 200 * time.Millisecond
+
+// fullHello advertises every capability the proxy knows
+func fullHello() *agentproto.HelloPayload {
+	return &agentproto.HelloPayload{
+		ProtocolVersion: agentproto.ProtocolVersion,
+		AgentVersion:    "fake",
+		Capabilities:    agent.ServerCapabilities,
+	}
+}
+
+// connectAgent dials the agent endpoint as agentID, says hello with every
+// capability and waits until the manager has registered it
+func (env *proxyEnv) connectAgent(t *testing.T, agentID, subprotocol string, respond fakeResponder) *fakeAgent {
+	t.Helper()
+	return env.connectAgentWithHello(t, agentID, subprotocol, fullHello(), respond)
+}
+
+// connectAgentWithHello is connectAgent with a chosen hello; nil behaves like
+// an agent that predates the handshake
+func (env *proxyEnv) connectAgentWithHello(t *testing.T, agentID, subprotocol string, hello *agentproto.HelloPayload, respond fakeResponder) *fakeAgent {
+	t.Helper()
+
+	dialer := *websocket.DefaultDialer
+	if subprotocol != "" {
+		dialer.Subprotocols = []string{subprotocol}
+	}
+	conn, _, err := dialer.Dial(env.agentURL, http.Header{"X-Agent-ID": {agentID}})
+	require.NoError(t, err)
+	require.Equal(t, subprotocol, conn.Subprotocol())
+	t.Cleanup(func() { conn.Close() })
+
+	fake := &fakeAgent{
+		t:        t,
+		conn:     conn,
+		codec:    agentproto.CodecForSubprotocol(conn.Subprotocol()),
+		respond:  respond,
+		received: make(chan *receivedRequest, 64),
+		canceled: make(chan string, 64),
+		closed:   make(chan *agentproto.BodyFrame, 64),
+		welcome:  make(chan *agentproto.WelcomePayload, 1),
+		goAway:   make(chan *agentproto.GoAwayPayload, 1),
+		inbound:  make(map[string]*receivedRequest),
+		outbound: make(map[string]chan struct{}),
+		tunnels:  make(map[string]bool),
+		targets:  make(map[string]net.Conn),
+	}
+	if hello != nil {
+		fake.send(agentproto.MessageTypeHello, "", hello)
+	}
+	go fake.run()
+
+	require.Eventually(t, func() bool {
+		return env.manager.GetAgentStatus(agentID) == "connected"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	return fake
+}
+
+func (a *fakeAgent) send(messageType, requestID string, payload interface{}) {
+	data, err := a.codec.Encode(agentproto.NewMessage(messageType, requestID, payload))
+	if err != nil {
+		a.t.Errorf("encode %s: %v", messageType, err)
+		return
+	}
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	a.conn.WriteMessage(a.codec.FrameType(), data)
+}
+
+func (a *fakeAgent) run() {
+	for {
+		frameType, data, err := a.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if frameType != a.codec.FrameType() {
+			a.t.Errorf("unexpected frame type %d", frameType)
+			continue
+		}
+		msg, err := a.codec.Decode(data)
+		if err != nil {
+			a.t.Errorf("decode message: %v", err)
+			continue
+		}
+
+		switch msg.Type {
+		case agentproto.MessageTypeProxyRequest:
+			req := &receivedRequest{RequestID: msg.RequestID}
+			if err := msg.Decode(&req.ProxyRequest); err != nil {
+				a.t.Errorf("decode proxy request: %v", err)
+				continue
+			}
+			if !req.Streamed {
+				req.FullBody = req.Body
+				go a.serve(msg.RequestID, req)
+				continue
+			}
+			a.mu.Lock()
+			a.inbound[msg.RequestID] = req
+			a.mu.Unlock()
+		case agentproto.MessageTypeBodyChunk:
+			var frame agentproto.BodyFrame
+			if err := msg.Decode(&frame); err != nil {
+				a.t.Errorf("decode body frame: %v", err)
+				continue
+			}
+			a.handleFrame(msg.RequestID, &frame)
+		case agentproto.MessageTypeCancel:
+			a.canceled <- msg.RequestID
+		case agentproto.MessageTypeWelcome:
+			var welcome agentproto.WelcomePayload
+			if err := msg.Decode(&welcome); err != nil {
+				a.t.Errorf("decode welcome: %v", err)
+				continue
+			}
+			a.welcome <- &welcome
+		case agentproto.MessageTypeGoAway:
+			var goAway agentproto.GoAwayPayload
+			if err := msg.Decode(&goAway); err != nil {
+				a.t.Errorf("decode goaway: %v", err)
+				continue
+			}
+			a.goAway <- &goAway
+		}
+	}
+}
+
+func (a *fakeAgent) handleFrame(requestID string, frame *agentproto.BodyFrame) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.tunnels[requestID] {
+		a.handleTunnelFrame(requestID, frame)
+		return
+	}
+	if target, ok := a.targets[requestID]; ok {
+		a.handleTargetFrame(requestID, target, frame)
+		return
+	}
+
+	switch frame.Frame {
+	case agentproto.BodyFrameData:
+		a.inbound[requestID].FullBody = append(a.inbound[requestID].FullBody, frame.Data...)
+		go a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameAck, Count: 1})
+	case agentproto.BodyFrameEnd:
+		req := a.inbound[requestID]
+		delete(a.inbound, requestID)
+		if req.Trailers == nil {
+			req.Trailers = make(map[string][]string)
+		}
+		for name, values := range frame.Trailers {
+			req.Trailers[name] = values
+		}
+		go a.serve(requestID, req)
+	case agentproto.BodyFrameAck:
+		if credits, ok := a.outbound[requestID]; ok {
+			for i := 0; i < frame.Count; i++ {
+				credits <- struct{}{}
+			}
+		}
+	}
+}
+
+// handleTunnelFrame plays an echo server behind an accepted tunnel. A text
+// message "close <code> <reason>" makes the upstream close the socket.
+func (a *fakeAgent) handleTunnelFrame(requestID string, frame *agentproto.BodyFrame) {
+	switch frame.Frame {
+	case agentproto.BodyFrameData:
+		a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameAck, Count: 1})
+
+		var code int
+		var reason string
+		if _, err := fmt.Sscanf(string(frame.Data), "close %d %s", &code, &reason); err == nil {
+			delete(a.tunnels, requestID)
+			a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameEnd, CloseCode: code, CloseText: reason})
+			return
+		}
+		a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameData, MessageType: frame.MessageType, Data: frame.Data})
+	case agentproto.BodyFrameEnd:
+		delete(a.tunnels, requestID)
+		a.closed <- frame
+	}
+}
+
+// handleTargetFrame writes tunnel data to the TCP target of a CONNECT
+func (a *fakeAgent) handleTargetFrame(requestID string, target net.Conn, frame *agentproto.BodyFrame) {
+	switch frame.Frame {
+	case agentproto.BodyFrameData:
+		a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameAck, Count: 1})
+		target.Write(frame.Data)
+	case agentproto.BodyFrameEnd:
+		delete(a.targets, requestID)
+		target.Close()
+		a.closed <- frame
+	}
+}
+
+// pumpTarget sends what the TCP target writes back through the tunnel, and
+// closes the tunnel when the target hangs up
+func (a *fakeAgent) pumpTarget(requestID string, target net.Conn) {
+	buf := make([]byte, agentproto.BodyChunkSize)
+	for {
+		n, err := target.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameData, MessageType: websocket.BinaryMessage, Data: data})
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.targets[requestID]; ok {
+		delete(a.targets, requestID)
+		a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameEnd, CloseCode: websocket.CloseNormalClosure})
+	}
+}
+
+func (a *fakeAgent) serve(requestID string, req *receivedRequest) {
+	a.received <- req
+	resp := a.respond(req)
+
+	if req.Tunnel && resp.Status == http.StatusSwitchingProtocols {
+		a.mu.Lock()
+		a.tunnels[requestID] = true
+		a.mu.Unlock()
+	}
+
+	// An accepted CONNECT dials the target like a real agent would
+	var target net.Conn
+	if req.Tunnel && req.Method == http.MethodConnect && resp.Status/100 == 2 {
+		conn, err := net.Dial("tcp", req.Path)
+		if err != nil {
+			resp = &fakeResponse{Status: http.StatusBadGateway}
+		} else {
+			target = conn
+			a.mu.Lock()
+			a.targets[requestID] = target
+			a.mu.Unlock()
+		}
+	}
+
+	if !resp.Stream {
+		a.send(agentproto.MessageTypeProxyResponse, requestID, agentproto.ProxyResponse{
+			StatusCode: resp.Status,
+			Headers:    resp.Headers,
+			Body:       resp.Body,
+			Trailers:   resp.Trailers,
+		})
+		if target != nil {
+			go a.pumpTarget(requestID, target)
+		}
+		return
+	}
+
+	credits := make(chan struct{}, agentproto.StreamWindow)
+	for i := 0; i < agentproto.StreamWindow; i++ {
+		credits <- struct{}{}
+	}
+	a.mu.Lock()
+	a.outbound[requestID] = credits
+	a.mu.Unlock()
+
+	declared := make(map[string][]string)
+	for name := range resp.Trailers {
+		declared[name] = nil
+	}
+
+	a.send(agentproto.MessageTypeProxyResponse, requestID, agentproto.ProxyResponse{
+		StatusCode: resp.Status,
+		Headers:    resp.Headers,
+		Trailers:   declared,
+		Streamed:   true,
+	})
+	a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameStart, Size: int64(len(resp.Body))})
+	for offset := 0; offset < len(resp.Body); offset += agentproto.BodyChunkSize {
+		end := offset + agentproto.BodyChunkSize
+		if end > len(resp.Body) {
+			end = len(resp.Body)
+		}
+		<-credits
+		a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameData, Data: resp.Body[offset:end]})
+	}
+	a.send(agentproto.MessageTypeBodyChunk, requestID, agentproto.BodyFrame{Frame: agentproto.BodyFrameEnd, Trailers: resp.Trailers})
+}
+
+// next returns the next request the agent received
+func (a *fakeAgent) next(t *testing.T) *receivedRequest {
+	t.Helper()
+	select {
+	case req := <-a.received:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent received no request")
+		return nil
+	}
+}
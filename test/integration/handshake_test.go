@@ -0,0 +1,145 @@
+package integration
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentproto"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connectionOf(t *testing.T, env *proxyEnv, agentID string) *agent.AgentConnection {
+	t.Helper()
+	for _, conn := range env.manager.GetCustomerAgents(testCustomerID) {
+		if conn.AgentID == agentID {
+			return conn
+		}
+	}
+	t.Fatalf("agent %s is not routable", agentID)
+	return nil
+}
+
+func nextWelcome(t *testing.T, fake *fakeAgent) *agentproto.WelcomePayload {
+	t.Helper()
+	select {
+	case welcome := <-fake.welcome:
+		return welcome
+	case <-time.After(2 * time.Second):
+		t.Fatal("no welcome received")
+		return nil
+	}
+}
+
+// expectRejected dials as agentID, sends hello unless it is nil, and expects
+// the proxy to close the socket with a policy violation
+func expectRejected(t *testing.T, env *proxyEnv, agentID string, hello *agentproto.HelloPayload) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(env.agentURL, http.Header{"X-Agent-ID": {agentID}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	if hello != nil {
+		data, err := agentproto.CodecForSubprotocol("").Encode(agentproto.NewMessage(agentproto.MessageTypeHello, "", hello))
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, data))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+	assert.Contains(t, closeErr.Text, "below the minimum")
+
+	assert.Eventually(t, func() bool {
+		return env.manager.GetAgentStatus(agentID) == ""
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestHandshakeNegotiatesCapabilities(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	fake := env.connectAgentWithHello(t, "newer-agent", agentproto.SubprotocolJSON, &agentproto.HelloPayload{
+		ProtocolVersion: agentproto.ProtocolVersion + 1,
+		AgentVersion:    "9.9.9",
+		// binary_codec does not apply to a JSON connection
+		Capabilities: []string{agentproto.CapabilityStreaming, agentproto.CapabilityBinaryCodec, "telepathy", agentproto.CapabilityCompression},
+	}, nameResponder("newer-agent"))
+
+	welcome := nextWelcome(t, fake)
+	assert.Equal(t, agentproto.ProtocolVersion, welcome.ProtocolVersion)
+	assert.Equal(t, []string{agentproto.CapabilityCompression, agentproto.CapabilityStreaming}, welcome.Capabilities)
+
+	conn := connectionOf(t, env, "newer-agent")
+	assert.Equal(t, agentproto.ProtocolVersion, conn.ProtocolVersion())
+	assert.Equal(t, "9.9.9", conn.AgentVersion())
+	assert.Equal(t, welcome.Capabilities, conn.Capabilities())
+	assert.True(t, conn.Supports(agentproto.CapabilityStreaming))
+	assert.False(t, conn.Supports(agentproto.CapabilityBinaryCodec))
+	assert.False(t, conn.Supports(agentproto.CapabilityTCPTunnels))
+
+	assert.Equal(t, "newer-agent", servedBy(t, env, "/api/v1/hello", nil))
+}
+
+func TestHandshakeAdmitsLegacyAgents(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	fake := env.connectAgentWithHello(t, "legacy-agent", "", nil, nameResponder("legacy-agent"))
+
+	conn := connectionOf(t, env, "legacy-agent")
+	assert.Equal(t, agentproto.ProtocolVersionLegacy, conn.ProtocolVersion())
+	assert.Empty(t, conn.Capabilities())
+	assert.Empty(t, fake.welcome)
+
+	assert.Equal(t, "legacy-agent", servedBy(t, env, "/api/v1/legacy", nil))
+}
+
+func TestHandshakeRejectsOldAgents(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	env.manager.SetHandshakePolicy(agent.HandshakePolicy{MinProtocolVersion: agentproto.ProtocolVersion})
+
+	expectRejected(t, env, "old-agent", &agentproto.HelloPayload{ProtocolVersion: agentproto.ProtocolVersionLegacy})
+	// Saying nothing until the timeout makes an agent legacy as well
+	expectRejected(t, env, "silent-agent", nil)
+
+	assert.Empty(t, env.manager.GetCustomerAgents(testCustomerID))
+}
+
+func TestRoutingSkipsAgentsWithoutCapability(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	plain := env.connectAgentWithHello(t, "a-plain-agent", "", &agentproto.HelloPayload{
+		ProtocolVersion: agentproto.ProtocolVersion,
+		Capabilities:    []string{agentproto.CapabilityStreaming},
+	}, acceptTunnel)
+	capable := env.connectAgent(t, "b-tunnel-agent", "", acceptTunnel)
+
+	for i := 0; i < 4; i++ {
+		dialTunnel(t, env, nil).Close()
+		assert.True(t, capable.next(t).Tunnel)
+	}
+	assert.Empty(t, plain.received)
+}
+
+func TestRoutingFailsWithoutCapableAgent(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	legacy := env.connectAgentWithHello(t, "legacy-agent", "", nil, acceptTunnel)
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(env.proxyURL, "http")+"/api/v1/live", nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// A body too large to send inline needs streaming
+	large := bytes.Repeat([]byte("x"), agentproto.MaxInlineBodySize+1)
+	resp, err = http.Post(env.proxyURL+"/api/v1/upload", "application/octet-stream", bytes.NewReader(large))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	assert.Empty(t, legacy.received)
+}
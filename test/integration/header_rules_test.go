@@ -0,0 +1,221 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fetchUpstream makes a GET to the proxy and returns the response and what
+// the recording upstream received
+func fetchUpstream(t *testing.T, target string, header http.Header) (*http.Response, *upstreamRequest) {
+	t.Helper()
+	resp, body := fetch(t, http.MethodGet, target, header)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+
+	var received upstreamRequest
+	require.NoError(t, json.Unmarshal([]byte(body), &received))
+	return resp, &received
+}
+
+func TestDefaultForwardingHeaders(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	env := newDirectEnv(t, upstream.URL, nil)
+
+	_, received := fetchUpstream(t, env.proxyURL+"/api/v1/items", http.Header{
+		"Authorization": {"Bearer client-token"},
+		"X-Agent-Token": {"agent-token"},
+		"X-Custom":      {"kept"},
+	})
+	assert.Equal(t, "127.0.0.1", received.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "127.0.0.1", received.Header.Get("X-Real-IP"))
+	assert.Equal(t, "proxy-service", received.Header.Get("X-Proxy-ID"))
+	assert.Equal(t, "kept", received.Header.Get("X-Custom"))
+
+	// The proxy's credentials never reach the upstream
+	assert.Empty(t, received.Header.Values("Authorization"))
+	assert.Empty(t, received.Header.Values("X-Agent-Token"))
+}
+
+func TestCustomerHeaderRules(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	env := newDirectEnv(t, upstream.URL, nil)
+	env.setProxyConfig(t, &models.ProxyConfig{
+		RoutingMode: service.RoutingModeDirect,
+		TargetURL:   upstream.URL,
+		Headers:     map[string]string{"X-Tenant": "${customer_id}"},
+		HeaderPolicy: &models.HeaderPolicy{
+			Request: []models.HeaderRule{
+				{Action: service.HeaderActionAppend, Name: "X-Trace", Value: "proxy"},
+				{Action: service.HeaderActionRemove, Name: "X-Debug"},
+				{Action: service.HeaderActionRename, Name: "X-Old", To: "X-New"},
+				{Action: service.HeaderActionSet, Name: "X-Correlation-ID", Value: "req-${request_id}"},
+				{Action: service.HeaderActionRemove, Name: "X-Proxy-ID"},
+			},
+			Response: []models.HeaderRule{
+				{Action: service.HeaderActionSet, Name: "X-Request-ID", Value: "${request_id}"},
+				{Action: service.HeaderActionRename, Name: "X-Served-By", To: "X-Origin"},
+			},
+			Strip: []string{"X-Internal"},
+			Keep:  []string{"Authorization"},
+		},
+	})
+
+	resp, received := fetchUpstream(t, env.proxyURL+"/api/v1/items", http.Header{
+		"Authorization":         {"Bearer upstream-token"},
+		"X-Internal":            {"secret"},
+		"X-Trace":               {"client"},
+		"X-Debug":               {"1"},
+		"X-Old":                 {"a", "b"},
+		service.RequestIDHeader: {"request-1"},
+	})
+
+	assert.Equal(t, testCustomerID, received.Header.Get("X-Tenant"))
+	assert.Equal(t, []string{"client", "proxy"}, received.Header.Values("X-Trace"))
+	assert.Empty(t, received.Header.Values("X-Debug"))
+	assert.Empty(t, received.Header.Values("X-Old"))
+	assert.Equal(t, []string{"a", "b"}, received.Header.Values("X-New"))
+	assert.Equal(t, "req-request-1", received.Header.Get("X-Correlation-ID"))
+	assert.Equal(t, "Bearer upstream-token", received.Header.Get("Authorization"))
+	assert.Empty(t, received.Header.Values("X-Internal"))
+	assert.Empty(t, received.Header.Values("X-Proxy-ID"))
+	assert.Equal(t, "127.0.0.1", received.Header.Get("X-Forwarded-For"))
+
+	assert.Equal(t, "request-1", resp.Header.Get(service.RequestIDHeader))
+	assert.Equal(t, "upstream", resp.Header.Get("X-Origin"))
+	assert.Empty(t, resp.Header.Values("X-Served-By"))
+}
+
+func TestRouteHeaderRules(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Headers: http.Header{"Server": {"internal/1.0"}}}
+	})
+	env.setProxyConfig(t, &models.ProxyConfig{HeaderPolicy: &models.HeaderPolicy{
+		Request: []models.HeaderRule{{Action: service.HeaderActionSet, Name: "X-Scope", Value: "customer"}},
+	}})
+	_, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{
+		Routes: []models.RouteConfig{{Path: "/api/v1/admin/**", HeaderPolicy: &models.HeaderPolicy{
+			Request: []models.HeaderRule{
+				{Action: service.HeaderActionSet, Name: "X-Scope", Value: "admin"},
+				{Action: service.HeaderActionSet, Name: "X-Request-ID", Value: "${request_id}"},
+			},
+			Response: []models.HeaderRule{
+				{Action: service.HeaderActionRemove, Name: "Server"},
+				{Action: service.HeaderActionSet, Name: "X-Request-ID", Value: "${request_id}"},
+			},
+		}}},
+	})
+	require.NoError(t, err)
+
+	resp, _ := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+	assert.Equal(t, "internal/1.0", resp.Header.Get("Server"))
+	got := env.agent.next(t)
+	assert.Equal(t, "customer", http.Header(got.Headers).Get("X-Scope"))
+
+	// Route rules run after the customer's, with a request ID made up for
+	// requests that bring none
+	resp, _ = fetch(t, http.MethodGet, env.proxyURL+"/api/v1/admin/users", nil)
+	assert.Empty(t, resp.Header.Values("Server"))
+	got = env.agent.next(t)
+	assert.Equal(t, "admin", http.Header(got.Headers).Get("X-Scope"))
+	requestID := resp.Header.Get(service.RequestIDHeader)
+	assert.NotEmpty(t, requestID)
+	assert.Equal(t, requestID, http.Header(got.Headers).Get(service.RequestIDHeader))
+}
+
+func TestHeaderRulesAreValidated(t *testing.T) {
+	_, configURL := newConfigEnv(t)
+
+	for _, rule := range []models.HeaderRule{
+		{Action: "replace", Name: "X-Scope", Value: "admin"},
+		{Action: service.HeaderActionSet, Name: "X-Scope"},
+		{Action: service.HeaderActionSet, Name: "X Scope", Value: "admin"},
+		{Action: service.HeaderActionSet, Name: "X-Scope", Value: "${user_id}"},
+		{Action: service.HeaderActionSet, Name: "X-Scope", Value: "a\r\nX-Injected: b"},
+		{Action: service.HeaderActionRename, Name: "X-Scope"},
+		{Action: service.HeaderActionRemove, Name: "Content-Length"},
+		{Action: service.HeaderActionRename, Name: "X-Scope", To: "Transfer-Encoding"},
+	} {
+		data, err := json.Marshal(models.AgentConfig{Routes: []models.RouteConfig{{
+			Path:         "/api/v1/**",
+			HeaderPolicy: &models.HeaderPolicy{Response: []models.HeaderRule{rule}},
+		}}})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPut, configURL, bytes.NewReader(data))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, rule)
+	}
+
+	stored := putConfig(t, configURL, &models.AgentConfig{Routes: []models.RouteConfig{{
+		Path: "/api/v1/**",
+		HeaderPolicy: &models.HeaderPolicy{
+			Request: []models.HeaderRule{{Action: service.HeaderActionSet, Name: "X-Tenant", Value: "${customer_id}@${client_ip}"}},
+			Strip:   []string{"Cookie"},
+		},
+	}}})
+	require.Len(t, stored.Routes, 1)
+	require.NotNil(t, stored.Routes[0].HeaderPolicy)
+	assert.Equal(t, "${customer_id}@${client_ip}", stored.Routes[0].HeaderPolicy.Request[0].Value)
+}
+
+func TestManagedHeadersAreNotRewritten(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	env := newDirectEnv(t, upstream.URL, nil)
+
+	// Agent configs set on the manager are not validated
+	_, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{
+		Routes: []models.RouteConfig{{Path: "/api/v1/**", HeaderPolicy: &models.HeaderPolicy{
+			Request: []models.HeaderRule{
+				{Action: service.HeaderActionSet, Name: "X-Forwarded-For", Value: "203.0.113.7"},
+				{Action: service.HeaderActionRename, Name: "X-Spoofed", To: "X-Forwarded-For"},
+				{Action: service.HeaderActionSet, Name: "X-Scope", Value: "route"},
+			},
+			Response: []models.HeaderRule{
+				{Action: service.HeaderActionSet, Name: "Content-Length", Value: "1"},
+			},
+		}}},
+	})
+	require.NoError(t, err)
+
+	resp, received := fetchUpstream(t, env.proxyURL+"/api/v1/items", http.Header{
+		"X-Spoofed": {"198.51.100.2"},
+	})
+	assert.Equal(t, []string{"127.0.0.1"}, received.Header.Values("X-Forwarded-For"))
+	assert.Equal(t, "198.51.100.2", received.Header.Get("X-Spoofed"))
+	assert.Equal(t, "route", received.Header.Get("X-Scope"))
+	assert.NotEqual(t, int64(1), resp.ContentLength)
+}
+
+func TestInvalidProxyConfigHeadersAreRefused(t *testing.T) {
+	for _, proxyConfig := range []*models.ProxyConfig{
+		{Headers: map[string]string{"X-Forwarded-For": "203.0.113.7"}},
+		{Headers: map[string]string{"X-Tenant": "${user_id}"}},
+		{HeaderPolicy: &models.HeaderPolicy{Request: []models.HeaderRule{
+			{Action: service.HeaderActionSet, Name: "Host", Value: "internal"},
+		}}},
+	} {
+		upstream, counter := newCountingUpstream(t)
+		env := newDirectEnv(t, upstream.URL, nil)
+		proxyConfig.RoutingMode = service.RoutingModeDirect
+		proxyConfig.TargetURL = upstream.URL
+		env.setProxyConfig(t, proxyConfig)
+
+		status, _, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+		assert.Equal(t, http.StatusBadGateway, status, proxyConfig)
+		opened, _ := counter.counts()
+		assert.Zero(t, opened, proxyConfig)
+	}
+}
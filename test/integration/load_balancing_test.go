@@ -0,0 +1,179 @@
+package integration
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nameResponder answers with the ID of the agent that served the request
+func nameResponder(agentID string) fakeResponder {
+	return func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Body: []byte(agentID)}
+	}
+}
+
+// servedBy sends a GET with the given headers and returns which agent answered
+func servedBy(t *testing.T, env *proxyEnv, path string, header http.Header) string {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, env.proxyURL+path, nil)
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+	return string(body)
+}
+
+func TestLoadBalancingRoundRobin(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	for _, id := range []string{"agent-a", "agent-b", "agent-c"} {
+		env.connectAgent(t, id, "", nameResponder(id))
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		counts[servedBy(t, env, "/api/v1/rr", nil)]++
+	}
+
+	assert.Equal(t, map[string]int{"agent-a": 3, "agent-b": 3, "agent-c": 3}, counts)
+}
+
+func TestLoadBalancingLeastInFlight(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	env.setProxyConfig(t, &models.ProxyConfig{LoadBalancing: service.StrategyLeastInFlight})
+
+	release := make(chan struct{})
+	defer close(release)
+	responder := func(agentID string) fakeResponder {
+		return func(req *receivedRequest) *fakeResponse {
+			if req.Path == "/api/v1/slow" {
+				<-release
+			}
+			return &fakeResponse{Status: http.StatusOK, Body: []byte(agentID)}
+		}
+	}
+	agentA := env.connectAgent(t, "agent-a", "", responder("agent-a"))
+	agentB := env.connectAgent(t, "agent-b", "", responder("agent-b"))
+
+	go func() {
+		resp, err := http.Get(env.proxyURL + "/api/v1/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	idle := ""
+	select {
+	case <-agentA.received:
+		idle = "agent-b"
+	case <-agentB.received:
+		idle = "agent-a"
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow request was not routed")
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, idle, servedBy(t, env, "/api/v1/fast", nil))
+	}
+}
+
+func TestLoadBalancingLatencyEWMA(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	env.setProxyConfig(t, &models.ProxyConfig{LoadBalancing: service.StrategyLatencyEWMA})
+
+	env.connectAgent(t, "agent-fast", "", nameResponder("agent-fast"))
+	env.connectAgent(t, "agent-slow", "", func(req *receivedRequest) *fakeResponse {
+		time.Sleep(50 * time.Millisecond)
+		return &fakeResponse{Status: http.StatusOK, Body: []byte("agent-slow")}
+	})
+
+	// Until both agents have a latency sample they are weighted equally
+	seen := make(map[string]bool)
+	for !seen["agent-fast"] || !seen["agent-slow"] {
+		seen[servedBy(t, env, "/api/v1/warmup", nil)] = true
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		counts[servedBy(t, env, "/api/v1/ewma", nil)]++
+	}
+
+	assert.Greater(t, counts["agent-fast"], 4*counts["agent-slow"], counts)
+}
+
+func TestLoadBalancingConsistentHash(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	env.setProxyConfig(t, &models.ProxyConfig{
+		LoadBalancing: service.StrategyConsistentHash,
+		HashHeader:    "X-Session",
+	})
+	for _, id := range []string{"agent-a", "agent-b", "agent-c"} {
+		env.connectAgent(t, id, "", nameResponder(id))
+	}
+
+	owners := make(map[string]string)
+	spread := make(map[string]bool)
+	for _, session := range []string{"s1", "s2", "s3", "s4", "s5", "s6", "s7", "s8"} {
+		header := http.Header{"X-Session": {session}}
+		owners[session] = servedBy(t, env, "/api/v1/hash", header)
+		spread[owners[session]] = true
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, owners[session], servedBy(t, env, "/api/v1/hash", header), session)
+		}
+	}
+	assert.Greater(t, len(spread), 1, "all sessions hashed to one agent")
+
+	// Removing an agent only moves the sessions it owned
+	require.NoError(t, env.manager.DeregisterAgent(context.Background(), "agent-a", testCustomerID))
+	for session, owner := range owners {
+		got := servedBy(t, env, "/api/v1/hash", http.Header{"X-Session": {session}})
+		assert.NotEqual(t, "agent-a", got)
+		if owner != "agent-a" {
+			assert.Equal(t, owner, got, session)
+		}
+	}
+
+	// Requests without the header are still served
+	assert.NotEmpty(t, servedBy(t, env, "/api/v1/hash", nil))
+}
+
+func TestRoutingFollowsAgentChanges(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+
+	resp, err := http.Get(env.proxyURL + "/api/v1/none")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+
+	env.connectAgent(t, "agent-a", "", nameResponder("agent-a"))
+	assert.Equal(t, "agent-a", servedBy(t, env, "/api/v1/one", nil))
+
+	env.connectAgent(t, "agent-b", "", nameResponder("agent-b"))
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[servedBy(t, env, "/api/v1/two", nil)] = true
+	}
+	assert.Equal(t, map[string]bool{"agent-a": true, "agent-b": true}, seen)
+
+	require.NoError(t, env.manager.DeregisterAgent(context.Background(), "agent-a", testCustomerID))
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "agent-b", servedBy(t, env, "/api/v1/after", nil))
+	}
+}
@@ -0,0 +1,362 @@
+package integration
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/agentclient"
+	"proxy-service/pkg/agentproto"
+	"proxy-service/pkg/cache"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a CA agent certificates chain to
+type testCA struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{certificate: certificate, key: key}
+}
+
+// issue signs a client certificate naming the agent in its subject only
+func (ca *testCA) issue(t *testing.T, agentID, customerID string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: agentID, Organization: []string{customerID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, key.Public(), ca.key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// mtlsEnv serves the agent endpoint over TLS, asking agents for a client
+// certificate of the test CA
+type mtlsEnv struct {
+	*proxyEnv
+	ca        *testCA
+	authority *agent.CertificateAuthority
+	// apiURL is the base of the agent API over TLS
+	apiURL  string
+	roots   *x509.CertPool
+	handler http.Handler
+}
+
+func newMTLSEnv(t *testing.T, policy agent.CertificatePolicy) *mtlsEnv {
+	t.Helper()
+	env := &mtlsEnv{ca: newTestCA(t, "agent CA")}
+	env.proxyEnv = newProxyEnvWithEndpoint(t, func(manager *agent.AgentManager, redisCache *cache.RedisCache) http.Handler {
+		env.authority = agent.NewCertificateAuthority(env.ca.certificate, env.ca.key, redisCache, policy)
+		manager.SetCertificateAuthority(env.authority)
+
+		handler := newTestAgentHandler(manager, redisCache)
+		router := gin.New()
+		router.GET("/api/v1/agents/connect", handler.HandleConnection)
+		router.POST("/api/v1/agents/certificates", handler.HandleSignCertificate)
+		api := router.Group("/api/v1/agents", func(c *gin.Context) {
+			c.Set("customer_id", testCustomerID)
+		})
+		api.POST("/certificates/bootstrap", handler.HandleIssueBootstrapToken)
+		api.DELETE("/certificates", handler.HandleRevokeCertificate)
+		env.handler = router
+		return router
+	})
+
+	server := httptest.NewUnstartedServer(env.handler)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  env.authority.Pool(),
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	env.roots = x509.NewCertPool()
+	env.roots.AddCert(server.Certificate())
+	env.agentURL = "wss" + strings.TrimPrefix(server.URL, "https")
+	env.apiURL = server.URL + "/api/v1/agents"
+	return env
+}
+
+// httpClient trusts the test server and presents the given certificates
+func (env *mtlsEnv) httpClient(certificates ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: env.tlsConfig(certificates...)}}
+}
+
+func (env *mtlsEnv) tlsConfig(certificates ...tls.Certificate) *tls.Config {
+	return &tls.Config{RootCAs: env.roots, Certificates: certificates}
+}
+
+func (env *mtlsEnv) bootstrapToken(t *testing.T, agentID string) string {
+	t.Helper()
+	resp, err := env.httpClient().Post(env.apiURL+"/certificates/bootstrap?agent_id="+agentID, "application/json", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var issued struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&issued))
+	require.NotEmpty(t, issued.Token)
+	return issued.Token
+}
+
+// enroll redeems a bootstrap token for a certificate signed by the proxy
+func (env *mtlsEnv) enroll(t *testing.T, agentID string) tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM, err := agentclient.RequestCertificate(context.Background(), env.httpClient(), env.apiURL+"/certificates", env.bootstrapToken(t, agentID))
+	require.NoError(t, err)
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	return certificate
+}
+
+// dial connects with a certificate and the given headers, which may be
+// empty, and returns the status the endpoint answered with
+func (env *mtlsEnv) dial(t *testing.T, header http.Header, certificates ...tls.Certificate) (*websocket.Conn, int) {
+	t.Helper()
+	dialer := websocket.Dialer{TLSClientConfig: env.tlsConfig(certificates...), HandshakeTimeout: 5 * time.Second}
+	conn, resp, err := dialer.Dial(env.agentURL+"/api/v1/agents/connect", header)
+	if err != nil {
+		require.NotNil(t, resp, "dial failed: %v", err)
+		return nil, resp.StatusCode
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, http.StatusSwitchingProtocols
+}
+
+func TestAgentEnrollsAndConnectsWithCertificate(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{CertificateTTL: time.Hour})
+	certificate := env.enroll(t, testAgentID)
+	assert.Equal(t, testAgentID, certificate.Leaf.Subject.CommonName)
+	require.Len(t, certificate.Leaf.URIs, 1)
+	assert.Equal(t, "agent://"+testCustomerID+"/"+testAgentID, certificate.Leaf.URIs[0].String())
+	assert.WithinDuration(t, time.Now().Add(time.Hour), certificate.Leaf.NotAfter, time.Minute)
+
+	upstream := newEchoUpstream(t)
+	client, err := agentclient.New(agentclient.Config{
+		ServerURL:  env.agentURL + "/api/v1/agents/connect",
+		AgentID:    testAgentID,
+		CustomerID: testCustomerID,
+		Upstream:   upstream.URL,
+		TLSConfig:  env.tlsConfig(certificate),
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	waitForAgent(t, env.proxyEnv, testAgentID)
+
+	resp, err := http.Get(env.proxyURL + "/api/v1/hello")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestBootstrapTokenIsSingleUse(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{})
+	token := env.bootstrapToken(t, testAgentID)
+
+	_, _, err := agentclient.RequestCertificate(context.Background(), env.httpClient(), env.apiURL+"/certificates", token)
+	require.NoError(t, err)
+	_, _, err = agentclient.RequestCertificate(context.Background(), env.httpClient(), env.apiURL+"/certificates", token)
+	assert.ErrorContains(t, err, "status 401")
+}
+
+func TestAgentRenewsCertificateWithCurrentOne(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{})
+	current := env.enroll(t, testAgentID)
+
+	// Without a certificate or token there is nothing to renew
+	_, _, err := agentclient.RequestCertificate(context.Background(), env.httpClient(), env.apiURL+"/certificates", "")
+	assert.ErrorContains(t, err, "status 401")
+
+	certPEM, keyPEM, err := agentclient.RequestCertificate(context.Background(), env.httpClient(current), env.apiURL+"/certificates", "")
+	require.NoError(t, err)
+	source, err := agentclient.NewCertificateSource(certPEM, keyPEM)
+	require.NoError(t, err)
+	renewed, err := source.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, current.Leaf.SerialNumber, renewed.Leaf.SerialNumber)
+	assert.Equal(t, testAgentID, renewed.Leaf.Subject.CommonName)
+}
+
+func TestCertificateFromExternalIssuerNamesAgentInSubject(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{})
+
+	conn, status := env.dial(t, nil, env.ca.issue(t, testAgentID, testCustomerID))
+	require.NotNil(t, conn, "status %d", status)
+	waitForAgent(t, env.proxyEnv, testAgentID)
+}
+
+func TestCertificateMustMatchAgentHeaders(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{})
+
+	_, status := env.dial(t, http.Header{"X-Agent-ID": {"agent-2"}, "X-Customer-ID": {testCustomerID}}, env.ca.issue(t, testAgentID, testCustomerID))
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestCertificateWithInvalidTokenIsRefused(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{})
+
+	_, status := env.dial(t, http.Header{"X-Agent-Token": {"1.bad"}}, env.ca.issue(t, testAgentID, testCustomerID))
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestCertificateOfUnknownCAIsRefused(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{})
+	other := newTestCA(t, "other CA")
+
+	dialer := websocket.Dialer{TLSClientConfig: env.tlsConfig(other.issue(t, testAgentID, testCustomerID)), HandshakeTimeout: 5 * time.Second}
+	_, _, err := dialer.Dial(env.agentURL+"/api/v1/agents/connect", nil)
+	assert.Error(t, err)
+	assert.Empty(t, env.manager.GetAgentStatus(testAgentID))
+}
+
+func TestRevokedCertificateIsRefused(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{})
+	certificate := env.enroll(t, testAgentID)
+	serial := certificate.Leaf.SerialNumber.Text(16)
+
+	revoke := func(serial string) int {
+		req, err := http.NewRequest(http.MethodDelete, env.apiURL+"/certificates?serial="+serial, nil)
+		require.NoError(t, err)
+		resp, err := env.httpClient().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNotFound, revoke("abc"))
+	assert.Equal(t, http.StatusOK, revoke(serial))
+
+	_, status := env.dial(t, nil, certificate)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// A revoked certificate cannot be renewed either
+	_, _, err := agentclient.RequestCertificate(context.Background(), env.httpClient(certificate), env.apiURL+"/certificates", "")
+	assert.ErrorContains(t, err, "status 401")
+}
+
+func TestRevokingCertificateClosesSession(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{})
+	certificate := env.enroll(t, testAgentID)
+	other := env.enroll(t, "agent-2")
+
+	conn, status := env.dial(t, nil, certificate)
+	require.NotNil(t, conn, "status %d", status)
+	kept, status := env.dial(t, nil, other)
+	require.NotNil(t, kept, "status %d", status)
+
+	req, err := http.NewRequest(http.MethodDelete, env.apiURL+"/certificates?serial="+certificate.Leaf.SerialNumber.Text(16), nil)
+	require.NoError(t, err)
+	resp, err := env.httpClient().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, websocket.ClosePolicyViolation, waitForClose(t, conn))
+	assert.NotEmpty(t, env.manager.GetAgentStatus("agent-2"))
+
+	// A revocation made elsewhere arrives through Redis
+	require.NoError(t, env.authority.Revoke(context.Background(), testCustomerID, other.Leaf.SerialNumber.Text(16)))
+	assert.Equal(t, websocket.ClosePolicyViolation, waitForClose(t, kept))
+}
+
+func TestCRLRevokesCertificate(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{})
+	revoked := env.ca.issue(t, testAgentID, testCustomerID)
+	kept := env.ca.issue(t, "agent-2", testCustomerID)
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: revoked.Leaf.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, env.ca.certificate, env.ca.key)
+	require.NoError(t, err)
+	require.NoError(t, env.authority.LoadCRL(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})))
+
+	_, status := env.dial(t, nil, revoked)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	conn, status := env.dial(t, nil, kept)
+	require.NotNil(t, conn, "status %d", status)
+
+	// A CRL signed by anyone else is refused
+	other := newTestCA(t, "other CA")
+	forged, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(2),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, other.certificate, other.key)
+	require.NoError(t, err)
+	assert.Error(t, env.authority.LoadCRL(forged))
+}
+
+func TestRequiredCertificateRefusesTokens(t *testing.T) {
+	env := newMTLSEnv(t, agent.CertificatePolicy{Required: true})
+
+	_, status := env.dial(t, http.Header{
+		"X-Agent-ID":    {testAgentID},
+		"X-Customer-ID": {testCustomerID},
+		"X-Agent-Token": {agentproto.SignToken(testAgentID, testCustomerID, testAPIKey, time.Now())},
+	})
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
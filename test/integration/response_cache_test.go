@@ -0,0 +1,472 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"proxy-service/internal/handler"
+	"proxy-service/internal/middleware"
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// versionedUpstream answers with the number of requests it has seen, as
+// version "v<n>", and the headers set by its test
+type versionedUpstream struct {
+	*httptest.Server
+	requests atomic.Int32
+	received chan http.Header
+	headers  atomic.Value // func(version int32) http.Header
+	status   atomic.Int32
+}
+
+func newVersionedUpstream(t *testing.T, headers func(version int32) http.Header) *versionedUpstream {
+	t.Helper()
+	upstream := &versionedUpstream{received: make(chan http.Header, 100)}
+	upstream.headers.Store(headers)
+	upstream.status.Store(http.StatusOK)
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := upstream.requests.Add(1)
+		upstream.received <- r.Header.Clone()
+		for name, values := range upstream.headers.Load().(func(int32) http.Header)(version) {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+		if etag := w.Header().Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(int(upstream.status.Load()))
+		fmt.Fprintf(w, "v%d", version)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func (u *versionedUpstream) respond(headers func(version int32) http.Header) {
+	u.headers.Store(headers)
+}
+
+func cacheControl(value string) func(int32) http.Header {
+	return func(int32) http.Header {
+		return http.Header{"Cache-Control": {value}}
+	}
+}
+
+// newCacheEnv routes the test customer directly to upstream with caching on
+func newCacheEnv(t *testing.T, upstream *versionedUpstream, proxyConfig *models.ProxyConfig) *proxyEnv {
+	t.Helper()
+	env := newDirectEnv(t, upstream.URL, nil)
+	proxyConfig.RoutingMode = service.RoutingModeDirect
+	proxyConfig.TargetURL = upstream.URL
+	env.setProxyConfig(t, proxyConfig)
+	return env
+}
+
+// fetch makes a request to the proxy and returns its response with the
+// body read
+func fetch(t *testing.T, method, target string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, target, nil)
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestResponseCacheHit(t *testing.T) {
+	upstream := newVersionedUpstream(t, cacheControl("max-age=60"))
+	env := newCacheEnv(t, upstream, &models.ProxyConfig{CacheEnabled: true})
+
+	resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items?a=1&b=2", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, service.CacheMiss, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "v1", body)
+
+	// The order of query parameters does not matter
+	resp, body = fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items?b=2&a=1", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, service.CacheHit, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, "max-age=60", resp.Header.Get("Cache-Control"))
+	assert.NotEmpty(t, resp.Header.Get("Age"))
+
+	// HEAD is answered from the stored GET
+	resp, body = fetch(t, http.MethodHead, env.proxyURL+"/api/v1/items?a=1&b=2", nil)
+	assert.Equal(t, service.CacheHit, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "2", resp.Header.Get("Content-Length"))
+	assert.Empty(t, body)
+
+	// Other queries, paths and methods are not
+	resp, body = fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items?a=2", nil)
+	assert.Equal(t, service.CacheMiss, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "v2", body)
+	resp, _ = fetch(t, http.MethodPost, env.proxyURL+"/api/v1/items?a=1&b=2", nil)
+	assert.Equal(t, service.CacheBypass, resp.Header.Get(service.CacheHeader))
+
+	assert.EqualValues(t, 3, upstream.requests.Load())
+}
+
+func TestResponseCacheIsOffByDefault(t *testing.T) {
+	upstream := newVersionedUpstream(t, cacheControl("max-age=60"))
+	env := newCacheEnv(t, upstream, &models.ProxyConfig{})
+
+	for i := 1; i <= 2; i++ {
+		resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+		assert.Empty(t, resp.Header.Get(service.CacheHeader))
+		assert.Equal(t, fmt.Sprintf("v%d", i), body)
+	}
+}
+
+func TestRouteCacheSettings(t *testing.T) {
+	// Without freshness of its own a response is fresh for the route's TTL
+	upstream := newVersionedUpstream(t, func(int32) http.Header { return http.Header{} })
+	env := newCacheEnv(t, upstream, &models.ProxyConfig{})
+	enabled := true
+	_, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{
+		Routes: []models.RouteConfig{{Path: "/api/v1/static/**", CacheEnabled: &enabled, CacheTTL: time.Minute}},
+	})
+	require.NoError(t, err)
+
+	resp, _ := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/static/app.js", nil)
+	assert.Equal(t, service.CacheMiss, resp.Header.Get(service.CacheHeader))
+	resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/static/app.js", nil)
+	assert.Equal(t, service.CacheHit, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "v1", body)
+
+	resp, _ = fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+	assert.Empty(t, resp.Header.Get(service.CacheHeader))
+}
+
+func TestRouteDisablesCache(t *testing.T) {
+	upstream := newVersionedUpstream(t, cacheControl("max-age=60"))
+	env := newCacheEnv(t, upstream, &models.ProxyConfig{CacheEnabled: true})
+	disabled := false
+	_, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{
+		Routes: []models.RouteConfig{
+			{Path: "/api/v1/live/**", CacheEnabled: &disabled},
+			{Path: "/api/v1/static/**", CacheTTL: time.Minute},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, version := range []string{"v1", "v2"} {
+		resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/live/prices", nil)
+		assert.Empty(t, resp.Header.Get(service.CacheHeader))
+		assert.Equal(t, version, body)
+	}
+
+	// Routes that leave caching alone keep the customer's default
+	fetch(t, http.MethodGet, env.proxyURL+"/api/v1/static/app.js", nil)
+	resp, _ := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/static/app.js", nil)
+	assert.Equal(t, service.CacheHit, resp.Header.Get(service.CacheHeader))
+}
+
+func TestResponseCacheRespectsCacheControl(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  http.Header
+		request  http.Header
+		expected string // of the second request
+	}{
+		{name: "max-age", headers: http.Header{"Cache-Control": {"public, max-age=60"}}, expected: service.CacheHit},
+		{name: "no freshness", headers: http.Header{}, expected: service.CacheMiss},
+		{name: "no-store", headers: http.Header{"Cache-Control": {"no-store, max-age=60"}}, expected: service.CacheMiss},
+		{
+			name:     "request no-store",
+			headers:  http.Header{"Cache-Control": {"max-age=60"}},
+			request:  http.Header{"Cache-Control": {"no-store"}},
+			expected: service.CacheBypass,
+		},
+		{
+			name:     "request max-age",
+			headers:  http.Header{"Cache-Control": {"max-age=60"}},
+			request:  http.Header{"Cache-Control": {"max-age=0"}},
+			expected: service.CacheMiss,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newVersionedUpstream(t, func(int32) http.Header { return tt.headers })
+			env := newCacheEnv(t, upstream, &models.ProxyConfig{CacheEnabled: true})
+
+			fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+			resp, _ := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", tt.request)
+			assert.Equal(t, tt.expected, resp.Header.Get(service.CacheHeader))
+		})
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	upstream := newVersionedUpstream(t, func(int32) http.Header {
+		return http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}
+	})
+	env := newCacheEnv(t, upstream, &models.ProxyConfig{CacheEnabled: true, CacheVary: []string{"x-tenant"}})
+
+	get := func(tenant, language string) (string, string) {
+		resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", http.Header{
+			"X-Tenant":        {tenant},
+			"Accept-Language": {language},
+		})
+		return resp.Header.Get(service.CacheHeader), body
+	}
+
+	status, body := get("a", "en")
+	assert.Equal(t, service.CacheMiss, status)
+	assert.Equal(t, "v1", body)
+	status, body = get("a", "en")
+	assert.Equal(t, service.CacheHit, status)
+	assert.Equal(t, "v1", body)
+
+	// The configured header is part of the key
+	status, body = get("b", "en")
+	assert.Equal(t, service.CacheMiss, status)
+	assert.Equal(t, "v2", body)
+	status, _ = get("a", "en")
+	assert.Equal(t, service.CacheHit, status)
+
+	// The response's Vary header has the last response win
+	status, body = get("a", "de")
+	assert.Equal(t, service.CacheMiss, status)
+	assert.Equal(t, "v3", body)
+	status, body = get("a", "de")
+	assert.Equal(t, service.CacheHit, status)
+	assert.Equal(t, "v3", body)
+}
+
+func TestResponseCacheRevalidation(t *testing.T) {
+	upstream := newVersionedUpstream(t, func(int32) http.Header {
+		return http.Header{"Cache-Control": {"no-cache"}, "ETag": {`"one"`}}
+	})
+	env := newCacheEnv(t, upstream, &models.ProxyConfig{CacheEnabled: true})
+
+	resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+	assert.Equal(t, service.CacheMiss, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "v1", body)
+	<-upstream.received
+
+	// no-cache responses are checked with the upstream every time
+	resp, body = fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, service.CacheRevalidated, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, `"one"`, (<-upstream.received).Get("If-None-Match"))
+
+	// Clients that have the response get a 304
+	resp, body = fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", http.Header{"If-None-Match": {`W/"one"`}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, `"one"`, resp.Header.Get("ETag"))
+	assert.Empty(t, body)
+	<-upstream.received
+
+	// A changed response replaces the stored one
+	upstream.respond(func(int32) http.Header {
+		return http.Header{"Cache-Control": {"no-cache"}, "ETag": {`"two"`}}
+	})
+	resp, body = fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+	assert.Equal(t, service.CacheMiss, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "v4", body)
+	resp, body = fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+	assert.Equal(t, service.CacheRevalidated, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "v4", body)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	upstream := newVersionedUpstream(t, cacheControl("max-age=0, stale-while-revalidate=60"))
+	env := newCacheEnv(t, upstream, &models.ProxyConfig{CacheEnabled: true})
+
+	_, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+	assert.Equal(t, "v1", body)
+
+	// The stale response is served at once and refreshed behind it
+	resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+	assert.Equal(t, service.CacheStale, resp.Header.Get(service.CacheHeader))
+	assert.Equal(t, "v1", body)
+
+	require.Eventually(t, func() bool {
+		_, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+		return body != "v1"
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestStaleIfError(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		config       *models.ProxyConfig
+		stale        bool
+	}{
+		{name: "directive", cacheControl: "max-age=0, stale-if-error=60", config: &models.ProxyConfig{CacheEnabled: true}, stale: true},
+		{name: "configured", cacheControl: "max-age=0", config: &models.ProxyConfig{CacheEnabled: true, CacheStaleTTL: 60}, stale: true},
+		{name: "must-revalidate", cacheControl: "max-age=0, must-revalidate", config: &models.ProxyConfig{CacheEnabled: true, CacheStaleTTL: 60}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newVersionedUpstream(t, cacheControl(tt.cacheControl))
+			env := newCacheEnv(t, upstream, tt.config)
+
+			_, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+			require.Equal(t, "v1", body)
+
+			// The upstream fails
+			upstream.status.Store(http.StatusServiceUnavailable)
+			resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+			if tt.stale {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, service.CacheStale, resp.Header.Get(service.CacheHeader))
+				assert.Equal(t, "v1", body)
+			} else {
+				assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+			}
+
+			// The upstream is gone
+			upstream.Close()
+			resp, body = fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+			if tt.stale {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, "v1", body)
+			} else {
+				assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestResponseCacheInFrontOfAgents(t *testing.T) {
+	var requests atomic.Int32
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		requests.Add(1)
+		return &fakeResponse{
+			Status:  http.StatusOK,
+			Headers: http.Header{"Cache-Control": {"max-age=60"}, "Cache-Tag": {"items"}},
+			Body:    []byte("from agent"),
+		}
+	})
+	env.setProxyConfig(t, &models.ProxyConfig{CacheEnabled: true})
+
+	for _, expected := range []string{service.CacheMiss, service.CacheHit} {
+		resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/items", nil)
+		assert.Equal(t, expected, resp.Header.Get(service.CacheHeader))
+		assert.Equal(t, "from agent", body)
+		assert.Empty(t, resp.Header.Get("Cache-Tag"))
+	}
+	assert.EqualValues(t, 1, requests.Load())
+}
+
+// newPurgeEndpoint serves the admin purge endpoint guarded by token
+func newPurgeEndpoint(t *testing.T, env *proxyEnv, token string) string {
+	t.Helper()
+	router := gin.New()
+	admin := router.Group("/admin/v1", middleware.AdminToken(token))
+	admin.POST("/cache/purge", handler.NewCacheHandler(env.proxy).HandlePurge)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server.URL + "/admin/v1/cache/purge"
+}
+
+func purge(t *testing.T, url, token string, request any) (int, int64) {
+	t.Helper()
+	data, err := json.Marshal(request)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var result struct {
+		Purged int64 `json:"purged"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result.Purged
+}
+
+func TestPurgeResponses(t *testing.T) {
+	upstream := newVersionedUpstream(t, cacheControl("max-age=60"))
+	env := newCacheEnv(t, upstream, &models.ProxyConfig{CacheEnabled: true})
+	purgeURL := newPurgeEndpoint(t, env, "operator-secret")
+
+	paths := []string{"/api/v1/users/1", "/api/v1/users/2", "/api/v1/orders/1"}
+	upstream.respond(func(int32) http.Header {
+		return http.Header{"Cache-Control": {"max-age=60"}, "Surrogate-Key": {"all orders"}}
+	})
+	cached := func() []string {
+		var statuses []string
+		for _, path := range paths {
+			resp, _ := fetch(t, http.MethodGet, env.proxyURL+path, nil)
+			statuses = append(statuses, resp.Header.Get(service.CacheHeader))
+		}
+		return statuses
+	}
+	cached()
+	hit, miss := service.CacheHit, service.CacheMiss
+
+	status, _ := purge(t, purgeURL, "wrong", map[string]any{"customer_id": testCustomerID})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = purge(t, purgeURL, "operator-secret", map[string]any{"path_prefix": "/api/v1"})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// By tag
+	status, purged := purge(t, purgeURL, "operator-secret", map[string]any{"customer_id": testCustomerID, "tags": []string{"orders"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 3, purged)
+	assert.Equal(t, []string{miss, miss, miss}, cached())
+	assert.Equal(t, []string{hit, hit, hit}, cached())
+
+	// By path prefix
+	_, purged = purge(t, purgeURL, "operator-secret", map[string]any{"customer_id": testCustomerID, "path_prefix": "/api/v1/users/"})
+	assert.EqualValues(t, 2, purged)
+	assert.Equal(t, []string{miss, miss, hit}, cached())
+
+	// Other customers keep theirs
+	_, purged = purge(t, purgeURL, "operator-secret", map[string]any{"customer_id": "other-customer"})
+	assert.EqualValues(t, 0, purged)
+	assert.Equal(t, []string{hit, hit, hit}, cached())
+
+	// Everything of the customer
+	_, purged = purge(t, purgeURL, "operator-secret", map[string]any{"customer_id": testCustomerID})
+	assert.EqualValues(t, 3, purged)
+	assert.Equal(t, []string{miss, miss, miss}, cached())
+}
+
+func TestResponseCacheBodyLimit(t *testing.T) {
+	large := strings.Repeat("x", service.MaxCachedBodySize+1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(large))
+	}))
+	t.Cleanup(upstream.Close)
+	env := newDirectEnv(t, upstream.URL, nil)
+	env.setProxyConfig(t, &models.ProxyConfig{RoutingMode: service.RoutingModeDirect, TargetURL: upstream.URL, CacheEnabled: true})
+
+	for i := 0; i < 2; i++ {
+		resp, body := fetch(t, http.MethodGet, env.proxyURL+"/api/v1/large", nil)
+		assert.Equal(t, service.CacheMiss, resp.Header.Get(service.CacheHeader))
+		assert.Len(t, body, len(large))
+	}
+}
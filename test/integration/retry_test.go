@@ -0,0 +1,200 @@
+package integration
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyUpstream fails the first failures requests with a 503 and records
+// the bodies it received
+type flakyUpstream struct {
+	*httptest.Server
+	failures atomic.Int32
+	requests atomic.Int32
+	bodies   chan string
+}
+
+func newFlakyUpstream(t *testing.T, failures int32) *flakyUpstream {
+	t.Helper()
+	upstream := &flakyUpstream{bodies: make(chan string, 100)}
+	upstream.failures.Store(failures)
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstream.bodies <- string(body)
+		if upstream.requests.Add(1) <= upstream.failures.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// newRetryEnv routes the test customer directly to target, retrying with a
+// short backoff
+func newRetryEnv(t *testing.T, target string, proxyConfig *models.ProxyConfig) *proxyEnv {
+	t.Helper()
+	env := newDirectEnv(t, target, nil)
+	proxyConfig.RoutingMode = service.RoutingModeDirect
+	proxyConfig.TargetURL = target
+	env.setProxyConfig(t, proxyConfig)
+	setRetryDelay(t, env, time.Millisecond)
+	return env
+}
+
+func setRetryDelay(t *testing.T, env *proxyEnv, delay time.Duration) {
+	t.Helper()
+	_, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{RetryDelay: delay})
+	require.NoError(t, err)
+}
+
+// request sends a request to the proxy and returns its status, retries
+// header and body
+func request(t *testing.T, method, target, body string, header http.Header) (int, string, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, resp.Header.Get(service.RetriesHeader), string(data)
+}
+
+func TestRetriesIdempotentRequests(t *testing.T) {
+	upstream := newFlakyUpstream(t, 2)
+	env := newRetryEnv(t, upstream.URL, &models.ProxyConfig{RetryCount: 3})
+
+	status, retries, body := request(t, http.MethodPut, env.proxyURL+"/api/v1/items/1", "item", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "2", retries)
+	assert.Equal(t, "ok", body)
+
+	// Every attempt carried the body
+	require.EqualValues(t, 3, upstream.requests.Load())
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "item", <-upstream.bodies)
+	}
+
+	// Requests that succeed at once carry no retries
+	status, retries, _ = request(t, http.MethodGet, env.proxyURL+"/api/v1/items/1", "", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, retries)
+}
+
+func TestRetriesAreExhausted(t *testing.T) {
+	upstream := newFlakyUpstream(t, 100)
+	env := newRetryEnv(t, upstream.URL, &models.ProxyConfig{RetryCount: 2})
+
+	status, retries, _ := request(t, http.MethodGet, env.proxyURL+"/api/v1/items", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "2", retries)
+	assert.EqualValues(t, 3, upstream.requests.Load())
+
+	// Requests that never got a response are retried too
+	upstream.Close()
+	status, retries, _ = request(t, http.MethodGet, env.proxyURL+"/api/v1/items", "", nil)
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, "2", retries)
+}
+
+func TestPostRetriesNeedIdempotencyKey(t *testing.T) {
+	upstream := newFlakyUpstream(t, 1)
+	env := newRetryEnv(t, upstream.URL, &models.ProxyConfig{RetryCount: 1})
+
+	status, retries, _ := request(t, http.MethodPost, env.proxyURL+"/api/v1/orders", "order", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Empty(t, retries)
+	assert.EqualValues(t, 1, upstream.requests.Load())
+
+	upstream.failures.Store(2)
+	status, retries, _ = request(t, http.MethodPost, env.proxyURL+"/api/v1/orders", "order",
+		http.Header{service.IdempotencyKeyHeader: {"order-1"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "1", retries)
+	assert.EqualValues(t, 3, upstream.requests.Load())
+}
+
+func TestRetriesFromAgentConfig(t *testing.T) {
+	upstream := newFlakyUpstream(t, 1)
+	env := newRetryEnv(t, upstream.URL, &models.ProxyConfig{})
+
+	// The built-in default configuration does not retry
+	_, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{RetryAttempts: 1, RetryDelay: time.Millisecond})
+	require.NoError(t, err)
+
+	status, retries, _ := request(t, http.MethodGet, env.proxyURL+"/api/v1/items", "", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "1", retries)
+}
+
+func TestRetryBudget(t *testing.T) {
+	upstream := newFlakyUpstream(t, 1000)
+	env := newRetryEnv(t, upstream.URL, &models.ProxyConfig{RetryCount: 5})
+
+	// A full budget pays for two requests' retries, after which requests
+	// only earn a fraction of one
+	expected := []string{"5", "5", "", "", ""}
+	for i, want := range expected {
+		status, retries, _ := request(t, http.MethodGet, env.proxyURL+"/api/v1/items", "", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, want, retries, "request %d", i)
+	}
+	assert.EqualValues(t, len(expected)+2*5, upstream.requests.Load())
+}
+
+func TestRetryOnAnotherAgent(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	failing := env.connectAgent(t, "agent-a", "", func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusBadGateway, Body: []byte("agent-a")}
+	})
+	env.connectAgent(t, "agent-b", "", nameResponder("agent-b"))
+	setRetryDelay(t, env, time.Millisecond)
+
+	// Find a key the failing agent is picked for
+	env.setProxyConfig(t, &models.ProxyConfig{LoadBalancing: service.StrategyConsistentHash, HashHeader: "X-Key"})
+	key := ""
+	for i := 0; i < 50 && key == ""; i++ {
+		candidate := strings.Repeat("k", i+1)
+		if status, _, _ := request(t, http.MethodGet, env.proxyURL+"/api/v1/items", "", http.Header{"X-Key": {candidate}}); status == http.StatusBadGateway {
+			key = candidate
+		}
+	}
+	require.NotEmpty(t, key)
+	header := http.Header{"X-Key": {key}}
+
+	// Retries stick with the agent the key hashes to
+	env.setProxyConfig(t, &models.ProxyConfig{LoadBalancing: service.StrategyConsistentHash, HashHeader: "X-Key", RetryCount: 1})
+	for len(failing.received) > 0 {
+		<-failing.received
+	}
+	status, retries, _ := request(t, http.MethodGet, env.proxyURL+"/api/v1/items", "", header)
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, "1", retries)
+	assert.Len(t, failing.received, 2)
+
+	// Unless they are sent to another one
+	env.setProxyConfig(t, &models.ProxyConfig{LoadBalancing: service.StrategyConsistentHash, HashHeader: "X-Key", RetryCount: 1, RetryOtherAgent: true})
+	status, retries, body := request(t, http.MethodGet, env.proxyURL+"/api/v1/items", "", header)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "1", retries)
+	assert.Equal(t, "agent-b", body)
+}
@@ -0,0 +1,302 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+	"proxy-service/pkg/cloudflare"
+	"proxy-service/pkg/logger"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstreamRequest is what a direct upstream received
+type upstreamRequest struct {
+	Method  string
+	Host    string
+	RawPath string
+	Query   string
+	Header  http.Header
+	Body    string
+}
+
+// newRecordingUpstream answers 201 with the request it received
+func newRecordingUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Served-By", "upstream")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(upstreamRequest{
+			Method:  r.Method,
+			Host:    r.Host,
+			RawPath: r.URL.EscapedPath(),
+			Query:   r.URL.RawQuery,
+			Header:  r.Header,
+			Body:    string(body),
+		})
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// send makes a request to the proxy and returns the status, the header
+// telling who served it and, for the upstream, what it received
+func send(t *testing.T, method, target string, body string) (int, string, *upstreamRequest) {
+	t.Helper()
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	require.NoError(t, err)
+	if body == "" {
+		req.Body = http.NoBody
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	servedBy := resp.Header.Get("X-Served-By")
+	if servedBy != "upstream" {
+		return resp.StatusCode, servedBy, nil
+	}
+	var received upstreamRequest
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&received))
+	return resp.StatusCode, servedBy, &received
+}
+
+// startEdge starts a tunnel client against a stand-in for the Cloudflare
+// edge that accepts the tunnel and its heartbeats
+func startEdge(t *testing.T) *cloudflare.TunnelClient {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(edge.Close)
+
+	tunnel := cloudflare.NewTunnelClient(cloudflare.TunnelConfig{
+		ID:                "tunnel-1",
+		Token:             "tunnel-token",
+		TargetURL:         "ws" + strings.TrimPrefix(edge.URL, "http"),
+		HeartbeatInterval: time.Hour,
+	}, logger.NewLogger())
+	require.NoError(t, tunnel.Start(context.Background()))
+	t.Cleanup(func() { tunnel.Stop() })
+	return tunnel
+}
+
+func TestDirectRoutingMode(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	upstream := newRecordingUpstream(t)
+	env.setProxyConfig(t, &models.ProxyConfig{
+		RoutingMode: service.RoutingModeDirect,
+		TargetURL:   upstream.URL + "/base?key=value",
+	})
+
+	req, err := http.NewRequest(http.MethodGet, env.proxyURL+"/api/v1/items/a%2Fb?x=1&x=2", nil)
+	require.NoError(t, err)
+	req.Header.Set(service.AgentSelectorHeader, "region=eu")
+	req.Header.Set("X-Test", "kept")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var received upstreamRequest
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&received))
+	assert.Equal(t, "/base/api/v1/items/a%2Fb", received.RawPath)
+
+	// The path is passed on as it came, not cleaned
+	_, _, raw := send(t, http.MethodGet, env.proxyURL+"/api/v1/a//b/../c%2Fd", "")
+	assert.Equal(t, "/base/api/v1/a//b/../c%2Fd", raw.RawPath)
+	assert.Equal(t, "key=value&x=1&x=2", received.Query)
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), received.Host)
+	assert.Equal(t, "kept", received.Header.Get("X-Test"))
+	assert.Empty(t, received.Header.Get(service.AgentSelectorHeader))
+
+	status, _, posted := send(t, http.MethodPost, env.proxyURL+"/api/v1/items", `{"name":"item"}`)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, http.MethodPost, posted.Method)
+	assert.Equal(t, `{"name":"item"}`, posted.Body)
+}
+
+func TestDirectRoutingModeWithoutTarget(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	env.setProxyConfig(t, &models.ProxyConfig{RoutingMode: service.RoutingModeDirect})
+
+	status, _, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestRouteRoutingModeOverride(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Headers: http.Header{"X-Served-By": {"agent"}}}
+	})
+	upstream := newRecordingUpstream(t)
+	env.setProxyConfig(t, &models.ProxyConfig{TargetURL: upstream.URL})
+	_, err := env.manager.SetCustomerConfig(context.Background(), testCustomerID, &models.AgentConfig{
+		Routes: []models.RouteConfig{{Path: "/api/v1/direct/**", RoutingMode: service.RoutingModeDirect}},
+	})
+	require.NoError(t, err)
+
+	status, servedBy, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "agent", servedBy)
+
+	status, servedBy, received := send(t, http.MethodGet, env.proxyURL+"/api/v1/direct/items", "")
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "upstream", servedBy)
+	assert.Equal(t, "/api/v1/direct/items", received.RawPath)
+}
+
+func TestFailoverFromAgentToDirect(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	upstream := newRecordingUpstream(t)
+
+	// Without failover a customer with no agent is refused
+	env.setProxyConfig(t, &models.ProxyConfig{TargetURL: upstream.URL})
+	status, _, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	assert.Equal(t, http.StatusBadGateway, status)
+
+	env.setProxyConfig(t, &models.ProxyConfig{
+		TargetURL:    upstream.URL,
+		FailoverMode: service.RoutingModeDirect,
+	})
+	status, servedBy, received := send(t, http.MethodPost, env.proxyURL+"/api/v1/items", "payload")
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "upstream", servedBy)
+	assert.Equal(t, "payload", received.Body)
+}
+
+func TestFailoverAfterSendFailure(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Headers: http.Header{"X-Served-By": {"agent"}}, Body: req.FullBody}
+	})
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	env.setProxyConfig(t, &models.ProxyConfig{
+		RoutingMode:  service.RoutingModeDirect,
+		FailoverMode: service.RoutingModeAgent,
+		TargetURL:    gone.URL,
+	})
+
+	// An idempotent request is sent again through the agent, body included
+	req, err := http.NewRequest(http.MethodPut, env.proxyURL+"/api/v1/items/1", bytes.NewReader([]byte("replayed")))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "agent", resp.Header.Get("X-Served-By"))
+	assert.Equal(t, "replayed", string(body))
+
+	// One that may have reached the upstream is not
+	status, _, _ := send(t, http.MethodPost, env.proxyURL+"/api/v1/items", "once")
+	assert.Equal(t, http.StatusBadGateway, status)
+}
+
+func TestCloudflareRoutingMode(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	upstream := newRecordingUpstream(t)
+	env.proxy.EnableCloudflareTunnel(startEdge(t))
+	env.setProxyConfig(t, &models.ProxyConfig{
+		RoutingMode: service.RoutingModeCloudflare,
+		TargetURL:   upstream.URL,
+	})
+
+	status, servedBy, received := send(t, http.MethodGet, env.proxyURL+"/api/v1/items?page=2", "")
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "upstream", servedBy)
+	assert.Equal(t, "/api/v1/items", received.RawPath)
+	assert.Equal(t, "page=2", received.Query)
+	assert.Equal(t, "tunnel-1", received.Header.Get("CF-Tunnel-ID"))
+	assert.Equal(t, testCustomerID, received.Header.Get("CF-Customer-ID"))
+}
+
+func TestUnavailableTunnelFailsOver(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	upstream := newRecordingUpstream(t)
+
+	// A tunnel that never connected is not healthy
+	env.proxy.EnableCloudflareTunnel(cloudflare.NewTunnelClient(cloudflare.TunnelConfig{ID: "tunnel-1"}, logger.NewLogger()))
+	env.setProxyConfig(t, &models.ProxyConfig{
+		RoutingMode: service.RoutingModeCloudflare,
+		TargetURL:   upstream.URL,
+	})
+	status, _, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	env.setProxyConfig(t, &models.ProxyConfig{
+		RoutingMode:  service.RoutingModeCloudflare,
+		FailoverMode: service.RoutingModeDirect,
+		TargetURL:    upstream.URL,
+	})
+	status, servedBy, received := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "upstream", servedBy)
+	assert.Empty(t, received.Header.Get("CF-Tunnel-ID"))
+}
+
+func TestWebSocketRequiresAgentMode(t *testing.T) {
+	env := newEmptyProxyEnv(t)
+	upstream := newRecordingUpstream(t)
+	env.setProxyConfig(t, &models.ProxyConfig{
+		RoutingMode: service.RoutingModeDirect,
+		TargetURL:   upstream.URL,
+	})
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(env.proxyURL, "http")+"/api/v1/socket", nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+}
+
+func TestRouteRoutingModeIsValidated(t *testing.T) {
+	_, configURL := newConfigEnv(t)
+
+	for _, route := range []models.RouteConfig{
+		{Path: "/api/v1/**", RoutingMode: "carrier-pigeon"},
+		{Path: "/api/v1/**", FailoverMode: "tunnel"},
+	} {
+		data, err := json.Marshal(models.AgentConfig{Routes: []models.RouteConfig{route}})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPut, configURL, bytes.NewReader(data))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, route)
+	}
+
+	stored := putConfig(t, configURL, &models.AgentConfig{Routes: []models.RouteConfig{{
+		Path:         "/api/v1/**",
+		RoutingMode:  service.RoutingModeCloudflare,
+		FailoverMode: service.RoutingModeDirect,
+	}}})
+	require.Len(t, stored.Routes, 1)
+	assert.Equal(t, service.RoutingModeCloudflare, stored.Routes[0].RoutingMode)
+}
@@ -0,0 +1,124 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"proxy-service/internal/app"
+	"proxy-service/internal/config"
+	"proxy-service/internal/handler"
+	"proxy-service/internal/repository"
+	"proxy-service/internal/service"
+	"proxy-service/internal/service/agent"
+	"proxy-service/pkg/cache"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newTestServer runs the routes of NewServer over services built like
+// NewServices does, with MongoDB unreachable, no auth service and agent
+// commands in memory
+func newTestServer(t *testing.T, adminToken string) string {
+	t.Helper()
+	redisCache, err := cache.NewRedisCache(&config.RedisConfig{Address: miniredis.RunT(t).Addr()})
+	require.NoError(t, err)
+
+	// The driver connects lazily; nothing here reaches the database
+	client, err := mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	db := client.Database("proxy_test")
+
+	cfg := &config.Config{
+		Admin: config.AdminConfig{Token: adminToken},
+		Agent: config.AgentConfig{Security: config.SecurityConfig{
+			RateLimit: config.RateLimitConfig{Requests: 100, TimeWindow: time.Minute},
+		}},
+	}
+	var managerCache cache.Cache = agentConfigCache{redisCache}
+	manager := agent.NewAgentManager(sharedCollector(), &managerCache)
+	// The agent the requests name is not registered
+	agents := newStubAgentStore()
+	agents.deleted["unknown-agent"] = true
+	manager.SetRegistry(agent.NewRegistry(agents, redisCache))
+	manager.SetCommandLog(agent.NewCommandLog(newStubCommandStore(), redisCache))
+	t.Cleanup(manager.Close)
+
+	// No request here gets as far as the auth service
+	handlers := handler.NewHandler(handler.Deps{
+		Services: &service.Services{
+			Proxy:   service.NewProxyService(manager, redisCache, sharedCollector()),
+			Metrics: service.NewMetricsService(repository.NewMetricsRepository(db), sharedCollector()),
+			Agents:  manager,
+		},
+		Config: cfg,
+		Cache:  redisCache,
+	})
+
+	server := httptest.NewServer(app.NewServer(cfg, handlers).Handler())
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// serverRequest sends a request with the agent headers the server's
+// request validator requires of every request
+func serverRequest(t *testing.T, method, url, token string) (int, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Agent-ID", "unknown-agent")
+	req.Header.Set("X-Customer-ID", testCustomerID)
+	req.Header.Set("X-Agent-Token", "not-a-token")
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var body map[string]any
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestServerMountsAgentRoutes(t *testing.T) {
+	serverURL := newTestServer(t, "operator-secret")
+
+	// The agent endpoint refuses the unknown agent itself instead of the
+	// proxy asking for a customer token
+	status, body := serverRequest(t, http.MethodGet, serverURL+"/api/v1/agents/connect", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "invalid agent credentials", body["error"])
+
+	// Agent commands are served to operators only
+	commands := serverURL + "/admin/v1/customers/" + testCustomerID + "/agents/" + testAgentID + "/commands"
+	status, body = serverRequest(t, http.MethodGet, commands, "operator-secret")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, body["commands"])
+	status, _ = serverRequest(t, http.MethodGet, commands, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// Every other path under /api/v1 still goes to the proxy
+	status, body = serverRequest(t, http.MethodGet, serverURL+"/api/v1/items", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "AUTH_HEADER_MISSING", body["code"])
+	status, _ = serverRequest(t, http.MethodGet, serverURL+"/elsewhere", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestServerWithoutAdminTokenHasNoOperatorRoutes(t *testing.T) {
+	serverURL := newTestServer(t, "")
+
+	status, _ := serverRequest(t, http.MethodGet, serverURL+"/admin/v1/customers/"+testCustomerID+"/agents/"+testAgentID+"/commands", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,216 @@
+package integration
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-service/internal/handler"
+	"proxy-service/internal/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func acceptConnect(req *receivedRequest) *fakeResponse {
+	return &fakeResponse{Status: http.StatusOK}
+}
+
+// startEchoServer plays a database or SSH host on the customer network
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func echoThrough(t *testing.T, conn net.Conn, reader io.Reader, message string) {
+	t.Helper()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err := conn.Write([]byte(message))
+	require.NoError(t, err)
+
+	reply := make([]byte, len(message))
+	_, err = io.ReadFull(reader, reply)
+	require.NoError(t, err)
+	assert.Equal(t, message, string(reply))
+}
+
+// connectThrough opens a CONNECT tunnel and returns the connection with the
+// reader to use for it, or the refusal
+func connectThrough(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	return conn, reader, resp
+}
+
+// startConnectServer serves CONNECT requests for the proxy of env, as the
+// customer that resolve returns
+func startConnectServer(t *testing.T, env *proxyEnv, resolve handler.CustomerResolver) string {
+	t.Helper()
+	if resolve == nil {
+		resolve = func(r *http.Request) (string, error) { return testCustomerID, nil }
+	}
+	tcpHandler := handler.NewTCPHandler(env.proxy, resolve)
+	server := httptest.NewServer(tcpHandler.Wrap(http.NotFoundHandler()))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestTCPForwardingConnect(t *testing.T) {
+	env := newProxyEnv(t, acceptConnect)
+	echoAddr := startEchoServer(t)
+	env.setProxyConfig(t, &models.ProxyConfig{
+		TCPTargets: []models.TCPTarget{{Name: "echo-connect", Address: echoAddr}},
+	})
+	proxyAddr := startConnectServer(t, env, nil)
+
+	// Counters are global to the test binary, so only deltas are checked
+	bytesLabels := map[string]string{"customer_id": testCustomerID, "target": "echo-connect"}
+	bytesLabels["direction"] = "client_to_target"
+	sentBefore := metricValue(t, "proxy_tcp_bytes_total", bytesLabels)
+	bytesLabels["direction"] = "target_to_client"
+	receivedBefore := metricValue(t, "proxy_tcp_bytes_total", bytesLabels)
+	openedLabels := map[string]string{"customer_id": testCustomerID, "target": "echo-connect", "result": "opened"}
+	openedBefore := metricValue(t, "proxy_tcp_connections_total", openedLabels)
+
+	conn, reader, resp := connectThrough(t, proxyAddr, echoAddr)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	echoThrough(t, conn, reader, "SSH-2.0-test\r\n")
+	long := strings.Repeat("x", 3*64*1024)
+	echoThrough(t, conn, reader, long)
+
+	req := env.agent.next(t)
+	assert.Equal(t, http.MethodConnect, req.Method)
+	assert.Equal(t, echoAddr, req.Path)
+	assert.True(t, req.Tunnel)
+
+	conn.Close()
+	select {
+	case frame := <-env.agent.closed:
+		assert.Equal(t, websocket.CloseNormalClosure, frame.CloseCode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent never saw the connection close")
+	}
+
+	require.Eventually(t, func() bool {
+		return metricValue(t, "proxy_tcp_connections_active", map[string]string{"customer_id": testCustomerID}) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	sent := float64(len("SSH-2.0-test\r\n") + len(long))
+	bytesLabels["direction"] = "client_to_target"
+	assert.Equal(t, sent, metricValue(t, "proxy_tcp_bytes_total", bytesLabels)-sentBefore)
+	bytesLabels["direction"] = "target_to_client"
+	assert.Equal(t, sent, metricValue(t, "proxy_tcp_bytes_total", bytesLabels)-receivedBefore)
+	assert.Equal(t, 1.0, metricValue(t, "proxy_tcp_connections_total", openedLabels)-openedBefore)
+}
+
+func TestTCPForwardingConnectOutlivesServerTimeouts(t *testing.T) {
+	env := newProxyEnv(t, acceptConnect)
+	echoAddr := startEchoServer(t)
+	env.setProxyConfig(t, &models.ProxyConfig{
+		TCPTargets: []models.TCPTarget{{Address: echoAddr}},
+	})
+
+	tcpHandler := handler.NewTCPHandler(env.proxy, func(r *http.Request) (string, error) {
+		return testCustomerID, nil
+	})
+	server := httptest.NewUnstartedServer(tcpHandler.Wrap(http.NotFoundHandler()))
+	server.Config.ReadTimeout = 200 * time.Millisecond
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	t.Cleanup(server.Close)
+
+	conn, reader, resp := connectThrough(t, strings.TrimPrefix(server.URL, "http://"), echoAddr)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	echoThrough(t, conn, reader, "before")
+
+	// Idle past both timeouts, as an interactive session does
+	time.Sleep(500 * time.Millisecond)
+	echoThrough(t, conn, reader, "after")
+}
+
+func TestTCPForwardingConnectRequiresAuthentication(t *testing.T) {
+	env := newProxyEnv(t, acceptConnect)
+	echoAddr := startEchoServer(t)
+	env.setProxyConfig(t, &models.ProxyConfig{
+		TCPTargets: []models.TCPTarget{{Address: echoAddr}},
+	})
+	proxyAddr := startConnectServer(t, env, func(r *http.Request) (string, error) {
+		return "", errors.New("missing proxy authorization")
+	})
+
+	_, _, resp := connectThrough(t, proxyAddr, echoAddr)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, "Bearer", resp.Header.Get("Proxy-Authenticate"))
+
+	select {
+	case req := <-env.agent.received:
+		t.Fatalf("agent was asked to connect to %s", req.Path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTCPForwardingConnectRejectsUnlistedTarget(t *testing.T) {
+	env := newProxyEnv(t, acceptConnect)
+	echoAddr := startEchoServer(t)
+	env.setProxyConfig(t, &models.ProxyConfig{
+		TCPTargets: []models.TCPTarget{{Address: "db.internal:5432"}},
+	})
+
+	proxyAddr := startConnectServer(t, env, nil)
+
+	_, _, resp := connectThrough(t, proxyAddr, echoAddr)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	select {
+	case req := <-env.agent.received:
+		t.Fatalf("agent was asked to connect to %s", req.Path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTCPForwardingConnectReportsRefusal(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusForbidden}
+	})
+	echoAddr := startEchoServer(t)
+	env.setProxyConfig(t, &models.ProxyConfig{
+		TCPTargets: []models.TCPTarget{{Address: echoAddr}},
+	})
+
+	_, _, resp := connectThrough(t, startConnectServer(t, env, nil), echoAddr)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
@@ -0,0 +1,269 @@
+package integration
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"proxy-service/internal/config"
+	"proxy-service/internal/models"
+	"proxy-service/internal/service"
+	"proxy-service/pkg/proxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connCounter counts the connections an upstream accepted and closed
+type connCounter struct {
+	mu     sync.Mutex
+	opened int
+	closed int
+}
+
+func (c *connCounter) track(conn net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		c.opened++
+	case http.StateClosed, http.StateHijacked:
+		c.closed++
+	}
+}
+
+func (c *connCounter) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opened, c.closed
+}
+
+// newCountingUpstream answers 201 with an empty object and counts its
+// connections
+func newCountingUpstream(t *testing.T) (*httptest.Server, *connCounter) {
+	t.Helper()
+	counter := &connCounter{}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "upstream")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	}))
+	upstream.Config.ConnState = counter.track
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream, counter
+}
+
+// newDirectEnv routes the test customer directly to target through pool
+func newDirectEnv(t *testing.T, target string, pool *proxy.TransportPool) *proxyEnv {
+	t.Helper()
+	env := newEmptyProxyEnv(t)
+	if pool != nil {
+		env.proxy.SetTransportPool(pool)
+		t.Cleanup(pool.Close)
+	}
+	env.setProxyConfig(t, &models.ProxyConfig{RoutingMode: service.RoutingModeDirect, TargetURL: target})
+	return env
+}
+
+func TestDirectRequestsShareConnections(t *testing.T) {
+	upstream, counter := newCountingUpstream(t)
+	pool := proxy.NewTransportPool(config.UpstreamTransportConfig{}, sharedCollector())
+	env := newDirectEnv(t, upstream.URL, pool)
+
+	for i := 0; i < 10; i++ {
+		status, servedBy, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+		require.Equal(t, http.StatusCreated, status)
+		require.Equal(t, "upstream", servedBy)
+	}
+
+	opened, _ := counter.counts()
+	assert.Equal(t, 1, opened)
+	stats := pool.Stats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, testCustomerID, stats[0].CustomerID)
+	assert.Equal(t, upstream.URL, stats[0].Upstream)
+	assert.EqualValues(t, 1, stats[0].OpenConns)
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(upstream.Close)
+	pool := proxy.NewTransportPool(config.UpstreamTransportConfig{MaxConnsPerHost: 2}, sharedCollector())
+	env := newDirectEnv(t, upstream.URL, pool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(env.proxyURL + "/api/v1/items")
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return inFlight == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 2, peak)
+}
+
+func TestUpstreamTLSSettings(t *testing.T) {
+	ca := newTestCA(t, "upstream clients")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.certificate)
+
+	type seen struct {
+		serverName string
+		proto      int
+		client     string
+	}
+	received := make(chan seen, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- seen{serverName: r.TLS.ServerName, proto: r.ProtoMajor, client: r.TLS.PeerCertificates[0].Subject.CommonName}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+
+	env := newDirectEnv(t, upstream.URL, nil)
+
+	// The upstream's certificate is not trusted by default
+	status, _, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	assert.Equal(t, http.StatusBadGateway, status)
+
+	client := ca.issue(t, "gateway", testCustomerID)
+	key, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	require.NoError(t, err)
+	upstreamTLS := &models.UpstreamTLS{
+		CACert:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})),
+		ServerName: "example.com",
+		ClientCert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: client.Certificate[0]})),
+		ClientKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})),
+	}
+	env.setProxyConfig(t, &models.ProxyConfig{RoutingMode: service.RoutingModeDirect, TargetURL: upstream.URL, UpstreamTLS: upstreamTLS})
+
+	status, _, _ = send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	require.Equal(t, http.StatusCreated, status)
+	got := <-received
+	assert.Equal(t, "example.com", got.serverName)
+	assert.Equal(t, 2, got.proto)
+	assert.Equal(t, "gateway", got.client)
+
+	// Settings that cannot be used fail the request
+	env.setProxyConfig(t, &models.ProxyConfig{
+		RoutingMode: service.RoutingModeDirect,
+		TargetURL:   upstream.URL,
+		UpstreamTLS: &models.UpstreamTLS{CACert: "not a certificate"},
+	})
+	status, _, _ = send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	assert.Equal(t, http.StatusBadGateway, status)
+}
+
+func TestIdlePoolsAreEvicted(t *testing.T) {
+	upstream, counter := newCountingUpstream(t)
+	pool := proxy.NewTransportPool(config.UpstreamTransportConfig{PoolIdleTimeout: 100 * time.Millisecond}, sharedCollector())
+	env := newDirectEnv(t, upstream.URL, pool)
+
+	status, _, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	require.Equal(t, http.StatusCreated, status)
+	require.Len(t, pool.Stats(), 1)
+
+	require.Eventually(t, func() bool {
+		_, closed := counter.counts()
+		return len(pool.Stats()) == 0 && closed == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRemovedCustomerPoolsAreEvicted(t *testing.T) {
+	upstream, counter := newCountingUpstream(t)
+	pool := proxy.NewTransportPool(config.UpstreamTransportConfig{}, sharedCollector())
+	env := newDirectEnv(t, upstream.URL, pool)
+
+	status, _, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	require.Equal(t, http.StatusCreated, status)
+	require.Len(t, pool.Stats(), 1)
+
+	require.NoError(t, env.cache.Delete(context.Background(), "proxy_config:"+testCustomerID))
+	status, _, _ = send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Empty(t, pool.Stats())
+	require.Eventually(t, func() bool {
+		_, closed := counter.counts()
+		return closed == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUnreadableConfigKeepsCustomerPools(t *testing.T) {
+	upstream, counter := newCountingUpstream(t)
+	pool := proxy.NewTransportPool(config.UpstreamTransportConfig{}, sharedCollector())
+	env := newDirectEnv(t, upstream.URL, pool)
+
+	status, _, _ := send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	require.Equal(t, http.StatusCreated, status)
+	require.Len(t, pool.Stats(), 1)
+
+	require.NoError(t, env.cache.Set(context.Background(), "proxy_config:"+testCustomerID, "not json", time.Hour))
+	status, _, _ = send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Len(t, pool.Stats(), 1)
+
+	env.setProxyConfig(t, &models.ProxyConfig{RoutingMode: service.RoutingModeDirect, TargetURL: upstream.URL})
+	status, _, _ = send(t, http.MethodGet, env.proxyURL+"/api/v1/items", "")
+	require.Equal(t, http.StatusCreated, status)
+	opened, closed := counter.counts()
+	assert.Equal(t, 1, opened)
+	assert.Zero(t, closed)
+}
+
+func TestProxyHandlerSharesConnections(t *testing.T) {
+	upstream, counter := newCountingUpstream(t)
+	pool := proxy.NewTransportPool(config.UpstreamTransportConfig{}, sharedCollector())
+	t.Cleanup(pool.Close)
+	handler, err := proxy.NewProxyHandler(&config.Config{Proxy: config.ProxyConfig{TargetHost: upstream.URL}}, sharedCollector(), pool)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.Handle(w, r.WithContext(context.WithValue(r.Context(), "customer_id", testCustomerID)))
+	}))
+	t.Cleanup(server.Close)
+
+	for i := 0; i < 5; i++ {
+		status, servedBy, _ := send(t, http.MethodGet, server.URL+"/items", "")
+		require.Equal(t, http.StatusCreated, status)
+		require.Equal(t, "upstream", servedBy)
+	}
+	opened, _ := counter.counts()
+	assert.Equal(t, 1, opened)
+}
@@ -0,0 +1,166 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acceptTunnel accepts every tunnel, picking the first offered subprotocol
+func acceptTunnel(req *receivedRequest) *fakeResponse {
+	headers := http.Header{}
+	if offered := http.Header(req.Headers).Get("Sec-Websocket-Protocol"); offered != "" {
+		headers.Set("Sec-Websocket-Protocol", strings.TrimSpace(strings.Split(offered, ",")[0]))
+	}
+	return &fakeResponse{Status: http.StatusSwitchingProtocols, Headers: headers}
+}
+
+func dialTunnel(t *testing.T, env *proxyEnv, header http.Header) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(env.proxyURL, "http")+"/api/v1/live?feed=1", header)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// metricValue reads a counter or gauge from the default registry, where the
+// shared collector registers its metrics
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	next:
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if want, ok := labels[pair.GetName()]; ok && want != pair.GetValue() {
+					continue next
+				}
+			}
+			if metric.GetGauge() != nil {
+				return metric.GetGauge().GetValue()
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestTunnelRelaysMessages(t *testing.T) {
+	env := newProxyEnv(t, acceptTunnel)
+
+	conn := dialTunnel(t, env, http.Header{
+		"Sec-Websocket-Protocol": {"graphql-ws, chat"},
+		"Origin":                 {"https://dashboard.example"},
+	})
+	assert.Equal(t, "graphql-ws", conn.Subprotocol())
+
+	got := env.agent.next(t)
+	assert.True(t, got.Tunnel)
+	assert.Equal(t, "/api/v1/live", got.Path)
+	assert.Equal(t, "feed=1", got.RawQuery)
+	headers := http.Header(got.Headers)
+	assert.Equal(t, "https://dashboard.example", headers.Get("Origin"))
+	assert.Equal(t, "graphql-ws, chat", headers.Get("Sec-Websocket-Protocol"))
+	for _, name := range []string{"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version"} {
+		assert.Empty(t, headers.Values(name), name)
+	}
+
+	// More messages than the window, in both frame types
+	for i := 0; i < 40; i++ {
+		messageType, payload := websocket.TextMessage, []byte(strings.Repeat("m", i+1))
+		if i%2 == 1 {
+			messageType, payload = websocket.BinaryMessage, []byte{byte(i), 0, 0xff}
+		}
+		require.NoError(t, conn.WriteMessage(messageType, payload))
+
+		gotType, gotPayload, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, messageType, gotType)
+		assert.Equal(t, payload, gotPayload)
+	}
+}
+
+func TestTunnelClientCloseReachesAgent(t *testing.T) {
+	env := newProxyEnv(t, acceptTunnel)
+	conn := dialTunnel(t, env, nil)
+
+	require.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "done")))
+
+	select {
+	case frame := <-env.agent.closed:
+		assert.Equal(t, 4000, frame.CloseCode)
+		assert.Equal(t, "done", frame.CloseText)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not see the close")
+	}
+}
+
+func TestTunnelAgentCloseReachesClient(t *testing.T) {
+	env := newProxyEnv(t, acceptTunnel)
+	conn := dialTunnel(t, env, nil)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("close 4001 bye")))
+
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, 4001, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Text)
+}
+
+func TestTunnelRefused(t *testing.T) {
+	env := newProxyEnv(t, func(req *receivedRequest) *fakeResponse {
+		return &fakeResponse{
+			Status:  http.StatusForbidden,
+			Headers: http.Header{"Content-Type": {"text/plain"}},
+			Body:    []byte("no sockets here"),
+		}
+	})
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(env.proxyURL, "http")+"/api/v1/live", nil)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "no sockets here", string(body))
+}
+
+func TestTunnelMetrics(t *testing.T) {
+	env := newProxyEnv(t, acceptTunnel)
+	labels := map[string]string{"customer_id": testCustomerID}
+	// Tunnels of earlier tests wind down once their clients are gone
+	require.Eventually(t, func() bool {
+		return metricValue(t, "proxy_tunnels_active", labels) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	opened := metricValue(t, "proxy_tunnels_total", map[string]string{"customer_id": testCustomerID, "result": "opened"})
+	relayed := metricValue(t, "proxy_tunnel_messages_total", map[string]string{"customer_id": testCustomerID, "direction": "client_to_agent"})
+
+	conn := dialTunnel(t, env, nil)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+	_, _, err := conn.ReadMessage()
+	require.NoError(t, err)
+
+	assert.Equal(t, opened+1, metricValue(t, "proxy_tunnels_total", map[string]string{"customer_id": testCustomerID, "result": "opened"}))
+	assert.Equal(t, relayed+1, metricValue(t, "proxy_tunnel_messages_total", map[string]string{"customer_id": testCustomerID, "direction": "client_to_agent"}))
+	assert.Equal(t, 1.0, metricValue(t, "proxy_tunnels_active", labels))
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.ReadMessage()
+	assert.Eventually(t, func() bool {
+		return metricValue(t, "proxy_tunnels_active", labels) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,96 @@
+package unit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"proxy-service/internal/service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	directives := service.ParseCacheControl(http.Header{"Cache-Control": {
+		`Public, MAX-AGE=60, no-cache="Set-Cookie"`,
+		"stale-if-error=30,, s-maxage=abc",
+	}})
+
+	assert.True(t, directives.Has("public"))
+	assert.True(t, directives.Has("no-cache"))
+	assert.False(t, directives.Has("private"))
+	assert.Equal(t, "Set-Cookie", directives["no-cache"])
+
+	maxAge, ok := directives.Seconds("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, maxAge)
+	staleIfError, ok := directives.Seconds("stale-if-error")
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, staleIfError)
+
+	_, ok = directives.Seconds("s-maxage")
+	assert.False(t, ok, "invalid delta-seconds")
+	_, ok = directives.Seconds("stale-while-revalidate")
+	assert.False(t, ok, "missing directive")
+
+	// Values past 2^31 seconds are capped there
+	directives = service.ParseCacheControl(http.Header{"Cache-Control": {"max-age=9999999999"}})
+	maxAge, ok = directives.Seconds("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, 2147483647*time.Second, maxAge)
+}
+
+func TestFreshness(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ttl := 10 * time.Second
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{name: "max-age", header: http.Header{"Cache-Control": {"public, max-age=60"}}, expected: time.Minute},
+		{name: "s-maxage", header: http.Header{"Cache-Control": {"max-age=0, s-maxage=60"}}, expected: time.Minute},
+		{name: "no-cache", header: http.Header{"Cache-Control": {"no-cache, max-age=60"}}, expected: 0},
+		{name: "expires", header: http.Header{"Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, expected: time.Hour},
+		{
+			name: "expires from date header",
+			header: http.Header{
+				"Date":    {date.Add(30 * time.Minute).Format(http.TimeFormat)},
+				"Expires": {date.Add(time.Hour).Format(http.TimeFormat)},
+			},
+			expected: 30 * time.Minute,
+		},
+		{name: "past expires", header: http.Header{"Expires": {date.Add(-time.Hour).Format(http.TimeFormat)}}, expected: 0},
+		{name: "invalid expires", header: http.Header{"Expires": {"0"}}, expected: 0},
+		{name: "no freshness", header: http.Header{}, expected: ttl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, service.Freshness(tt.header, date, ttl))
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		header   http.Header
+		expected bool
+	}{
+		{name: "max-age", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}}, expected: true},
+		{name: "not found", status: http.StatusNotFound, header: http.Header{}, expected: true},
+		{name: "created", status: http.StatusCreated, header: http.Header{"Cache-Control": {"max-age=60"}}, expected: false},
+		{name: "no-store", status: http.StatusOK, header: http.Header{"Cache-Control": {"no-store, max-age=60"}}, expected: false},
+		{name: "private", status: http.StatusOK, header: http.Header{"Cache-Control": {"private, max-age=60"}}, expected: false},
+		{name: "set-cookie", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}}, expected: false},
+		{name: "vary star", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: tt.header}
+			assert.Equal(t, tt.expected, service.Storable(resp))
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"proxy-service/internal/config"
+	"proxy-service/pkg/cache"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCache(t *testing.T) (*cache.RedisCache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	redisCache, err := cache.NewRedisCache(&config.RedisConfig{Address: mr.Addr()})
+	require.NoError(t, err)
+	return redisCache, mr
+}
+
+func TestCacheStoresStringsRaw(t *testing.T) {
+	redisCache, mr := newTestCache(t)
+	ctx := context.Background()
+
+	require.NoError(t, redisCache.Set(ctx, "agent_config:customer-1", `{"revision":3}`, time.Minute))
+	stored, err := mr.Get("agent_config:customer-1")
+	require.NoError(t, err)
+	assert.Equal(t, `{"revision":3}`, stored)
+
+	require.NoError(t, redisCache.Set(ctx, "counter", 3, time.Minute))
+	value, err := redisCache.Get(ctx, "counter")
+	require.NoError(t, err)
+	assert.Equal(t, "3", value)
+}
+
+func TestCacheReadsJSONEncodedStrings(t *testing.T) {
+	redisCache, mr := newTestCache(t)
+	ctx := context.Background()
+
+	// Values the JSON-encoding Set stored before strings were kept raw
+	require.NoError(t, mr.Set("agent_config:customer-1", `"{\"revision\":3}"`))
+	require.NoError(t, mr.Set("agent_token:customer-1_agent-1", `"1700000000.abc"`))
+
+	value, err := redisCache.Get(ctx, "agent_config:customer-1")
+	require.NoError(t, err)
+	assert.Equal(t, `{"revision":3}`, value)
+
+	values, err := redisCache.GetMany(ctx, "agent_config:customer-1", "agent_token:customer-1_agent-1", "missing")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"agent_config:customer-1":        `{"revision":3}`,
+		"agent_token:customer-1_agent-1": "1700000000.abc",
+	}, values)
+
+	// Anything that is not a JSON string comes back as stored
+	require.NoError(t, mr.Set("broken", `"unterminated`))
+	value, err = redisCache.Get(ctx, "broken")
+	require.NoError(t, err)
+	assert.Equal(t, `"unterminated`, value)
+}
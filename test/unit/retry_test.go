@@ -0,0 +1,80 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"proxy-service/internal/service"
+	"proxy-service/internal/service/agent"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelayDoubles(t *testing.T) {
+	base := 100 * time.Millisecond
+	for n, full := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond} {
+		for range 50 {
+			delay := service.BackoffDelay(base, n)
+			assert.GreaterOrEqual(t, delay, full/2, "retry %d", n)
+			assert.LessOrEqual(t, delay, full, "retry %d", n)
+		}
+	}
+}
+
+func TestBackoffDelayIsCapped(t *testing.T) {
+	// Large retry counts and base delays must not overflow past the cap
+	for _, n := range []int{6, 31, 32, 63, 1000} {
+		delay := service.BackoffDelay(service.DefaultRetryBaseDelay, n)
+		assert.GreaterOrEqual(t, delay, service.MaxRetryDelay/2, "retry %d", n)
+		assert.LessOrEqual(t, delay, service.MaxRetryDelay, "retry %d", n)
+	}
+	delay := service.BackoffDelay(time.Duration(1)<<62, 2)
+	assert.LessOrEqual(t, delay, service.MaxRetryDelay)
+	assert.Positive(t, delay)
+}
+
+func TestBackoffDelayIsJittered(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for range 20 {
+		seen[service.BackoffDelay(time.Second, 0)] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
+
+func TestShouldRetrySentRequests(t *testing.T) {
+	ctx := context.Background()
+	sent := fmt.Errorf("%w: %w", service.ErrForwardFailed, io.ErrUnexpectedEOF)
+	assert.True(t, service.ShouldRetry(ctx, nil, sent))
+	assert.True(t, service.ShouldRetry(ctx, nil, fmt.Errorf("attempt 2: %w", sent)))
+
+	for _, status := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		assert.True(t, service.ShouldRetry(ctx, &http.Response{StatusCode: status}, nil), status)
+	}
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError, http.StatusTooManyRequests} {
+		assert.False(t, service.ShouldRetry(ctx, &http.Response{StatusCode: status}, nil), status)
+	}
+}
+
+func TestShouldRetrySkipsRequestsThatWereNotSent(t *testing.T) {
+	ctx := context.Background()
+	for _, err := range []error{
+		service.ErrNoTargetURL,
+		fmt.Errorf("%w, not %q", service.ErrInvalidRoutingMode, "carrier-pigeon"),
+		fmt.Errorf("failed to get agent: %w: region=eu", service.ErrNoMatchingAgent),
+		fmt.Errorf("failed to get agent: %w", agent.ErrInvalidSelector),
+		fmt.Errorf("failed to read request body: %w", io.ErrUnexpectedEOF),
+	} {
+		assert.False(t, service.ShouldRetry(ctx, nil, err), err.Error())
+	}
+}
+
+func TestShouldRetryStopsAtTheDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, service.ShouldRetry(ctx, nil, fmt.Errorf("%w: %w", service.ErrForwardFailed, io.ErrUnexpectedEOF)))
+	assert.False(t, service.ShouldRetry(ctx, &http.Response{StatusCode: http.StatusBadGateway}, nil))
+}
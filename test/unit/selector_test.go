@@ -0,0 +1,35 @@
+package unit
+
+import (
+	"testing"
+
+	"proxy-service/internal/service/agent"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectorParsing(t *testing.T) {
+	selector, err := agent.ParseSelector(" region=eu, env!=staging ,gpu,!canary")
+	require.NoError(t, err)
+	assert.Equal(t, "region=eu,env!=staging,gpu,!canary", selector.String())
+
+	assert.True(t, selector.Matches(map[string]string{"region": "eu", "gpu": "a100"}))
+	assert.False(t, selector.Matches(map[string]string{"region": "eu", "gpu": "a100", "env": "staging"}))
+	assert.False(t, selector.Matches(map[string]string{"region": "eu"}))
+	assert.False(t, selector.Matches(map[string]string{"region": "eu", "gpu": "a100", "canary": "true"}))
+
+	selector, err = agent.ParseSelector("region==eu")
+	require.NoError(t, err)
+	assert.Equal(t, "region=eu", selector.String())
+
+	empty, err := agent.ParseSelector("")
+	require.NoError(t, err)
+	assert.True(t, empty.Empty())
+	assert.True(t, empty.Matches(nil))
+
+	for _, invalid := range []string{"region=", "=eu", "region=e u", "a,,b", "region=eu;drop"} {
+		_, err := agent.ParseSelector(invalid)
+		assert.ErrorIs(t, err, agent.ErrInvalidSelector, invalid)
+	}
+}